@@ -0,0 +1,239 @@
+package cluster
+
+import (
+	"fmt"
+	bitcask "kv-go/db"
+	"kv-go/utils"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCluster struct {
+	t       *testing.T
+	network *InmemNetwork
+	opts    map[string]Options
+	nodes   map[string]*Node
+}
+
+func newTestCluster(t *testing.T, size int, snapshotThreshold uint64) *testCluster {
+	c := &testCluster{
+		t:       t,
+		network: NewInmemNetwork(),
+		opts:    make(map[string]Options),
+		nodes:   make(map[string]*Node),
+	}
+	var peers []string
+	for i := 0; i < size; i++ {
+		peers = append(peers, fmt.Sprintf("node-%d", i))
+	}
+	for _, id := range peers {
+		opts := DefaultOptions
+		opts.ID = id
+		opts.Peers = peers
+		opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-cluster-"+id)
+		opts.ElectionTimeout = 300 * time.Millisecond
+		opts.HeartbeatInterval = 30 * time.Millisecond
+		opts.RequestTimeout = 3 * time.Second
+		opts.SnapshotThreshold = snapshotThreshold
+		opts.DBOptions.MergeInterval = 0
+		c.opts[id] = opts
+		c.start(id)
+	}
+	return c
+}
+
+func (c *testCluster) start(id string) *Node {
+	opts := c.opts[id]
+	opts.Transport = c.network.Transport()
+	node, err := NewNode(opts)
+	assert.Nil(c.t, err)
+	c.nodes[id] = node
+	return node
+}
+
+func (c *testCluster) close() {
+	for _, node := range c.nodes {
+		_ = node.Close()
+	}
+	for _, opts := range c.opts {
+		_ = os.RemoveAll(opts.DirPath)
+	}
+}
+
+// 等待除exclude以外的节点选出leader
+func (c *testCluster) waitLeader(exclude string) *Node {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for id, node := range c.nodes {
+			if id != exclude && node.IsLeader() {
+				return node
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatal("no leader elected")
+	return nil
+}
+
+// 等待节点的状态机包含key
+func waitStale(t *testing.T, node *Node, key []byte, value []byte) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if val, err := node.GetWithConsistency(key, Stale); err == nil && string(val) == string(value) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s did not apply the write", node.ID())
+}
+
+func TestCluster(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	defer c.close()
+	leader := c.waitLeader("")
+
+	// 任意节点都可以写入，follower把写入转发给leader
+	for id, node := range c.nodes {
+		assert.Nil(t, node.Put([]byte("key-"+id), []byte("value-"+id)))
+	}
+	wb := leader.NewWriteBatch()
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	assert.Nil(t, wb.Delete(utils.GetTestKey(0)))
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, leader.Delete(utils.GetTestKey(1)))
+	assert.Equal(t, bitcask.ErrEmptyKey, leader.Put(nil, []byte("value")))
+
+	// 线性一致读在任意节点都能读到已经完成的写入
+	for _, node := range c.nodes {
+		for id := range c.nodes {
+			val, err := node.Get([]byte("key-" + id))
+			assert.Nil(t, err)
+			assert.Equal(t, "value-"+id, string(val))
+		}
+		_, err := node.Get(utils.GetTestKey(0))
+		assert.Equal(t, bitcask.ErrKeyNotFound, err)
+		_, err = node.Get(utils.GetTestKey(1))
+		assert.Equal(t, bitcask.ErrKeyNotFound, err)
+		val, err := node.Get(utils.GetTestKey(99))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+		err = node.View(Linearizable, func(db *bitcask.DB) error {
+			assert.Equal(t, 101, len(db.ListKeys(false)))
+			return nil
+		})
+		assert.Nil(t, err)
+	}
+	// 过期读最终也能读到
+	for _, node := range c.nodes {
+		waitStale(t, node, []byte("key-"+leader.ID()), []byte("value-"+leader.ID()))
+	}
+}
+
+func TestClusterFailover(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	defer c.close()
+	old := c.waitLeader("")
+	assert.Nil(t, old.Put([]byte("before"), []byte("1")))
+
+	// leader被隔离后，其余节点选出新的leader并继续写入
+	c.network.Disconnect(old.ID())
+	leader := c.waitLeader(old.ID())
+	assert.NotEqual(t, old.ID(), leader.ID())
+	assert.Nil(t, leader.Put([]byte("after"), []byte("2")))
+	val, err := leader.Get([]byte("before"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1", string(val))
+
+	// 被隔离的旧leader无法完成写入与线性一致读，但可以过期读
+	assert.NotNil(t, old.Put([]byte("lost"), []byte("3")))
+	_, err = old.Get([]byte("before"))
+	assert.NotNil(t, err)
+	val, err = old.GetWithConsistency([]byte("before"), Stale)
+	assert.Nil(t, err)
+	assert.Equal(t, "1", string(val))
+
+	// 恢复连接后追上新的leader，未提交的写入被丢弃
+	c.network.Connect(old.ID())
+	val, err = old.Get([]byte("after"))
+	assert.Nil(t, err)
+	assert.Equal(t, "2", string(val))
+	_, err = old.Get([]byte("lost"))
+	assert.Equal(t, bitcask.ErrKeyNotFound, err)
+}
+
+func TestClusterSnapshot(t *testing.T) {
+	c := newTestCluster(t, 3, 50)
+	defer c.close()
+	leader := c.waitLeader("")
+	var lagging *Node
+	for _, node := range c.nodes {
+		if node != leader {
+			lagging = node
+			break
+		}
+	}
+	c.network.Disconnect(lagging.ID())
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, leader.Put(utils.GetTestKey(i), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	// leader的日志已经被压缩，落后的节点只能通过快照追上
+	leader.mu.Lock()
+	assert.True(t, leader.log.snapshotIndex > 200)
+	leader.mu.Unlock()
+	c.network.Connect(lagging.ID())
+	val, err := lagging.Get(utils.GetTestKey(299))
+	assert.Nil(t, err)
+	assert.Equal(t, "value-299", string(val))
+	val, err = lagging.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, "value-0", string(val))
+
+	// 重启后从快照与剩余的日志恢复
+	assert.Nil(t, lagging.Close())
+	assert.Nil(t, leader.Put([]byte("after-restart"), []byte("1")))
+	lagging = c.start(lagging.ID())
+	waitStale(t, lagging, []byte("after-restart"), []byte("1"))
+	val, err = lagging.GetWithConsistency(utils.GetTestKey(150), Stale)
+	assert.Nil(t, err)
+	assert.Equal(t, "value-150", string(val))
+}
+
+func TestClusterTCP(t *testing.T) {
+	var transports []*TCPTransport
+	var peers []string
+	for i := 0; i < 3; i++ {
+		transport, err := NewTCPTransport("127.0.0.1:0")
+		assert.Nil(t, err)
+		transports = append(transports, transport)
+		peers = append(peers, transport.Addr())
+	}
+	var nodes []*Node
+	for _, transport := range transports {
+		opts := DefaultOptions
+		opts.ID = transport.Addr()
+		opts.Peers = peers
+		opts.Transport = transport
+		opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-cluster-tcp")
+		opts.DBOptions.MergeInterval = 0
+		defer os.RemoveAll(opts.DirPath)
+		node, err := NewNode(opts)
+		assert.Nil(t, err)
+		defer node.Close()
+		nodes = append(nodes, node)
+	}
+	for i, node := range nodes {
+		assert.Nil(t, node.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("value")))
+	}
+	for _, node := range nodes {
+		for i := range nodes {
+			val, err := node.Get([]byte(fmt.Sprintf("key-%d", i)))
+			assert.Nil(t, err)
+			assert.Equal(t, "value", string(val))
+		}
+	}
+}
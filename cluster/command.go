@@ -0,0 +1,112 @@
+package cluster
+
+import (
+	"encoding/binary"
+	bitcask "kv-go/db"
+	"sync"
+)
+
+type opType = byte
+
+const (
+	opPut opType = iota + 1
+	opDelete
+)
+
+// 日志中记录的一次写操作
+type op struct {
+	typ   opType
+	key   []byte
+	value []byte
+}
+
+// 一条日志包含的所有写操作，作为一个WriteBatch应用到状态机
+// 编码格式：type + key size + key + value size + value
+func encodeCommand(ops []op) []byte {
+	var buf []byte
+	for _, o := range ops {
+		buf = append(buf, o.typ)
+		buf = binary.AppendUvarint(buf, uint64(len(o.key)))
+		buf = append(buf, o.key...)
+		buf = binary.AppendUvarint(buf, uint64(len(o.value)))
+		buf = append(buf, o.value...)
+	}
+	return buf
+}
+
+func decodeCommand(buf []byte) ([]op, error) {
+	var ops []op
+	for len(buf) > 0 {
+		o := op{typ: buf[0]}
+		if o.typ != opPut && o.typ != opDelete {
+			return nil, ErrInvalidCommand
+		}
+		buf = buf[1:]
+		var ok bool
+		if o.key, buf, ok = readBytes(buf); !ok {
+			return nil, ErrInvalidCommand
+		}
+		if o.value, buf, ok = readBytes(buf); !ok {
+			return nil, ErrInvalidCommand
+		}
+		ops = append(ops, o)
+	}
+	return ops, nil
+}
+
+func readBytes(buf []byte) ([]byte, []byte, bool) {
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < size {
+		return nil, nil, false
+	}
+	return buf[n : n+int(size)], buf[n+int(size):], true
+}
+
+// WriteBatch 暂存的写操作在提交时作为一条日志复制到集群，所有节点都原子地应用
+type WriteBatch struct {
+	node *Node
+	ops  []op
+	mu   *sync.Mutex
+}
+
+// 创建WriteBatch
+func (n *Node) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{node: n, mu: new(sync.Mutex)}
+}
+
+// 暂存写入
+func (wb *WriteBatch) Put(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return bitcask.ErrEmptyKey
+	}
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	wb.ops = append(wb.ops, op{typ: opPut, key: key, value: value})
+	return nil
+}
+
+// 暂存删除
+func (wb *WriteBatch) Delete(key []byte) error {
+	if len(key) == 0 {
+		return bitcask.ErrEmptyKey
+	}
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	wb.ops = append(wb.ops, op{typ: opDelete, key: key})
+	return nil
+}
+
+// 提交暂存的写操作，返回时所有写操作已经提交并应用到leader的状态机
+func (wb *WriteBatch) Commit() error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	// 空事务无需提交
+	if len(wb.ops) == 0 {
+		return nil
+	}
+	if err := wb.node.propose(encodeCommand(wb.ops)); err != nil {
+		return err
+	}
+	wb.ops = nil
+	return nil
+}
@@ -0,0 +1,46 @@
+package cluster
+
+import (
+	"errors"
+	bitcask "kv-go/db"
+)
+
+// 描述集群运行时可能出现的错误
+var (
+	ErrInvalidOptions   = errors.New("cluster options are invalid, the node id must be one of the peers")
+	ErrNotLeader        = errors.New("the node is not the leader")
+	ErrNoLeader         = errors.New("there is no leader in the cluster, try again later")
+	ErrTimeout          = errors.New("the request timed out, the write may or may not be applied")
+	ErrClosed           = errors.New("the node is closed")
+	ErrUnreachable      = errors.New("the peer is unreachable")
+	ErrSnapshotNotFound = errors.New("the snapshot of the compacted log is missing")
+	ErrInvalidCommand   = errors.New("invalid command in the raft log")
+)
+
+// leader在本节点任期内的日志提交之前，无法确定之前任期的日志是否已经提交，需要稍后重试
+var errLeaderNotReady = errors.New("the leader has not committed an entry in its term")
+
+// 通过Message.Err在节点之间传递的错误
+var knownErrors = []error{
+	ErrNotLeader, ErrNoLeader, ErrTimeout, ErrClosed, errLeaderNotReady,
+	bitcask.ErrEmptyKey, bitcask.ErrKeyNotFound,
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func parseError(s string) error {
+	if s == "" {
+		return nil
+	}
+	for _, err := range knownErrors {
+		if err.Error() == s {
+			return err
+		}
+	}
+	return errors.New(s)
+}
@@ -0,0 +1,227 @@
+package cluster
+
+import (
+	"encoding/binary"
+	bitcask "kv-go/db"
+	"strconv"
+)
+
+const (
+	hardStateTermKey = "term"
+	hardStateVoteKey = "vote"
+	snapshotMetaKey  = "snapshot"
+	entryKeyPrefix   = "entry/"
+)
+
+// Entry raft日志中的一条记录
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Data  []byte // 编码后的写操作，为空时是leader当选后提交的空日志
+}
+
+// raft日志与需要持久化的状态，保存在单独的bitcask实例中
+// 所有修改都同步写入磁盘，之后才会响应其他节点
+type raftLog struct {
+	db            *bitcask.DB
+	snapshotIndex uint64  // 最后一个快照包含的日志
+	snapshotTerm  uint64  //
+	entries       []Entry // snapshotIndex之后的所有日志
+}
+
+func openRaftLog(dirPath string) (*raftLog, error) {
+	opts := bitcask.DefaultDBOptions
+	opts.DirPath = dirPath
+	opts.AlwaysSync = true
+	db, err := bitcask.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	l := &raftLog{db: db}
+	if meta, err := db.Get([]byte(snapshotMetaKey)); err == nil && len(meta) == 16 {
+		l.snapshotIndex = binary.BigEndian.Uint64(meta)
+		l.snapshotTerm = binary.BigEndian.Uint64(meta[8:])
+	} else if err != nil && err != bitcask.ErrKeyNotFound {
+		_ = db.Close()
+		return nil, err
+	}
+	// 日志的key按index的大端序排列，迭代器按顺序返回
+	iter := db.NewIterator(bitcask.ItOptions{Prefix: []byte(entryKeyPrefix)})
+	defer iter.Close()
+	for iter.Rewind(); !iter.IsEnd(); iter.Next() {
+		index := binary.BigEndian.Uint64(iter.Key()[len(entryKeyPrefix):])
+		if index <= l.snapshotIndex {
+			continue
+		}
+		value, err := iter.Value()
+		if err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+		l.entries = append(l.entries, decodeEntry(index, value))
+	}
+	return l, nil
+}
+
+func (l *raftLog) close() error {
+	return l.db.Close()
+}
+
+// 读取持久化的term与投票
+func (l *raftLog) hardState() (uint64, string, error) {
+	var term uint64
+	value, err := l.db.Get([]byte(hardStateTermKey))
+	if err == nil {
+		if term, err = strconv.ParseUint(string(value), 10, 64); err != nil {
+			return 0, "", err
+		}
+	} else if err != bitcask.ErrKeyNotFound {
+		return 0, "", err
+	}
+	vote, err := l.db.Get([]byte(hardStateVoteKey))
+	if err != nil && err != bitcask.ErrKeyNotFound {
+		return 0, "", err
+	}
+	return term, string(vote), nil
+}
+
+func (l *raftLog) setHardState(term uint64, vote string) error {
+	wb := l.db.NewWriteBatch(bitcask.DefaultWBOptions)
+	if err := wb.Put([]byte(hardStateTermKey), []byte(strconv.FormatUint(term, 10))); err != nil {
+		return err
+	}
+	var err error
+	if vote == "" {
+		err = wb.Delete([]byte(hardStateVoteKey))
+	} else {
+		err = wb.Put([]byte(hardStateVoteKey), []byte(vote))
+	}
+	if err != nil {
+		return err
+	}
+	return wb.Commit()
+}
+
+func (l *raftLog) lastIndex() uint64 {
+	return l.snapshotIndex + uint64(len(l.entries))
+}
+
+func (l *raftLog) lastTerm() uint64 {
+	if len(l.entries) == 0 {
+		return l.snapshotTerm
+	}
+	return l.entries[len(l.entries)-1].Term
+}
+
+// index处日志的term，日志已经被快照压缩或者不存在时返回false
+func (l *raftLog) term(index uint64) (uint64, bool) {
+	if index == l.snapshotIndex {
+		return l.snapshotTerm, true
+	}
+	if index < l.snapshotIndex || index > l.lastIndex() {
+		return 0, false
+	}
+	return l.entries[index-l.snapshotIndex-1].Term, true
+}
+
+// 获取[from, to]之间的日志，最多返回limit条
+func (l *raftLog) slice(from uint64, to uint64, limit int) []Entry {
+	if from <= l.snapshotIndex {
+		from = l.snapshotIndex + 1
+	}
+	to = min(to, l.lastIndex())
+	if from > to {
+		return nil
+	}
+	entries := l.entries[from-l.snapshotIndex-1 : to-l.snapshotIndex]
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries
+}
+
+// 追加日志，调用者需要保证日志是连续的
+func (l *raftLog) append(entries ...Entry) error {
+	wb := l.db.NewWriteBatch(bitcask.DefaultWBOptions)
+	for _, entry := range entries {
+		if err := wb.Put(entryKey(entry.Index), encodeEntry(entry)); err != nil {
+			return err
+		}
+	}
+	if err := wb.Commit(); err != nil {
+		return err
+	}
+	l.entries = append(l.entries, entries...)
+	return nil
+}
+
+// 删除index及之后的日志，用于解决与leader的冲突
+func (l *raftLog) truncate(index uint64) error {
+	if index <= l.snapshotIndex || index > l.lastIndex() {
+		return nil
+	}
+	wb := l.db.NewWriteBatch(bitcask.DefaultWBOptions)
+	for i := index; i <= l.lastIndex(); i++ {
+		if err := wb.Delete(entryKey(i)); err != nil {
+			return err
+		}
+	}
+	if err := wb.Commit(); err != nil {
+		return err
+	}
+	l.entries = l.entries[:index-l.snapshotIndex-1]
+	return nil
+}
+
+// 快照已经包含index及之前的日志，删除这些日志
+// 日志中不存在index处term相同的记录时，之后的日志也与快照冲突，全部删除
+func (l *raftLog) compact(index uint64, term uint64) error {
+	if index <= l.snapshotIndex {
+		return nil
+	}
+	keep := index
+	if t, ok := l.term(index); !ok || t != term {
+		keep = l.lastIndex()
+	}
+	wb := l.db.NewWriteBatch(bitcask.DefaultWBOptions)
+	for i := l.snapshotIndex + 1; i <= keep; i++ {
+		if err := wb.Delete(entryKey(i)); err != nil {
+			return err
+		}
+	}
+	meta := make([]byte, 16)
+	binary.BigEndian.PutUint64(meta, index)
+	binary.BigEndian.PutUint64(meta[8:], term)
+	if err := wb.Put([]byte(snapshotMetaKey), meta); err != nil {
+		return err
+	}
+	if err := wb.Commit(); err != nil {
+		return err
+	}
+	if keep == index {
+		l.entries = append([]Entry(nil), l.entries[index-l.snapshotIndex:]...)
+	} else {
+		l.entries = nil
+	}
+	l.snapshotIndex, l.snapshotTerm = index, term
+	// 删除的日志在merge时回收
+	return nil
+}
+
+func entryKey(index uint64) []byte {
+	key := make([]byte, len(entryKeyPrefix)+8)
+	copy(key, entryKeyPrefix)
+	binary.BigEndian.PutUint64(key[len(entryKeyPrefix):], index)
+	return key
+}
+
+func encodeEntry(entry Entry) []byte {
+	buf := make([]byte, 8+len(entry.Data))
+	binary.BigEndian.PutUint64(buf, entry.Term)
+	copy(buf[8:], entry.Data)
+	return buf
+}
+
+func decodeEntry(index uint64, buf []byte) Entry {
+	return Entry{Index: index, Term: binary.BigEndian.Uint64(buf), Data: buf[8:]}
+}
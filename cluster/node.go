@@ -0,0 +1,555 @@
+package cluster
+
+import (
+	"encoding/binary"
+	bitcask "kv-go/db"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	raftDirName  = "raft"
+	stateDirName = "state"
+	// 状态机中记录已应用日志位置的column family
+	metaFamilyName = "raft"
+)
+
+var appliedKey = []byte("applied")
+
+// Node 集群中的一个节点，写入通过raft日志复制到所有节点，再应用到每个节点的状态机DB
+type Node struct {
+	opts  Options
+	peers []string // 除自己以外的节点
+
+	mu               *sync.Mutex
+	role             role
+	term             uint64
+	vote             string
+	leader           string
+	log              *raftLog
+	commitIndex      uint64
+	lastApplied      uint64
+	appliedTerm      uint64
+	applied          chan struct{}               // 应用新的日志后关闭并替换，用来唤醒等待者
+	waiters          map[uint64]chan applyResult // 等待日志应用的写入
+	nextIndex        map[string]uint64
+	matchIndex       map[string]uint64
+	lastAck          map[string]time.Time
+	electionDeadline time.Time
+	snapshotDir      string // 最新的快照，与log.snapshotIndex对应
+	closed           bool
+
+	applyMu *sync.Mutex   // 应用日志与替换状态机时持有
+	stateMu *sync.RWMutex // 读取状态机时持有读锁，替换或关闭状态机时持有写锁
+	state   *bitcask.DB
+	meta    *bitcask.ColumnFamily
+
+	recvMu *sync.Mutex // 接收快照时持有
+	recv   *snapshotReceiver
+
+	kicks     map[string]chan struct{}
+	applyKick chan struct{}
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+type applyResult struct {
+	term uint64
+	err  error
+}
+
+// 打开或创建节点并加入集群
+func NewNode(opts Options) (*Node, error) {
+	if err := checkOptions(opts); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(opts.DirPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+	n := &Node{
+		opts:       opts,
+		mu:         new(sync.Mutex),
+		applied:    make(chan struct{}),
+		waiters:    make(map[uint64]chan applyResult),
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		lastAck:    make(map[string]time.Time),
+		applyMu:    new(sync.Mutex),
+		stateMu:    new(sync.RWMutex),
+		recvMu:     new(sync.Mutex),
+		kicks:      make(map[string]chan struct{}),
+		applyKick:  make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+	for _, peer := range opts.Peers {
+		if peer != opts.ID {
+			n.peers = append(n.peers, peer)
+			n.kicks[peer] = make(chan struct{}, 1)
+		}
+	}
+	var err error
+	if n.log, err = openRaftLog(filepath.Join(opts.DirPath, raftDirName)); err != nil {
+		return nil, err
+	}
+	if err := n.recover(); err != nil {
+		if n.state != nil {
+			_ = n.state.Close()
+		}
+		_ = n.log.close()
+		return nil, err
+	}
+	n.resetElectionTimer()
+	if err := opts.Transport.Listen(opts.ID, n.handle); err != nil {
+		_ = n.state.Close()
+		_ = n.log.close()
+		return nil, err
+	}
+	n.wg.Add(2 + len(n.peers))
+	go n.tick()
+	go n.apply()
+	for peer, kick := range n.kicks {
+		go n.replicate(peer, kick)
+	}
+	return n, nil
+}
+
+func checkOptions(opts Options) error {
+	if opts.DirPath == "" || opts.Transport == nil || !slices.Contains(opts.Peers, opts.ID) {
+		return ErrInvalidOptions
+	}
+	if opts.ElectionTimeout <= 0 || opts.HeartbeatInterval <= 0 || opts.RequestTimeout <= 0 {
+		return ErrInvalidOptions
+	}
+	return nil
+}
+
+// 恢复持久化的状态，使状态机与日志保持一致
+func (n *Node) recover() error {
+	var err error
+	if n.term, n.vote, err = n.log.hardState(); err != nil {
+		return err
+	}
+	if err := n.loadSnapshotDir(); err != nil {
+		return err
+	}
+	if err := n.openState(); err != nil {
+		return err
+	}
+	// 状态机落后于快照时，从快照恢复
+	if n.lastApplied < n.log.snapshotIndex {
+		if err := n.replaceState(n.snapshotDir); err != nil {
+			return err
+		}
+	}
+	// 状态机超前于日志时，日志中缺少或者冲突的部分已经包含在状态机中，重新创建快照压缩日志
+	if term, ok := n.log.term(n.lastApplied); !ok || term != n.appliedTerm {
+		if err := n.takeSnapshot(); err != nil {
+			return err
+		}
+	}
+	// 已经应用的日志一定已经提交
+	n.commitIndex = n.lastApplied
+	return nil
+}
+
+// 打开状态机并读取已经应用的日志位置
+func (n *Node) openState() error {
+	opts := n.opts.DBOptions
+	opts.DirPath = filepath.Join(n.opts.DirPath, stateDirName)
+	state, err := bitcask.Open(opts)
+	if err != nil {
+		return err
+	}
+	meta, err := state.ColumnFamily(metaFamilyName)
+	if err == bitcask.ErrFamilyNotFound {
+		meta, err = state.CreateColumnFamily(metaFamilyName)
+	}
+	if err != nil {
+		_ = state.Close()
+		return err
+	}
+	n.lastApplied, n.appliedTerm = 0, 0
+	if value, err := meta.Get(appliedKey); err == nil && len(value) == 16 {
+		n.lastApplied = binary.BigEndian.Uint64(value)
+		n.appliedTerm = binary.BigEndian.Uint64(value[8:])
+	} else if err != nil && err != bitcask.ErrKeyNotFound {
+		_ = state.Close()
+		return err
+	}
+	n.state, n.meta = state, meta
+	return nil
+}
+
+// 不断将已经提交的日志应用到状态机
+func (n *Node) apply() {
+	defer n.wg.Done()
+	// 应用失败时定期重试
+	ticker := time.NewTicker(n.opts.ElectionTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.applyKick:
+		case <-ticker.C:
+		}
+		for n.applyCommitted() {
+		}
+	}
+}
+
+// 应用一批已经提交的日志，返回是否还有需要应用的日志
+func (n *Node) applyCommitted() bool {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return false
+	}
+	entries := append([]Entry(nil), n.log.slice(n.lastApplied+1, n.commitIndex, maxEntriesPerMessage)...)
+	n.mu.Unlock()
+	if len(entries) == 0 {
+		return false
+	}
+	for _, entry := range entries {
+		err := n.applyEntry(entry)
+		if err != nil {
+			return false
+		}
+		n.mu.Lock()
+		n.lastApplied, n.appliedTerm = entry.Index, entry.Term
+		if waiter, ok := n.waiters[entry.Index]; ok {
+			delete(n.waiters, entry.Index)
+			waiter <- applyResult{term: entry.Term}
+		}
+		close(n.applied)
+		n.applied = make(chan struct{})
+		n.mu.Unlock()
+	}
+	n.mu.Lock()
+	compact := n.opts.SnapshotThreshold > 0 && n.lastApplied-n.log.snapshotIndex >= n.opts.SnapshotThreshold
+	more := n.lastApplied < n.commitIndex
+	n.mu.Unlock()
+	if compact {
+		_ = n.takeSnapshot()
+	}
+	return more
+}
+
+// 将日志中的所有写操作与日志的位置作为一个WriteBatch写入状态机，调用者需要持有applyMu
+func (n *Node) applyEntry(entry Entry) error {
+	ops, err := decodeCommand(entry.Data)
+	if err != nil {
+		return err
+	}
+	// 日志已经持久化，状态机崩溃后丢失的写入会重新应用
+	wb := n.state.NewWriteBatch(bitcask.WBOptions{Sync: false, MaxWriteNum: uint(len(ops) + 1)})
+	for _, o := range ops {
+		if o.typ == opPut {
+			err = wb.Put(o.key, o.value)
+		} else {
+			err = wb.Delete(o.key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	applied := make([]byte, 16)
+	binary.BigEndian.PutUint64(applied, entry.Index)
+	binary.BigEndian.PutUint64(applied[8:], entry.Term)
+	if err := wb.PutCF(n.meta, appliedKey, applied); err != nil {
+		return err
+	}
+	return wb.Commit()
+}
+
+// 提交写操作，没有leader时在RequestTimeout内重试
+func (n *Node) propose(command []byte) error {
+	return n.retry(func() error {
+		n.mu.Lock()
+		if n.closed {
+			n.mu.Unlock()
+			return ErrClosed
+		}
+		if n.role == leader {
+			n.mu.Unlock()
+			return n.proposeLocal(command)
+		}
+		leaderId := n.leader
+		n.mu.Unlock()
+		if leaderId == "" {
+			return ErrNoLeader
+		}
+		reply, err := n.opts.Transport.Call(leaderId, &Message{Type: MsgPropose, From: n.opts.ID, Command: command}, n.opts.RequestTimeout)
+		if err == ErrUnreachable {
+			return ErrNoLeader
+		}
+		if err != nil {
+			return err
+		}
+		return parseError(reply.Err)
+	})
+}
+
+// leader追加日志并等待日志应用到状态机
+func (n *Node) proposeLocal(command []byte) error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return ErrClosed
+	}
+	if n.role != leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	entry := Entry{Index: n.log.lastIndex() + 1, Term: n.term, Data: command}
+	if err := n.log.append(entry); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	waiter := make(chan applyResult, 1)
+	n.waiters[entry.Index] = waiter
+	n.advanceCommit()
+	n.kickReplicators()
+	n.mu.Unlock()
+
+	timer := time.NewTimer(n.opts.RequestTimeout)
+	defer timer.Stop()
+	select {
+	case result := <-waiter:
+		// 日志被新的leader覆盖，写入没有生效
+		if result.term != entry.Term {
+			return ErrNotLeader
+		}
+		return result.err
+	case <-timer.C:
+		n.mu.Lock()
+		delete(n.waiters, entry.Index)
+		n.mu.Unlock()
+		return ErrTimeout
+	case <-n.stop:
+		return ErrClosed
+	}
+}
+
+// 获取线性一致读的read index，本节点不是leader时向leader获取
+func (n *Node) readIndex() (uint64, error) {
+	var index uint64
+	err := n.retry(func() error {
+		n.mu.Lock()
+		if n.closed {
+			n.mu.Unlock()
+			return ErrClosed
+		}
+		if n.role == leader {
+			n.mu.Unlock()
+			var err error
+			index, err = n.readIndexLocal()
+			return err
+		}
+		leaderId := n.leader
+		n.mu.Unlock()
+		if leaderId == "" {
+			return ErrNoLeader
+		}
+		reply, err := n.opts.Transport.Call(leaderId, &Message{Type: MsgReadIndex, From: n.opts.ID}, n.opts.RequestTimeout)
+		if err == ErrUnreachable {
+			return ErrNoLeader
+		}
+		if err != nil {
+			return err
+		}
+		index = reply.ReadIndex
+		return parseError(reply.Err)
+	})
+	return index, err
+}
+
+// leader记录当前的commit index，再确认自己仍然是leader
+func (n *Node) readIndexLocal() (uint64, error) {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return 0, ErrClosed
+	}
+	if n.role != leader {
+		n.mu.Unlock()
+		return 0, ErrNotLeader
+	}
+	if term, _ := n.log.term(n.commitIndex); term != n.term {
+		n.mu.Unlock()
+		return 0, errLeaderNotReady
+	}
+	index, term := n.commitIndex, n.term
+	n.mu.Unlock()
+	if !n.confirmLeadership(term) {
+		return 0, ErrNotLeader
+	}
+	return index, nil
+}
+
+// 等待状态机应用到index
+func (n *Node) waitApplied(index uint64) error {
+	timer := time.NewTimer(n.opts.RequestTimeout)
+	defer timer.Stop()
+	for {
+		n.mu.Lock()
+		if n.lastApplied >= index {
+			n.mu.Unlock()
+			return nil
+		}
+		applied := n.applied
+		n.mu.Unlock()
+		select {
+		case <-applied:
+		case <-timer.C:
+			return ErrTimeout
+		case <-n.stop:
+			return ErrClosed
+		}
+	}
+}
+
+// 暂时没有可用的leader时，在RequestTimeout内重试
+func (n *Node) retry(fn func() error) error {
+	deadline := time.Now().Add(n.opts.RequestTimeout)
+	for {
+		err := fn()
+		if err != ErrNoLeader && err != ErrNotLeader && err != errLeaderNotReady {
+			return err
+		}
+		if time.Now().After(deadline) {
+			if err == errLeaderNotReady {
+				return ErrNoLeader
+			}
+			return err
+		}
+		select {
+		case <-n.stop:
+			return ErrClosed
+		case <-time.After(n.opts.HeartbeatInterval):
+		}
+	}
+}
+
+// 写入key/value
+func (n *Node) Put(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return bitcask.ErrEmptyKey
+	}
+	return n.propose(encodeCommand([]op{{typ: opPut, key: key, value: value}}))
+}
+
+// 删除key
+func (n *Node) Delete(key []byte) error {
+	if len(key) == 0 {
+		return bitcask.ErrEmptyKey
+	}
+	return n.propose(encodeCommand([]op{{typ: opDelete, key: key}}))
+}
+
+// 线性一致地读取key
+func (n *Node) Get(key []byte) ([]byte, error) {
+	return n.GetWithConsistency(key, Linearizable)
+}
+
+// 以指定的一致性级别读取key
+func (n *Node) GetWithConsistency(key []byte, consistency Consistency) ([]byte, error) {
+	var value []byte
+	err := n.View(consistency, func(db *bitcask.DB) error {
+		var err error
+		value, err = db.Get(key)
+		return err
+	})
+	return value, err
+}
+
+// 线性一致地读取多个key，返回的value与error与keys一一对应
+func (n *Node) MultiGet(keys [][]byte) ([][]byte, []error) {
+	var values [][]byte
+	var errs []error
+	err := n.View(Linearizable, func(db *bitcask.DB) error {
+		values, errs = db.MultiGet(keys)
+		return nil
+	})
+	if err != nil {
+		values, errs = make([][]byte, len(keys)), make([]error, len(keys))
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+	return values, errs
+}
+
+// 以指定的一致性级别读取本地状态机，fn执行期间状态机不会被替换，fn中不能写入状态机
+func (n *Node) View(consistency Consistency, fn func(db *bitcask.DB) error) error {
+	if consistency == Linearizable {
+		index, err := n.readIndex()
+		if err != nil {
+			return err
+		}
+		if err := n.waitApplied(index); err != nil {
+			return err
+		}
+	}
+	n.stateMu.RLock()
+	defer n.stateMu.RUnlock()
+	n.mu.Lock()
+	closed := n.closed
+	n.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	return fn(n.state)
+}
+
+// 节点的id
+func (n *Node) ID() string {
+	return n.opts.ID
+}
+
+// 当前已知的leader，没有leader时返回空字符串
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+// 是否是leader
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == leader
+}
+
+// 关闭节点
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	close(n.stop)
+	n.mu.Unlock()
+	err := n.opts.Transport.Close()
+	n.wg.Wait()
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if closeErr := n.state.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if closeErr := n.log.close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,45 @@
+package cluster
+
+import (
+	bitcask "kv-go/db"
+	"time"
+)
+
+type Options struct {
+	// 节点的id，使用TCPTransport时就是节点的raft地址
+	ID string
+	// 集群中所有节点的id，包括自己
+	Peers []string
+	// 数据目录，raft日志保存在raft子目录中，状态机保存在state子目录中
+	DirPath string
+	// 状态机DB的配置，DirPath会被忽略
+	DBOptions bitcask.DBOptions
+	// 节点之间的通信方式，节点关闭时同时关闭
+	Transport Transport
+	// 超过该时间没有收到leader的消息则发起选举，实际时间在[ElectionTimeout, 2*ElectionTimeout)之间随机
+	ElectionTimeout time.Duration
+	// leader发送心跳的时间间隔，需要远小于ElectionTimeout
+	HeartbeatInterval time.Duration
+	// 快照之后应用的日志达到该数量时创建新的快照并压缩日志，为0时不压缩
+	SnapshotThreshold uint64
+	// 写入与线性一致读等待的最长时间，期间没有leader时会不断重试
+	RequestTimeout time.Duration
+}
+
+// Consistency 读取时的一致性级别
+type Consistency byte
+
+const (
+	// Linearizable 通过leader确认read index，等待本地状态机应用到该位置后再读取，总能读到之前完成的写入
+	Linearizable Consistency = iota
+	// Stale 直接读取本地状态机，可能读到旧的数据，但不需要与其他节点通信
+	Stale
+)
+
+var DefaultOptions = Options{
+	DBOptions:         bitcask.DefaultDBOptions,
+	ElectionTimeout:   500 * time.Millisecond,
+	HeartbeatInterval: 50 * time.Millisecond,
+	SnapshotThreshold: 10000,
+	RequestTimeout:    5 * time.Second,
+}
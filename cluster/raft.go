@@ -0,0 +1,448 @@
+package cluster
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+type role byte
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+// 每条消息最多携带的日志数量
+const maxEntriesPerMessage = 256
+
+// 持久化term与投票，之后才能响应其他节点，调用者需要持有mu
+func (n *Node) setTerm(term uint64, vote string) error {
+	if err := n.log.setHardState(term, vote); err != nil {
+		return err
+	}
+	n.term, n.vote = term, vote
+	return nil
+}
+
+// 转为follower，发现更大的term时更新term并清空投票，调用者需要持有mu
+func (n *Node) becomeFollower(term uint64, leaderId string) error {
+	if term > n.term {
+		if err := n.setTerm(term, ""); err != nil {
+			return err
+		}
+	}
+	n.role = follower
+	n.leader = leaderId
+	return nil
+}
+
+// 调用者需要持有mu
+func (n *Node) becomeLeader() {
+	n.role = leader
+	n.leader = n.opts.ID
+	now := time.Now()
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.log.lastIndex() + 1
+		n.matchIndex[peer] = 0
+		n.lastAck[peer] = now
+	}
+	// 提交一条当前任期的空日志，之前任期的日志随之提交，之后才能确定read index
+	entry := Entry{Index: n.log.lastIndex() + 1, Term: n.term}
+	if err := n.log.append(entry); err != nil {
+		_ = n.becomeFollower(n.term, "")
+		return
+	}
+	n.advanceCommit()
+	n.kickReplicators()
+}
+
+func (n *Node) quorum() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+// 随机的选举超时时间，避免多个节点同时发起选举
+func (n *Node) resetElectionTimer() {
+	timeout := n.opts.ElectionTimeout + time.Duration(rand.Int63n(int64(n.opts.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// 定期检查是否需要发起选举，leader检查是否仍然能联系到多数节点
+func (n *Node) tick() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.opts.ElectionTimeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+		n.mu.Lock()
+		now := time.Now()
+		switch {
+		case n.role == leader:
+			// 与多数节点失去联系的leader主动退位，不再接受写入
+			acked := 1
+			for _, peer := range n.peers {
+				if now.Sub(n.lastAck[peer]) < n.opts.ElectionTimeout {
+					acked++
+				}
+			}
+			if acked < n.quorum() {
+				_ = n.becomeFollower(n.term, "")
+				n.resetElectionTimer()
+			}
+			n.mu.Unlock()
+		case now.After(n.electionDeadline):
+			n.mu.Unlock()
+			n.campaign()
+		default:
+			n.mu.Unlock()
+		}
+	}
+}
+
+// 发起选举
+func (n *Node) campaign() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed || n.role == leader {
+		return
+	}
+	n.resetElectionTimer()
+	if err := n.setTerm(n.term+1, n.opts.ID); err != nil {
+		return
+	}
+	n.role = candidate
+	n.leader = ""
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	term := n.term
+	msg := &Message{
+		Type:         MsgVote,
+		Term:         term,
+		From:         n.opts.ID,
+		LastLogIndex: n.log.lastIndex(),
+		LastLogTerm:  n.log.lastTerm(),
+	}
+	for _, peer := range n.peers {
+		n.wg.Add(1)
+		go func(peer string) {
+			defer n.wg.Done()
+			reply, err := n.opts.Transport.Call(peer, msg, n.opts.ElectionTimeout)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if n.closed {
+				return
+			}
+			if reply.Term > n.term {
+				_ = n.becomeFollower(reply.Term, "")
+				return
+			}
+			if n.role != candidate || n.term != term || !reply.Granted {
+				return
+			}
+			votes++
+			if votes == n.quorum() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// 处理其他节点发来的请求
+func (n *Node) handle(msg *Message) *Message {
+	switch msg.Type {
+	case MsgVote:
+		return n.handleVote(msg)
+	case MsgAppend:
+		return n.handleAppend(msg)
+	case MsgSnapshot:
+		return n.handleSnapshot(msg)
+	case MsgPropose:
+		return &Message{Type: msg.Type, Err: errorString(n.proposeLocal(msg.Command))}
+	case MsgReadIndex:
+		index, err := n.readIndexLocal()
+		return &Message{Type: msg.Type, ReadIndex: index, Err: errorString(err)}
+	}
+	return &Message{Type: msg.Type, Err: ErrInvalidCommand.Error()}
+}
+
+func (n *Node) handleVote(msg *Message) *Message {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	reply := &Message{Type: MsgVote}
+	if n.closed {
+		reply.Err = ErrClosed.Error()
+		return reply
+	}
+	if msg.Term > n.term {
+		if err := n.becomeFollower(msg.Term, ""); err != nil {
+			reply.Term = n.term
+			return reply
+		}
+	}
+	reply.Term = n.term
+	if msg.Term < n.term || (n.vote != "" && n.vote != msg.From) {
+		return reply
+	}
+	// 只投票给日志至少与自己一样新的节点
+	lastTerm := n.log.lastTerm()
+	if msg.LastLogTerm < lastTerm || (msg.LastLogTerm == lastTerm && msg.LastLogIndex < n.log.lastIndex()) {
+		return reply
+	}
+	if err := n.setTerm(n.term, msg.From); err != nil {
+		return reply
+	}
+	n.resetElectionTimer()
+	reply.Granted = true
+	return reply
+}
+
+// 收到当前leader的消息，调用者需要持有mu
+func (n *Node) acceptLeader(msg *Message) error {
+	if msg.Term > n.term || n.role != follower {
+		if err := n.becomeFollower(msg.Term, msg.From); err != nil {
+			return err
+		}
+	}
+	n.leader = msg.From
+	n.resetElectionTimer()
+	return nil
+}
+
+func (n *Node) handleAppend(msg *Message) *Message {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	reply := &Message{Type: MsgAppend, Term: n.term}
+	if n.closed {
+		reply.Err = ErrClosed.Error()
+		return reply
+	}
+	if msg.Term < n.term {
+		return reply
+	}
+	if err := n.acceptLeader(msg); err != nil {
+		return reply
+	}
+	reply.Term = n.term
+
+	// 快照之前的日志都已经提交，从快照之后开始匹配
+	if msg.PrevLogIndex < n.log.snapshotIndex {
+		reply.ConflictIndex = n.log.snapshotIndex + 1
+		return reply
+	}
+	if msg.PrevLogIndex > n.log.lastIndex() {
+		reply.ConflictIndex = n.log.lastIndex() + 1
+		return reply
+	}
+	if term, _ := n.log.term(msg.PrevLogIndex); term != msg.PrevLogTerm {
+		// 跳过冲突的term中的所有日志
+		index := msg.PrevLogIndex
+		for index > n.log.snapshotIndex+1 {
+			if t, _ := n.log.term(index - 1); t != term {
+				break
+			}
+			index--
+		}
+		reply.ConflictIndex = index
+		return reply
+	}
+	for i, entry := range msg.Entries {
+		if term, ok := n.log.term(entry.Index); ok {
+			if term == entry.Term {
+				continue
+			}
+			if err := n.log.truncate(entry.Index); err != nil {
+				return reply
+			}
+		}
+		if err := n.log.append(msg.Entries[i:]...); err != nil {
+			return reply
+		}
+		break
+	}
+	// 只能提交与leader确认一致的日志
+	if commit := min(msg.LeaderCommit, msg.PrevLogIndex+uint64(len(msg.Entries))); commit > n.commitIndex {
+		n.commitIndex = commit
+		n.kickApplier()
+	}
+	reply.Success = true
+	return reply
+}
+
+// 向peer发送日志，返回是否还有日志需要立即发送
+func (n *Node) sendAppend(peer string) bool {
+	n.mu.Lock()
+	if n.closed || n.role != leader {
+		n.mu.Unlock()
+		return false
+	}
+	term := n.term
+	next := n.nextIndex[peer]
+	if next <= n.log.snapshotIndex {
+		n.mu.Unlock()
+		return n.sendSnapshot(peer, term)
+	}
+	prevTerm, _ := n.log.term(next - 1)
+	msg := &Message{
+		Type:         MsgAppend,
+		Term:         term,
+		From:         n.opts.ID,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  prevTerm,
+		Entries:      append([]Entry(nil), n.log.slice(next, n.log.lastIndex(), maxEntriesPerMessage)...),
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	reply, err := n.opts.Transport.Call(peer, msg, n.opts.ElectionTimeout)
+	if err != nil {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return false
+	}
+	if reply.Term > n.term {
+		_ = n.becomeFollower(reply.Term, "")
+		n.resetElectionTimer()
+		return false
+	}
+	if n.role != leader || n.term != term {
+		return false
+	}
+	n.lastAck[peer] = time.Now()
+	if !reply.Success {
+		if reply.ConflictIndex == 0 || reply.ConflictIndex == next {
+			return false
+		}
+		n.nextIndex[peer] = reply.ConflictIndex
+		return true
+	}
+	match := msg.PrevLogIndex + uint64(len(msg.Entries))
+	if match > n.matchIndex[peer] {
+		n.matchIndex[peer] = match
+		n.advanceCommit()
+	}
+	n.nextIndex[peer] = max(n.nextIndex[peer], match+1)
+	return n.nextIndex[peer] <= n.log.lastIndex()
+}
+
+// 多数节点都已经保存的日志可以提交，只直接提交当前任期的日志，调用者需要持有mu
+func (n *Node) advanceCommit() {
+	if n.role != leader {
+		return
+	}
+	matches := []uint64{n.log.lastIndex()}
+	for _, peer := range n.peers {
+		matches = append(matches, n.matchIndex[peer])
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+	index := matches[n.quorum()-1]
+	if index <= n.commitIndex {
+		return
+	}
+	if term, _ := n.log.term(index); term == n.term {
+		n.commitIndex = index
+		n.kickApplier()
+	}
+}
+
+// 每个peer都有一个goroutine负责复制日志与发送心跳
+func (n *Node) replicate(peer string, kick chan struct{}) {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.opts.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-kick:
+		case <-ticker.C:
+		}
+		for n.sendAppend(peer) {
+		}
+	}
+}
+
+// 调用者需要持有mu
+func (n *Node) kickReplicators() {
+	for _, kick := range n.kicks {
+		select {
+		case kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// 调用者需要持有mu
+func (n *Node) kickApplier() {
+	select {
+	case n.applyKick <- struct{}{}:
+	default:
+	}
+}
+
+// 向所有节点发送心跳，多数节点仍然承认本节点是term的leader时返回true
+func (n *Node) confirmLeadership(term uint64) bool {
+	n.mu.Lock()
+	if n.closed || n.role != leader || n.term != term {
+		n.mu.Unlock()
+		return false
+	}
+	if len(n.peers) == 0 {
+		n.mu.Unlock()
+		return true
+	}
+	acks := make(chan bool, len(n.peers))
+	for _, peer := range n.peers {
+		// 只携带已经确认一致的位置，不会让follower截断日志
+		prev := max(n.matchIndex[peer], n.log.snapshotIndex)
+		prevTerm, _ := n.log.term(prev)
+		msg := &Message{
+			Type:         MsgAppend,
+			Term:         term,
+			From:         n.opts.ID,
+			PrevLogIndex: prev,
+			PrevLogTerm:  prevTerm,
+			LeaderCommit: n.commitIndex,
+		}
+		go func(peer string) {
+			reply, err := n.opts.Transport.Call(peer, msg, n.opts.ElectionTimeout)
+			if err != nil {
+				acks <- false
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if !n.closed && reply.Term > n.term {
+				_ = n.becomeFollower(reply.Term, "")
+				n.resetElectionTimer()
+			}
+			acks <- reply.Term == term
+		}(peer)
+	}
+	quorum := n.quorum()
+	n.mu.Unlock()
+
+	acked := 1
+	for range n.peers {
+		if <-acks {
+			acked++
+		}
+		if acked >= quorum {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,349 @@
+package cluster
+
+import (
+	"fmt"
+	"io"
+	"kv-go/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotDirPrefix   = "snapshot-"
+	snapshotTmpDirName  = "snapshot-tmp"
+	snapshotRecvDirName = "snapshot-recv"
+	stateTmpDirName     = "state-tmp"
+	// 每条消息携带的快照数据大小
+	snapshotChunkSize = 1 << 20
+)
+
+// 正在从leader接收的快照
+type snapshotReceiver struct {
+	index uint64
+	term  uint64
+}
+
+func snapshotDirName(index uint64, term uint64) string {
+	return fmt.Sprintf("%s%d-%d", snapshotDirPrefix, index, term)
+}
+
+// 找到与日志对应的快照，删除其他快照以及中断的操作留下的目录
+func (n *Node) loadSnapshotDir() error {
+	stateDir := filepath.Join(n.opts.DirPath, stateDirName)
+	stateTmpDir := filepath.Join(n.opts.DirPath, stateTmpDirName)
+	// 替换状态机时在删除旧目录之后中断
+	if _, err := os.Stat(stateDir); os.IsNotExist(err) {
+		if _, err := os.Stat(stateTmpDir); err == nil {
+			if err := os.Rename(stateTmpDir, stateDir); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.RemoveAll(stateTmpDir); err != nil {
+		return err
+	}
+
+	var want string
+	if n.log.snapshotIndex > 0 {
+		want = snapshotDirName(n.log.snapshotIndex, n.log.snapshotTerm)
+	}
+	entries, err := os.ReadDir(n.opts.DirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), snapshotDirPrefix) && entry.Name() != want {
+			if err := os.RemoveAll(filepath.Join(n.opts.DirPath, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if want == "" {
+		return nil
+	}
+	n.snapshotDir = filepath.Join(n.opts.DirPath, want)
+	if _, err := os.Stat(n.snapshotDir); err != nil {
+		return ErrSnapshotNotFound
+	}
+	return nil
+}
+
+// 以checkpoint的方式保存状态机，再删除快照已经包含的日志，调用者需要持有applyMu
+func (n *Node) takeSnapshot() error {
+	n.mu.Lock()
+	index, term := n.lastApplied, n.appliedTerm
+	snapshotIndex := n.log.snapshotIndex
+	n.mu.Unlock()
+	if index <= snapshotIndex {
+		return nil
+	}
+	// 快照中的状态机需要包含index之前的所有写入
+	if err := n.state.Sync(); err != nil {
+		return err
+	}
+	tmpDir := filepath.Join(n.opts.DirPath, snapshotTmpDirName)
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := n.state.Checkpoint(tmpDir); err != nil {
+		return err
+	}
+	dir := filepath.Join(n.opts.DirPath, snapshotDirName(index, term))
+	if err := os.Rename(tmpDir, dir); err != nil {
+		return err
+	}
+	return n.switchSnapshot(dir, index, term)
+}
+
+// 使用新的快照并压缩日志
+func (n *Node) switchSnapshot(dir string, index uint64, term uint64) error {
+	n.mu.Lock()
+	err := n.log.compact(index, term)
+	old := n.snapshotDir
+	if err == nil {
+		n.snapshotDir = dir
+	}
+	n.mu.Unlock()
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return err
+	}
+	if old != "" && old != dir {
+		_ = os.RemoveAll(old)
+	}
+	return nil
+}
+
+// 用快照替换状态机，调用者需要持有applyMu
+func (n *Node) replaceState(snapshotDir string) error {
+	stateDir := filepath.Join(n.opts.DirPath, stateDirName)
+	tmpDir := filepath.Join(n.opts.DirPath, stateTmpDirName)
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	// 快照中的文件是硬链接，复制之后状态机的写入不会影响快照
+	if err := utils.CopyDir(snapshotDir, tmpDir, nil); err != nil {
+		return err
+	}
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+	if n.state != nil {
+		if err := n.state.Close(); err != nil {
+			return err
+		}
+		n.state = nil
+	}
+	if err := os.RemoveAll(stateDir); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpDir, stateDir); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.openState()
+}
+
+// 将快照发送给落后太多的peer，返回是否需要继续发送日志
+func (n *Node) sendSnapshot(peer string, term uint64) bool {
+	n.mu.Lock()
+	dir, index, snapshotTerm := n.snapshotDir, n.log.snapshotIndex, n.log.snapshotTerm
+	n.mu.Unlock()
+
+	send := func(msg *Message) bool {
+		msg.Type = MsgSnapshot
+		msg.Term = term
+		msg.From = n.opts.ID
+		msg.SnapshotIndex = index
+		msg.SnapshotTerm = snapshotTerm
+		reply, err := n.opts.Transport.Call(peer, msg, n.opts.ElectionTimeout)
+		if err != nil {
+			return false
+		}
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if n.closed {
+			return false
+		}
+		if reply.Term > n.term {
+			_ = n.becomeFollower(reply.Term, "")
+			n.resetElectionTimer()
+			return false
+		}
+		if n.role != leader || n.term != term {
+			return false
+		}
+		n.lastAck[peer] = time.Now()
+		return reply.Success
+	}
+
+	// 发送期间快照可能被新的快照替换并删除，之后重新发送新的快照
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			files = append(files, entry.Name())
+		}
+	}
+	if len(files) == 0 && !send(&Message{Done: true}) {
+		return false
+	}
+	for i, name := range files {
+		if !n.sendSnapshotFile(filepath.Join(dir, name), i == len(files)-1, send) {
+			return false
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed || n.role != leader || n.term != term {
+		return false
+	}
+	n.matchIndex[peer] = max(n.matchIndex[peer], index)
+	n.nextIndex[peer] = index + 1
+	n.advanceCommit()
+	return n.nextIndex[peer] <= n.log.lastIndex()
+}
+
+// 分段发送快照中的一个文件
+func (n *Node) sendSnapshotFile(fileName string, last bool, send func(msg *Message) bool) bool {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	var offset int64
+	for {
+		buf := make([]byte, snapshotChunkSize)
+		size, err := io.ReadFull(file, buf)
+		eof := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !eof {
+			return false
+		}
+		msg := &Message{
+			FileName: filepath.Base(fileName),
+			Offset:   offset,
+			Data:     buf[:size],
+			Done:     eof && last,
+		}
+		if !send(msg) {
+			return false
+		}
+		if eof {
+			return true
+		}
+		offset += int64(size)
+	}
+}
+
+func (n *Node) handleSnapshot(msg *Message) *Message {
+	n.mu.Lock()
+	reply := &Message{Type: MsgSnapshot, Term: n.term}
+	if n.closed {
+		n.mu.Unlock()
+		reply.Err = ErrClosed.Error()
+		return reply
+	}
+	if msg.Term < n.term {
+		n.mu.Unlock()
+		return reply
+	}
+	if err := n.acceptLeader(msg); err != nil {
+		n.mu.Unlock()
+		return reply
+	}
+	reply.Term = n.term
+	n.mu.Unlock()
+
+	n.recvMu.Lock()
+	defer n.recvMu.Unlock()
+	recvDir := filepath.Join(n.opts.DirPath, snapshotRecvDirName)
+	// 收到新的快照时丢弃之前接收的部分
+	if n.recv == nil || n.recv.index != msg.SnapshotIndex || n.recv.term != msg.SnapshotTerm {
+		if err := os.RemoveAll(recvDir); err != nil {
+			return reply
+		}
+		if err := os.MkdirAll(recvDir, os.ModePerm); err != nil {
+			return reply
+		}
+		n.recv = &snapshotReceiver{index: msg.SnapshotIndex, term: msg.SnapshotTerm}
+	}
+	if msg.FileName != "" {
+		if filepath.Base(msg.FileName) != msg.FileName || strings.HasPrefix(msg.FileName, ".") {
+			n.recv = nil
+			return reply
+		}
+		if err := writeSnapshotChunk(filepath.Join(recvDir, msg.FileName), msg.Offset, msg.Data); err != nil {
+			n.recv = nil
+			return reply
+		}
+	}
+	if msg.Done {
+		n.recv = nil
+		if err := n.installSnapshot(recvDir, msg.SnapshotIndex, msg.SnapshotTerm); err != nil {
+			return reply
+		}
+	}
+	reply.Success = true
+	return reply
+}
+
+func writeSnapshotChunk(fileName string, offset int64, data []byte) error {
+	flag := os.O_CREATE | os.O_WRONLY
+	// 每个文件的第一段覆盖之前中断的发送留下的内容
+	if offset == 0 {
+		flag |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(fileName, flag, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(data, offset); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// 用接收完成的快照替换状态机，并删除快照已经包含的日志
+func (n *Node) installSnapshot(recvDir string, index uint64, term uint64) error {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return ErrClosed
+	}
+	// 状态机已经包含快照中的所有写入
+	if index <= n.lastApplied {
+		n.mu.Unlock()
+		return os.RemoveAll(recvDir)
+	}
+	n.mu.Unlock()
+
+	dir := filepath.Join(n.opts.DirPath, snapshotDirName(index, term))
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Rename(recvDir, dir); err != nil {
+		return err
+	}
+	if err := n.replaceState(dir); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.commitIndex = max(n.commitIndex, n.lastApplied)
+	close(n.applied)
+	n.applied = make(chan struct{})
+	n.mu.Unlock()
+	return n.switchSnapshot(dir, index, term)
+}
@@ -0,0 +1,306 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+type MessageType = byte
+
+const (
+	MsgVote      MessageType = iota + 1 // 请求投票
+	MsgAppend                           // 复制日志，不包含日志时作为心跳
+	MsgSnapshot                         // 发送快照中的一段文件
+	MsgPropose                          // 将写入转发给leader
+	MsgReadIndex                        // 向leader获取线性一致读的read index
+)
+
+// Message 节点之间的请求与响应，不同类型的消息使用不同的字段
+type Message struct {
+	Type MessageType
+	Term uint64
+	From string
+
+	// 投票
+	LastLogIndex uint64
+	LastLogTerm  uint64
+	Granted      bool
+
+	// 日志复制
+	PrevLogIndex  uint64
+	PrevLogTerm   uint64
+	Entries       []Entry
+	LeaderCommit  uint64
+	Success       bool
+	ConflictIndex uint64 // 复制失败时，leader下一次从该位置开始发送
+
+	// 快照
+	SnapshotIndex uint64
+	SnapshotTerm  uint64
+	FileName      string
+	Offset        int64
+	Data          []byte
+	Done          bool // 快照的最后一段
+
+	// 转发给leader的请求
+	Command   []byte
+	ReadIndex uint64
+	Err       string
+}
+
+// Handler 处理发给节点的请求并返回响应
+type Handler func(msg *Message) *Message
+
+// Transport 节点之间的通信方式
+type Transport interface {
+	// 开始接收发往id的请求
+	Listen(id string, handler Handler) error
+	// 发送请求并等待响应
+	Call(to string, msg *Message, timeout time.Duration) (*Message, error)
+	// 停止接收请求并断开所有连接
+	Close() error
+}
+
+// InmemNetwork 在同一个进程中连接多个节点，可以断开节点来模拟网络分区
+type InmemNetwork struct {
+	mu           sync.RWMutex
+	handlers     map[string]Handler
+	disconnected map[string]bool
+}
+
+func NewInmemNetwork() *InmemNetwork {
+	return &InmemNetwork{
+		handlers:     make(map[string]Handler),
+		disconnected: make(map[string]bool),
+	}
+}
+
+// 获取节点在网络中的Transport
+func (network *InmemNetwork) Transport() Transport {
+	return &inmemTransport{network: network}
+}
+
+// 断开节点与其他所有节点的连接
+func (network *InmemNetwork) Disconnect(id string) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	network.disconnected[id] = true
+}
+
+// 恢复节点的连接
+func (network *InmemNetwork) Connect(id string) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	delete(network.disconnected, id)
+}
+
+type inmemTransport struct {
+	network *InmemNetwork
+	id      string
+}
+
+func (t *inmemTransport) Listen(id string, handler Handler) error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	t.id = id
+	t.network.handlers[id] = handler
+	return nil
+}
+
+func (t *inmemTransport) Call(to string, msg *Message, timeout time.Duration) (*Message, error) {
+	t.network.mu.RLock()
+	handler := t.network.handlers[to]
+	reachable := handler != nil && !t.network.disconnected[t.id] && !t.network.disconnected[to]
+	t.network.mu.RUnlock()
+	if !reachable {
+		return nil, ErrUnreachable
+	}
+	// 与TCPTransport一样经过编码，节点之间不会共享内存
+	req, err := copyMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	replies := make(chan *Message, 1)
+	go func() {
+		replies <- handler(req)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case reply := <-replies:
+		// 处理请求期间断开的节点收不到响应
+		t.network.mu.RLock()
+		reachable = !t.network.disconnected[t.id] && !t.network.disconnected[to]
+		t.network.mu.RUnlock()
+		if !reachable {
+			return nil, ErrUnreachable
+		}
+		return copyMessage(reply)
+	case <-timer.C:
+		return nil, ErrTimeout
+	}
+}
+
+func (t *inmemTransport) Close() error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	delete(t.network.handlers, t.id)
+	return nil
+}
+
+func copyMessage(msg *Message) (*Message, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(msg); err != nil {
+		return nil, err
+	}
+	copied := new(Message)
+	if err := gob.NewDecoder(&buf).Decode(copied); err != nil {
+		return nil, err
+	}
+	return copied, nil
+}
+
+// TCPTransport 通过TCP连接发送请求，节点的id就是它监听的地址
+type TCPTransport struct {
+	listener net.Listener
+	mu       sync.Mutex
+	clients  map[string]*rpc.Client
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+// 监听addr，端口为0时可以通过Addr获取实际的地址
+func NewTCPTransport(addr string) (*TCPTransport, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &TCPTransport{
+		listener: listener,
+		clients:  make(map[string]*rpc.Client),
+		conns:    make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// 实际监听的地址，作为节点的id
+func (t *TCPTransport) Addr() string {
+	return t.listener.Addr().String()
+}
+
+// net/rpc要求的服务类型
+type rpcService struct {
+	handler Handler
+}
+
+func (s *rpcService) Handle(msg *Message, reply *Message) error {
+	*reply = *s.handler(msg)
+	return nil
+}
+
+func (t *TCPTransport) Listen(_ string, handler Handler) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Raft", &rpcService{handler: handler}); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			conn, err := t.listener.Accept()
+			if err != nil {
+				return
+			}
+			t.mu.Lock()
+			if t.closed {
+				t.mu.Unlock()
+				_ = conn.Close()
+				return
+			}
+			t.conns[conn] = struct{}{}
+			t.mu.Unlock()
+			go func() {
+				server.ServeConn(conn)
+				t.mu.Lock()
+				delete(t.conns, conn)
+				t.mu.Unlock()
+			}()
+		}
+	}()
+	return nil
+}
+
+func (t *TCPTransport) Call(to string, msg *Message, timeout time.Duration) (*Message, error) {
+	client, err := t.client(to, timeout)
+	if err != nil {
+		return nil, err
+	}
+	reply := new(Message)
+	call := client.Go("Raft.Handle", msg, reply, make(chan *rpc.Call, 1))
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			// 连接已经断开，下次请求时重新建立
+			t.mu.Lock()
+			if t.clients[to] == client {
+				delete(t.clients, to)
+			}
+			t.mu.Unlock()
+			_ = client.Close()
+			return nil, call.Error
+		}
+		return reply, nil
+	case <-timer.C:
+		return nil, ErrTimeout
+	}
+}
+
+func (t *TCPTransport) client(to string, timeout time.Duration) (*rpc.Client, error) {
+	t.mu.Lock()
+	client, ok := t.clients[to]
+	closed := t.closed
+	t.mu.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	if ok {
+		return client, nil
+	}
+	// 不持有锁建立连接，无法连接的节点不会阻塞发往其他节点的请求
+	conn, err := net.DialTimeout("tcp", to, timeout)
+	if err != nil {
+		return nil, err
+	}
+	client = rpc.NewClient(conn)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		_ = client.Close()
+		return nil, ErrClosed
+	}
+	if existing, ok := t.clients[to]; ok {
+		_ = client.Close()
+		return existing, nil
+	}
+	t.clients[to] = client
+	return client, nil
+}
+
+func (t *TCPTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	for _, client := range t.clients {
+		_ = client.Close()
+	}
+	for conn := range t.conns {
+		_ = conn.Close()
+	}
+	return t.listener.Close()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"kv-go/data"
+	bitcask "kv-go/db"
+	"os"
+	"text/tabwriter"
+)
+
+// caskctl 离线检查、导出与修复已经关闭的数据目录
+// 用法: caskctl <verify|dump|stat|repair> -dir <数据目录> [选项]
+
+const usage = `usage: caskctl <command> -dir <path> [options]
+
+commands:
+  verify   check every record in data, blob, hint and merge-finish files and report crc failures
+  dump     print records of data files with their type, wbId, key and value size
+  stat     report live and dead bytes of every data file and blob file
+  repair   rewrite the directory into -out and drop corrupt records
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	cmd, args := os.Args[1], os.Args[2:]
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	dir := fs.String("dir", "", "database directory")
+	fid := fs.Uint("fid", 0, "dump: only dump the data file with this id")
+	out := fs.String("out", "", "repair: destination directory, default <dir>-repaired")
+	_ = fs.Parse(args)
+	if *dir == "" {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	opts := bitcask.DefaultDBOptions
+	opts.DirPath = *dir
+
+	var err error
+	switch cmd {
+	case "verify":
+		err = verify(opts)
+	case "dump":
+		err = dump(opts, uint32(*fid))
+	case "stat":
+		err = stat(opts)
+	case "repair":
+		if *out == "" {
+			*out = *dir + "-repaired"
+		}
+		err = repair(opts, *out)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "caskctl %s: %v\n", cmd, err)
+		os.Exit(1)
+	}
+}
+
+func verify(opts bitcask.DBOptions) error {
+	corrupts, err := bitcask.Verify(opts)
+	if err != nil {
+		return err
+	}
+	for _, c := range corrupts {
+		fmt.Printf("%s\toffset %d\tsize %d\t%v\n", c.File, c.Offset, c.Size, c.Err)
+	}
+	if len(corrupts) > 0 {
+		return fmt.Errorf("found %d corrupt ranges", len(corrupts))
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+func dump(opts bitcask.DBOptions, fid uint32) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FID\tOFFSET\tSIZE\tTYPE\tWBID\tFAMILY\tKEY\tVALUE SIZE\tEXPIRE")
+	err := bitcask.Dump(opts, fid, func(r *bitcask.DumpRecord) bool {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%d\t%d\t%q\t%d\t%d\n",
+			r.Fid, r.Offset, r.Size, typeName(r.Typ), r.WbId, r.Family, r.Key, r.ValueSize, r.Expire)
+		return true
+	})
+	w.Flush()
+	return err
+}
+
+func stat(opts bitcask.DBOptions) error {
+	// 不修改损坏的数据文件，需要先使用verify与repair检查
+	opts.RecoveryMode = bitcask.RecoveryStrict
+	db, err := bitcask.Open(opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	dataStats, err := db.DataFileStat()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tSIZE\tLIVE\tDEAD")
+	for _, s := range dataStats {
+		fmt.Fprintf(w, "%09d%s\t%d\t%d\t%d\n", s.Fid, data.DataFileNameSuffix, s.Size, s.LiveSize, s.Size-s.LiveSize)
+	}
+	for _, s := range db.BlobStat() {
+		fmt.Fprintf(w, "%09d%s\t%d\t%d\t%d\n", s.Fid, data.BlobFileNameSuffix, s.Size, s.Size-s.GarbageSize, s.GarbageSize)
+	}
+	return w.Flush()
+}
+
+func repair(opts bitcask.DBOptions, out string) error {
+	corrupts, err := bitcask.Repair(opts, out)
+	if err != nil {
+		return err
+	}
+	for _, c := range corrupts {
+		fmt.Printf("dropped %s\toffset %d\tsize %d\t%v\n", c.File, c.Offset, c.Size, c.Err)
+	}
+	fmt.Printf("repaired into %s, dropped %d corrupt ranges\n", out, len(corrupts))
+	return nil
+}
+
+func typeName(typ data.LogRecordType) string {
+	switch typ {
+	case data.LogRecordNormal:
+		return "normal"
+	case data.LogRecordDeleted:
+		return "deleted"
+	case data.LogRecordFinished:
+		return "finished"
+	case data.LogRecordBlob:
+		return "blob"
+	default:
+		return fmt.Sprintf("unknown(%d)", typ)
+	}
+}
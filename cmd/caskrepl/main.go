@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	bitcask "kv-go/db"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+// caskrepl 在本机的多个进程之间测试主从复制
+// 从标准输入读取命令，primary支持put/del/get/merge，follower支持get/keys
+
+const usage = `usage:
+  caskrepl primary -dir <path> -listen <addr>
+  caskrepl follower -dir <path> -primary <addr>
+
+commands read from stdin:
+  put <key> <value>   primary only
+  del <key>           primary only
+  merge               primary only
+  get <key>
+  keys
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	role, args := os.Args[1], os.Args[2:]
+	fs := flag.NewFlagSet(role, flag.ExitOnError)
+	dir := fs.String("dir", "", "database directory")
+	listen := fs.String("listen", "127.0.0.1:7380", "primary: address to accept followers on")
+	primary := fs.String("primary", "127.0.0.1:7380", "follower: address of the primary")
+	_ = fs.Parse(args)
+	if *dir == "" {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	opts := bitcask.DefaultDBOptions
+	opts.DirPath = *dir
+
+	var err error
+	switch role {
+	case "primary":
+		err = runPrimary(opts, *listen)
+	case "follower":
+		err = runFollower(opts, *primary)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "caskrepl %s: %v\n", role, err)
+		os.Exit(1)
+	}
+}
+
+func runPrimary(opts bitcask.DBOptions, addr string) error {
+	db, err := bitcask.Open(opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := db.ServeReplication(listener); err != nil {
+			fmt.Fprintf(os.Stderr, "serve replication: %v\n", err)
+		}
+	}()
+	fmt.Printf("primary serving %s on %s\n", opts.DirPath, listener.Addr())
+	return readCommands(func(cmd string, args []string) error {
+		switch {
+		case cmd == "put" && len(args) == 2:
+			return db.Put([]byte(args[0]), []byte(args[1]))
+		case cmd == "del" && len(args) == 1:
+			return db.Delete([]byte(args[0]))
+		case cmd == "merge" && len(args) == 0:
+			return db.Merge(context.Background())
+		}
+		return view(db, cmd, args)
+	})
+}
+
+func runFollower(opts bitcask.DBOptions, addr string) error {
+	follower, err := bitcask.Follow(opts, addr)
+	if err != nil {
+		return err
+	}
+	defer follower.Close()
+	fmt.Printf("follower of %s in %s\n", addr, opts.DirPath)
+	return readCommands(func(cmd string, args []string) error {
+		return follower.View(func(db *bitcask.DB) error {
+			return view(db, cmd, args)
+		})
+	})
+}
+
+func view(db *bitcask.DB, cmd string, args []string) error {
+	switch {
+	case cmd == "get" && len(args) == 1:
+		val, err := db.Get([]byte(args[0]))
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(val))
+	case cmd == "keys" && len(args) == 0:
+		for _, key := range db.ListKeys(false) {
+			fmt.Println(string(key))
+		}
+	default:
+		return fmt.Errorf("unknown command %q", strings.Join(append([]string{cmd}, args...), " "))
+	}
+	return nil
+}
+
+// 逐行执行命令，直到标准输入结束或收到中断信号
+func readCommands(exec func(cmd string, args []string) error) error {
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	for {
+		select {
+		case <-interrupt:
+			return nil
+		case line, ok := <-lines:
+			if !ok {
+				return nil
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			if err := exec(fields[0], fields[1:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+	}
+}
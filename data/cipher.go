@@ -0,0 +1,135 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"sync"
+)
+
+var (
+	ErrDecryptFailed      = errors.New("can not decrypt log record, the encryption key is wrong")
+	ErrNoKeyProvider      = errors.New("log record is encrypted but no key provider is configured")
+	ErrEncryptKeyNotFound = errors.New("can not found the encryption key")
+)
+
+const (
+	nonceSize = 12 // AES-GCM的nonce长度
+	tagSize   = 16 // AES-GCM的认证标签长度
+)
+
+// KeyProvider 提供加密使用的密钥，密钥长度为16、24或32字节，分别对应AES-128、AES-192与AES-256
+// 轮换密钥时，CurrentKey返回新的密钥，Key仍需要能返回旧的密钥，merge会使用新的密钥重新加密所有记录
+type KeyProvider interface {
+	// 获取当前用于加密的密钥及其id
+	CurrentKey() (uint32, []byte, error)
+	// 根据id获取解密使用的密钥
+	Key(id uint32) ([]byte, error)
+}
+
+// StaticKeyProvider 使用一组固定密钥的KeyProvider
+type StaticKeyProvider struct {
+	CurrentId uint32            // 当前用于加密的密钥id
+	Keys      map[uint32][]byte // 所有密钥
+}
+
+func (provider *StaticKeyProvider) CurrentKey() (uint32, []byte, error) {
+	key, err := provider.Key(provider.CurrentId)
+	return provider.CurrentId, key, err
+}
+
+func (provider *StaticKeyProvider) Key(id uint32) ([]byte, error) {
+	key, ok := provider.Keys[id]
+	if !ok {
+		return nil, ErrEncryptKeyNotFound
+	}
+	return key, nil
+}
+
+// Cipher 使用AES-GCM加解密LogRecord的key与value，每条记录使用随机的nonce
+type Cipher struct {
+	provider KeyProvider
+	aeads    map[uint32]cipher.AEAD // 根据密钥id缓存AEAD
+	mu       *sync.Mutex
+}
+
+// 创建Cipher，provider为nil时返回nil，表示不加密
+func NewCipher(provider KeyProvider) *Cipher {
+	if provider == nil {
+		return nil
+	}
+	return &Cipher{
+		provider: provider,
+		aeads:    make(map[uint32]cipher.AEAD),
+		mu:       new(sync.Mutex),
+	}
+}
+
+// 获取密钥id对应的AEAD
+func (c *Cipher) aead(id uint32, key []byte) (cipher.AEAD, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if aead, ok := c.aeads[id]; ok {
+		return aead, nil
+	}
+	if key == nil {
+		var err error
+		if key, err = c.provider.Key(id); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c.aeads[id] = aead
+	return aead, nil
+}
+
+// 检查当前的密钥是否可用
+func (c *Cipher) Check() error {
+	id, key, err := c.provider.CurrentKey()
+	if err != nil {
+		return err
+	}
+	_, err = c.aead(id, key)
+	return err
+}
+
+// 获取当前用于加密的密钥id与AEAD，以及一个随机的nonce
+func (c *Cipher) current() (uint32, cipher.AEAD, []byte, error) {
+	id, key, err := c.provider.CurrentKey()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	aead, err := c.aead(id, key)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, nil, nil, err
+	}
+	return id, aead, nonce, nil
+}
+
+// 使用id对应的密钥解密，认证失败说明密钥错误或数据被篡改
+func (c *Cipher) open(id uint32, nonce []byte, ciphertext []byte, aad []byte) ([]byte, error) {
+	if c == nil {
+		return nil, ErrNoKeyProvider
+	}
+	aead, err := c.aead(id, nil)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	return plain, nil
+}
@@ -0,0 +1,62 @@
+package data
+
+import (
+	"bytes"
+	"kv-go/fio"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeDecodeEncrypted(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "data-file-encrypted")
+	defer os.RemoveAll(dir)
+	provider := &StaticKeyProvider{CurrentId: 1, Keys: map[uint32][]byte{1: bytes.Repeat([]byte("k"), 32)}}
+	c := NewCipher(provider)
+	assert.Nil(t, c.Check())
+
+	// 加密后的record中不包含明文，相同的record每次加密的结果不同
+	logRecord := &LogRecord{
+		Key:         []byte("secret-key"),
+		Value:       bytes.Repeat([]byte("secret-value"), 10),
+		Expire:      1700000000000000000,
+		Family:      2,
+		Compression: Compression{Codec: CodecLZ},
+	}
+	encRecord, sz, err := EncodeLogRecordWithCipher(logRecord, c)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(encRecord)), sz)
+	assert.False(t, bytes.Contains(encRecord, []byte("secret")))
+	encRecord2, _, err := EncodeLogRecordWithCipher(logRecord, c)
+	assert.Nil(t, err)
+	assert.NotEqual(t, encRecord, encRecord2)
+
+	df, err := OpenDataFile(dir, 1, fio.FileIOType)
+	assert.Nil(t, err)
+	assert.Nil(t, df.Write(encRecord))
+	df.Cipher = c
+	llr, lsz, err := df.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, sz, lsz)
+	assert.Equal(t, &LogRecord{Key: logRecord.Key, Value: logRecord.Value, Expire: logRecord.Expire, Family: 2}, llr)
+
+	// 错误的密钥与缺少密钥时返回明确的错误
+	df.Cipher = NewCipher(&StaticKeyProvider{CurrentId: 1, Keys: map[uint32][]byte{1: bytes.Repeat([]byte("x"), 32)}})
+	_, _, err = df.ReadLogRecord(0)
+	assert.Equal(t, ErrDecryptFailed, err)
+	df.Cipher = NewCipher(&StaticKeyProvider{CurrentId: 2, Keys: map[uint32][]byte{2: bytes.Repeat([]byte("k"), 32)}})
+	_, _, err = df.ReadLogRecord(0)
+	assert.Equal(t, ErrEncryptKeyNotFound, err)
+	df.Cipher = nil
+	_, _, err = df.ReadLogRecord(0)
+	assert.Equal(t, ErrNoKeyProvider, err)
+}
+
+func TestCipherCheck(t *testing.T) {
+	assert.Nil(t, NewCipher(nil))
+	c := NewCipher(&StaticKeyProvider{CurrentId: 1, Keys: map[uint32][]byte{1: []byte("short")}})
+	assert.NotNil(t, c.Check())
+	c = NewCipher(&StaticKeyProvider{CurrentId: 1})
+	assert.Equal(t, ErrEncryptKeyNotFound, c.Check())
+}
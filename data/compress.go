@@ -0,0 +1,188 @@
+package data
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	ErrUnknownCodec           = errors.New("unknown compression codec")
+	ErrInvalidCompressedValue = errors.New("invalid compressed value")
+)
+
+type CodecType = byte
+
+const (
+	CodecNone  CodecType = iota // 不压缩
+	CodecFlate                  // 标准库的flate
+	CodecLZ                     // 内置的LZ77风格压缩，速度快，压缩率较低
+)
+
+// Compression 写入record时使用的压缩算法
+type Compression struct {
+	Codec CodecType // 压缩算法
+	Level int       // flate的压缩级别，范围为[flate.HuffmanOnly, flate.BestCompression]
+}
+
+// 检查压缩配置是否合法
+func (compression Compression) Valid() bool {
+	switch compression.Codec {
+	case CodecNone, CodecLZ:
+		return true
+	case CodecFlate:
+		return compression.Level >= flate.HuffmanOnly && compression.Level <= flate.BestCompression
+	default:
+		return false
+	}
+}
+
+// 压缩value，压缩后没有变小时不压缩，返回实际使用的压缩算法
+func compressValue(value []byte, compression Compression) (CodecType, []byte) {
+	if len(value) == 0 {
+		return CodecNone, value
+	}
+	var compressed []byte
+	switch compression.Codec {
+	case CodecFlate:
+		buf := new(bytes.Buffer)
+		writer, err := flate.NewWriter(buf, compression.Level)
+		if err != nil {
+			return CodecNone, value
+		}
+		if _, err := writer.Write(value); err != nil {
+			return CodecNone, value
+		}
+		if err := writer.Close(); err != nil {
+			return CodecNone, value
+		}
+		compressed = buf.Bytes()
+	case CodecLZ:
+		compressed = lzCompress(value)
+	default:
+		return CodecNone, value
+	}
+	if len(compressed) >= len(value) {
+		return CodecNone, value
+	}
+	return compression.Codec, compressed
+}
+
+// 根据header中记录的压缩算法解压value
+func decompressValue(codec CodecType, value []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return value, nil
+	case CodecFlate:
+		reader := flate.NewReader(bytes.NewReader(value))
+		defer reader.Close()
+		decompressed, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, ErrInvalidCompressedValue
+		}
+		return decompressed, nil
+	case CodecLZ:
+		return lzDecompress(value)
+	default:
+		return nil, ErrUnknownCodec
+	}
+}
+
+// 内置LZ压缩的格式: uvarint(原始长度) + 若干个块
+// 字面量块: 0x00 + uvarint(长度) + 原始字节
+// 复制块:   0x01 + uvarint(距离) + uvarint(长度)，从已经解压的数据中向前距离处复制，允许重叠
+const (
+	lzTagLiteral byte = 0x00
+	lzTagCopy    byte = 0x01
+	lzMinMatch        = 4
+	lzHashBits        = 14
+	lzMaxOffset       = 1 << 16
+)
+
+func lzHash(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - lzHashBits)
+}
+
+func lzCompress(src []byte) []byte {
+	dst := make([]byte, 0, len(src)/2+binary.MaxVarintLen64)
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+	// 保存每个4字节序列最后出现的位置+1，0表示没有出现过
+	var table [1 << lzHashBits]int32
+	lit, i := 0, 0
+	for i+lzMinMatch <= len(src) {
+		cur := binary.LittleEndian.Uint32(src[i:])
+		h := lzHash(cur)
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if cand < 0 || i-cand > lzMaxOffset || binary.LittleEndian.Uint32(src[cand:]) != cur {
+			i++
+			continue
+		}
+		// 尽可能地延长匹配
+		n := lzMinMatch
+		for i+n < len(src) && src[cand+n] == src[i+n] {
+			n++
+		}
+		dst = lzAppendLiteral(dst, src[lit:i])
+		dst = append(dst, lzTagCopy)
+		dst = binary.AppendUvarint(dst, uint64(i-cand))
+		dst = binary.AppendUvarint(dst, uint64(n))
+		i += n
+		lit = i
+	}
+	return lzAppendLiteral(dst, src[lit:])
+}
+
+func lzAppendLiteral(dst []byte, literal []byte) []byte {
+	if len(literal) == 0 {
+		return dst
+	}
+	dst = append(dst, lzTagLiteral)
+	dst = binary.AppendUvarint(dst, uint64(len(literal)))
+	return append(dst, literal...)
+}
+
+func lzDecompress(src []byte) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, ErrInvalidCompressedValue
+	}
+	src = src[n:]
+	dst := make([]byte, 0, size)
+	for len(src) > 0 {
+		tag := src[0]
+		src = src[1:]
+		switch tag {
+		case lzTagLiteral:
+			length, n := binary.Uvarint(src)
+			if n <= 0 || length > uint64(len(src)-n) || uint64(len(dst))+length > size {
+				return nil, ErrInvalidCompressedValue
+			}
+			dst = append(dst, src[n:n+int(length)]...)
+			src = src[n+int(length):]
+		case lzTagCopy:
+			offset, n1 := binary.Uvarint(src)
+			if n1 <= 0 {
+				return nil, ErrInvalidCompressedValue
+			}
+			length, n2 := binary.Uvarint(src[n1:])
+			if n2 <= 0 || offset == 0 || offset > uint64(len(dst)) || uint64(len(dst))+length > size {
+				return nil, ErrInvalidCompressedValue
+			}
+			src = src[n1+n2:]
+			// 复制的区间可能与正在写入的区间重叠，需要逐字节复制
+			start := len(dst) - int(offset)
+			for k := 0; k < int(length); k++ {
+				dst = append(dst, dst[start+k])
+			}
+		default:
+			return nil, ErrInvalidCompressedValue
+		}
+	}
+	if uint64(len(dst)) != size {
+		return nil, ErrInvalidCompressedValue
+	}
+	return dst, nil
+}
@@ -0,0 +1,70 @@
+package data
+
+import (
+	"bytes"
+	"compress/flate"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLZCompress(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.Read(random)
+	values := [][]byte{
+		[]byte("a"),
+		[]byte("abcd"),
+		bytes.Repeat([]byte("a"), 10000),
+		bytes.Repeat([]byte(`{"name":"bitcask-go","tags":["kv","log"]},`), 200),
+		random,
+	}
+	for _, value := range values {
+		compressed := lzCompress(value)
+		decompressed, err := lzDecompress(compressed)
+		assert.Nil(t, err)
+		assert.Equal(t, value, decompressed)
+	}
+	// 重复的数据能够被压缩
+	assert.Less(t, len(lzCompress(values[2])), 100)
+	assert.Less(t, len(lzCompress(values[3])), len(values[3])/10)
+}
+
+func TestLZDecompressCorrupted(t *testing.T) {
+	compressed := lzCompress(bytes.Repeat([]byte("bitcask-go"), 100))
+	// 截断、错误的tag、错误的距离都应该返回错误
+	_, err := lzDecompress(compressed[:len(compressed)-1])
+	assert.Equal(t, ErrInvalidCompressedValue, err)
+	_, err = lzDecompress([]byte{10, 0x07})
+	assert.Equal(t, ErrInvalidCompressedValue, err)
+	_, err = lzDecompress([]byte{10, lzTagCopy, 5, 5})
+	assert.Equal(t, ErrInvalidCompressedValue, err)
+	_, err = lzDecompress(nil)
+	assert.Equal(t, ErrInvalidCompressedValue, err)
+}
+
+func TestCompressValue(t *testing.T) {
+	value := bytes.Repeat([]byte(`{"name":"bitcask-go"},`), 100)
+	for _, compression := range []Compression{
+		{Codec: CodecFlate, Level: flate.BestSpeed},
+		{Codec: CodecFlate, Level: flate.DefaultCompression},
+		{Codec: CodecLZ},
+	} {
+		assert.True(t, compression.Valid())
+		codec, compressed := compressValue(value, compression)
+		assert.Equal(t, compression.Codec, codec)
+		assert.Less(t, len(compressed), len(value))
+		decompressed, err := decompressValue(codec, compressed)
+		assert.Nil(t, err)
+		assert.Equal(t, value, decompressed)
+	}
+	// 压缩后没有变小时保存原始数据
+	codec, compressed := compressValue([]byte("abc"), Compression{Codec: CodecLZ})
+	assert.Equal(t, CodecNone, codec)
+	assert.Equal(t, []byte("abc"), compressed)
+
+	assert.False(t, Compression{Codec: CodecFlate, Level: 10}.Valid())
+	assert.False(t, Compression{Codec: 9}.Valid())
+	_, err := decompressValue(9, compressed)
+	assert.Equal(t, ErrUnknownCodec, err)
+}
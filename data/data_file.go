@@ -12,9 +12,13 @@ import (
 
 const (
 	DataFileNameSuffix       string = ".data"
+	BlobFileNameSuffix       string = ".blob"
+	FileHintNameSuffix       string = ".hint"
 	HintFileName             string = "hint-index"
 	MergeFilishedFileName    string = "merge-finish"
 	NextWriteBatchIdFileName string = "wbid"
+	FamilyFileName           string = "column-families"
+	FamilyTmpFileName        string = "column-families.tmp"
 )
 
 var (
@@ -27,6 +31,7 @@ type DataFile struct {
 	FileId    uint32        // 与fd类似，用来唯一标识数据库中的数据文件
 	WriteOff  int64         // 当前文件数据的偏移量
 	IOManager fio.IOManager // 提供IO方法的接口
+	Cipher    *Cipher       // 用于解密record，为nil时不能读取加密的record
 }
 
 func newDataFile(fileName string, fileId uint32, ioType fio.IOType) (*DataFile, error) {
@@ -50,6 +55,27 @@ func OpenWriteBatchFile(dirPath string) (*DataFile, error) {
 	return newDataFile(fileName, 0, fio.FileIOType)
 }
 
+// 打开blob file，blob file与数据文件的格式相同，但只保存被分离出来的较大的value
+func OpenBlobFile(dirPath string, fileId uint32, ioType fio.IOType) (*DataFile, error) {
+	fileName := GetBlobFileNameById(dirPath, fileId)
+	return newDataFile(fileName, fileId, ioType)
+}
+
+// 根据fileId获取blob file的路径
+func GetBlobFileNameById(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+BlobFileNameSuffix)
+}
+
+// 打开数据文件对应的hint file，fileName为GetFileHintNameById返回的路径或写入时使用的临时文件
+func OpenFileHintFile(fileName string, fileId uint32) (*DataFile, error) {
+	return newDataFile(fileName, fileId, fio.FileIOType)
+}
+
+// 根据fileId获取数据文件对应的hint file的路径
+func GetFileHintNameById(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+FileHintNameSuffix)
+}
+
 // 打开文件，并保存其IO方法到DataFile中
 func OpenDataFile(dirPath string, fileId uint32, ioType fio.IOType) (*DataFile, error) {
 	fileName := GetDataFileNameById(dirPath, fileId)
@@ -75,6 +101,19 @@ func OpenHintFile(dirPath string) (*DataFile, error) {
 	return newDataFile(fileName, 0, fio.FileIOType)
 }
 
+// 创建并打开保存column family信息的文件，fileName为FamilyFileName或FamilyTmpFileName
+func OpenFamilyFile(dirPath string, fileName string) (*DataFile, error) {
+	return newDataFile(filepath.Join(dirPath, fileName), 0, fio.FileIOType)
+}
+
+// 打开已经存在的任意保存LogRecord的文件，供离线工具检查文件内容，文件不存在时返回错误
+func OpenLogFile(fileName string, fileId uint32) (*DataFile, error) {
+	if _, err := os.Stat(fileName); err != nil {
+		return nil, err
+	}
+	return newDataFile(fileName, fileId, fio.FileIOType)
+}
+
 // 往文件末尾追加 datas
 func (dataFile *DataFile) Write(datas []byte) error {
 	// 调用文件的Write方法
@@ -127,22 +166,138 @@ func (dataFile *DataFile) ReadLogRecord(off int64) (*LogRecord, int64, error) {
 	if keySize == 0 {
 		return nil, 0, ErrEmptyKey
 	}
-	recordSize := headerSize + keySize + valueSize
-	// 构造LogRecord
-	logRecord := &LogRecord{Typ: logRecordHeader.logRecordType}
+	// 加密的key-value后带有认证标签
+	var payloadSize = keySize + valueSize
+	if logRecordHeader.encrypted {
+		payloadSize += tagSize
+	}
+	recordSize := headerSize + payloadSize
+	// 崩溃时没有写完的记录，或者header已经损坏，记录超出了文件末尾
+	if off+recordSize > fileSize {
+		return nil, 0, io.EOF
+	}
 	// 继续调用readNBytes读取key与value
-	kvBuf, err := dataFile.readNBytes(keySize+valueSize, off+headerSize)
+	kvBuf, err := dataFile.readNBytes(payloadSize, off+headerSize)
 	if err != nil {
 		return nil, 0, err
 	}
+	logRecord, err := dataFile.decodePayload(logRecordHeader, headerBytes[:headerSize], kvBuf)
+	if err != nil {
+		return nil, 0, err
+	}
+	return logRecord, recordSize, nil
+}
+
+// DecodeLogRecord 从已经读入内存的数据中解析一条完整的记录，datas从记录的起始位置开始，可以包含之后的记录
+func (dataFile *DataFile) DecodeLogRecord(datas []byte) (*LogRecord, int64, error) {
+	logRecordHeader, headerSize := decodeLogRecordHeader(datas)
+	if logRecordHeader == nil {
+		return nil, 0, io.EOF
+	}
+	keySize, valueSize := int64(logRecordHeader.keySize), int64(logRecordHeader.valueSize)
+	if keySize == 0 {
+		return nil, 0, ErrEmptyKey
+	}
+	var payloadSize = keySize + valueSize
+	if logRecordHeader.encrypted {
+		payloadSize += tagSize
+	}
+	recordSize := headerSize + payloadSize
+	if recordSize > int64(len(datas)) {
+		return nil, 0, io.EOF
+	}
+	logRecord, err := dataFile.decodePayload(logRecordHeader, datas[:headerSize], datas[headerSize:recordSize])
+	if err != nil {
+		return nil, 0, err
+	}
+	return logRecord, recordSize, nil
+}
+
+// 校验、解密并解压记录的key与value
+func (dataFile *DataFile) decodePayload(logRecordHeader *LogRecordHeader, headerBytes []byte, kvBuf []byte) (*LogRecord, error) {
+	keySize := int64(logRecordHeader.keySize)
+	// 构造LogRecord
+	logRecord := &LogRecord{
+		Typ:    logRecordHeader.logRecordType,
+		Expire: logRecordHeader.expire,
+		Family: logRecordHeader.family,
+	}
 	logRecord.Key = kvBuf[:keySize]
 	logRecord.Value = kvBuf[keySize:]
 	// 最后验证数据有效性
-	crc := getLogRecordCRC(logRecord, headerBytes[crc32.Size:headerSize])
+	crc := getLogRecordCRC(logRecord, headerBytes[crc32.Size:])
 	if crc != logRecordHeader.crc {
-		return nil, 0, ErrInvalidCrc
+		return nil, ErrInvalidCrc
 	}
-	return logRecord, recordSize, nil
+	// crc校验的是密文，校验通过后再解密，密钥错误时认证失败
+	if logRecordHeader.encrypted {
+		plain, err := dataFile.Cipher.open(logRecordHeader.keyId, logRecordHeader.nonce, kvBuf, headerBytes[crc32.Size:])
+		if err != nil {
+			return nil, err
+		}
+		logRecord.Key = plain[:keySize]
+		logRecord.Value = plain[keySize:]
+	}
+	// 校验通过后再解压value
+	if logRecordHeader.codec != CodecNone {
+		value, err := decompressValue(logRecordHeader.codec, logRecord.Value)
+		if err != nil {
+			return nil, err
+		}
+		logRecord.Value = value
+	}
+	return logRecord, nil
+}
+
+// ReadBytes 从文件的off开始读取n byte，用来一次读取多条相邻的记录
+func (dataFile *DataFile) ReadBytes(n int64, off int64) ([]byte, error) {
+	return dataFile.readNBytes(n, off)
+}
+
+// 查找下一条记录时每次读入的数据量
+const findRecordChunkSize int64 = 1 << 20
+
+// FindNextRecord 从off之后查找下一条能够通过校验的记录，用于跳过损坏的数据，之后没有有效记录时返回io.EOF
+// 按块读入数据，只有能够解析出header且记录没有超出文件末尾的位置才会读取整条记录校验crc
+func (dataFile *DataFile) FindNextRecord(off int64) (int64, error) {
+	fileSize, err := dataFile.IOManager.Size()
+	if err != nil {
+		return 0, err
+	}
+	for start := off + 1; start < fileSize; {
+		// 多读入一个header的长度，块末尾的header不会被截断
+		n, end := fileSize-start, fileSize-start
+		if n > findRecordChunkSize+maxLogRecordHeadSize {
+			n, end = findRecordChunkSize+maxLogRecordHeadSize, findRecordChunkSize
+		}
+		buf, err := dataFile.readNBytes(n, start)
+		if err != nil {
+			return 0, err
+		}
+		for i := int64(0); i < end; i++ {
+			if !isRecordCandidate(buf[i:], fileSize-start-i) {
+				continue
+			}
+			if _, _, err := dataFile.ReadLogRecord(start + i); err == nil {
+				return start + i, nil
+			}
+		}
+		start += end
+	}
+	return 0, io.EOF
+}
+
+// datas能否解析为一条没有超出剩余remain字节的记录的header
+func isRecordCandidate(datas []byte, remain int64) bool {
+	logRecordHeader, headerSize := decodeLogRecordHeader(datas)
+	if logRecordHeader == nil || headerSize <= 0 || logRecordHeader.keySize == 0 {
+		return false
+	}
+	recordSize := headerSize + int64(logRecordHeader.keySize) + int64(logRecordHeader.valueSize)
+	if logRecordHeader.encrypted {
+		recordSize += tagSize
+	}
+	return recordSize <= remain
 }
 
 // 从文件的 off 开始读取 n byte
@@ -1,6 +1,8 @@
 package data
 
 import (
+	"bytes"
+	"io"
 	"kv-go/fio"
 	"kv-go/utils"
 	"os"
@@ -175,4 +177,101 @@ func TestDataFileRead(t *testing.T) {
 		assert.Equal(t, llr.Typ, byte(LogRecordDeleted))
 		offset4 += ssz
 	}
-}
\ No newline at end of file
+}
+
+func TestDataFileReadExpire(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "data-file-read-expire")
+	defer os.RemoveAll(dir)
+	df, err := OpenDataFile(dir, 1, fio.FileIOType)
+	assert.Nil(t, err)
+	// 写入带有过期时间与不带过期时间的record，读取时应该完全一致
+	lrs := []*LogRecord{
+		{Key: utils.GetTestKey(1), Value: utils.GetTestValue(100), Typ: LogRecordNormal, Expire: 1700000000000000000},
+		{Key: utils.GetTestKey(2), Value: utils.GetTestValue(100), Typ: LogRecordNormal},
+		{Key: utils.GetTestKey(3), Value: []byte{}, Typ: LogRecordDeleted, Expire: 1},
+	}
+	for _, lr := range lrs {
+		datas, _ := EncodeLogRecord(lr)
+		assert.Nil(t, df.Write(datas))
+	}
+	var offset int64 = 0
+	for _, lr := range lrs {
+		llr, sz, err := df.ReadLogRecord(offset)
+		assert.Nil(t, err)
+		assert.Equal(t, lr, llr)
+		offset += sz
+	}
+	_, _, err = df.ReadLogRecord(offset)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestDataFileReadCompressed(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "data-file-read-compressed")
+	defer os.RemoveAll(dir)
+	df, err := OpenDataFile(dir, 1, fio.FileIOType)
+	assert.Nil(t, err)
+	// 不同压缩算法的record可以共存，读取时透明地解压
+	value := bytes.Repeat([]byte(`{"name":"bitcask-go"},`), 100)
+	compressions := []Compression{{Codec: CodecNone}, {Codec: CodecFlate, Level: 5}, {Codec: CodecLZ}}
+	var sizes []int64
+	for i, compression := range compressions {
+		datas, sz := EncodeLogRecord(&LogRecord{Key: utils.GetTestKey(i), Value: value, Compression: compression, Family: 1})
+		assert.Nil(t, df.Write(datas))
+		sizes = append(sizes, sz)
+	}
+	assert.Less(t, sizes[1], sizes[0])
+	assert.Less(t, sizes[2], sizes[0])
+	var offset int64 = 0
+	for i := range compressions {
+		llr, sz, err := df.ReadLogRecord(offset)
+		assert.Nil(t, err)
+		assert.Equal(t, &LogRecord{Key: utils.GetTestKey(i), Value: value, Family: 1}, llr)
+		assert.Equal(t, sizes[i], sz)
+		offset += sz
+	}
+}
+
+func TestDataFileFindNextRecord(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "data-file-find-next")
+	defer os.RemoveAll(dir)
+	df, err := OpenDataFile(dir, 1, fio.FileIOType)
+	assert.Nil(t, err)
+	var offsets []int64
+	var offset int64 = 0
+	for i := 0; i < 3; i++ {
+		datas, sz := EncodeLogRecord(&LogRecord{Key: utils.GetTestKey(i), Value: utils.GetTestValue(64)})
+		assert.Nil(t, df.Write(datas))
+		offsets = append(offsets, offset)
+		offset += sz
+	}
+	// 只写入了一部分的记录被当作文件末尾
+	datas, _ := EncodeLogRecord(&LogRecord{Key: utils.GetTestKey(3), Value: utils.GetTestValue(64)})
+	assert.Nil(t, df.Write(datas[:len(datas)/2]))
+	_, _, err = df.ReadLogRecord(offset)
+	assert.Equal(t, io.EOF, err)
+
+	// 从损坏的位置之后找到下一条有效记录
+	next, err := df.FindNextRecord(offsets[0])
+	assert.Nil(t, err)
+	assert.Equal(t, offsets[1], next)
+	next, err = df.FindNextRecord(offsets[1] + 3)
+	assert.Nil(t, err)
+	assert.Equal(t, offsets[2], next)
+	_, err = df.FindNextRecord(offsets[2])
+	assert.Equal(t, io.EOF, err)
+
+	// 跨越多个读取块的损坏数据之后仍能找到有效记录
+	garbage := make([]byte, 2*findRecordChunkSize+100)
+	for i := range garbage {
+		garbage[i] = 0xff
+	}
+	assert.Nil(t, df.Write(garbage))
+	offset = df.WriteOff
+	datas, _ = EncodeLogRecord(&LogRecord{Key: utils.GetTestKey(4), Value: utils.GetTestValue(64)})
+	assert.Nil(t, df.Write(datas))
+	next, err = df.FindNextRecord(offsets[2])
+	assert.Nil(t, err)
+	assert.Equal(t, offset, next)
+	_, err = df.FindNextRecord(offset)
+	assert.Equal(t, io.EOF, err)
+}
@@ -1,6 +1,7 @@
 package data
 
 import (
+	"crypto/cipher"
 	"encoding/binary"
 	"hash/crc32"
 )
@@ -11,22 +12,40 @@ const (
 	LogRecordNormal = iota
 	LogRecordDeleted
 	LogRecordFinished
+	LogRecordBlob // value保存在blob file中，记录的value是编码后的BlobPos
 )
 
-// header的最大size: 4 + 1 + 5 + 5
-const maxLogRecordHeadSize = binary.MaxVarintLen32*2 + 5
+// 记录类型的高位用来标记header中的可选字段，低位才是记录的类型
+// 不带可选字段的记录与旧版本的格式完全相同
+const (
+	logRecordTypeMask   byte = 0x0f
+	logRecordExpireFlag byte = 0x80 // header中带有过期时间
+	logRecordFamilyFlag byte = 0x40 // header中带有column family id
+	logRecordCodecFlag  byte = 0x20 // header中带有压缩算法，value是压缩后的数据
+	logRecordCipherFlag byte = 0x10 // header中带有密钥id与nonce，key与value是加密后的数据
+)
+
+// header的最大size: 4 + 1 + 5 + 5 + 10 + 5 + 1 + 5 + 12
+const maxLogRecordHeadSize = binary.MaxVarintLen32*4 + 6 + binary.MaxVarintLen64 + nonceSize
 
 // LogRecord 描述k-v记录
 type LogRecord struct {
 	Key   []byte
 	Value []byte
 	Typ   LogRecordType
+	// 过期时间(UnixNano)，0表示永不过期
+	Expire int64
+	// 记录所属的column family，0表示默认的column family
+	Family uint32
+	// 写入时使用的压缩算法，读取时value已经被解压，该字段为空
+	Compression Compression
 }
 
-// +---------+----------+-------------------+--------------------+
-// |   crc   |   type   |     key size      |     value size     |
-// +---------+----------+-------------------+--------------------+
-//    4 byte    1 byte   varint(max 5 byte)   varint(max 5 byte)
+// +---------+----------+-------------------+--------------------+---------------------+---------------------+--------------------+---------------------+--------------------+
+// |   crc   |   type   |     key size      |     value size     |  expire (optional)  |  family (optional)  |  codec (optional)  |  key id (optional)  |  nonce (optional)  |
+// +---------+----------+-------------------+--------------------+---------------------+---------------------+--------------------+---------------------+--------------------+
+//    4 byte    1 byte   varint(max 5 byte)   varint(max 5 byte)   varint(max 10 byte)   varint(max 5 byte)      1 byte             varint(max 5 byte)      12 byte
+// value size是压缩后的大小，加密时key与value一起被加密，密文后带有16字节的认证标签，header作为附加数据被一起认证
 
 // LogRecordHeader LogRecored的头部信息
 type LogRecordHeader struct {
@@ -34,29 +53,53 @@ type LogRecordHeader struct {
 	logRecordType LogRecordType // 记录的类型(是否被删除)
 	keySize       uint32        // key的大小
 	valueSize     uint32        // value的大小
+	expire        int64         // 过期时间
+	family        uint32        // column family id
+	codec         CodecType     // value的压缩算法
+	encrypted     bool          // key与value是否被加密
+	keyId         uint32        // 加密使用的密钥id
+	nonce         []byte        // 加密使用的nonce
 }
 
 // LogRecordPos 描述记录在磁盘中的具体位置
 type LogRecordPos struct {
-	Fid        uint32 // Fid 唯一标识文件
-	Offset     int64  // Offset 记录在文件中的偏移量
-	RecordSize uint32 // record占用磁盘的字节数量
+	Fid        uint32   // Fid 唯一标识文件
+	Offset     int64    // Offset 记录在文件中的偏移量
+	RecordSize uint32   // record占用磁盘的字节数量
+	Expire     int64    // 过期时间(UnixNano)，0表示永不过期
+	Blob       *BlobPos // value被分离到blob file时，value所在的位置
+}
+
+// BlobPos 描述value在blob file中的位置
+type BlobPos struct {
+	Fid    uint32 // blob file id
+	Offset int64  // 记录在blob file中的偏移量
+	Size   uint32 // 记录在blob file中占用的字节数量
 }
 
 // 存储WriteBatch的record信息
 type WBLogRecord struct {
-	Key []byte
-	Pos *LogRecordPos
-	Typ LogRecordType
+	Key    []byte
+	Pos    *LogRecordPos
+	Typ    LogRecordType
+	Family uint32
 }
 
 // encodeRecordPos 将LogRecordPos序列化成[]byte
 func EncodeLogRecordPos(logRecordPos *LogRecordPos) []byte {
-	encLogRecordPos := make([]byte, 2*binary.MaxVarintLen32+binary.MaxVarintLen64)
+	encLogRecordPos := make([]byte, 4*binary.MaxVarintLen32+3*binary.MaxVarintLen64)
 	var idx = 0
 	idx += binary.PutUvarint(encLogRecordPos[idx:], uint64(logRecordPos.Fid))
 	idx += binary.PutVarint(encLogRecordPos[idx:], logRecordPos.Offset)
 	idx += binary.PutUvarint(encLogRecordPos[idx:], uint64(logRecordPos.RecordSize))
+	// 永不过期且value没有被分离时不编码过期时间，与旧版本的格式兼容
+	if logRecordPos.Expire != 0 || logRecordPos.Blob != nil {
+		idx += binary.PutVarint(encLogRecordPos[idx:], logRecordPos.Expire)
+	}
+	// blob的位置编码在过期时间之后
+	if logRecordPos.Blob != nil {
+		idx += copy(encLogRecordPos[idx:], EncodeBlobPos(logRecordPos.Blob))
+	}
 	return encLogRecordPos[:idx]
 }
 
@@ -66,35 +109,130 @@ func DecodeLogRecordPos(datas []byte) *LogRecordPos {
 	idx += n
 	offset, n := binary.Varint(datas[idx:])
 	idx += n
-	recordSize, _ := binary.Uvarint(datas[idx:])
+	recordSize, n := binary.Uvarint(datas[idx:])
+	idx += n
+	var expire int64 = 0
+	if idx < len(datas) {
+		expire, n = binary.Varint(datas[idx:])
+		idx += n
+	}
+	var blob *BlobPos
+	if idx < len(datas) {
+		blob = DecodeBlobPos(datas[idx:])
+	}
 	return &LogRecordPos{
 		Fid:    uint32(fid),
 		Offset: offset,
 		RecordSize: uint32(recordSize),
+		Expire: expire,
+		Blob:   blob,
+	}
+}
+
+// EncodeBlobPos 将BlobPos序列化成[]byte，作为LogRecordBlob记录的value
+func EncodeBlobPos(blobPos *BlobPos) []byte {
+	encBlobPos := make([]byte, 2*binary.MaxVarintLen32+binary.MaxVarintLen64)
+	var idx = 0
+	idx += binary.PutUvarint(encBlobPos[idx:], uint64(blobPos.Fid))
+	idx += binary.PutVarint(encBlobPos[idx:], blobPos.Offset)
+	idx += binary.PutUvarint(encBlobPos[idx:], uint64(blobPos.Size))
+	return encBlobPos[:idx]
+}
+
+func DecodeBlobPos(datas []byte) *BlobPos {
+	var idx = 0
+	fid, n := binary.Uvarint(datas[idx:])
+	idx += n
+	offset, n := binary.Varint(datas[idx:])
+	idx += n
+	size, _ := binary.Uvarint(datas[idx:])
+	return &BlobPos{
+		Fid:    uint32(fid),
+		Offset: offset,
+		Size:   uint32(size),
 	}
 }
 
+// 判断记录是否已经过期
+func (logRecordPos *LogRecordPos) IsExpired(now int64) bool {
+	return logRecordPos.Expire != 0 && logRecordPos.Expire <= now
+}
+
 // EncodeRecord 将LogRecord序列化成[]byte
 func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
+	// 不加密时不会失败
+	encRecord, sz, _ := EncodeLogRecordWithCipher(logRecord, nil)
+	return encRecord, sz
+}
+
+// EncodeLogRecordWithCipher 将LogRecord序列化成[]byte，c不为nil时加密key与value
+func EncodeLogRecordWithCipher(logRecord *LogRecord, c *Cipher) ([]byte, int64, error) {
+	// 先压缩value，压缩后没有变小时保存原始数据
+	codec, value := compressValue(logRecord.Value, logRecord.Compression)
 	// encode header部分
 	header := make([]byte, maxLogRecordHeadSize)
 	header[4] = logRecord.Typ
+	if logRecord.Expire != 0 {
+		header[4] |= logRecordExpireFlag
+	}
+	if logRecord.Family != 0 {
+		header[4] |= logRecordFamilyFlag
+	}
+	if codec != CodecNone {
+		header[4] |= logRecordCodecFlag
+	}
+	if c != nil {
+		header[4] |= logRecordCipherFlag
+	}
 	// encode key size, value size
 	var idx = 5
 	idx += binary.PutVarint(header[idx:], int64(len(logRecord.Key)))
-	idx += binary.PutVarint(header[idx:], int64(len(logRecord.Value)))
+	idx += binary.PutVarint(header[idx:], int64(len(value)))
+	// encode 可选的过期时间
+	if logRecord.Expire != 0 {
+		idx += binary.PutVarint(header[idx:], logRecord.Expire)
+	}
+	// encode 可选的column family id
+	if logRecord.Family != 0 {
+		idx += binary.PutUvarint(header[idx:], uint64(logRecord.Family))
+	}
+	// encode 可选的压缩算法
+	if codec != CodecNone {
+		header[idx] = codec
+		idx++
+	}
+	// encode 可选的密钥id与nonce
+	var aead cipher.AEAD
+	if c != nil {
+		keyId, currentAEAD, nonce, err := c.current()
+		if err != nil {
+			return nil, 0, err
+		}
+		aead = currentAEAD
+		idx += binary.PutUvarint(header[idx:], uint64(keyId))
+		idx += copy(header[idx:], nonce)
+	}
 	// 计算logRecord的总长度并定义bytes存储logRecord
-	sz := idx + len(logRecord.Key) + len(logRecord.Value)
-	encodeRecord := make([]byte, sz)
+	sz := idx + len(logRecord.Key) + len(value)
+	if aead != nil {
+		sz += tagSize
+	}
+	encodeRecord := make([]byte, idx, sz)
 	// 拷贝已经encode完成的header
 	copy(encodeRecord[:idx], header[:idx])
 	// 拷贝已经是byte的key-value
-	copy(encodeRecord[idx:], logRecord.Key)
-	copy(encodeRecord[idx+len(logRecord.Key):], logRecord.Value)
+	encodeRecord = append(encodeRecord, logRecord.Key...)
+	encodeRecord = append(encodeRecord, value...)
+	// 原地加密key-value，header作为附加数据
+	if aead != nil {
+		nonce := header[idx-nonceSize : idx]
+		aead.Seal(encodeRecord[idx:idx], nonce, encodeRecord[idx:], encodeRecord[4:idx])
+		encodeRecord = encodeRecord[:sz]
+	}
 	// 对 crc 字段外的数据，计算crc检验和
 	crc := crc32.ChecksumIEEE(encodeRecord[4:])
 	binary.LittleEndian.PutUint32(encodeRecord[:4], crc)
-	return encodeRecord, int64(sz)
+	return encodeRecord, int64(sz), nil
 }
 
 // 解码LogRecord的Header信息，同时返回 Header 长度
@@ -106,17 +244,61 @@ func decodeLogRecordHeader(datas []byte) (*LogRecordHeader, int64) {
 	// 构造 LogRecordHeader
 	logRecordHeader := &LogRecordHeader{
 		crc:           binary.LittleEndian.Uint32(datas[:4]),
-		logRecordType: datas[4],
+		logRecordType: datas[4] & logRecordTypeMask,
 	}
 	var idx = 5
 	// 获取key size
 	keySize, n := binary.Varint(datas[idx:])
+	if n <= 0 {
+		return nil, 0
+	}
 	logRecordHeader.keySize = uint32(keySize)
 	idx += n
 	// 获取value size
 	valueSize, n := binary.Varint(datas[idx:])
+	if n <= 0 {
+		return nil, 0
+	}
 	logRecordHeader.valueSize = uint32(valueSize)
 	idx += n
+	// 获取可选的过期时间
+	if datas[4]&logRecordExpireFlag != 0 {
+		expire, n := binary.Varint(datas[idx:])
+		if n <= 0 {
+			return nil, 0
+		}
+		logRecordHeader.expire = expire
+		idx += n
+	}
+	// 获取可选的column family id
+	if datas[4]&logRecordFamilyFlag != 0 {
+		family, n := binary.Uvarint(datas[idx:])
+		if n <= 0 {
+			return nil, 0
+		}
+		logRecordHeader.family = uint32(family)
+		idx += n
+	}
+	// 获取可选的压缩算法
+	if datas[4]&logRecordCodecFlag != 0 {
+		if idx >= len(datas) {
+			return nil, 0
+		}
+		logRecordHeader.codec = datas[idx]
+		idx++
+	}
+	// 获取可选的密钥id与nonce
+	if datas[4]&logRecordCipherFlag != 0 {
+		keyId, n := binary.Uvarint(datas[idx:])
+		if n <= 0 || idx+n+nonceSize > len(datas) {
+			return nil, 0
+		}
+		logRecordHeader.encrypted = true
+		logRecordHeader.keyId = uint32(keyId)
+		idx += n
+		logRecordHeader.nonce = datas[idx : idx+nonceSize]
+		idx += nonceSize
+	}
 	return logRecordHeader, int64(idx)
 }
 
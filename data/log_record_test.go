@@ -94,4 +94,67 @@ func TestGetLogRecordCRC(t *testing.T) {
 	headerBuf3 := []byte{43, 153, 86, 17, 1, 8, 20}
 	crc3 := getLogRecordCRC(rec3, headerBuf3[crc32.Size:])
 	assert.Equal(t, uint32(290887979), crc3)
-}
\ No newline at end of file
+}
+
+func TestEncodeDecodeExpire(t *testing.T) {
+	// 带有过期时间的record，header中包含过期时间，type不受影响
+	logRecord := &LogRecord{
+		Key:    []byte("name"),
+		Value:  []byte("bitcask-go"),
+		Typ:    LogRecordNormal,
+		Expire: 1700000000000000000,
+	}
+	encRecord, sz := EncodeLogRecord(logRecord)
+	header, headerSize := decodeLogRecordHeader(encRecord)
+	assert.NotNil(t, header)
+	assert.Equal(t, sz, headerSize+int64(len(logRecord.Key)+len(logRecord.Value)))
+	assert.Equal(t, byte(LogRecordNormal), header.logRecordType)
+	assert.Equal(t, logRecord.Expire, header.expire)
+	assert.Equal(t, header.crc, getLogRecordCRC(logRecord, encRecord[crc32.Size:headerSize]))
+
+	// 不带过期时间的record，编码与旧版本相同
+	encRecord, _ = EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: []byte("bitcask-go")})
+	assert.Equal(t, []byte{104, 82, 240, 150, 0, 8, 20}, encRecord[:7])
+}
+
+func TestEncodeDecodeLogRecordPos(t *testing.T) {
+	pos := &LogRecordPos{Fid: 3, Offset: 1024, RecordSize: 100}
+	assert.Equal(t, pos, DecodeLogRecordPos(EncodeLogRecordPos(pos)))
+
+	pos.Expire = 1700000000000000000
+	assert.Equal(t, pos, DecodeLogRecordPos(EncodeLogRecordPos(pos)))
+	assert.True(t, pos.IsExpired(pos.Expire))
+	assert.False(t, pos.IsExpired(pos.Expire-1))
+
+	// value被分离时，位置信息中带有value在blob file中的位置，永不过期时也能正确解码
+	pos.Blob = &BlobPos{Fid: 7, Offset: 1 << 20, Size: 4096}
+	assert.Equal(t, pos, DecodeLogRecordPos(EncodeLogRecordPos(pos)))
+	pos.Expire = 0
+	assert.Equal(t, pos, DecodeLogRecordPos(EncodeLogRecordPos(pos)))
+	assert.Equal(t, pos.Blob, DecodeBlobPos(EncodeBlobPos(pos.Blob)))
+}
+
+func TestEncodeDecodeFamily(t *testing.T) {
+	// 非默认column family的record，header中包含family id，可以与过期时间同时存在
+	logRecord := &LogRecord{
+		Key:    []byte("name"),
+		Value:  []byte("bitcask-go"),
+		Typ:    LogRecordDeleted,
+		Expire: 1700000000000000000,
+		Family: 300,
+	}
+	encRecord, sz := EncodeLogRecord(logRecord)
+	header, headerSize := decodeLogRecordHeader(encRecord)
+	assert.NotNil(t, header)
+	assert.Equal(t, sz, headerSize+int64(len(logRecord.Key)+len(logRecord.Value)))
+	assert.Equal(t, byte(LogRecordDeleted), header.logRecordType)
+	assert.Equal(t, logRecord.Expire, header.expire)
+	assert.Equal(t, logRecord.Family, header.family)
+	assert.Equal(t, header.crc, getLogRecordCRC(logRecord, encRecord[crc32.Size:headerSize]))
+
+	logRecord.Expire = 0
+	encRecord, _ = EncodeLogRecord(logRecord)
+	header, _ = decodeLogRecordHeader(encRecord)
+	assert.Equal(t, int64(0), header.expire)
+	assert.Equal(t, logRecord.Family, header.family)
+}
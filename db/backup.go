@@ -0,0 +1,482 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"kv-go/data"
+	"kv-go/index"
+	"kv-go/utils"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// 在线备份与恢复
+// 备份时只在持有锁期间切换活跃文件并引用所有封存的文件，文件的复制不会阻塞读写
+
+const (
+	backupManifestName    = "backup-manifest"
+	backupManifestTmpName = "backup-manifest.tmp"
+	backupCopyBufferSize  = 1 << 20
+)
+
+// BackupManifest 备份目录中的清单，记录了恢复数据库需要的所有文件
+// 清单在所有文件复制完成后最后写入，存在清单的备份才是完整的
+type BackupManifest struct {
+	Base  string       `json:"base,omitempty"` // 增量备份依赖的上一次备份，为相对于当前备份目录的路径
+	Files []BackupFile `json:"files"`
+}
+
+// BackupFile 备份中的一个文件
+type BackupFile struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mod_time"`          // 备份时文件的修改时间，增量备份根据名称、大小与修改时间判断文件是否变化
+	Crc     uint32 `json:"crc"`               // 文件内容的crc32，恢复时校验
+	InBase  bool   `json:"in_base,omitempty"` // 文件没有变化，内容保存在Base备份中
+}
+
+// 备份时被引用的文件
+type backupSource struct {
+	name     string
+	file     *data.DataFile
+	opened   bool // 文件由备份打开，复制完成后直接关闭，不需要引用计数
+	size     int64
+	modTime  int64
+	contents []byte // 较小的元数据文件直接在持有锁时读取
+}
+
+// BackUp 将数据库完整备份到dir中，复制文件期间不会阻塞读写
+func (db *DB) BackUp(dir string) error {
+	return db.backUp(dir, "")
+}
+
+// BackUpIncremental 以baseDir中的备份为基础增量备份到dir中，只复制baseDir之后新增或变化的文件
+// 恢复时需要baseDir以及它依赖的所有备份，且它们与dir的相对位置不能改变
+func (db *DB) BackUpIncremental(dir string, baseDir string) error {
+	return db.backUp(dir, baseDir)
+}
+
+func (db *DB) backUp(dir string, baseDir string) error {
+	// B+树的index保存在磁盘中，需要持有锁复制整个目录
+	if db.opts.Indexer == index.BPlusTreeType {
+		if baseDir != "" {
+			return ErrBackupUnsupported
+		}
+		return db.backUpLocked(dir)
+	}
+	var base *BackupManifest
+	if baseDir != "" {
+		var err error
+		if base, err = loadBackupManifest(baseDir); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	// 删除旧的清单，备份失败时目录中不会留下看起来完整的备份
+	if err := os.RemoveAll(filepath.Join(dir, backupManifestName)); err != nil {
+		return err
+	}
+	sources, err := db.pinBackupSources()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		for _, source := range sources {
+			if source.opened {
+				_ = source.file.Close()
+			} else if source.file != nil {
+				_ = db.releaseFile(source.file)
+			}
+		}
+	}()
+
+	manifest := &BackupManifest{}
+	baseFiles := make(map[string]BackupFile)
+	if base != nil {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		absBase, err := filepath.Abs(baseDir)
+		if err != nil {
+			return err
+		}
+		if manifest.Base, err = filepath.Rel(absDir, absBase); err != nil {
+			return err
+		}
+		for _, file := range base.Files {
+			baseFiles[file.Name] = file
+		}
+	}
+	for _, source := range sources {
+		// 封存的文件没有变化，不需要再次复制
+		if baseFile, ok := baseFiles[source.name]; ok && source.file != nil &&
+			baseFile.Size == source.size && baseFile.ModTime == source.modTime {
+			manifest.Files = append(manifest.Files, BackupFile{
+				Name:    source.name,
+				Size:    source.size,
+				ModTime: source.modTime,
+				Crc:     baseFile.Crc,
+				InBase:  true,
+			})
+			continue
+		}
+		var reader io.Reader
+		if source.file != nil {
+			reader = io.NewSectionReader(ioManagerReaderAt{source.file}, 0, source.size)
+		} else {
+			reader = bytes.NewReader(source.contents)
+		}
+		crc, err := copyBackupFile(filepath.Join(dir, source.name), reader, source.size)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, BackupFile{
+			Name:    source.name,
+			Size:    source.size,
+			ModTime: source.modTime,
+			Crc:     crc,
+		})
+	}
+	return saveBackupManifest(dir, manifest)
+}
+
+// 切换活跃文件，并引用所有封存的数据文件与blob file
+func (db *DB) pinBackupSources() ([]*backupSource, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// 活跃文件中已有数据时切换一个新的活跃文件，使所有已经写入的记录都在封存的文件中
+	if db.activeFile != nil && db.activeFile.WriteOff > 0 {
+		if err := db.syncBlobFile(); err != nil {
+			return nil, err
+		}
+		if err := db.syncFile(db.activeFile); err != nil {
+			return nil, err
+		}
+		db.inActivaFile[db.activeFile.FileId] = db.activeFile
+		db.writeFileHintAsync(db.activeFile)
+		if err := db.newActiveFile(); err != nil {
+			return nil, err
+		}
+	}
+	var sources []*backupSource
+	for fileId, dataFile := range db.inActivaFile {
+		sources = append(sources, &backupSource{
+			name: filepath.Base(data.GetDataFileNameById(db.opts.DirPath, fileId)),
+			file: dataFile,
+		})
+	}
+	for fileId, blobFile := range db.blobFiles {
+		sources = append(sources, &backupSource{
+			name: filepath.Base(data.GetBlobFileNameById(db.opts.DirPath, fileId)),
+			file: blobFile,
+		})
+	}
+	for _, source := range sources {
+		info, err := os.Stat(filepath.Join(db.opts.DirPath, source.name))
+		if err != nil {
+			return nil, err
+		}
+		source.modTime = info.ModTime().UnixNano()
+		// 活跃的blob file仍会被追加，只复制已经写入的部分
+		if source.file == db.activeBlobFile {
+			source.size = source.file.WriteOff
+		} else if source.size, err = source.file.IOManager.Size(); err != nil {
+			return nil, err
+		}
+	}
+	// column family信息较小，直接读取
+	contents, err := os.ReadFile(filepath.Join(db.opts.DirPath, data.FamilyFileName))
+	if err == nil {
+		sources = append(sources, &backupSource{
+			name:     data.FamilyFileName,
+			size:     int64(len(contents)),
+			contents: contents,
+		})
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	// hint file写入后不会再被修改，由备份打开，merge删除或替换它们后仍然可以读取，恢复后启动时不需要读取全部数据文件
+	hintSources, err := db.openBackupHintFiles()
+	if err != nil {
+		return nil, err
+	}
+	sources = append(sources, hintSources...)
+	for _, source := range sources {
+		if source.file != nil && !source.opened {
+			db.fileRefs[source.file]++
+		}
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].name < sources[j].name
+	})
+	return sources, nil
+}
+
+// 打开所有不活跃文件的hint file以及merge生成的hint file与finish file，调用者需要持有db.mu
+func (db *DB) openBackupHintFiles() ([]*backupSource, error) {
+	var sources []*backupSource
+	open := func(name string, openFile func() (*data.DataFile, error)) error {
+		info, err := os.Stat(filepath.Join(db.opts.DirPath, name))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		file, err := openFile()
+		if err != nil {
+			return err
+		}
+		sources = append(sources, &backupSource{name: name, file: file, opened: true, size: info.Size(), modTime: info.ModTime().UnixNano()})
+		return nil
+	}
+	err := open(data.HintFileName, func() (*data.DataFile, error) {
+		return data.OpenHintFile(db.opts.DirPath)
+	})
+	if err == nil {
+		err = open(data.MergeFilishedFileName, func() (*data.DataFile, error) {
+			return data.OpenMergeFinsihedFile(db.opts.DirPath)
+		})
+	}
+	for fileId := range db.inActivaFile {
+		if err != nil {
+			break
+		}
+		hintFileName := data.GetFileHintNameById(db.opts.DirPath, fileId)
+		err = open(filepath.Base(hintFileName), func() (*data.DataFile, error) {
+			return data.OpenFileHintFile(hintFileName, fileId)
+		})
+	}
+	if err != nil {
+		for _, source := range sources {
+			_ = source.file.Close()
+		}
+		return nil, err
+	}
+	return sources, nil
+}
+
+// 持有锁复制整个数据目录并记录复制的文件，包括column family的index目录中的文件，解锁后再计算复制的文件的crc生成清单
+func (db *DB) backUpLocked(dir string) error {
+	exclude := map[string]struct{}{fileLockName: {}, backupManifestName: {}, backupManifestTmpName: {}}
+	manifest := &BackupManifest{}
+	db.mu.Lock()
+	// 与CopyDir一样按名称排除，目录被排除时跳过其中的所有文件
+	err := filepath.WalkDir(db.opts.DirPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == db.opts.DirPath {
+			return err
+		}
+		if _, ok := exclude[entry.Name()]; ok {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(db.opts.DirPath, path)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, BackupFile{
+			Name:    filepath.ToSlash(name),
+			Size:    info.Size(),
+			ModTime: info.ModTime().UnixNano(),
+		})
+		return nil
+	})
+	if err == nil {
+		err = utils.CopyDir(db.opts.DirPath, dir, exclude)
+	}
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for i := range manifest.Files {
+		file := &manifest.Files[i]
+		if file.Crc, err = backupFileCrc(filepath.Join(dir, filepath.FromSlash(file.Name)), file.Size); err != nil {
+			return err
+		}
+	}
+	return saveBackupManifest(dir, manifest)
+}
+
+// 计算文件内容的crc32，文件大小与size不一致时返回错误
+func backupFileCrc(fileName string, size int64) (uint32, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	hash := crc32.NewIEEE()
+	n, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, err
+	}
+	if n != size {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return hash.Sum32(), nil
+}
+
+// Restore 将backupDir中的备份恢复到targetDir，targetDir必须不存在或者为空
+// 所有文件都会校验大小与crc，校验失败时返回ErrBackupCorrupted并删除targetDir
+func Restore(backupDir string, targetDir string) error {
+	manifest, err := loadBackupManifest(backupDir)
+	if err != nil {
+		return err
+	}
+	if entries, err := os.ReadDir(targetDir); err == nil && len(entries) > 0 {
+		return ErrRestoreDirNotEmpty
+	}
+	if err := os.MkdirAll(targetDir, os.ModePerm); err != nil {
+		return err
+	}
+	for _, file := range manifest.Files {
+		if err = restoreBackupFile(backupDir, manifest, file, targetDir); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		_ = os.RemoveAll(targetDir)
+	}
+	return err
+}
+
+// 将备份中的文件复制到targetDir，保存在Base备份中的文件会沿着备份链查找
+func restoreBackupFile(backupDir string, manifest *BackupManifest, file BackupFile, targetDir string) error {
+	dir := backupDir
+	for file.InBase {
+		if manifest.Base == "" {
+			return ErrBackupCorrupted
+		}
+		dir = filepath.Join(dir, manifest.Base)
+		baseManifest, err := loadBackupManifest(dir)
+		if err != nil {
+			return err
+		}
+		baseFile, ok := findBackupFile(baseManifest, file.Name)
+		if !ok || baseFile.Size != file.Size || baseFile.Crc != file.Crc {
+			return ErrBackupCorrupted
+		}
+		manifest, file = baseManifest, baseFile
+	}
+	srcFile, err := os.Open(filepath.Join(dir, filepath.FromSlash(file.Name)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrBackupCorrupted
+		}
+		return err
+	}
+	defer srcFile.Close()
+	if info, err := srcFile.Stat(); err != nil {
+		return err
+	} else if info.Size() != file.Size {
+		return ErrBackupCorrupted
+	}
+	// column family的index保存在子目录中
+	targetFileName := filepath.Join(targetDir, filepath.FromSlash(file.Name))
+	if err := os.MkdirAll(filepath.Dir(targetFileName), os.ModePerm); err != nil {
+		return err
+	}
+	crc, err := copyBackupFile(targetFileName, srcFile, file.Size)
+	if err != nil {
+		return err
+	}
+	if crc != file.Crc {
+		return ErrBackupCorrupted
+	}
+	return nil
+}
+
+func findBackupFile(manifest *BackupManifest, name string) (BackupFile, bool) {
+	for _, file := range manifest.Files {
+		if file.Name == name {
+			return file, true
+		}
+	}
+	return BackupFile{}, false
+}
+
+// 复制size字节到fileName，返回复制内容的crc32
+func copyBackupFile(fileName string, reader io.Reader, size int64) (uint32, error) {
+	dstFile, err := os.Create(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer dstFile.Close()
+	hash := crc32.NewIEEE()
+	buf := make([]byte, max(min(size, backupCopyBufferSize), 1))
+	n, err := io.CopyBuffer(io.MultiWriter(dstFile, hash), io.LimitReader(reader, size), buf)
+	if err != nil {
+		return 0, err
+	}
+	if n != size {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if err := dstFile.Sync(); err != nil {
+		return 0, err
+	}
+	return hash.Sum32(), nil
+}
+
+func loadBackupManifest(dir string) (*BackupManifest, error) {
+	contents, err := os.ReadFile(filepath.Join(dir, backupManifestName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrBackupManifestNotFound
+		}
+		return nil, err
+	}
+	manifest := &BackupManifest{}
+	if err := json.Unmarshal(contents, manifest); err != nil {
+		return nil, ErrBackupCorrupted
+	}
+	return manifest, nil
+}
+
+// 先写入临时文件再重命名，清单要么完整存在要么不存在
+func saveBackupManifest(dir string, manifest *BackupManifest) error {
+	contents, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	tmpFileName := filepath.Join(dir, backupManifestTmpName)
+	tmpFile, err := os.Create(tmpFileName)
+	if err != nil {
+		return err
+	}
+	if _, err = tmpFile.Write(contents); err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, filepath.Join(dir, backupManifestName))
+}
+
+// 使用数据文件的IOManager读取，merge替换文件后仍然可以读取到被引用的旧文件
+type ioManagerReaderAt struct {
+	dataFile *data.DataFile
+}
+
+func (r ioManagerReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	return r.dataFile.IOManager.Read(b, off)
+}
@@ -0,0 +1,179 @@
+package db
+
+import (
+	"context"
+	"kv-go/data"
+	"kv-go/index"
+	"kv-go/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackUpRestore(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-backup")
+	opts.DataFileSize = 64 * 1024
+	opts.MergeRatio = 0
+	opts.BlobThreshold = 1024
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	backupDir, _ := os.MkdirTemp("", "KeyCache-test-backup-dest")
+	defer os.RemoveAll(backupDir)
+	full, incr, merged := filepath.Join(backupDir, "full"), filepath.Join(backupDir, "incr"), filepath.Join(backupDir, "merged")
+
+	vals := make(map[string][]byte)
+	put := func(from, to int, size int) {
+		for i := from; i < to; i++ {
+			val := utils.GetTestValue(size)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), val))
+			vals[string(utils.GetTestKey(i))] = val
+		}
+	}
+	// 恢复的目录中的hint file
+	var restoredHints []string
+	check := func(dir string, vals map[string][]byte) {
+		restoreOpts := opts
+		restoreOpts.DirPath = filepath.Join(backupDir, "restore")
+		assert.Nil(t, Restore(dir, restoreOpts.DirPath))
+		defer os.RemoveAll(restoreOpts.DirPath)
+		restoredHints = restoredHints[:0]
+		entries, err := os.ReadDir(restoreOpts.DirPath)
+		assert.Nil(t, err)
+		for _, entry := range entries {
+			if strings.HasSuffix(entry.Name(), data.FileHintNameSuffix) || entry.Name() == data.HintFileName || entry.Name() == data.MergeFilishedFileName {
+				restoredHints = append(restoredHints, entry.Name())
+			}
+		}
+		restored, err := Open(restoreOpts)
+		assert.Nil(t, err)
+		defer restored.Close()
+		assert.Equal(t, len(vals), len(restored.ListKeys(false)))
+		for key, val := range vals {
+			res, err := restored.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, val, res)
+		}
+	}
+	manifestFiles := func(dir string) (copied, inBase int) {
+		manifest, err := loadBackupManifest(dir)
+		assert.Nil(t, err)
+		for _, file := range manifest.Files {
+			if file.InBase {
+				inBase++
+			} else {
+				copied++
+			}
+		}
+		return copied, inBase
+	}
+	{
+		// 完整备份包含活跃文件中已经写入的数据，备份之后的写入不可见
+		put(0, 1000, 128)
+		put(1000, 1010, 2048)
+		_, err := db.CreateColumnFamily("cf")
+		assert.Nil(t, err)
+		db.hintWg.Wait()
+		assert.Nil(t, db.BackUp(full))
+		fullVals := make(map[string][]byte, len(vals))
+		for key, val := range vals {
+			fullVals[key] = val
+		}
+		put(1010, 2000, 128)
+		check(full, fullVals)
+		// hint file同样被备份，恢复后启动时不需要读取全部数据文件
+		assert.Greater(t, len(restoredHints), 0)
+	}
+	{
+		// 增量备份只复制新增的文件，未变化的文件从上一次备份中恢复
+		assert.Nil(t, db.BackUpIncremental(incr, full))
+		copied, inBase := manifestFiles(incr)
+		assert.Greater(t, inBase, 0)
+		assert.Greater(t, copied, 0)
+		check(incr, vals)
+	}
+	{
+		// merge替换的文件与上一次备份中的同名文件不同，需要重新复制
+		for i := 0; i < 1000; i += 2 {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+			delete(vals, string(utils.GetTestKey(i)))
+		}
+		assert.Nil(t, db.Merge(context.Background()))
+		assert.Nil(t, db.BackUpIncremental(merged, incr))
+		check(merged, vals)
+		assert.Contains(t, restoredHints, data.HintFileName)
+		assert.Contains(t, restoredHints, data.MergeFilishedFileName)
+	}
+	{
+		// 备份链中的文件损坏或缺失时恢复失败，且不会留下目标目录
+		target := filepath.Join(backupDir, "restore")
+		assert.Nil(t, os.WriteFile(filepath.Join(backupDir, "restore-file"), nil, os.ModePerm))
+		assert.Equal(t, ErrRestoreDirNotEmpty, Restore(full, backupDir))
+
+		manifest, err := loadBackupManifest(full)
+		assert.Nil(t, err)
+		fileName := filepath.Join(full, manifest.Files[0].Name)
+		contents, err := os.ReadFile(fileName)
+		assert.Nil(t, err)
+		contents[len(contents)/2] ^= 0xff
+		assert.Nil(t, os.WriteFile(fileName, contents, os.ModePerm))
+		assert.Equal(t, ErrBackupCorrupted, Restore(incr, target))
+		_, err = os.Stat(target)
+		assert.True(t, os.IsNotExist(err))
+
+		assert.Nil(t, os.Remove(fileName))
+		assert.Equal(t, ErrBackupCorrupted, Restore(full, target))
+		assert.Nil(t, os.Remove(filepath.Join(full, backupManifestName)))
+		assert.Equal(t, ErrBackupManifestNotFound, Restore(full, target))
+	}
+}
+
+func TestBackUpRestoreBPlusTree(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("/tmp", "test-backup-bptree")
+	opts.Indexer = index.BPlusTreeType
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	backupDir, _ := os.MkdirTemp("/tmp", "test-backup-bptree-dest")
+	defer os.RemoveAll(backupDir)
+
+	// B+树的index保存在磁盘中，column family的index目录同样需要备份与恢复
+	cnt := 100
+	cf, err := db.CreateColumnFamily("cf")
+	assert.Nil(t, err)
+	for i := 0; i < cnt; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(32)))
+		assert.Nil(t, cf.Put(utils.GetTestKey(i), utils.GetTestValue(32)))
+	}
+	full := filepath.Join(backupDir, "full")
+	assert.Nil(t, db.BackUp(full))
+	manifest, err := loadBackupManifest(full)
+	assert.Nil(t, err)
+	inFamilyDir := 0
+	for _, file := range manifest.Files {
+		if strings.HasPrefix(file.Name, familyDirPrefix) {
+			inFamilyDir++
+		}
+	}
+	assert.Greater(t, inFamilyDir, 0)
+
+	restoreOpts := opts
+	restoreOpts.DirPath = filepath.Join(backupDir, "restore")
+	assert.Nil(t, Restore(full, restoreOpts.DirPath))
+	restored, err := Open(restoreOpts)
+	assert.Nil(t, err)
+	defer restored.Close()
+	restoredCf, err := restored.ColumnFamily("cf")
+	assert.Nil(t, err)
+	for i := 0; i < cnt; i++ {
+		_, err := restored.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		_, err = restoredCf.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"kv-go/data"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
@@ -15,52 +16,105 @@ const (
 var wbFinKey = []byte("wb-finsh") // 最后提交的finsh record的key
 
 type WriteBatch struct {
-	opts          WBOptions                  // 配置选项
-	db            *DB                        // 保存DB实例
-	pendingWrites map[string]*data.LogRecord // 暂存事务的写入操作
-	mu            *sync.Mutex                // 保证WriteBatch操作的原子性，用户可能用多个线程访问WriteBatch
+	opts          WBOptions                      // 配置选项
+	db            *DB                            // 保存DB实例
+	pendingWrites map[pendingKey]*data.LogRecord // 暂存事务的写入操作
+	conditions    map[pendingKey]*condition      // 条件写入的条件，提交时检查，任意条件不满足则整个批次都不会写入
+	mu            *sync.Mutex                    // 保证WriteBatch操作的原子性，用户可能用多个线程访问WriteBatch
+}
+
+// 暂存区中key的标识，不同column family中的相同key互不影响
+type pendingKey struct {
+	family *ColumnFamily
+	key    string
 }
 
 // 写入数据到暂存区
 func (writeBatch *WriteBatch) Put(key []byte, value []byte) error {
+	return writeBatch.PutCF(writeBatch.db.defaultFamily, key, value)
+}
+
+// 写入指定column family的数据到暂存区
+func (writeBatch *WriteBatch) PutCF(cf *ColumnFamily, key []byte, value []byte) error {
 	writeBatch.mu.Lock()
 	defer writeBatch.mu.Unlock()
 	// key不能为空
 	if len(key) == 0 {
 		return ErrEmptyKey
 	}
+	pk := pendingKey{family: cf, key: string(key)}
 	// TODO: LogRecord与pending都存储了key，是否不够优雅？
-	writeBatch.pendingWrites[string(key)] = &data.LogRecord{
+	writeBatch.pendingWrites[pk] = &data.LogRecord{
 		Key:   key,
 		Value: value,
 		Typ:   data.LogRecordNormal,
 	}
+	// 同一个key以最后一次写入为准
+	delete(writeBatch.conditions, pk)
 	return nil
 }
 
 // 从暂存区中删除数据
 func (writeBatch *WriteBatch) Delete(key []byte) error {
+	return writeBatch.DeleteCF(writeBatch.db.defaultFamily, key)
+}
+
+// 从暂存区中删除指定column family的数据
+func (writeBatch *WriteBatch) DeleteCF(cf *ColumnFamily, key []byte) error {
 	writeBatch.mu.Lock()
 	defer writeBatch.mu.Unlock()
 	if len(key) == 0 {
 		return ErrEmptyKey
 	}
+	pk := pendingKey{family: cf, key: string(key)}
+	delete(writeBatch.conditions, pk)
 	// 先判断key是否存在
-	logRecordPos := writeBatch.db.index.Get(key)
+	logRecordPos := cf.index.Get(key)
 	// 如果key不存在
 	if logRecordPos == nil {
-		delete(writeBatch.pendingWrites, string(key))
+		delete(writeBatch.pendingWrites, pk)
 		return nil
 	}
 	// 如果key存在，更新一条delete record即可
-	writeBatch.pendingWrites[string(key)] = &data.LogRecord{
+	writeBatch.pendingWrites[pk] = &data.LogRecord{
 		Key: key,
 		Typ: data.LogRecordDeleted,
 	}
 	return nil
 }
 
-// 将暂存区中的数据提交到data file
+// 暂存key不存在时才写入的操作，条件在提交时检查
+func (writeBatch *WriteBatch) PutIfAbsent(key []byte, value []byte) error {
+	return writeBatch.putWithCondition(key, value, data.LogRecordNormal, &condition{absent: true})
+}
+
+// 暂存key当前的value等于oldValue时才替换的操作，条件在提交时检查
+func (writeBatch *WriteBatch) CompareAndSwap(key []byte, oldValue []byte, newValue []byte) error {
+	return writeBatch.putWithCondition(key, newValue, data.LogRecordNormal, &condition{expected: oldValue})
+}
+
+// 暂存key当前的value等于oldValue时才删除的操作，条件在提交时检查
+func (writeBatch *WriteBatch) CompareAndDelete(key []byte, oldValue []byte) error {
+	return writeBatch.putWithCondition(key, nil, data.LogRecordDeleted, &condition{expected: oldValue})
+}
+
+func (writeBatch *WriteBatch) putWithCondition(key []byte, value []byte, typ data.LogRecordType, cond *condition) error {
+	writeBatch.mu.Lock()
+	defer writeBatch.mu.Unlock()
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	pk := pendingKey{family: writeBatch.db.defaultFamily, key: string(key)}
+	writeBatch.pendingWrites[pk] = &data.LogRecord{
+		Key:   key,
+		Value: value,
+		Typ:   typ,
+	}
+	writeBatch.conditions[pk] = cond
+	return nil
+}
+
+// 将暂存区中的数据提交到data file，有条件不满足时返回ErrConditionFailed，暂存区保持不变
 func (writeBatch *WriteBatch) Commit() error {
 	writeBatch.mu.Lock()
 	defer writeBatch.mu.Unlock()
@@ -72,34 +126,58 @@ func (writeBatch *WriteBatch) Commit() error {
 	if uint(len(writeBatch.pendingWrites)) > writeBatch.opts.MaxWriteNum {
 		return ErrExceedMaxWriteNum
 	}
-	// 修改DB时，需要保证串行化
-	writeBatch.db.mu.Lock()
-	defer writeBatch.db.mu.Unlock()
+	// 修改DB时，需要保证串行化，需要持久化时与其他并发的写入合并持久化
+	start := time.Now()
+	if err := writeBatch.db.write(writeBatch.commit, len(writeBatch.conditions) > 0, writeBatch.needSync()); err != nil {
+		return err
+	}
+	writeBatch.db.metrics.observeWrite(&writeBatch.db.metrics.batchCommits, start)
+	return nil
+}
+
+// 提交时是否需要持久化
+func (writeBatch *WriteBatch) needSync() bool {
+	return writeBatch.opts.Sync || writeBatch.db.opts.AlwaysSync
+}
+
+// 将暂存区中的数据写入data file，返回更新index的publish，调用者需要持有writeBatch.mu与db.mu
+func (writeBatch *WriteBatch) commit() (func() error, error) {
+	// 在写入任何record之前检查所有column family都有效，且所有条件都满足
+	for pk := range writeBatch.pendingWrites {
+		if !pk.family.isAlive() {
+			return nil, ErrFamilyNotFound
+		}
+	}
+	for pk, cond := range writeBatch.conditions {
+		if err := pk.family.checkCondition([]byte(pk.key), cond); err != nil {
+			return nil, err
+		}
+	}
 	// 获取wbId
 	id := atomic.AddUint64(&writeBatch.db.wbId, 1)
 	// TODO:如果先大量更新，然后再全部删除，那么维护index时，也先更新再删除，是否是无效操作？
 	// 还是说这里的两个map不够优雅？
-	updatePos := make(map[string]*data.LogRecordPos)
-	deletePos := make(map[string]struct{})
+	updatePos := make(map[pendingKey]*data.LogRecordPos)
+	deletePos := make(map[pendingKey]struct{})
 	// 将writes写入磁盘
-	for _, record := range writeBatch.pendingWrites {
+	for pk, record := range writeBatch.pendingWrites {
 		realKey := record.Key
 		// 磁盘中的key需要带有id
 		record.Key = serializeKeyId(realKey, id)
+		record.Family = pk.family.id
 		// 向磁盘中的data file追加数据
 		logRecordPos, err := writeBatch.db.appendLogRecord(record)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		// 暂存pos信息，所有record追加完成后，统一更新index
-		strRealKey := string(realKey)
 		if record.Typ == data.LogRecordNormal {
-			updatePos[strRealKey] = logRecordPos
+			updatePos[pk] = logRecordPos
 		} else if record.Typ == data.LogRecordDeleted {
-			delete(updatePos, strRealKey)
-			deletePos[strRealKey] = struct{}{}
+			delete(updatePos, pk)
+			deletePos[pk] = struct{}{}
 		} else {
-			return ErrInvalidRecordType
+			return nil, ErrInvalidRecordType
 		}
 	}
 	// 最后写入一条finish record
@@ -109,37 +187,54 @@ func (writeBatch *WriteBatch) Commit() error {
 	}
 	_, err := writeBatch.db.appendLogRecord(finLogRecord)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	// 根据配置信息决定是否持久化(这里不能调用db.Sync(), 因为死锁)
-	if writeBatch.opts.Sync {
-		if err := writeBatch.db.activeFile.Sync(); err != nil {
-			return err
+	// 根据配置信息决定是否持久化(这里不能调用db.Sync(), 因为死锁)，group commit时由leader统一持久化
+	if writeBatch.opts.Sync && !writeBatch.db.inGroupCommit {
+		if err := writeBatch.db.syncBlobFile(); err != nil {
+			return nil, err
+		}
+		if err := writeBatch.db.syncFile(writeBatch.db.activeFile); err != nil {
+			return nil, err
 		}
 	}
-	// 所有record写入磁盘后，更新索引，TODO:[]byte->string的转换开销小，但顶不住频繁的转换
-	// 记得维护无效字节数
-	for key, pos := range updatePos {
-		ok, oldValue := writeBatch.db.index.Put([]byte(key), pos)
-		if !ok {
-			return ErrUpdateIndexFailed
+	// 持久化之后再更新索引并通知订阅者
+	return func() error {
+		// 所有record写入磁盘后，更新索引，TODO:[]byte->string的转换开销小，但顶不住频繁的转换
+		// 记得维护无效字节数
+		for pk, pos := range updatePos {
+			ok, oldValue := pk.family.index.Put([]byte(pk.key), pos)
+			if !ok {
+				return ErrUpdateIndexFailed
+			}
+			writeBatch.db.addLiveSize(pos)
+			if oldValue != nil {
+				pk.family.discard(oldValue)
+			}
 		}
-		if oldValue != nil {
-			writeBatch.db.invalidSize += int64(oldValue.RecordSize)
+		for pk := range deletePos {
+			ok, oldValue := pk.family.index.Delete([]byte(pk.key))
+			if !ok {
+				return ErrUpdateIndexFailed
+			}
+			if oldValue != nil {
+				pk.family.discard(oldValue)
+			}
 		}
-	}
-	for key := range deletePos {
-		ok, oldValue := writeBatch.db.index.Delete([]byte(key))
-		if !ok {
-			return ErrUpdateIndexFailed
+		// 一个WriteBatch中的所有变更一起通知订阅者
+		changes := make([]watchChange, 0, len(updatePos)+len(deletePos))
+		for pk := range updatePos {
+			changes = append(changes, watchChange{family: pk.family, typ: WatchPut, key: []byte(pk.key), value: writeBatch.pendingWrites[pk].Value})
 		}
-		if oldValue != nil {
-			writeBatch.db.invalidSize += int64(oldValue.RecordSize)
+		for pk := range deletePos {
+			changes = append(changes, watchChange{family: pk.family, typ: WatchDelete, key: []byte(pk.key)})
 		}
-	}
-	// 清空wb中暂存的record
-	writeBatch.pendingWrites = make(map[string]*data.LogRecord)
-	return nil
+		writeBatch.db.notifyWatchers(changes)
+		// 清空wb中暂存的record
+		writeBatch.pendingWrites = make(map[pendingKey]*data.LogRecord)
+		writeBatch.conditions = make(map[pendingKey]*condition)
+		return nil
+	}, nil
 }
 
 // 将key与id序列化到一起
@@ -0,0 +1,290 @@
+package db
+
+import (
+	"context"
+	"io"
+	"kv-go/data"
+	"kv-go/fio"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BlobStat blob file的统计信息
+type BlobStat struct {
+	Fid         uint32 // blob file id
+	Size        int64  // blob file的大小(Byte)
+	GarbageSize int64  // 已经失效的数据量(Byte)
+}
+
+// 加载目录下的所有blob file，id最大的文件作为活跃的blob file
+func (db *DB) loadBlobFiles() error {
+	dirEntryes, err := os.ReadDir(db.opts.DirPath)
+	if err != nil {
+		return err
+	}
+	var fileIds []int
+	for _, entry := range dirEntryes {
+		if strings.HasSuffix(entry.Name(), data.BlobFileNameSuffix) {
+			fileId, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), data.BlobFileNameSuffix))
+			if err != nil {
+				return ErrDataFileNameCorrupted
+			}
+			fileIds = append(fileIds, fileId)
+		}
+	}
+	sort.Ints(fileIds)
+	for _, fileId := range fileIds {
+		// blob file只会被随机读取，不需要使用mmap
+		blobFile, err := db.withCipher(data.OpenBlobFile(db.opts.DirPath, uint32(fileId), fio.FileIOType))
+		if err != nil {
+			return err
+		}
+		sz, err := blobFile.IOManager.Size()
+		if err != nil {
+			return err
+		}
+		blobFile.WriteOff = sz
+		db.blobFiles[uint32(fileId)] = blobFile
+		db.activeBlobFile = blobFile
+	}
+	return nil
+}
+
+// 将value写入活跃的blob file，返回value在blob file中的位置
+// blob file中的记录保存了真实的key与family id，blob GC时用来查找index
+func (db *DB) writeBlob(logRecord *data.LogRecord) (*data.BlobPos, error) {
+	realKey, _ := parseKeyId(logRecord.Key)
+	encRecord, sz, err := db.encodeLogRecord(&data.LogRecord{
+		Key:         realKey,
+		Value:       logRecord.Value,
+		Expire:      logRecord.Expire,
+		Family:      logRecord.Family,
+		Compression: db.opts.Compression,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// 第一次写入或超出阈值时，打开新的blob file
+	if db.activeBlobFile == nil || db.activeBlobFile.WriteOff+sz > db.opts.BlobFileSize {
+		if err := db.newActiveBlobFile(); err != nil {
+			return nil, err
+		}
+	}
+	writeOff := db.activeBlobFile.WriteOff
+	if err := db.activeBlobFile.Write(encRecord); err != nil {
+		return nil, err
+	}
+	db.metrics.bytesWritten.Add(uint64(sz))
+	return &data.BlobPos{
+		Fid:    db.activeBlobFile.FileId,
+		Offset: writeOff,
+		Size:   uint32(sz),
+	}, nil
+}
+
+// 持久化并替换当前活跃的blob file
+func (db *DB) newActiveBlobFile() error {
+	var fileId uint32 = 1
+	if db.activeBlobFile != nil {
+		if err := db.syncFile(db.activeBlobFile); err != nil {
+			return err
+		}
+		fileId = db.activeBlobFile.FileId + 1
+	}
+	blobFile, err := db.withCipher(data.OpenBlobFile(db.opts.DirPath, fileId, fio.FileIOType))
+	if err != nil {
+		return err
+	}
+	db.blobFiles[fileId] = blobFile
+	db.blobGarbage[fileId] = 0
+	db.activeBlobFile = blobFile
+	return nil
+}
+
+// 持久化活跃的blob file，需要在持久化数据文件之前调用，保证数据文件中的位置总是指向已经持久化的value
+func (db *DB) syncBlobFile() error {
+	if db.activeBlobFile == nil {
+		return nil
+	}
+	return db.syncFile(db.activeBlobFile)
+}
+
+// 记录被覆盖或删除后，其在blob file中的value变为无效数据
+func (db *DB) discardBlob(pos *data.LogRecordPos) {
+	if pos == nil || pos.Blob == nil {
+		return
+	}
+	if _, ok := db.blobFiles[pos.Blob.Fid]; ok {
+		db.blobGarbage[pos.Blob.Fid] += int64(pos.Blob.Size)
+	}
+}
+
+// LogRecordBlob记录的value是value在blob file中的位置，其他记录返回nil
+func getBlobPos(logRecord *data.LogRecord) *data.BlobPos {
+	if logRecord.Typ != data.LogRecordBlob {
+		return nil
+	}
+	return data.DecodeBlobPos(logRecord.Value)
+}
+
+// 从blob file中读取value
+func readValueFromBlob(blobFile *data.DataFile, blobPos *data.BlobPos) ([]byte, error) {
+	return readValueFromFile(blobFile, &data.LogRecordPos{Fid: blobPos.Fid, Offset: blobPos.Offset, RecordSize: blobPos.Size})
+}
+
+// 所有blob file的统计信息，按照file id排序
+func (db *DB) BlobStat() []BlobStat {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	stats := make([]BlobStat, 0, len(db.blobFiles))
+	for fileId, blobFile := range db.blobFiles {
+		stats = append(stats, BlobStat{Fid: fileId, Size: blobFile.WriteOff, GarbageSize: db.blobGarbage[fileId]})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Fid < stats[j].Fid
+	})
+	return stats
+}
+
+// 所有blob file占用的字节数
+func (db *DB) blobSize() int64 {
+	var size int64 = 0
+	for _, blobFile := range db.blobFiles {
+		size += blobFile.WriteOff
+	}
+	return size
+}
+
+// BlobGC 回收无效数据比例达到BlobGCRatio的blob file
+// 仍然有效的value被重新写入活跃的blob file，同时在数据文件中追加指向新位置的记录，完成后删除旧的blob file
+func (db *DB) BlobGC(ctx context.Context) error {
+	if db.isReplica {
+		return ErrReplicaReadOnly
+	}
+	db.mu.Lock()
+	if db.isBlobGC {
+		db.mu.Unlock()
+		return ErrBlobGCIsProgress
+	}
+	db.isBlobGC = true
+	defer func() {
+		db.mu.Lock()
+		db.isBlobGC = false
+		db.mu.Unlock()
+	}()
+	// 活跃的blob file仍在写入，不参与回收
+	var blobFiles []*data.DataFile
+	for fileId, blobFile := range db.blobFiles {
+		if blobFile == db.activeBlobFile || blobFile.WriteOff == 0 {
+			continue
+		}
+		if float32(db.blobGarbage[fileId])/float32(blobFile.WriteOff) >= db.opts.BlobGCRatio {
+			blobFiles = append(blobFiles, blobFile)
+		}
+	}
+	db.mu.Unlock()
+	sort.Slice(blobFiles, func(i, j int) bool {
+		return blobFiles[i].FileId < blobFiles[j].FileId
+	})
+	for _, blobFile := range blobFiles {
+		if err := db.rewriteBlobFile(ctx, blobFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 重写blob file中仍然有效的value，然后删除该blob file
+func (db *DB) rewriteBlobFile(ctx context.Context, blobFile *data.DataFile) error {
+	var off int64 = 0
+	for {
+		// 用户取消时立即停止，已经重写的value仍然有效
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		blobRecord, sz, err := blobFile.ReadLogRecord(off)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if err := db.rewriteBlob(blobRecord, &data.BlobPos{Fid: blobFile.FileId, Offset: off, Size: uint32(sz)}); err != nil {
+			return err
+		}
+		off += sz
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// 先持久化重写后的value与记录，再删除旧的blob file
+	if err := db.syncBlobFile(); err != nil {
+		return err
+	}
+	if db.activeFile != nil {
+		if err := db.syncFile(db.activeFile); err != nil {
+			return err
+		}
+	}
+	db.metrics.reclaimedBytes.Add(uint64(db.blobGarbage[blobFile.FileId]))
+	delete(db.blobFiles, blobFile.FileId)
+	delete(db.blobGarbage, blobFile.FileId)
+	// 被快照引用的blob file会延迟到快照释放时关闭
+	if err := db.retireFile(blobFile); err != nil {
+		return err
+	}
+	if err := os.Remove(data.GetBlobFileNameById(db.opts.DirPath, blobFile.FileId)); err != nil {
+		return err
+	}
+	// follower中被回收的blob file不会被删除，需要重新全量同步
+	db.bumpReplicationGen()
+	return nil
+}
+
+// index仍然指向blobPos时，重新写入该value
+func (db *DB) rewriteBlob(blobRecord *data.LogRecord, blobPos *data.BlobPos) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	cf, ok := db.families[blobRecord.Family]
+	if !ok {
+		return nil
+	}
+	pos := cf.index.Get(blobRecord.Key)
+	if pos == nil || pos.Blob == nil || *pos.Blob != *blobPos {
+		return nil
+	}
+	// 已经过期的key与delete一样写入墓碑值后从index中移除，否则数据文件中的旧记录仍然指向即将删除的blob file
+	if pos.IsExpired(time.Now().UnixNano()) {
+		logRecord := &data.LogRecord{Key: serializeKeyId(blobRecord.Key, zeroWbId), Typ: data.LogRecordDeleted, Family: cf.id}
+		deletedPos, err := db.appendLogRecord(logRecord)
+		if err != nil {
+			return err
+		}
+		cf.addInvalidSize(int64(deletedPos.RecordSize))
+		cf.index.Delete(blobRecord.Key)
+		cf.addInvalidSize(int64(pos.RecordSize))
+		db.discardLiveSize(pos)
+		return nil
+	}
+	// 与普通的写入相同，value仍然超过阈值时会被写入活跃的blob file
+	newPos, err := db.appendLogRecord(&data.LogRecord{
+		Key:    serializeKeyId(blobRecord.Key, zeroWbId),
+		Value:  blobRecord.Value,
+		Typ:    data.LogRecordNormal,
+		Expire: pos.Expire,
+		Family: cf.id,
+	})
+	if err != nil {
+		return err
+	}
+	if ok, _ := cf.index.Put(blobRecord.Key, newPos); !ok {
+		return ErrUpdateIndexFailed
+	}
+	db.addLiveSize(newPos)
+	// 旧的记录变为无效数据，旧的blob file即将被删除，不需要统计
+	cf.addInvalidSize(int64(pos.RecordSize))
+	db.discardLiveSize(pos)
+	return nil
+}
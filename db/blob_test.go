@@ -0,0 +1,267 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"kv-go/data"
+	"kv-go/utils"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 所有blob file的大小与无效数据量
+func blobSizes(db *DB) (int64, int64) {
+	var size, garbage int64 = 0, 0
+	for _, stat := range db.BlobStat() {
+		size += stat.Size
+		garbage += stat.GarbageSize
+	}
+	return size, garbage
+}
+
+func TestBlobSeparation(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-blob")
+	opts.BlobThreshold = 256
+	opts.BlobFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	cnt := 200
+	large, small := utils.GetTestValue(4096), utils.GetTestValue(16)
+	{
+		// 较大的value被写入blob file，数据文件中只保存位置
+		for i := 0; i < cnt; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), large))
+		}
+		assert.Nil(t, db.Put(utils.GetTestKey(cnt), small))
+		assert.Less(t, db.activeFile.WriteOff, int64(cnt*100))
+		stat, err := db.Stat()
+		assert.Nil(t, err)
+		assert.Greater(t, stat.BlobFileNum, int64(10))
+		assert.Equal(t, int64(0), stat.BlobGarbageSize)
+		pos := db.index.Get(utils.GetTestKey(1))
+		assert.NotNil(t, pos.Blob)
+		assert.Nil(t, db.index.Get(utils.GetTestKey(cnt)).Blob)
+
+		// Get、迭代器与Fold透明地读取blob file中的value
+		val, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, large, val)
+		iter := db.NewIterator(DefaultItOptions)
+		iter.Seek(utils.GetTestKey(2))
+		val, err = iter.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, large, val)
+		iter.Close()
+		num := 0
+		assert.Nil(t, db.Fold(func(key []byte, val []byte) bool {
+			num++
+			return len(val) == len(large) || bytes.Equal(val, small)
+		}))
+		assert.Equal(t, cnt+1, num)
+	}
+
+	{
+		// 覆盖与删除使blob file中的value失效
+		for i := 0; i < cnt/2; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), small))
+		}
+		assert.Nil(t, db.Delete(utils.GetTestKey(cnt/2)))
+		size, garbage := blobSizes(db)
+		assert.Greater(t, garbage, size/2)
+
+		// 重启后根据index重新统计无效数据
+		assert.Nil(t, db.Close())
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		reopenSize, reopenGarbage := blobSizes(db)
+		assert.Equal(t, size, reopenSize)
+		assert.Equal(t, garbage, reopenGarbage)
+	}
+
+	{
+		// blob GC回收无效数据，快照仍然能读取被回收的blob file
+		snap, err := db.Snapshot()
+		assert.Nil(t, err)
+		gen := db.replication.gen
+		assert.Nil(t, db.BlobGC(context.Background()))
+		// 删除了blob file，follower需要重新全量同步
+		assert.Greater(t, db.replication.gen, gen)
+		size, garbage := blobSizes(db)
+		assert.Less(t, size, int64((cnt/2)*len(large)))
+		assert.Less(t, garbage, size/2)
+		for i := 0; i <= cnt; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			if i == cnt/2 {
+				assert.Equal(t, ErrKeyNotFound, err)
+			} else if i < cnt/2 || i == cnt {
+				assert.Nil(t, err)
+				assert.Equal(t, small, val)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, large, val)
+			}
+		}
+		moved := 0
+		for i := cnt/2 + 1; i < cnt; i++ {
+			if *snap.index.Get(utils.GetTestKey(i)).Blob == *db.index.Get(utils.GetTestKey(i)).Blob {
+				continue
+			}
+			moved++
+			val, err := snap.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, large, val)
+		}
+		assert.Greater(t, moved, 0)
+		assert.Nil(t, snap.Close())
+
+		assert.Nil(t, db.Close())
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		val, err := db.Get(utils.GetTestKey(cnt - 1))
+		assert.Nil(t, err)
+		assert.Equal(t, large, val)
+		reopenSize, reopenGarbage := blobSizes(db)
+		assert.Equal(t, size, reopenSize)
+		assert.Equal(t, garbage, reopenGarbage)
+	}
+}
+
+func TestBlobGCExpired(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("/tmp", "test-blob-gc-expired")
+	opts.BlobThreshold = 256
+	opts.BlobFileSize = 16 * 1024
+	opts.BlobGCRatio = 0
+	db, err := Open(opts)
+	defer func() { destoryDB(db) }()
+	assert.Nil(t, err)
+	{
+		// 过期的key在blob GC时写入墓碑值，重启后不会指向已经删除的blob file
+		large := utils.GetTestValue(4096)
+		cnt := 10
+		for i := 0; i < cnt; i++ {
+			assert.Nil(t, db.PutWithTTL(utils.GetTestKey(i), large, 100*time.Millisecond))
+		}
+		for i := cnt; i < 2*cnt; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), large))
+		}
+		time.Sleep(150 * time.Millisecond)
+		assert.Nil(t, db.BlobGC(context.Background()))
+
+		deleted := make(map[string]bool)
+		var off int64 = 0
+		for {
+			logRecord, sz, err := db.activeFile.ReadLogRecord(off)
+			if err != nil {
+				break
+			}
+			off += sz
+			if logRecord.Typ == data.LogRecordDeleted {
+				realKey, _ := parseKeyId(logRecord.Key)
+				deleted[string(realKey)] = true
+			}
+		}
+		for i := 0; i < cnt; i++ {
+			// 活跃的blob file不参与回收
+			if pos := db.index.Get(utils.GetTestKey(i)); pos == nil {
+				assert.True(t, deleted[string(utils.GetTestKey(i))])
+			}
+		}
+		assert.Greater(t, len(deleted), 0)
+
+		assert.Nil(t, db.Close())
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < 2*cnt; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			if i < cnt {
+				assert.Equal(t, ErrKeyNotFound, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, large, val)
+			}
+		}
+	}
+}
+
+func TestBlobMerge(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-blob-merge")
+	opts.BlobThreshold = 256
+	opts.BlobFileSize = 64 * 1024
+	opts.MergeRatio = 0
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	cnt := 100
+	large := utils.GetTestValue(4096)
+	for i := 0; i < cnt; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), large))
+	}
+	// WriteBatch与column family中较大的value同样被分离
+	wb := db.NewWriteBatch(DefaultWBOptions)
+	assert.Nil(t, wb.Put(utils.GetTestKey(cnt), large))
+	assert.Nil(t, wb.Commit())
+	cf, err := db.CreateColumnFamily("blob")
+	assert.Nil(t, err)
+	assert.Nil(t, cf.Put([]byte("cf-key"), large))
+	for i := 0; i < cnt; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(cnt+1), utils.GetTestValue(16)))
+	}
+	sizeBefore, _ := blobSizes(db)
+
+	// merge只重写数据文件中指向blob file的记录，不会重写value
+	assert.Nil(t, db.Merge(context.Background()))
+	size, garbage := blobSizes(db)
+	assert.Equal(t, sizeBefore, size)
+	assert.Equal(t, int64(0), garbage)
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i <= cnt; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, large, val)
+	}
+	cf, err = db.ColumnFamily("blob")
+	assert.Nil(t, err)
+	val, err := cf.Get([]byte("cf-key"))
+	assert.Nil(t, err)
+	assert.Equal(t, large, val)
+
+	// 删除column family后，其中的value都变为无效数据
+	assert.Nil(t, db.DropColumnFamily("blob"))
+	_, garbage = blobSizes(db)
+	assert.Greater(t, garbage, int64(len(large)))
+
+	// 关闭分离后，blob GC将有效的value写回数据文件
+	assert.Nil(t, db.Close())
+	opts.BlobThreshold = 0
+	opts.BlobGCRatio = 0
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.BlobGC(context.Background()))
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), stat.BlobFileNum)
+	val, err = db.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, large, val)
+	assert.Nil(t, db.index.Get(utils.GetTestKey(0)).Blob)
+
+	// 非法的blob配置
+	badOpts := DefaultDBOptions
+	badOpts.DirPath = opts.DirPath
+	badOpts.BlobThreshold = -1
+	_, err = Open(badOpts)
+	assert.Equal(t, ErrInvalidBlobOptions, err)
+	badOpts.BlobThreshold = 256
+	badOpts.BlobGCRatio = 2
+	_, err = Open(badOpts)
+	assert.Equal(t, ErrInvalidBlobOptions, err)
+}
@@ -0,0 +1,246 @@
+package db
+
+import (
+	"bytes"
+	"container/list"
+	"kv-go/data"
+	"math/bits"
+	"sync"
+)
+
+// 缓存中每个条目除value以外的内存开销估计(Byte)
+const cacheEntryOverhead = 96
+
+// 缓存的key，数据文件与blob file的id是分开分配的
+type cacheKey struct {
+	blob   bool
+	fid    uint32
+	offset int64
+}
+
+func newCacheKey(logRecordPos *data.LogRecordPos) cacheKey {
+	if blob := logRecordPos.Blob; blob != nil {
+		return cacheKey{blob: true, fid: blob.Fid, offset: blob.Offset}
+	}
+	return cacheKey{fid: logRecordPos.Fid, offset: logRecordPos.Offset}
+}
+
+// 缓存条目所在的区域
+const (
+	cacheWindow = iota
+	cacheProbation
+	cacheProtected
+)
+
+type cacheEntry struct {
+	key     cacheKey
+	value   []byte
+	segment int
+}
+
+func (e *cacheEntry) cost() int64 {
+	return int64(len(e.value)) + cacheEntryOverhead
+}
+
+// 按LogRecordPos缓存value，使用W-TinyLFU淘汰策略：
+// 新的value先进入很小的LRU窗口，被挤出窗口后与主区域中最久未访问的value比较访问频率，频率更高的才能留在缓存中，
+// 所以Fold与迭代器的一次性扫描不会把热点数据挤出缓存。主区域是分段LRU，再次命中的value从probation晋升到protected
+// 同一个位置上的记录不会改变，只有merge会复用文件id，所以merge之后需要清空缓存
+type valueCache struct {
+	mu           sync.Mutex
+	capacity     int64
+	windowCap    int64 // 窗口区域的容量，占总容量的1%
+	protectedCap int64 // protected区域的容量，占主区域的80%
+	lists        [3]*list.List
+	sizes        [3]int64
+	items        map[cacheKey]*list.Element
+	sketch       *countMinSketch
+	hits         uint64
+	misses       uint64
+	evictions    uint64
+}
+
+func newValueCache(capacity int64) *valueCache {
+	c := &valueCache{
+		capacity:  capacity,
+		windowCap: max(capacity/100, 1),
+		items:     make(map[cacheKey]*list.Element),
+		// 按平均每个条目1KB估计条目数量
+		sketch: newCountMinSketch(capacity / 1024),
+	}
+	c.protectedCap = (capacity - c.windowCap) * 8 / 10
+	for i := range c.lists {
+		c.lists[i] = list.New()
+	}
+	return c
+}
+
+// 获取缓存的value，返回的是副本，调用者可以修改
+func (c *valueCache) get(key cacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sketch.increment(key)
+	elem, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	entry := elem.Value.(*cacheEntry)
+	switch entry.segment {
+	case cacheWindow, cacheProtected:
+		c.lists[entry.segment].MoveToFront(elem)
+	case cacheProbation:
+		// 再次命中后晋升到protected，protected超出容量时把最久未访问的降级回probation
+		c.move(elem, cacheProtected)
+		for c.sizes[cacheProtected] > c.protectedCap {
+			c.move(c.lists[cacheProtected].Back(), cacheProbation)
+		}
+	}
+	return bytes.Clone(entry.value), true
+}
+
+// 把刚从磁盘读取的value放入窗口区域，value会被复制
+func (c *valueCache) put(key cacheKey, value []byte) {
+	entry := &cacheEntry{key: key, value: bytes.Clone(value), segment: cacheWindow}
+	if entry.cost() > c.capacity-c.windowCap {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[key]; ok {
+		return
+	}
+	c.items[key] = c.lists[cacheWindow].PushFront(entry)
+	c.sizes[cacheWindow] += entry.cost()
+	// 被挤出窗口的value尝试进入主区域
+	for c.sizes[cacheWindow] > c.windowCap {
+		c.admit(c.lists[cacheWindow].Back())
+	}
+}
+
+// 主区域已满时，候选者的访问频率高于主区域中最久未访问的value才能进入
+func (c *valueCache) admit(candidate *list.Element) {
+	candidateEntry := candidate.Value.(*cacheEntry)
+	mainCap := c.capacity - c.windowCap
+	for c.sizes[cacheProbation]+c.sizes[cacheProtected]+candidateEntry.cost() > mainCap {
+		victim := c.lists[cacheProbation].Back()
+		if victim == nil {
+			victim = c.lists[cacheProtected].Back()
+		}
+		if c.sketch.estimate(candidateEntry.key) <= c.sketch.estimate(victim.Value.(*cacheEntry).key) {
+			c.remove(candidate)
+			return
+		}
+		c.remove(victim)
+	}
+	c.move(candidate, cacheProbation)
+}
+
+// 把条目移动到另一个区域的头部
+func (c *valueCache) move(elem *list.Element, segment int) {
+	entry := elem.Value.(*cacheEntry)
+	c.lists[entry.segment].Remove(elem)
+	c.sizes[entry.segment] -= entry.cost()
+	entry.segment = segment
+	c.items[entry.key] = c.lists[segment].PushFront(entry)
+	c.sizes[segment] += entry.cost()
+}
+
+func (c *valueCache) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	c.lists[entry.segment].Remove(elem)
+	c.sizes[entry.segment] -= entry.cost()
+	delete(c.items, entry.key)
+	c.evictions++
+}
+
+// 清空缓存，访问频率的统计与命中率统计保留
+func (c *valueCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.lists {
+		c.lists[i].Init()
+		c.sizes[i] = 0
+	}
+	c.items = make(map[cacheKey]*list.Element)
+}
+
+func (c *valueCache) stat() CacheStat {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStat{
+		Capacity:  c.capacity,
+		Size:      c.sizes[cacheWindow] + c.sizes[cacheProbation] + c.sizes[cacheProtected],
+		Entries:   len(c.items),
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+// CacheStat value缓存的统计信息
+type CacheStat struct {
+	Capacity  int64  // 缓存的容量(Byte)
+	Size      int64  // 缓存占用的内存(Byte)，包含估计的条目开销
+	Entries   int    // 缓存的value数量
+	Hits      uint64 // 命中次数
+	Misses    uint64 // 未命中次数
+	Evictions uint64 // 被淘汰或者没有被接纳的value数量
+}
+
+// 用4行4位计数器估计key的访问频率，计数总数达到阈值后所有计数减半，使过去的热点逐渐冷却
+type countMinSketch struct {
+	rows      [4][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+func newCountMinSketch(entries int64) *countMinSketch {
+	width := uint64(1) << bits.Len64(uint64(min(max(entries, 64), 1<<24)-1))
+	s := &countMinSketch{mask: width - 1, resetAt: int(width) * 10}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+var sketchSeeds = [4]uint64{0xc3a5c85c97cb3127, 0xb492b66fbe98f273, 0x9ae16a3b2f90404f, 0xcbf29ce484222325}
+
+// 每一行使用不同的种子计算计数器的位置
+func (s *countMinSketch) index(key cacheKey, row int) uint64 {
+	h := uint64(key.offset)*0x9e3779b97f4a7c15 ^ uint64(key.fid)<<1 ^ sketchSeeds[row]
+	if key.blob {
+		h ^= 1
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return h & s.mask
+}
+
+func (s *countMinSketch) increment(key cacheKey) {
+	for i := range s.rows {
+		if idx := s.index(key, i); s.rows[i][idx] < 15 {
+			s.rows[i][idx]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAt {
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] >>= 1
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+func (s *countMinSketch) estimate(key cacheKey) uint8 {
+	freq := uint8(15)
+	for i := range s.rows {
+		freq = min(freq, s.rows[i][s.index(key, i)])
+	}
+	return freq
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"kv-go/utils"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValueCache(t *testing.T) {
+	c := newValueCache(64 * 1024)
+	value := make([]byte, 1024-cacheEntryOverhead)
+	key := func(i int) cacheKey { return cacheKey{fid: 1, offset: int64(i) * 1024} }
+
+	// 热点数据被反复访问
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 32; i++ {
+			if _, ok := c.get(key(i)); !ok {
+				c.put(key(i), value)
+			}
+		}
+	}
+	// 一次性扫描大量数据不会把热点数据挤出缓存
+	for i := 1000; i < 5000; i++ {
+		if _, ok := c.get(key(i)); !ok {
+			c.put(key(i), value)
+		}
+	}
+	hot := 0
+	for i := 0; i < 32; i++ {
+		if _, ok := c.get(key(i)); ok {
+			hot++
+		}
+	}
+	assert.True(t, hot >= 30)
+	stat := c.stat()
+	assert.True(t, stat.Size <= stat.Capacity)
+	assert.True(t, stat.Evictions > 0)
+	assert.True(t, stat.Hits > 0)
+
+	// 返回的是副本
+	got, ok := c.get(key(0))
+	assert.True(t, ok)
+	got[0] = 1
+	got, _ = c.get(key(0))
+	assert.Equal(t, byte(0), got[0])
+
+	// 超过容量的value不会被缓存
+	c.put(key(10000), make([]byte, 64*1024))
+	_, ok = c.get(key(10000))
+	assert.False(t, ok)
+
+	c.clear()
+	_, ok = c.get(key(0))
+	assert.False(t, ok)
+	assert.Equal(t, 0, c.stat().Entries)
+	assert.Equal(t, int64(0), c.stat().Size)
+}
+
+func TestDBValueCache(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.ValueCacheSize = -1
+	_, err := Open(opts)
+	assert.Equal(t, ErrInvalidValueCacheSize, err)
+
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-value-cache")
+	opts.DataFileSize = 32 * 1024
+	opts.ValueCacheSize = 1024 * 1024
+	opts.MergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destoryDB(db)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 500; i++ {
+		values[i] = utils.GetTestValue(128)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 10; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, values[i], val)
+		}
+	}
+	metrics, err := db.Metrics()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(20), metrics.ValueCache.Hits)
+	assert.Equal(t, uint64(10), metrics.ValueCache.Misses)
+	readBytes := metrics.BytesRead
+
+	// 命中缓存时不读取磁盘，修改返回的value不影响缓存
+	val, err := db.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	val[0] ^= 0xff
+	vals, errs := db.MultiGet([][]byte{utils.GetTestKey(0), utils.GetTestKey(1)})
+	assert.Nil(t, errs[0])
+	assert.Equal(t, values[0], vals[0])
+	assert.Equal(t, values[1], vals[1])
+	metrics, err = db.Metrics()
+	assert.Nil(t, err)
+	assert.Equal(t, readBytes, metrics.BytesRead)
+
+	// merge复用了文件id，之后读到的仍然是正确的value
+	for i := 0; i < 500; i += 2 {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	for i := 1; i < 500; i += 2 {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Merge(context.Background()))
+	metrics, err = db.Metrics()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, metrics.ValueCache.Entries)
+	for i := 1; i < 500; i += 2 {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], val)
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, db.WritePrometheus(&buf))
+	assert.True(t, strings.Contains(buf.String(), "# TYPE bitcask_value_cache_hits_total counter\n"))
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"bytes"
+	"io"
+	"kv-go/data"
+	"kv-go/index"
+	"os"
+	"path/filepath"
+)
+
+// 检查点中需要复制的文件，其余文件都以硬链接的方式创建
+type checkpointCopy struct {
+	name string
+	file *data.DataFile
+	size int64
+}
+
+// Checkpoint 在dir中创建数据库的检查点，dir可以直接作为数据目录被Open
+// 封存的文件不会再被修改，以硬链接的方式创建，只有活跃文件会被复制，因此dir必须与数据目录在同一个文件系统中
+func (db *DB) Checkpoint(dir string) error {
+	// B+树的index由bbolt持有，无法在不阻塞写入的情况下得到一致的副本
+	if db.opts.Indexer == index.BPlusTreeType {
+		return ErrCheckpointUnsupported
+	}
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return ErrCheckpointDirNotEmpty
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	copies, err := db.linkCheckpointFiles(dir)
+	if err == nil {
+		err = db.copyCheckpointFiles(dir, copies)
+	}
+	if err != nil {
+		_ = os.RemoveAll(dir)
+	}
+	return err
+}
+
+// 持有锁时创建硬链接，并引用需要复制的活跃文件
+func (db *DB) linkCheckpointFiles(dir string) ([]*checkpointCopy, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// 活跃文件在Open检查点时会被继续写入，不能与数据目录共享
+	var copies []*checkpointCopy
+	if db.activeFile != nil {
+		copies = append(copies, &checkpointCopy{
+			name: filepath.Base(data.GetDataFileNameById(db.opts.DirPath, db.activeFile.FileId)),
+			file: db.activeFile,
+			size: db.activeFile.WriteOff,
+		})
+	}
+	// id最大的blob file在Open检查点时会作为活跃的blob file
+	var maxBlobId uint32
+	for fileId := range db.blobFiles {
+		maxBlobId = max(maxBlobId, fileId)
+	}
+	for fileId, blobFile := range db.blobFiles {
+		if fileId == maxBlobId || blobFile == db.activeBlobFile {
+			copies = append(copies, &checkpointCopy{
+				name: filepath.Base(data.GetBlobFileNameById(db.opts.DirPath, fileId)),
+				file: blobFile,
+				size: blobFile.WriteOff,
+			})
+			continue
+		}
+		if err := linkCheckpointFile(dir, data.GetBlobFileNameById(db.opts.DirPath, fileId)); err != nil {
+			return nil, err
+		}
+	}
+	// 封存的数据文件与对应的hint file
+	for fileId := range db.inActivaFile {
+		if err := linkCheckpointFile(dir, data.GetDataFileNameById(db.opts.DirPath, fileId)); err != nil {
+			return nil, err
+		}
+		hintFileName := data.GetFileHintNameById(db.opts.DirPath, fileId)
+		if _, err := os.Stat(hintFileName); err == nil {
+			if err := linkCheckpointFile(dir, hintFileName); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// merge生成的hint file与finish file需要一起存在
+	mergeFinishedFileName := filepath.Join(db.opts.DirPath, data.MergeFilishedFileName)
+	if _, err := os.Stat(mergeFinishedFileName); err == nil {
+		if err := linkCheckpointFile(dir, filepath.Join(db.opts.DirPath, data.HintFileName)); err != nil {
+			return nil, err
+		}
+		if err := linkCheckpointFile(dir, mergeFinishedFileName); err != nil {
+			return nil, err
+		}
+	}
+	// column family信息较小，直接复制
+	contents, err := os.ReadFile(filepath.Join(db.opts.DirPath, data.FamilyFileName))
+	if err == nil {
+		_, err = copyBackupFile(filepath.Join(dir, data.FamilyFileName), bytes.NewReader(contents), int64(len(contents)))
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, c := range copies {
+		db.fileRefs[c.file]++
+	}
+	return copies, nil
+}
+
+func linkCheckpointFile(dir string, fileName string) error {
+	return os.Link(fileName, filepath.Join(dir, filepath.Base(fileName)))
+}
+
+// 释放锁后复制活跃文件中已经写入的部分，这部分数据不会再被修改
+func (db *DB) copyCheckpointFiles(dir string, copies []*checkpointCopy) error {
+	defer func() {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		for _, c := range copies {
+			_ = db.releaseFile(c.file)
+		}
+	}()
+	for _, c := range copies {
+		reader := io.NewSectionReader(ioManagerReaderAt{c.file}, 0, c.size)
+		if _, err := copyBackupFile(filepath.Join(dir, c.name), reader, c.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"context"
+	"kv-go/data"
+	"kv-go/utils"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpoint(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-checkpoint")
+	opts.DataFileSize = 64 * 1024
+	opts.MergeRatio = 0
+	opts.BlobThreshold = 1024
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	dir, _ := os.MkdirTemp("", "KeyCache-test-checkpoint-dest")
+	defer os.RemoveAll(dir)
+
+	vals := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		size := 128
+		if i%100 == 0 {
+			size = 2048
+		}
+		vals[string(utils.GetTestKey(i))] = utils.GetTestValue(size)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), vals[string(utils.GetTestKey(i))]))
+	}
+	for i := 0; i < 500; i += 2 {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		delete(vals, string(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge(context.Background()))
+	cf, err := db.CreateColumnFamily("cf")
+	assert.Nil(t, err)
+	assert.Nil(t, cf.Put([]byte("cf-key"), []byte("cf-val")))
+	for i := 1000; i < 1100; i++ {
+		vals[string(utils.GetTestKey(i))] = utils.GetTestValue(128)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), vals[string(utils.GetTestKey(i))]))
+	}
+	{
+		// 检查点不能覆盖非空目录
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, "file"), nil, os.ModePerm))
+		assert.Equal(t, ErrCheckpointDirNotEmpty, db.Checkpoint(dir))
+		assert.Nil(t, os.Remove(filepath.Join(dir, "file")))
+	}
+	cpOpts := opts
+	cpOpts.DirPath = filepath.Join(dir, "checkpoint")
+	assert.Nil(t, db.Checkpoint(cpOpts.DirPath))
+	{
+		// 封存的数据文件与数据目录共享，活跃文件是独立的副本
+		for fileId := range db.inActivaFile {
+			name := filepath.Base(data.GetDataFileNameById(opts.DirPath, fileId))
+			src, err := os.Stat(filepath.Join(opts.DirPath, name))
+			assert.Nil(t, err)
+			dst, err := os.Stat(filepath.Join(cpOpts.DirPath, name))
+			assert.Nil(t, err)
+			assert.True(t, os.SameFile(src, dst))
+		}
+		name := filepath.Base(data.GetDataFileNameById(opts.DirPath, db.activeFile.FileId))
+		src, err := os.Stat(filepath.Join(opts.DirPath, name))
+		assert.Nil(t, err)
+		dst, err := os.Stat(filepath.Join(cpOpts.DirPath, name))
+		assert.Nil(t, err)
+		assert.False(t, os.SameFile(src, dst))
+	}
+	// 检查点之后的写入对检查点不可见，检查点中的写入也不影响数据库
+	assert.Nil(t, db.Put(utils.GetTestKey(1), utils.GetTestValue(128)))
+	cpDB, err := Open(cpOpts)
+	assert.Nil(t, err)
+	defer cpDB.Close()
+	{
+		assert.Equal(t, len(vals), len(cpDB.ListKeys(false)))
+		for key, val := range vals {
+			res, err := cpDB.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, val, res)
+		}
+		cpCf, err := cpDB.ColumnFamily("cf")
+		assert.Nil(t, err)
+		res, err := cpCf.Get([]byte("cf-key"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("cf-val"), res)
+
+		assert.Nil(t, cpDB.Put(utils.GetTestKey(2000), utils.GetTestValue(2048)))
+		assert.Nil(t, cpDB.Delete(utils.GetTestKey(999)))
+		_, err = db.Get(utils.GetTestKey(2000))
+		assert.Equal(t, ErrKeyNotFound, err)
+		res, err = db.Get(utils.GetTestKey(999))
+		assert.Nil(t, err)
+		assert.Equal(t, vals[string(utils.GetTestKey(999))], res)
+	}
+}
@@ -0,0 +1,111 @@
+package db
+
+import "sync"
+
+// 一次需要持久化的写入
+type commitRequest struct {
+	apply     writeFunc
+	readIndex bool         // apply是否需要读取index，需要先持久化并发布之前的写入
+	publish   func() error // apply返回的publish
+	err       error        // 写入或持久化的结果
+	lead      chan bool    // leader完成写入后发送false，需要接替leader时发送true
+}
+
+// 持有db.mu时追加记录，返回持久化之后更新index并通知订阅者的publish，没有需要发布的内容时publish为nil
+type writeFunc func() (publish func() error, err error)
+
+// group commit的等待队列，同一时刻只有一个leader，leader为队列中所有的写入追加记录，并且只持久化一次
+type commitQueue struct {
+	mu      sync.Mutex
+	pending []*commitRequest
+	leading bool
+}
+
+// 执行需要持有db.mu的写入，sync为true时与其他并发的写入合并持久化，持久化完成后才更新index并返回
+// readIndex表示apply会读取index，例如检查写入条件或key是否存在
+func (db *DB) write(apply writeFunc, readIndex bool, sync bool) error {
+	// follower只能通过复制写入
+	if db.isReplica {
+		return ErrReplicaReadOnly
+	}
+	if !sync {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		publish, err := apply()
+		if err != nil || publish == nil {
+			return err
+		}
+		return publish()
+	}
+	req := &commitRequest{apply: apply, readIndex: readIndex, lead: make(chan bool, 1)}
+	q := db.commitQueue
+	q.mu.Lock()
+	q.pending = append(q.pending, req)
+	if q.leading {
+		q.mu.Unlock()
+		// 等待leader完成写入，或者被上一个leader唤醒成为新的leader
+		if !<-req.lead {
+			return req.err
+		}
+		q.mu.Lock()
+	}
+	q.leading = true
+	group := q.pending
+	q.pending = nil
+	q.mu.Unlock()
+
+	db.commitGroup(group)
+
+	q.mu.Lock()
+	if len(q.pending) > 0 {
+		// leader期间到达的写入由其中第一个写入接替leader
+		q.pending[0].lead <- true
+	} else {
+		q.leading = false
+	}
+	q.mu.Unlock()
+	for _, r := range group {
+		if r != req {
+			r.lead <- false
+		}
+	}
+	return req.err
+}
+
+// 按照到达的顺序执行一组写入，所有记录追加完成后统一持久化一次，持久化成功后才更新index并通知订阅者
+// 持久化失败时这些写入都返回该错误，且不会被读取到；需要读取index的写入会先持久化并发布之前的写入
+func (db *DB) commitGroup(group []*commitRequest) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// 已经追加了记录，等待持久化的写入
+	var appended []*commitRequest
+	flush := func() {
+		if len(appended) == 0 {
+			return
+		}
+		err := db.syncBlobFile()
+		if err == nil {
+			err = db.syncFile(db.activeFile)
+		}
+		for _, req := range appended {
+			if err != nil {
+				req.err = err
+			} else if req.publish != nil {
+				req.err = req.publish()
+			}
+		}
+		appended = appended[:0]
+	}
+	db.inGroupCommit = true
+	for _, req := range group {
+		if req.readIndex {
+			flush()
+		}
+		req.publish, req.err = req.apply()
+		if req.err == nil {
+			appended = append(appended, req)
+		}
+	}
+	db.inGroupCommit = false
+	flush()
+}
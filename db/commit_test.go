@@ -0,0 +1,168 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"kv-go/fio"
+	"kv-go/utils"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupCommit(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-group-commit")
+	opts.AlwaysSync = true
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+
+	// 并发的Put、Delete、条件写入、WriteBatch与事务被合并持久化
+	workers, cnt := 16, 50
+	// GetTestValue不是并发安全的
+	value := utils.GetTestValue(64)
+	var absentOk int32
+	wg := new(sync.WaitGroup)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < cnt; i++ {
+				key := utils.GetTestKey(w*cnt + i)
+				assert.Nil(t, db.Put(key, value))
+				if i%5 == 0 {
+					assert.Nil(t, db.Delete(key))
+				}
+			}
+			if db.PutIfAbsent([]byte("absent"), value) == nil {
+				atomic.AddInt32(&absentOk, 1)
+			}
+			wb := db.NewWriteBatch(WBOptions{Sync: false, MaxWriteNum: 100})
+			for i := 0; i < 10; i++ {
+				assert.Nil(t, wb.Put(utils.GetTestKey(workers*cnt+w*10+i), value))
+			}
+			assert.Nil(t, wb.Commit())
+			txn, err := db.Begin()
+			assert.Nil(t, err)
+			assert.Nil(t, txn.Put([]byte("txn"), value))
+			_ = txn.Commit()
+		}(w)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), absentOk)
+
+	checkData := func(db *DB) {
+		for i := 0; i < workers*cnt; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			if i%cnt%5 == 0 {
+				assert.Equal(t, ErrKeyNotFound, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		}
+		for i := workers * cnt; i < workers*cnt+workers*10; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+		_, err := db.Get([]byte("txn"))
+		assert.Nil(t, err)
+	}
+	checkData(db)
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	checkData(db)
+	assert.Nil(t, db.Close())
+}
+
+// 持久化总是失败的IOManager
+type failSyncIOManager struct {
+	fio.IOManager
+}
+
+var errSyncFailed = errors.New("sync failed")
+
+func (m failSyncIOManager) Sync() error {
+	return errSyncFailed
+}
+
+func TestGroupCommitSyncFailure(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("/tmp", "test-group-commit-sync-failure")
+	opts.AlwaysSync = true
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(0), utils.GetTestValue(32)))
+	ch, err := db.Watch(context.Background(), nil)
+	assert.Nil(t, err)
+
+	// 持久化失败时，写入返回错误，既不能被读取到也不会通知订阅者
+	ioManager := db.activeFile.IOManager
+	db.activeFile.IOManager = failSyncIOManager{ioManager}
+	assert.Equal(t, errSyncFailed, db.Put(utils.GetTestKey(1), utils.GetTestValue(32)))
+	assert.Equal(t, errSyncFailed, db.Delete(utils.GetTestKey(0)))
+	wb := db.NewWriteBatch(DefaultWBOptions)
+	assert.Nil(t, wb.Put(utils.GetTestKey(2), utils.GetTestValue(32)))
+	assert.Equal(t, errSyncFailed, wb.Commit())
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	select {
+	case events := <-ch:
+		t.Fatalf("unexpected events %v", events)
+	default:
+	}
+
+	// 持久化恢复后写入正常
+	db.activeFile.IOManager = ioManager
+	assert.Nil(t, db.Put(utils.GetTestKey(1), utils.GetTestValue(32)))
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	events := receiveEvents(t, ch)
+	assert.Equal(t, utils.GetTestKey(1), events[0].Key)
+}
+
+func BenchmarkGroupCommit(b *testing.B) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-bench-group-commit")
+	defer os.RemoveAll(opts.DirPath)
+	opts.AlwaysSync = true
+	db, err := Open(opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	value := utils.GetTestValue(512)
+
+	// 单个写入者每次写入都需要等待一次fsync
+	b.Run("serial", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := db.Put(utils.GetTestKey(i), value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	// 并发的写入者共享一次fsync
+	b.Run("parallel", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetParallelism(64)
+		var n int64
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if err := db.Put(utils.GetTestKey(int(atomic.AddInt64(&n, 1))), value); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	})
+}
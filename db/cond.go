@@ -0,0 +1,54 @@
+package db
+
+import (
+	"bytes"
+	"time"
+)
+
+// condition 条件写入的条件，在db.mu中与追加记录一起检查，保证检查与写入的原子性
+// 已经过期的key视为不存在
+type condition struct {
+	absent   bool   // 要求key不存在
+	expected []byte // absent为false时，要求key存在且value等于expected
+}
+
+// 检查key是否满足写入条件，调用者需要持有db.mu
+func (cf *ColumnFamily) checkCondition(key []byte, cond *condition) error {
+	if cond == nil {
+		return nil
+	}
+	logRecordPos := cf.index.Get(key)
+	exists := logRecordPos != nil && !logRecordPos.IsExpired(time.Now().UnixNano())
+	if cond.absent {
+		if exists {
+			return ErrConditionFailed
+		}
+		return nil
+	}
+	if !exists {
+		return ErrConditionFailed
+	}
+	val, err := cf.db.GetValueByPos(logRecordPos)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(val, cond.expected) {
+		return ErrConditionFailed
+	}
+	return nil
+}
+
+// PutIfAbsent key不存在时才写入，key已经存在时返回ErrConditionFailed
+func (db *DB) PutIfAbsent(key []byte, value []byte) error {
+	return db.defaultFamily.put(key, value, 0, &condition{absent: true})
+}
+
+// CompareAndSwap key当前的value等于oldValue时才替换为newValue，否则返回ErrConditionFailed
+func (db *DB) CompareAndSwap(key []byte, oldValue []byte, newValue []byte) error {
+	return db.defaultFamily.put(key, newValue, 0, &condition{expected: oldValue})
+}
+
+// CompareAndDelete key当前的value等于oldValue时才删除，否则返回ErrConditionFailed
+func (db *DB) CompareAndDelete(key []byte, oldValue []byte) error {
+	return db.defaultFamily.delete(key, &condition{expected: oldValue})
+}
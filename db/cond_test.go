@@ -0,0 +1,153 @@
+package db
+
+import (
+	"kv-go/utils"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPutIfAbsent(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-put-if-absent")
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	{
+		// key存在时不会覆盖，过期的key视为不存在
+		val := utils.GetTestValue(128)
+		assert.Nil(t, db.PutIfAbsent(utils.GetTestKey(1), val))
+		assert.Equal(t, ErrConditionFailed, db.PutIfAbsent(utils.GetTestKey(1), utils.GetTestValue(128)))
+		res, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, val, res)
+
+		assert.Nil(t, db.PutWithTTL(utils.GetTestKey(2), utils.GetTestValue(128), 50*time.Millisecond))
+		time.Sleep(100 * time.Millisecond)
+		assert.Nil(t, db.PutIfAbsent(utils.GetTestKey(2), val))
+		res, err = db.Get(utils.GetTestKey(2))
+		assert.Nil(t, err)
+		assert.Equal(t, val, res)
+		assert.Equal(t, ErrEmptyKey, db.PutIfAbsent(nil, val))
+	}
+
+	{
+		// 并发插入同一个key，只有一个能成功
+		succ := 0
+		mu, wg := new(sync.Mutex), new(sync.WaitGroup)
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if db.PutIfAbsent([]byte("lock"), []byte(strconv.Itoa(i))) == nil {
+					mu.Lock()
+					succ++
+					mu.Unlock()
+				}
+			}(i)
+		}
+		wg.Wait()
+		assert.Equal(t, 1, succ)
+	}
+}
+
+func TestCompareAndSwapDelete(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-cas")
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	{
+		// value不匹配或key不存在时失败
+		key := []byte("counter")
+		assert.Equal(t, ErrConditionFailed, db.CompareAndSwap(key, []byte("0"), []byte("1")))
+		assert.Nil(t, db.Put(key, []byte("0")))
+		assert.Equal(t, ErrConditionFailed, db.CompareAndSwap(key, []byte("1"), []byte("2")))
+		assert.Nil(t, db.CompareAndSwap(key, []byte("0"), []byte("1")))
+
+		assert.Equal(t, ErrConditionFailed, db.CompareAndDelete(key, []byte("0")))
+		assert.Nil(t, db.CompareAndDelete(key, []byte("1")))
+		_, err := db.Get(key)
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.Equal(t, ErrConditionFailed, db.CompareAndDelete(key, []byte("1")))
+	}
+
+	{
+		// 多个线程使用CompareAndSwap对计数器加一，最终结果应该是准确的
+		key := []byte("counter")
+		assert.Nil(t, db.Put(key, []byte("0")))
+		workers, cnt := 8, 100
+		wg := new(sync.WaitGroup)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < cnt; i++ {
+					for {
+						val, err := db.Get(key)
+						assert.Nil(t, err)
+						n, _ := strconv.Atoi(string(val))
+						err = db.CompareAndSwap(key, val, []byte(strconv.Itoa(n+1)))
+						if err == ErrConditionFailed {
+							continue
+						}
+						assert.Nil(t, err)
+						break
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		val, err := db.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, strconv.Itoa(workers*cnt), string(val))
+	}
+}
+
+func TestBatchCondition(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-batch-cond")
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	{
+		// 任意条件不满足时，整个批次都不会写入
+		assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("a")))
+		assert.Nil(t, db.Put(utils.GetTestKey(2), []byte("b")))
+		wb := db.NewWriteBatch(DefaultWBOptions)
+		assert.Nil(t, wb.PutIfAbsent(utils.GetTestKey(3), []byte("c")))
+		assert.Nil(t, wb.CompareAndSwap(utils.GetTestKey(1), []byte("a"), []byte("aa")))
+		assert.Nil(t, wb.CompareAndDelete(utils.GetTestKey(2), []byte("x")))
+		assert.Equal(t, ErrConditionFailed, wb.Commit())
+		val, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("a"), val)
+		_, err = db.Get(utils.GetTestKey(3))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		// 条件满足后提交成功
+		assert.Nil(t, wb.CompareAndDelete(utils.GetTestKey(2), []byte("b")))
+		assert.Nil(t, wb.Commit())
+		val, err = db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("aa"), val)
+		_, err = db.Get(utils.GetTestKey(2))
+		assert.Equal(t, ErrKeyNotFound, err)
+		val, err = db.Get(utils.GetTestKey(3))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("c"), val)
+
+		// 之后的普通写入会覆盖同一个key的条件
+		wb = db.NewWriteBatch(DefaultWBOptions)
+		assert.Nil(t, wb.PutIfAbsent(utils.GetTestKey(3), []byte("d")))
+		assert.Nil(t, wb.Put(utils.GetTestKey(3), []byte("e")))
+		assert.Nil(t, wb.Commit())
+		val, err = db.Get(utils.GetTestKey(3))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("e"), val)
+	}
+}
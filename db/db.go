@@ -1,8 +1,8 @@
 package db
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"kv-go/data"
 	"kv-go/fio"
 	"kv-go/index"
@@ -13,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gofrs/flock"
 )
@@ -30,21 +31,51 @@ type DB struct {
 	mu             *sync.RWMutex             // 用于多线程并发安全
 	wbId           uint64                    // 用于支持原子写操作，表示事务id
 	isMerge        bool                      // 是否正在进行merge操作
+	mergeGen       uint64                    // merge替换数据文件的次数，merge复用了文件id，之前取得的位置可能指向其他记录
 	wbIdFileExists bool                      // wbIdFile是否存在
 	isInitial      bool                      // 是否第一次初始化数据目录
 	fileLock       *flock.Flock              // 用于保持进程互斥的文件锁
 	writeBytes     int64                     // 未持久化的字节数
 	invalidSize    int64                     // 更新导致的无效数据
+	liveSize       map[uint32]int64          // 每个数据文件中仍然被index引用的数据量
+	mergeCancel    context.CancelFunc        // 用于停止后台的自动merge
+	mergeWg        *sync.WaitGroup           // 用于等待后台的自动merge退出
+	fileRefs       map[*data.DataFile]int    // 数据文件被快照引用的次数
+	retiredFiles   map[*data.DataFile]bool   // 已经被merge替换，但仍被快照引用的数据文件
+	families       map[uint32]*ColumnFamily  // 所有column family，key为family id
+	defaultFamily  *ColumnFamily             // 默认的column family，使用db.index
+	nextFamilyId   uint32                    // 下一个可用的family id
+	cipher         *data.Cipher              // 加解密记录，为nil时不加密
+	blobFiles      map[uint32]*data.DataFile // 所有blob file，包括活跃的blob file
+	activeBlobFile *data.DataFile            // 当前写入的blob file
+	blobGarbage    map[uint32]int64          // 每个blob file中的无效数据量
+	isBlobGC       bool                      // 是否正在进行blob GC
+	hintWg         *sync.WaitGroup           // 用于等待后台生成hint file的协程退出
+	hintDisabled   bool                      // 是否禁止生成数据文件的hint file
+	unhintedFiles  []*data.DataFile          // 启动时没有hint file的不活跃文件
+	discarded      []DiscardedRange          // 启动时被丢弃的损坏数据
+	watchers       map[*watcher]struct{}     // 所有订阅者
+	watchSeq       uint64                    // 最后一个变更事件的序号
+	commitQueue    *commitQueue              // 等待group commit的写入
+	inGroupCommit  bool                      // leader是否正在执行一组写入，此时追加记录不会逐条持久化
+	replication    *replication              // 向follower发送记录的状态
+	isReplica      bool                      // 是否是follower的只读副本，只能通过复制写入
+	metrics        *metrics                  // 运行统计
+	valueCache     *valueCache               // value缓存，为nil时不缓存
 }
 
 type DBStat struct {
-	KeyNum      int64 // key的数量
-	DataFileNum int64 // 使用的数据文件数量
-	InvalidSize int64 // 无效数据量(Byte)
-	DiskSize    int64 // 占用磁盘的空间(Byte)
+	KeyNum          int64 // key的数量
+	DataFileNum     int64 // 使用的数据文件数量
+	InvalidSize     int64 // 无效数据量(Byte)
+	DiskSize        int64 // 占用磁盘的空间(Byte)
+	BlobFileNum     int64 // 使用的blob file数量
+	BlobGarbageSize int64 // blob file中的无效数据量(Byte)
 }
 
 func (db *DB) Stat() (*DBStat, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	dataFileNum := len(db.inActivaFile)
 	if db.activeFile != nil {
 		dataFileNum++
@@ -53,20 +84,71 @@ func (db *DB) Stat() (*DBStat, error) {
 	if err != nil {
 		return nil, err
 	}
+	// key的数量包含所有column family
+	var keyNum int64 = 0
+	for _, cf := range db.families {
+		keyNum += int64(cf.index.Size())
+	}
+	var blobGarbageSize int64 = 0
+	for _, garbage := range db.blobGarbage {
+		blobGarbageSize += garbage
+	}
 	return &DBStat{
-		KeyNum: int64(db.index.Size()),
-		DataFileNum: int64(dataFileNum),
-		InvalidSize: db.invalidSize,
-		DiskSize: diskSize,
+		KeyNum:          keyNum,
+		DataFileNum:     int64(dataFileNum),
+		InvalidSize:     db.invalidSize,
+		DiskSize:        diskSize,
+		BlobFileNum:     int64(len(db.blobFiles)),
+		BlobGarbageSize: blobGarbageSize,
 	}, nil
 }
 
-func (db *DB) BackUp(dir string) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	exclude := map[string]struct{}{}
-	exclude[fileLockName] = struct{}{}
-	return utils.CopyDir(db.opts.DirPath, dir, exclude)
+// DataFileStat 数据文件的统计信息
+type DataFileStat struct {
+	Fid      uint32 // 数据文件id
+	Size     int64  // 数据文件的大小(Byte)
+	LiveSize int64  // 仍然被index引用的数据量(Byte)，其余都是无效数据
+}
+
+// DataFileStat 所有数据文件的统计信息，按照file id排序
+func (db *DB) DataFileStat() ([]DataFileStat, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	result := make([]DataFileStat, 0, len(db.inActivaFile)+1)
+	for fileId, dataFile := range db.inActivaFile {
+		size, err := dataFile.IOManager.Size()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, DataFileStat{Fid: fileId, Size: size, LiveSize: db.liveSize[fileId]})
+	}
+	if db.activeFile != nil {
+		result = append(result, DataFileStat{Fid: db.activeFile.FileId, Size: db.activeFile.WriteOff, LiveSize: db.liveSize[db.activeFile.FileId]})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Fid < result[j].Fid
+	})
+	return result, nil
+}
+
+// 启动时根据index统计每个数据文件中的有效数据与每个blob file中的无效数据，之后随着写入与删除更新
+func (db *DB) loadLiveSize() {
+	db.liveSize = make(map[uint32]int64, len(db.inActivaFile)+1)
+	blobLiveSize := make(map[uint32]int64, len(db.blobFiles))
+	for _, cf := range db.families {
+		iter := index.NewUnorderedIterator(cf.index)
+		for iter.Rewind(); !iter.IsEnd(); iter.Next() {
+			pos := iter.Value()
+			db.liveSize[pos.Fid] += int64(pos.RecordSize)
+			if pos.Blob != nil {
+				blobLiveSize[pos.Blob.Fid] += int64(pos.Blob.Size)
+			}
+		}
+		iter.Close()
+	}
+	for fileId, blobFile := range db.blobFiles {
+		db.blobGarbage[fileId] = max(blobFile.WriteOff-blobLiveSize[fileId], 0)
+	}
 }
 
 // 打开/创建数据库实例
@@ -108,20 +190,81 @@ func Open(opts DBOptions) (*DB, error) {
 		mu:           new(sync.RWMutex),
 		isInitial:    isInitial,
 		fileLock:     fileLock,
+		mergeWg:      new(sync.WaitGroup),
+		fileRefs:     make(map[*data.DataFile]int),
+		retiredFiles: make(map[*data.DataFile]bool),
+		families:     make(map[uint32]*ColumnFamily),
+		nextFamilyId: 1,
+		cipher:       data.NewCipher(opts.KeyProvider),
+		blobFiles:    make(map[uint32]*data.DataFile),
+		blobGarbage:  make(map[uint32]int64),
+		liveSize:     make(map[uint32]int64),
+		hintWg:       new(sync.WaitGroup),
+		watchers:     make(map[*watcher]struct{}),
+		commitQueue:  new(commitQueue),
+		replication:  newReplication(),
+		metrics:      new(metrics),
+	}
+	if opts.ValueCacheSize > 0 {
+		db.valueCache = newValueCache(opts.ValueCacheSize)
+	}
+	db.defaultFamily = &ColumnFamily{db: db, id: 0, name: DefaultFamilyName, index: db.index}
+	db.families[0] = db.defaultFamily
+	// 加载column family信息，加载index时需要根据family id区分记录
+	if err := db.loadFamilies(); err != nil {
+		db.releaseOnOpenFailed()
+		return nil, err
 	}
-	// 加载data file与index
+	// 加载data file与index，密钥错误等情况下会失败
 	if err := db.loadDataFileAndIndex(opts); err != nil {
+		db.releaseOnOpenFailed()
+		return nil, err
+	}
+	// 加载blob file，并根据index统计数据文件中的有效数据与blob file中的无效数据
+	if err := db.loadBlobFiles(); err != nil {
+		db.releaseOnOpenFailed()
 		return nil, err
 	}
+	db.loadLiveSize()
 	// 如果用户选择了mmap以加载文件，需要重置IO类型为file IO
 	if opts.MMapStartUp {
 		if err := db.resetToFileIOType(); err != nil {
+			db.releaseOnOpenFailed()
 			return nil, err
 		}
 	}
+	// 在后台为没有hint file的不活跃文件生成hint file，加快下次启动
+	for _, dataFile := range db.unhintedFiles {
+		db.writeFileHintAsync(dataFile)
+	}
+	db.unhintedFiles = nil
+	// 开启后台的自动merge
+	if opts.MergeInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		db.mergeCancel = cancel
+		db.mergeWg.Add(1)
+		go db.autoMerge(ctx)
+	}
 	return db, nil
 }
 
+// 打开失败时关闭已经打开的文件并释放文件锁，之后可以使用正确的配置重新打开
+func (db *DB) releaseOnOpenFailed() {
+	for _, cf := range db.families {
+		_ = cf.index.Close()
+	}
+	if db.activeFile != nil {
+		_ = db.activeFile.Close()
+	}
+	for _, dataFile := range db.inActivaFile {
+		_ = dataFile.Close()
+	}
+	for _, blobFile := range db.blobFiles {
+		_ = blobFile.Close()
+	}
+	_ = db.fileLock.Unlock()
+}
+
 // TODO: Close Sync可以多次调用，没有设置脏位！
 // 关闭数据库，返回失败的具体原因
 func (db *DB) Close() error {
@@ -131,17 +274,30 @@ func (db *DB) Close() error {
 			panic(fmt.Sprintf("failed to unlock file, %v", err))
 		}
 	}()
+	// 先停止后台的自动merge，避免与Close竞争
+	if db.mergeCancel != nil {
+		db.mergeCancel()
+		db.mergeWg.Wait()
+	}
+	// 断开所有follower的连接
+	db.stopReplication()
+	// 等待后台生成hint file的协程退出
+	db.hintWg.Wait()
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	// 关闭所有订阅者的channel
+	db.removeWatchers(nil)
 	if db.activeFile == nil {
 		return nil
 	}
-	// 先关闭index
-	if err := db.index.Close(); err != nil {
-		return err
+	// 先关闭所有column family的index
+	for _, cf := range db.families {
+		if err := cf.index.Close(); err != nil {
+			return err
+		}
 	}
 	// 保存wbid到指定文件中
-	wbIdFile, err := data.OpenWriteBatchFile(db.opts.DirPath)
+	wbIdFile, err := db.withCipher(data.OpenWriteBatchFile(db.opts.DirPath))
 	if err != nil {
 		return err
 	}
@@ -149,7 +305,10 @@ func (db *DB) Close() error {
 		Key:   []byte(wbIbKey),
 		Value: []byte(strconv.FormatUint(db.wbId, 10)),
 	}
-	encRecord, _ := data.EncodeLogRecord(logRecord)
+	encRecord, _, err := db.encodeLogRecord(logRecord)
+	if err != nil {
+		return err
+	}
 	if err := wbIdFile.Write(encRecord); err != nil {
 		return err
 	}
@@ -158,7 +317,10 @@ func (db *DB) Close() error {
 	}
 
 	// 先持久化活跃文件再关闭
-	err = db.activeFile.Sync()
+	if err := db.syncBlobFile(); err != nil {
+		return err
+	}
+	err = db.syncFile(db.activeFile)
 	if err != nil {
 		return err
 	}
@@ -173,6 +335,18 @@ func (db *DB) Close() error {
 			return err
 		}
 	}
+	for _, blobFile := range db.blobFiles {
+		if err := blobFile.Close(); err != nil {
+			return err
+		}
+	}
+	// 仍被快照引用的旧文件也需要关闭
+	for file := range db.retiredFiles {
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	db.retiredFiles = make(map[*data.DataFile]bool)
 	return nil
 }
 
@@ -183,8 +357,11 @@ func (db *DB) Sync() error {
 	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	// 只需要持久化活跃文件即可
-	err := db.activeFile.Sync()
+	// 只需要持久化活跃文件即可，value被分离时还需要先持久化活跃的blob file
+	if err := db.syncBlobFile(); err != nil {
+		return err
+	}
+	err := db.syncFile(db.activeFile)
 	if err != nil {
 		return err
 	}
@@ -193,31 +370,62 @@ func (db *DB) Sync() error {
 
 // Put 插入k-v到数据库中
 func (db *DB) Put(key []byte, value []byte) error {
+	return db.defaultFamily.put(key, value, 0, nil)
+}
+
+// PutWithTTL 插入k-v到数据库中，k-v在ttl后过期，ttl为0表示永不过期
+func (db *DB) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	var expire int64 = 0
+	if ttl != 0 {
+		expire = time.Now().Add(ttl).UnixNano()
+	}
+	return db.defaultFamily.put(key, value, expire, nil)
+}
+
+// cond不为nil时，在追加记录前检查写入条件
+func (cf *ColumnFamily) put(key []byte, value []byte, expire int64, cond *condition) error {
+	defer cf.db.metrics.observeWrite(&cf.db.metrics.puts, time.Now())
 	// key不能为空
 	if len(key) == 0 {
 		return ErrEmptyKey
 	}
 	// 构建要Put的记录
 	logRecord := &data.LogRecord{
-		Key:   serializeKeyId(key, zeroWbId),
-		Value: value,
-		Typ:   data.LogRecordNormal,
-	}
-	// 将记录追加到文件中
-	logRecordLog, err := db.appendLogRecordWithLock(logRecord)
-	if err != nil {
-		return err
-	}
-	// 根据记录的位置信息 logRecordLog 维护索引
-	ok, oldPos := db.index.Put(key, logRecordLog)
-	if !ok {
-		return ErrUpdateIndexFailed
-	}
-	if oldPos != nil {
-		// 统计无效字节数
-		db.invalidSize += int64(oldPos.RecordSize)
-	}
-	return nil
+		Key:    serializeKeyId(key, zeroWbId),
+		Value:  value,
+		Typ:    data.LogRecordNormal,
+		Expire: expire,
+	}
+	db := cf.db
+	return db.write(func() (func() error, error) {
+		if !cf.isAlive() {
+			return nil, ErrFamilyNotFound
+		}
+		if err := cf.checkCondition(key, cond); err != nil {
+			return nil, err
+		}
+		// 将记录追加到文件中
+		logRecord.Family = cf.id
+		logRecordLog, err := db.appendLogRecord(logRecord)
+		if err != nil {
+			return nil, err
+		}
+		// 持久化之后再维护索引并通知订阅者
+		return func() error {
+			// 根据记录的位置信息 logRecordLog 维护索引
+			ok, oldPos := cf.index.Put(key, logRecordLog)
+			if !ok {
+				return ErrUpdateIndexFailed
+			}
+			db.addLiveSize(logRecordLog)
+			if oldPos != nil {
+				// 统计无效字节数
+				cf.discard(oldPos)
+			}
+			db.notifyWatchers([]watchChange{{family: cf, typ: WatchPut, key: key, value: value}})
+			return nil
+		}, nil
+	}, cond != nil, db.opts.AlwaysSync)
 }
 
 func (db *DB) resetToFileIOType() error {
@@ -242,10 +450,24 @@ func (db *DB) resetToFileIOType() error {
 }
 
 func (db *DB) ListKeys(reverse bool) [][]byte {
+	return db.defaultFamily.listKeys(reverse)
+}
+
+func (cf *ColumnFamily) listKeys(reverse bool) [][]byte {
+	cf.db.mu.RLock()
+	defer cf.db.mu.RUnlock()
+	if !cf.isAlive() {
+		return nil
+	}
 	// 获取内存index的迭代器，遍历index
-	iter := db.index.NewIterator(reverse)
-	keys := make([][]byte, 0, db.index.Size())
+	iter := cf.index.NewIterator(reverse)
+	keys := make([][]byte, 0, cf.index.Size())
+	now := time.Now().UnixNano()
 	for iter.Rewind(); !iter.IsEnd(); iter.Next() {
+		// 跳过已经过期的key
+		if iter.Value().IsExpired(now) {
+			continue
+		}
 		keys = append(keys, iter.Key())
 	}
 	iter.Close()
@@ -253,12 +475,25 @@ func (db *DB) ListKeys(reverse bool) [][]byte {
 }
 
 func (db *DB) Fold(fn func(key []byte, val []byte) bool) error {
+	return db.defaultFamily.fold(fn)
+}
+
+func (cf *ColumnFamily) fold(fn func(key []byte, val []byte) bool) error {
+	db := cf.db
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if !cf.isAlive() {
+		return ErrFamilyNotFound
+	}
 	// 获取内存index的迭代器，遍历index
-	iter := db.index.NewIterator(false)
+	iter := cf.index.NewIterator(false)
+	now := time.Now().UnixNano()
 	for iter.Rewind(); !iter.IsEnd(); iter.Next() {
 		logRecordPos := iter.Value()
+		// 跳过已经过期的key
+		if logRecordPos.IsExpired(now) {
+			continue
+		}
 		val, err := db.GetValueByPos(logRecordPos)
 		if err != nil {
 			return err
@@ -272,21 +507,77 @@ func (db *DB) Fold(fn func(key []byte, val []byte) bool) error {
 
 // Get 获取key对应的value, 若key不存在返回nil
 func (db *DB) Get(key []byte) ([]byte, error) {
+	return db.defaultFamily.get(key)
+}
+
+func (cf *ColumnFamily) get(key []byte) ([]byte, error) {
+	db := cf.db
+	defer db.metrics.observeGet(time.Now())
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 	// key不能为空
 	if len(key) == 0 {
 		return nil, ErrEmptyKey
 	}
+	if !cf.isAlive() {
+		return nil, ErrFamilyNotFound
+	}
 	// 通过索引获取记录的位置信息 logRecordPos
-	logRecordPos := db.index.Get(key)
-	if logRecordPos == nil {
+	logRecordPos := cf.index.Get(key)
+	if logRecordPos == nil || logRecordPos.IsExpired(time.Now().UnixNano()) {
 		return nil, ErrKeyNotFound
 	}
 	return db.GetValueByPos(logRecordPos)
 }
 
+// TTL 获取key的剩余存活时间，返回0表示永不过期
+func (db *DB) TTL(key []byte) (time.Duration, error) {
+	return db.defaultFamily.ttl(key)
+}
+
+func (cf *ColumnFamily) ttl(key []byte) (time.Duration, error) {
+	cf.db.mu.RLock()
+	defer cf.db.mu.RUnlock()
+	if len(key) == 0 {
+		return 0, ErrEmptyKey
+	}
+	if !cf.isAlive() {
+		return 0, ErrFamilyNotFound
+	}
+	logRecordPos := cf.index.Get(key)
+	now := time.Now().UnixNano()
+	if logRecordPos == nil || logRecordPos.IsExpired(now) {
+		return 0, ErrKeyNotFound
+	}
+	if logRecordPos.Expire == 0 {
+		return 0, nil
+	}
+	return time.Duration(logRecordPos.Expire - now), nil
+}
+
 func (db *DB) GetValueByPos(logRecordPos *data.LogRecordPos) ([]byte, error) {
+	if db.valueCache == nil {
+		return db.readValueByPos(logRecordPos)
+	}
+	key := newCacheKey(logRecordPos)
+	if value, ok := db.valueCache.get(key); ok {
+		return value, nil
+	}
+	value, err := db.readValueByPos(logRecordPos)
+	if err != nil {
+		return nil, err
+	}
+	db.valueCache.put(key, value)
+	return value, nil
+}
+
+// 从磁盘读取logRecordPos处的value
+func (db *DB) readValueByPos(logRecordPos *data.LogRecordPos) ([]byte, error) {
+	db.metrics.observeRead(logRecordPos)
+	// value被分离时直接从blob file中读取
+	if logRecordPos.Blob != nil {
+		return readValueFromBlob(db.blobFiles[logRecordPos.Blob.Fid], logRecordPos.Blob)
+	}
 	// 根据logRecordPos.FileId读取文件
 	fileId := logRecordPos.Fid
 	var dataFile *data.DataFile
@@ -296,6 +587,11 @@ func (db *DB) GetValueByPos(logRecordPos *data.LogRecordPos) ([]byte, error) {
 	} else {
 		dataFile = db.inActivaFile[logRecordPos.Fid]
 	}
+	return readValueFromFile(dataFile, logRecordPos)
+}
+
+// 从dataFile中读取logRecordPos处的value
+func readValueFromFile(dataFile *data.DataFile, logRecordPos *data.LogRecordPos) ([]byte, error) {
 	if dataFile == nil {
 		return nil, ErrDataFileNotFound
 	}
@@ -313,40 +609,59 @@ func (db *DB) GetValueByPos(logRecordPos *data.LogRecordPos) ([]byte, error) {
 }
 
 func (db *DB) Delete(key []byte) error {
+	return db.defaultFamily.delete(key, nil)
+}
+
+// cond不为nil时，在追加墓碑值前检查写入条件
+func (cf *ColumnFamily) delete(key []byte, cond *condition) error {
+	defer cf.db.metrics.observeWrite(&cf.db.metrics.deletes, time.Now())
 	// 不能删除空的key
 	if len(key) == 0 {
 		return ErrEmptyKey
 	}
-	// 向index查询key是否存在(可能被删除，可能本就不存在)
-	logRecordPos := db.index.Get(key)
-	if logRecordPos == nil {
-		return ErrKeyNotFound
-	}
-	// 构造墓碑值
-	logRecord := &data.LogRecord{Key: serializeKeyId(key, zeroWbId), Typ: data.LogRecordDeleted}
-	pos, err := db.appendLogRecord(logRecord)
-	if err != nil {
-		return err
-	}
-	// delete时，追加的record也是无效的
-	db.invalidSize += int64(pos.RecordSize)
-	// 维护index, 这里应该是成功删除，因为之前Get key成功了
-	// TODO: 抛异常
-	ok, oldPos := db.index.Delete(key)
-	if !ok {
-		return ErrUpdateIndexFailed
-	}
-	if oldPos != nil {
-		// 统计无效字节数
-		db.invalidSize += int64(oldPos.RecordSize)
-	}
-	return nil
-}
-
-func (db *DB) appendLogRecordWithLock(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	return db.appendLogRecord(logRecord)
+	db := cf.db
+	return db.write(func() (func() error, error) {
+		if !cf.isAlive() {
+			return nil, ErrFamilyNotFound
+		}
+		if err := cf.checkCondition(key, cond); err != nil {
+			return nil, err
+		}
+		// 向index查询key是否存在(可能被删除，可能本就不存在)
+		logRecordPos := cf.index.Get(key)
+		if logRecordPos == nil {
+			return nil, ErrKeyNotFound
+		}
+		// 已经过期的key视为不存在，只需从index中移除，重启时过期的记录也不会被加载
+		if logRecordPos.IsExpired(time.Now().UnixNano()) {
+			cf.index.Delete(key)
+			cf.discard(logRecordPos)
+			return nil, ErrKeyNotFound
+		}
+		// 构造墓碑值
+		logRecord := &data.LogRecord{Key: serializeKeyId(key, zeroWbId), Typ: data.LogRecordDeleted, Family: cf.id}
+		pos, err := db.appendLogRecord(logRecord)
+		if err != nil {
+			return nil, err
+		}
+		// delete时，追加的record也是无效的
+		cf.addInvalidSize(int64(pos.RecordSize))
+		// 持久化之后再维护索引并通知订阅者
+		return func() error {
+			// 维护index, 这里应该是成功删除，因为之前Get key成功了
+			// TODO: 抛异常
+			ok, oldPos := cf.index.Delete(key)
+			if !ok {
+				return ErrUpdateIndexFailed
+			}
+			if oldPos != nil {
+				// 统计无效字节数
+				cf.discard(oldPos)
+			}
+			db.notifyWatchers([]watchChange{{family: cf, typ: WatchDelete, key: key}})
+			return nil
+		}, nil
+	}, true, db.opts.AlwaysSync)
 }
 
 // appendLogRecord 向文件中追加记录
@@ -357,15 +672,38 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 			return nil, err
 		}
 	}
-	// 将结构体序列化成[]byte
-	encRecord, sz := data.EncodeLogRecord(logRecord)
+	// 较大的value先写入blob file，数据文件中只保存value在blob file中的位置
+	if db.opts.BlobThreshold > 0 && logRecord.Typ == data.LogRecordNormal && len(logRecord.Value) > db.opts.BlobThreshold {
+		blobPos, err := db.writeBlob(logRecord)
+		if err != nil {
+			return nil, err
+		}
+		logRecord = &data.LogRecord{
+			Key:    logRecord.Key,
+			Value:  data.EncodeBlobPos(blobPos),
+			Typ:    data.LogRecordBlob,
+			Expire: logRecord.Expire,
+			Family: logRecord.Family,
+		}
+	}
+	// 使用当前配置的压缩算法，将结构体序列化成[]byte
+	logRecord.Compression = db.opts.Compression
+	encRecord, sz, err := db.encodeLogRecord(logRecord)
+	if err != nil {
+		return nil, err
+	}
 	// 判断此次写入是否会超出阈值
 	if db.activeFile.WriteOff+sz > db.opts.DataFileSize {
 		// 先保存当前数据文件，持久化+维护inActivaFile
-		if err := db.activeFile.Sync(); err != nil {
+		if err := db.syncBlobFile(); err != nil {
+			return nil, err
+		}
+		if err := db.syncFile(db.activeFile); err != nil {
 			return nil, err
 		}
 		db.inActivaFile[db.activeFile.FileId] = db.activeFile
+		// 写满的文件不会再被修改，在后台为其生成hint file
+		db.writeFileHintAsync(db.activeFile)
 		// 打开新的活跃文件
 		if err := db.newActiveFile(); err != nil {
 			return nil, err
@@ -377,10 +715,17 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 	if err := db.activeFile.Write(encRecord); err != nil {
 		return nil, err
 	}
+	db.metrics.bytesWritten.Add(uint64(sz))
 	// 根据配置信息决定是否持久化
 	if db.opts.AlwaysSync {
-		if err := db.activeFile.Sync(); err != nil {
-			return nil, err
+		// group commit时由leader在所有记录追加完成后统一持久化
+		if !db.inGroupCommit {
+			if err := db.syncBlobFile(); err != nil {
+				return nil, err
+			}
+			if err := db.syncFile(db.activeFile); err != nil {
+				return nil, err
+			}
 		}
 	} else {
 		// 统计未持久化的字节数
@@ -388,16 +733,23 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 		if db.opts.BytesSync > 0 && db.writeBytes >= db.opts.BytesSync {
 			// 如果达到持久化阈值就持久化，并重置未持久化的字节数
 			db.writeBytes = 0
-			if err := db.activeFile.Sync(); err != nil {
+			if err := db.syncBlobFile(); err != nil {
+				return nil, err
+			}
+			if err := db.syncFile(db.activeFile); err != nil {
 				return nil, err
 			}
 		}
 	}
+	// 唤醒等待新数据的follower连接
+	db.notifyReplication()
 	// 构造记录的位置信息LogRecordPos
 	return &data.LogRecordPos{
 		Fid:        db.activeFile.FileId,
 		Offset:     writeOff,
 		RecordSize: uint32(sz),
+		Expire:     logRecord.Expire,
+		Blob:       getBlobPos(logRecord),
 	}, nil
 }
 
@@ -409,7 +761,7 @@ func (db *DB) newActiveFile() error {
 		fileId = db.activeFile.FileId + 1
 	}
 	// 在数据库目录下，创建新的数据文件
-	dataFile, err := data.OpenDataFile(db.opts.DirPath, fileId, fio.FileIOType)
+	dataFile, err := db.withCipher(data.OpenDataFile(db.opts.DirPath, fileId, fio.FileIOType))
 	if err != nil {
 		return err
 	}
@@ -452,7 +804,7 @@ func (db *DB) loadDataFileAndIndex(opts DBOptions) error {
 	// 加载data file信息
 	for i, fileId := range fileIds {
 		// 根据fileId打开文件，并加载数据到dataFile中
-		dataFile, err := data.OpenDataFile(db.opts.DirPath, uint32(fileId), dataFileIOType)
+		dataFile, err := db.withCipher(data.OpenDataFile(db.opts.DirPath, uint32(fileId), dataFileIOType))
 		if err != nil {
 			return err
 		}
@@ -490,22 +842,80 @@ func (db *DB) loadDataFileAndIndex(opts DBOptions) error {
 	return nil
 }
 
-// 加载index信息
-func (db *DB) loadIndexFromDataFile(fileIds []int) error {
-	// 定义更新/删除index的闭包
-	load := func(key []byte, typ data.LogRecordType, logRecordPos *data.LogRecordPos) {
-		if typ == data.LogRecordDeleted {
-			db.index.Delete(key)
-		} else if typ == data.LogRecordNormal {
-			db.index.Put(key, logRecordPos)
-		} else {
-			panic("invalid record type")
+// 根据数据文件中的记录更新index，WriteBatch中的记录在读到结束标记后才会生效
+// 启动时加载数据文件与follower应用primary发送的记录都使用它
+type indexLoader struct {
+	db      *DB
+	now     int64                          // 判断记录是否过期的时间
+	writes  map[uint64][]*data.WBLogRecord // 暂存WriteBatch的writes, 读到wbfinish时将writes加载到index中，并将其从writes中删除
+	maxWbId uint64                         // 数据库中最大的wb Id
+}
+
+func newIndexLoader(db *DB) *indexLoader {
+	return &indexLoader{
+		db:      db,
+		now:     time.Now().UnixNano(),
+		writes:  make(map[uint64][]*data.WBLogRecord),
+		maxWbId: zeroWbId,
+	}
+}
+
+// 加载一条记录
+func (loader *indexLoader) loadRecord(logRecord *data.LogRecord, logRecordPos *data.LogRecordPos) {
+	// 解析key获取wbId
+	realKey, wbId := parseKeyId(logRecord.Key)
+	// 根据wbId判断该记录是否是一个wb操作
+	if wbId == zeroWbId {
+		// 不是wb操作，正常加载index
+		loader.load(logRecord.Family, realKey, logRecord.Typ, logRecordPos)
+		return
+	}
+	// 是wb操作，根据record类型决定是更新索引还是暂存record信息
+	// 先更新maxWbId
+	loader.maxWbId = max(loader.maxWbId, wbId)
+	if logRecord.Typ == data.LogRecordFinished {
+		// 更新索引
+		for _, record := range loader.writes[wbId] {
+			loader.load(record.Family, record.Key, record.Typ, record.Pos)
 		}
+		delete(loader.writes, wbId)
+	} else {
+		// 暂存record信息
+		loader.writes[wbId] = append(loader.writes[wbId], &data.WBLogRecord{
+			Key:    realKey,
+			Pos:    logRecordPos,
+			Typ:    logRecord.Typ,
+			Family: logRecord.Family,
+		})
 	}
-	// 暂存WriteBatch的writes, 读到wbfinish时将writes加载到index中，并将其从writes中删除
-	writes := make(map[uint64][]*data.WBLogRecord)
-	// 维护数据库中最大的wb Id
-	maxWbId := zeroWbId
+}
+
+// 更新/删除index
+func (loader *indexLoader) load(family uint32, key []byte, typ data.LogRecordType, logRecordPos *data.LogRecordPos) {
+	// 已经被删除或清空的column family中的记录直接忽略
+	cf, ok := loader.db.families[family]
+	if !ok {
+		return
+	}
+	// 已经过期的记录等同于被删除
+	var oldPos *data.LogRecordPos
+	if typ == data.LogRecordDeleted || logRecordPos.IsExpired(loader.now) {
+		_, oldPos = cf.index.Delete(key)
+	} else if typ == data.LogRecordNormal || typ == data.LogRecordBlob {
+		_, oldPos = cf.index.Put(key, logRecordPos)
+		loader.db.addLiveSize(logRecordPos)
+	} else {
+		panic("invalid record type")
+	}
+	// follower持续应用记录，需要维护有效数据量
+	if oldPos != nil {
+		loader.db.discardLiveSize(oldPos)
+	}
+}
+
+// 加载index信息
+func (db *DB) loadIndexFromDataFile(fileIds []int) error {
+	loader := newIndexLoader(db)
 	// 保存merge finish信息
 	var hasMerged = false
 	var maxMergeFileId uint32 = 0
@@ -519,67 +929,36 @@ func (db *DB) loadIndexFromDataFile(fileIds []int) error {
 		hasMerged = true
 	}
 	// 获取data file中的信息，以加载index
+	var dataFiles []*data.DataFile
 	for i, fileId := range fileIds {
 		// 已经从hintfile中获取索引信息，无需读取data file
 		if hasMerged && fileId <= int(maxMergeFileId) {
 			continue
 		}
-		var dataFile data.DataFile
 		if i == len(fileIds)-1 {
-			dataFile = *db.activeFile
+			dataFiles = append(dataFiles, db.activeFile)
 		} else {
-			dataFile = *db.inActivaFile[uint32(fileId)]
+			dataFiles = append(dataFiles, db.inActivaFile[uint32(fileId)])
 		}
-		var offset int64 = 0
-		// 读取dataFile中的所有LogRecord
-		for {
-			logRecord, sz, err := dataFile.ReadLogRecord(offset)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return err
-			}
-			// 构造logRecordPos
-			logRecordPos := &data.LogRecordPos{
-				Fid:        uint32(fileId),
-				Offset:     offset,
-				RecordSize: uint32(sz),
-			}
-			// 解析key获取wbId
-			realKey, wbId := parseKeyId(logRecord.Key)
-			// 根据wbId判断该记录是否是一个wb操作
-			if wbId == zeroWbId {
-				// 不是wb操作，正常加载index
-				load(realKey, logRecord.Typ, logRecordPos)
-			} else {
-				// 是wb操作，根据record类型决定是更新索引还是暂存record信息
-				// 先更新maxWbId
-				maxWbId = max(maxWbId, wbId)
-				if logRecord.Typ == data.LogRecordFinished {
-					// 更新索引
-					for _, record := range writes[wbId] {
-						load(record.Key, record.Typ, record.Pos)
-					}
-					delete(writes, wbId)
-				} else {
-					// 暂存record信息
-					writes[wbId] = append(writes[wbId], &data.WBLogRecord{
-						Key: realKey,
-						Pos: logRecordPos,
-						Typ: logRecord.Typ,
-					})
-				}
-			}
-			offset += sz
-		}
-		// 如果是活跃文件，需要更新WriteOff
-		if i == len(fileIds)-1 {
-			db.activeFile.WriteOff = offset
+	}
+	err := db.foreachRecoveryRecord(dataFiles, loader.loadRecord, func(dataFile *data.DataFile, hinted bool, writeOff int64, discarded []DiscardedRange) error {
+		db.discardRanges(discarded)
+		// 如果是活跃文件，需要更新WriteOff，并截断末尾损坏的数据
+		if dataFile == db.activeFile {
+			db.activeFile.WriteOff = writeOff
+			return db.truncateActiveFile()
+		} else if !hinted {
+			// 没有hint file的不活跃文件，在启动后补充生成
+			dataFile.WriteOff = writeOff
+			db.unhintedFiles = append(db.unhintedFiles, dataFile)
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 	// 最后更新wbId
-	db.wbId = maxWbId
+	db.wbId = loader.maxWbId
 	return nil
 }
 
@@ -590,7 +969,7 @@ func (db *DB) loadWbIdFile() error {
 		return nil
 	}
 	// 打开指定文件并读取record，提取出wbid
-	wbIdFile, err := data.OpenWriteBatchFile(db.opts.DirPath)
+	wbIdFile, err := db.withCipher(data.OpenWriteBatchFile(db.opts.DirPath))
 	if err != nil {
 		return err
 	}
@@ -615,7 +994,8 @@ func (db *DB) NewWriteBatch(opts WBOptions) *WriteBatch {
 	return &WriteBatch{
 		opts:          opts,
 		db:            db,
-		pendingWrites: make(map[string]*data.LogRecord),
+		pendingWrites: make(map[pendingKey]*data.LogRecord),
+		conditions:    make(map[pendingKey]*condition),
 		mu:            new(sync.Mutex),
 	}
 }
@@ -631,5 +1011,45 @@ func checkOptions(opts DBOptions) error {
 	if opts.MergeRatio < 0 || opts.MergeRatio > 1 {
 		return ErrInvalidMergeRatio
 	}
+	if !opts.Compression.Valid() {
+		return ErrInvalidCompression
+	}
+	if opts.BlobThreshold < 0 || (opts.BlobThreshold > 0 && opts.BlobFileSize <= 0) || opts.BlobGCRatio < 0 || opts.BlobGCRatio > 1 {
+		return ErrInvalidBlobOptions
+	}
+	if opts.RecoveryConcurrency < 0 {
+		return ErrInvalidRecoveryConcurrency
+	}
+	if opts.RecoveryMode > RecoverySkipCorrupt {
+		return ErrInvalidRecoveryMode
+	}
+	if opts.WatchBufferSize < 0 || opts.WatchOverflow > WatchOverflowBlock {
+		return ErrInvalidWatchOptions
+	}
+	if opts.ValueCacheSize < 0 {
+		return ErrInvalidValueCacheSize
+	}
+	if opts.KeyProvider != nil {
+		if opts.Indexer == index.BPlusTreeType {
+			return ErrEncryptionUnsupported
+		}
+		if err := data.NewCipher(opts.KeyProvider).Check(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// 设置文件用于解密的cipher，用来包装打开文件的函数
+func (db *DB) withCipher(dataFile *data.DataFile, err error) (*data.DataFile, error) {
+	if err != nil {
+		return nil, err
+	}
+	dataFile.Cipher = db.cipher
+	return dataFile, nil
+}
+
+// 使用db的cipher序列化记录
+func (db *DB) encodeLogRecord(logRecord *data.LogRecord) ([]byte, int64, error) {
+	return data.EncodeLogRecordWithCipher(logRecord, db.cipher)
+}
@@ -2,11 +2,16 @@ package db
 
 import (
 	"bytes"
+	"compress/flate"
+	"context"
 	"fmt"
+	"kv-go/data"
 	"kv-go/index"
 	"kv-go/utils"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -544,4 +549,312 @@ func TestBackUp(t *testing.T) {
 		err := db.BackUp(dest)
 		assert.Nil(t, err)
 	}
-}
\ No newline at end of file
+}
+
+func TestPutWithTTL(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-put-ttl")
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	{
+		// 过期的key对Get、TTL、ListKeys、迭代器与Fold都不可见
+		assert.Nil(t, db.PutWithTTL(utils.GetTestKey(1), utils.GetTestValue(128), 100*time.Millisecond))
+		assert.Nil(t, db.PutWithTTL(utils.GetTestKey(2), utils.GetTestValue(128), time.Hour))
+		assert.Nil(t, db.Put(utils.GetTestKey(3), utils.GetTestValue(128)))
+
+		ttl, err := db.TTL(utils.GetTestKey(2))
+		assert.Nil(t, err)
+		assert.Greater(t, ttl, 59*time.Minute)
+		ttl, err = db.TTL(utils.GetTestKey(3))
+		assert.Nil(t, err)
+		assert.Equal(t, time.Duration(0), ttl)
+		_, err = db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+
+		time.Sleep(150 * time.Millisecond)
+		_, err = db.Get(utils.GetTestKey(1))
+		assert.Equal(t, ErrKeyNotFound, err)
+		_, err = db.TTL(utils.GetTestKey(1))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.Equal(t, [][]byte{utils.GetTestKey(2), utils.GetTestKey(3)}, db.ListKeys(false))
+
+		iter := db.NewIterator(DefaultItOptions)
+		assert.Equal(t, utils.GetTestKey(2), iter.Key())
+		iter.Close()
+		var cnt = 0
+		assert.Nil(t, db.Fold(func(key []byte, val []byte) bool {
+			cnt++
+			return true
+		}))
+		assert.Equal(t, 2, cnt)
+
+		// 重新写入后不再过期
+		assert.Nil(t, db.Put(utils.GetTestKey(2), utils.GetTestValue(128)))
+		ttl, err = db.TTL(utils.GetTestKey(2))
+		assert.Nil(t, err)
+		assert.Equal(t, time.Duration(0), ttl)
+	}
+
+	{
+		// 重启后过期的key不会被加载
+		assert.Nil(t, db.PutWithTTL(utils.GetTestKey(4), utils.GetTestValue(128), 100*time.Millisecond))
+		assert.Nil(t, db.PutWithTTL(utils.GetTestKey(5), utils.GetTestValue(128), time.Hour))
+		assert.Nil(t, db.Close())
+		time.Sleep(150 * time.Millisecond)
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		_, err = db.Get(utils.GetTestKey(4))
+		assert.Equal(t, ErrKeyNotFound, err)
+		ttl, err := db.TTL(utils.GetTestKey(5))
+		assert.Nil(t, err)
+		assert.Greater(t, ttl, 59*time.Minute)
+		assert.Equal(t, 3, db.index.Size())
+	}
+}
+
+func TestMergeDropExpired(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-merge-expired")
+	opts.MergeRatio = 0
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	{
+		// merge会丢弃过期的记录，并从index中删除它们，hint file中也不会有过期的key
+		cnt := 1000
+		for i := 0; i < cnt; i++ {
+			assert.Nil(t, db.PutWithTTL(utils.GetTestKey(i), utils.GetTestValue(128), 100*time.Millisecond))
+			assert.Nil(t, db.PutWithTTL(utils.GetTestKey(cnt+i), utils.GetTestValue(128), time.Hour))
+		}
+		time.Sleep(150 * time.Millisecond)
+		assert.Nil(t, db.Merge(context.Background()))
+		assert.Equal(t, cnt, db.index.Size())
+		assert.Nil(t, db.Close())
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, cnt, db.index.Size())
+		for i := cnt; i < 2*cnt; i++ {
+			ttl, err := db.TTL(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Greater(t, ttl, time.Duration(0))
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-compression")
+	opts.MergeRatio = 0
+	opts.Compression = data.Compression{Codec: data.CodecFlate, Level: flate.BestSpeed}
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	cnt := 1000
+	value := bytes.Repeat([]byte(`{"name":"bitcask-go","tags":["kv","log"]},`), 50)
+	{
+		// 压缩后占用的磁盘空间远小于原始数据
+		for i := 0; i < cnt; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), value))
+		}
+		stat, err := db.Stat()
+		assert.Nil(t, err)
+		assert.Less(t, stat.DiskSize, int64(cnt*len(value)/5))
+		val, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+
+	{
+		// 切换压缩算法后，新旧记录可以共存，merge使用新的算法重新压缩
+		assert.Nil(t, db.Close())
+		opts.Compression = data.Compression{Codec: data.CodecLZ}
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < cnt/2; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(cnt+i), value))
+		}
+		for i := 0; i < cnt+cnt/2; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+		}
+		// 关闭压缩后merge，所有记录都以原始数据重写
+		assert.Nil(t, db.Close())
+		opts.Compression = data.Compression{Codec: data.CodecNone}
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		assert.Nil(t, db.Merge(context.Background()))
+		stat, err := db.Stat()
+		assert.Nil(t, err)
+		assert.Greater(t, stat.DiskSize, int64((cnt+cnt/2)*len(value)))
+		for i := 0; i < cnt+cnt/2; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+		}
+		assert.Nil(t, db.Close())
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		val, err := db.Get(utils.GetTestKey(cnt))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+
+	{
+		// 非法的压缩配置
+		invalidOpts := opts
+		invalidOpts.Compression = data.Compression{Codec: data.CodecFlate, Level: 100}
+		_, err := Open(invalidOpts)
+		assert.Equal(t, ErrInvalidCompression, err)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-encryption")
+	opts.MergeRatio = 0
+	provider := &data.StaticKeyProvider{CurrentId: 1, Keys: map[uint32][]byte{1: bytes.Repeat([]byte("1"), 32)}}
+	opts.KeyProvider = provider
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	cnt := 100
+	value := []byte("plaintext-value-should-not-be-on-disk")
+	for i := 0; i < cnt; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), value))
+	}
+	cf, err := db.CreateColumnFamily("encrypted")
+	assert.Nil(t, err)
+	assert.Nil(t, cf.Put([]byte("cf-key"), value))
+	assert.Nil(t, db.Close())
+
+	// 磁盘上的数据文件中不包含明文
+	entries, err := os.ReadDir(opts.DirPath)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(opts.DirPath, entry.Name()))
+		assert.Nil(t, err)
+		assert.False(t, bytes.Contains(content, value), entry.Name())
+		assert.False(t, bytes.Contains(content, []byte("encrypted")), entry.Name())
+	}
+
+	{
+		// 错误的密钥与缺少密钥时无法打开
+		wrongOpts := opts
+		wrongOpts.KeyProvider = &data.StaticKeyProvider{CurrentId: 1, Keys: map[uint32][]byte{1: bytes.Repeat([]byte("x"), 32)}}
+		_, err = Open(wrongOpts)
+		assert.Equal(t, data.ErrDecryptFailed, err)
+		wrongOpts.KeyProvider = nil
+		_, err = Open(wrongOpts)
+		assert.Equal(t, data.ErrNoKeyProvider, err)
+	}
+
+	{
+		// 轮换密钥后新旧记录可以共存，merge使用新的密钥重新加密
+		provider.Keys[2] = bytes.Repeat([]byte("2"), 16)
+		provider.CurrentId = 2
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		assert.Nil(t, db.Put(utils.GetTestKey(cnt), value))
+		assert.Nil(t, db.Merge(context.Background()))
+		assert.Nil(t, db.Close())
+		opts.KeyProvider = &data.StaticKeyProvider{CurrentId: 2, Keys: map[uint32][]byte{2: provider.Keys[2]}}
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i <= cnt; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+		}
+		cf, err := db.ColumnFamily("encrypted")
+		assert.Nil(t, err)
+		val, err := cf.Get([]byte("cf-key"))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+
+	{
+		// 非法的加密配置
+		badOpts := DefaultDBOptions
+		badOpts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-encryption-bad")
+		defer os.RemoveAll(badOpts.DirPath)
+		badOpts.KeyProvider = &data.StaticKeyProvider{CurrentId: 1, Keys: map[uint32][]byte{1: []byte("short")}}
+		_, err = Open(badOpts)
+		assert.NotNil(t, err)
+		badOpts.KeyProvider = provider
+		badOpts.Indexer = index.BPlusTreeType
+		_, err = Open(badOpts)
+		assert.Equal(t, ErrEncryptionUnsupported, err)
+	}
+}
+
+func TestHashIndex(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.Indexer = index.HashType
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-hash-index")
+	opts.DataFileSize = 64 * 1024
+	opts.MergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { destoryDB(db) }()
+	{
+		cnt := 2000
+		vals := make([][]byte, cnt)
+		for i := 0; i < cnt; i++ {
+			vals[i] = utils.GetTestValue(64)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), vals[i]))
+		}
+		for i := 0; i < cnt; i += 2 {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		}
+		// 重启后重新加载索引
+		assert.Nil(t, db.Close())
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < cnt; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			if i%2 == 0 {
+				assert.Equal(t, ErrKeyNotFound, err)
+			} else {
+				assert.Equal(t, vals[i], val)
+			}
+		}
+
+		// 迭代器与ListKeys仍然是有序的
+		keys := db.ListKeys(false)
+		assert.Equal(t, cnt/2, len(keys))
+		for i := 1; i < len(keys); i++ {
+			assert.True(t, bytes.Compare(keys[i-1], keys[i]) < 0)
+		}
+		iter := db.NewIterator(ItOptions{Prefix: []byte("go-kv-key-00000001"), Reverse: true})
+		var got [][]byte
+		for ; !iter.IsEnd(); iter.Next() {
+			got = append(got, iter.Key())
+		}
+		iter.Close()
+		assert.Equal(t, [][]byte{utils.GetTestKey(19), utils.GetTestKey(17), utils.GetTestKey(15), utils.GetTestKey(13), utils.GetTestKey(11)}, got)
+
+		// 不关心顺序的统计使用无序遍历
+		stats, err := db.DataFileStat()
+		assert.Nil(t, err)
+		var liveSize int64
+		for _, stat := range stats {
+			liveSize += stat.LiveSize
+		}
+		assert.True(t, liveSize > 0)
+
+		assert.Nil(t, db.Merge(context.Background()))
+		for i := 1; i < cnt; i += 2 {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, vals[i], val)
+		}
+		stat, err := db.Stat()
+		assert.Nil(t, err)
+		assert.Equal(t, int64(cnt/2), stat.KeyNum)
+	}
+}
@@ -6,19 +6,54 @@ import (
 
 // 描述数据库运行时可能出现的错误
 var (
-	ErrEmptyKey              = errors.New("the key is empty")
-	ErrUpdateIndexFailed     = errors.New("can not update index")
-	ErrKeyNotFound           = errors.New("can not found the key")
-	ErrDataFileNotFound      = errors.New("can not found data file")
-	ErrDeletedKey            = errors.New("the key is deleted")
-	ErrInvalidDirPath        = errors.New("directory path is invailded")
-	ErrInvalidDataFileSize   = errors.New("data file size is invailded")
-	ErrDataFileNameCorrupted = errors.New("data file name is corrupted")
-	ErrExceedMaxWriteNum     = errors.New("too many writes")
-	ErrInvalidRecordType     = errors.New("invalid record type exists")
-	ErrDBMerging             = errors.New("db is merging")
-	ErrDBUsing               = errors.New("db is using")
-	ErrInvalidMergeRatio     = errors.New("merge ratio must be in ther range [0, 1]")
-	ErrMergeRatioUnreached   = errors.New("merge ratio unreach")
-	ErrDiskSpaceNotEnough    = errors.New("disk space not enough")
+	ErrEmptyKey                   = errors.New("the key is empty")
+	ErrUpdateIndexFailed          = errors.New("can not update index")
+	ErrKeyNotFound                = errors.New("can not found the key")
+	ErrDataFileNotFound           = errors.New("can not found data file")
+	ErrDeletedKey                 = errors.New("the key is deleted")
+	ErrInvalidDirPath             = errors.New("directory path is invailded")
+	ErrInvalidDataFileSize        = errors.New("data file size is invailded")
+	ErrDataFileNameCorrupted      = errors.New("data file name is corrupted")
+	ErrExceedMaxWriteNum          = errors.New("too many writes")
+	ErrInvalidRecordType          = errors.New("invalid record type exists")
+	ErrDBMerging                  = errors.New("db is merging")
+	ErrDBUsing                    = errors.New("db is using")
+	ErrInvalidMergeRatio          = errors.New("merge ratio must be in ther range [0, 1]")
+	ErrMergeRatioUnreached        = errors.New("merge ratio unreach")
+	ErrDiskSpaceNotEnough         = errors.New("disk space not enough")
+	ErrTxnConflict                = errors.New("transaction conflict, keys read by the transaction have been changed")
+	ErrTxnClosed                  = errors.New("transaction has been committed or rolled back")
+	ErrConditionFailed            = errors.New("write condition not satisfied")
+	ErrEmptyFamilyName            = errors.New("the column family name is empty")
+	ErrFamilyExists               = errors.New("column family already exists")
+	ErrFamilyNotFound             = errors.New("can not found the column family")
+	ErrDefaultFamily              = errors.New("the default column family can not be dropped or truncated")
+	ErrCreateIndexFailed          = errors.New("can not create index")
+	ErrInvalidCompression         = errors.New("compression codec or level is invalid")
+	ErrEncryptionUnsupported      = errors.New("encryption is not supported by the B+ tree index")
+	ErrInvalidBlobOptions         = errors.New("blob threshold, blob file size or blob gc ratio is invalid")
+	ErrBlobGCIsProgress           = errors.New("blob gc is in progress, try again later")
+	ErrInvalidRecoveryConcurrency = errors.New("recovery concurrency can not be negative")
+	ErrInvalidRecoveryMode        = errors.New("unknown recovery mode")
+	ErrRepairUnsupported          = errors.New("repair is not supported by the B+ tree index")
+	ErrRepairDirNotEmpty          = errors.New("the repair destination directory is not empty")
+	ErrInvalidWatchOptions        = errors.New("watch buffer size can not be negative or the overflow policy is unknown")
+	ErrBackupUnsupported          = errors.New("incremental backup is not supported by the B+ tree index")
+	ErrBackupManifestNotFound     = errors.New("backup manifest not found, the backup may be incomplete")
+	ErrBackupCorrupted            = errors.New("the backup is corrupted or incomplete")
+	ErrRestoreDirNotEmpty         = errors.New("the restore target directory is not empty")
+	ErrCheckpointUnsupported      = errors.New("checkpoint is not supported by the B+ tree index")
+	ErrCheckpointDirNotEmpty      = errors.New("the checkpoint directory is not empty")
+	ErrReplicationUnsupported     = errors.New("replication is not supported by the B+ tree index")
+	ErrReplicaReadOnly            = errors.New("the replica is read only, write to the primary instead")
+	ErrReplicaNotReady            = errors.New("the replica is seeding from the primary, try again later")
+	ErrReplicationDiverged        = errors.New("the replicated data does not continue the local files")
+	ErrReplicaDirNotEmpty         = errors.New("the replica directory is not empty and is not a replica")
+	ErrInvalidReplicationFrame    = errors.New("invalid replication frame")
+	ErrIncompleteRecord           = errors.New("the log record is incomplete, the data file may be torn by a crash")
+	ErrKeysOnlyIterator           = errors.New("the iterator only iterates keys, values are not read")
+	ErrInvalidValueCacheSize      = errors.New("value cache size can not be negative")
+	ErrSnapshotUnsupported        = errors.New("can not create a snapshot of the index")
+	ErrWriteBatchUnavailable      = errors.New("write batch is unavailable, the B+ tree index has no write batch id file")
+	ErrFileHintCorrupted          = errors.New("the hint file does not match its data file")
 )
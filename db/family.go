@@ -0,0 +1,405 @@
+package db
+
+import (
+	"io"
+	"kv-go/data"
+	"kv-go/index"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultFamilyName = "default"
+	familyNextIdKey   = "next-family-id"
+	familyDirPrefix   = "family-"
+)
+
+// ColumnFamily 数据库中一个独立的keyspace
+// 每个column family有自己的index与统计信息，所有column family共享数据文件，WriteBatch可以原子地写入多个column family
+type ColumnFamily struct {
+	db          *DB
+	id          uint32        // 写入数据文件的family id，Truncate后会分配新的id，旧id的记录随之失效
+	name        string        // column family的名字
+	index       index.Indexer // 该column family的索引
+	invalidSize int64         // 该column family中的无效数据
+}
+
+type FamilyStat struct {
+	KeyNum      int64 // key的数量
+	InvalidSize int64 // 无效数据量(Byte)
+}
+
+// 创建column family
+func (db *DB) CreateColumnFamily(name string) (*ColumnFamily, error) {
+	if len(name) == 0 {
+		return nil, ErrEmptyFamilyName
+	}
+	if db.isReplica {
+		return nil, ErrReplicaReadOnly
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.getFamily(name) != nil {
+		return nil, ErrFamilyExists
+	}
+	id := db.nextFamilyId
+	familyIndex, err := db.newFamilyIndex(id)
+	if err != nil {
+		return nil, err
+	}
+	cf := &ColumnFamily{db: db, id: id, name: name, index: familyIndex}
+	db.families[id] = cf
+	db.nextFamilyId++
+	// 先持久化family信息，失败时回滚
+	if err := db.saveFamilies(); err != nil {
+		delete(db.families, id)
+		db.nextFamilyId--
+		_ = db.closeFamilyIndex(id, familyIndex)
+		return nil, err
+	}
+	return cf, nil
+}
+
+// 获取指定名字的column family
+func (db *DB) ColumnFamily(name string) (*ColumnFamily, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	cf := db.getFamily(name)
+	if cf == nil {
+		return nil, ErrFamilyNotFound
+	}
+	return cf, nil
+}
+
+// 获取默认的column family，DB上的读写操作都作用于它
+func (db *DB) DefaultColumnFamily() *ColumnFamily {
+	return db.defaultFamily
+}
+
+// 获取所有column family的名字，按名字排序
+func (db *DB) ListColumnFamilies() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	names := make([]string, 0, len(db.families))
+	for _, cf := range db.families {
+		names = append(names, cf.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 删除column family，其中的数据在下一次merge时被回收
+// 调用前需要关闭该column family上的迭代器
+func (db *DB) DropColumnFamily(name string) error {
+	if name == DefaultFamilyName {
+		return ErrDefaultFamily
+	}
+	if db.isReplica {
+		return ErrReplicaReadOnly
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	cf := db.getFamily(name)
+	if cf == nil {
+		return ErrFamilyNotFound
+	}
+	delete(db.families, cf.id)
+	if err := db.saveFamilies(); err != nil {
+		db.families[cf.id] = cf
+		return err
+	}
+	// 该column family中的所有记录都变为无效数据
+	db.invalidSize += cf.discardAll()
+	db.removeWatchers(cf)
+	return db.closeFamilyIndex(cf.id, cf.index)
+}
+
+// Truncate 清空column family中的所有数据，其中的数据在下一次merge时被回收
+// 调用前需要关闭该column family上的迭代器
+func (cf *ColumnFamily) Truncate() error {
+	if cf.id == 0 {
+		return ErrDefaultFamily
+	}
+	db := cf.db
+	if db.isReplica {
+		return ErrReplicaReadOnly
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !cf.isAlive() {
+		return ErrFamilyNotFound
+	}
+	// 分配新的family id，旧id的记录不会再被加载
+	oldId, newId := cf.id, db.nextFamilyId
+	familyIndex, err := db.newFamilyIndex(newId)
+	if err != nil {
+		return err
+	}
+	delete(db.families, oldId)
+	db.families[newId] = cf
+	db.nextFamilyId++
+	cf.id = newId
+	if err := db.saveFamilies(); err != nil {
+		delete(db.families, newId)
+		db.families[oldId] = cf
+		db.nextFamilyId--
+		cf.id = oldId
+		_ = db.closeFamilyIndex(newId, familyIndex)
+		return err
+	}
+	db.invalidSize += cf.discardAll()
+	cf.invalidSize = 0
+	oldIndex := cf.index
+	cf.index = familyIndex
+	return db.closeFamilyIndex(oldId, oldIndex)
+}
+
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+func (cf *ColumnFamily) Stat() (*FamilyStat, error) {
+	cf.db.mu.RLock()
+	defer cf.db.mu.RUnlock()
+	if !cf.isAlive() {
+		return nil, ErrFamilyNotFound
+	}
+	return &FamilyStat{
+		KeyNum:      int64(cf.index.Size()),
+		InvalidSize: cf.invalidSize,
+	}, nil
+}
+
+func (cf *ColumnFamily) Put(key []byte, value []byte) error {
+	return cf.put(key, value, 0, nil)
+}
+
+func (cf *ColumnFamily) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	var expire int64 = 0
+	if ttl != 0 {
+		expire = time.Now().Add(ttl).UnixNano()
+	}
+	return cf.put(key, value, expire, nil)
+}
+
+func (cf *ColumnFamily) Get(key []byte) ([]byte, error) {
+	return cf.get(key)
+}
+
+func (cf *ColumnFamily) MultiGet(keys [][]byte) ([][]byte, []error) {
+	return cf.multiGet(keys)
+}
+
+func (cf *ColumnFamily) TTL(key []byte) (time.Duration, error) {
+	return cf.ttl(key)
+}
+
+func (cf *ColumnFamily) Delete(key []byte) error {
+	return cf.delete(key, nil)
+}
+
+func (cf *ColumnFamily) PutIfAbsent(key []byte, value []byte) error {
+	return cf.put(key, value, 0, &condition{absent: true})
+}
+
+func (cf *ColumnFamily) CompareAndSwap(key []byte, oldValue []byte, newValue []byte) error {
+	return cf.put(key, newValue, 0, &condition{expected: oldValue})
+}
+
+func (cf *ColumnFamily) CompareAndDelete(key []byte, oldValue []byte) error {
+	return cf.delete(key, &condition{expected: oldValue})
+}
+
+func (cf *ColumnFamily) ListKeys(reverse bool) [][]byte {
+	return cf.listKeys(reverse)
+}
+
+func (cf *ColumnFamily) Fold(fn func(key []byte, val []byte) bool) error {
+	return cf.fold(fn)
+}
+
+// 获取column family上的迭代器，column family已经被删除时返回nil
+func (cf *ColumnFamily) NewIterator(opts ItOptions) *DBIterator {
+	cf.db.mu.RLock()
+	alive := cf.isAlive()
+	cf.db.mu.RUnlock()
+	if !alive {
+		return nil
+	}
+	return cf.newIterator(opts)
+}
+
+// 判断column family是否仍然有效，调用者需要持有db.mu
+func (cf *ColumnFamily) isAlive() bool {
+	return cf.db.families[cf.id] == cf
+}
+
+// 统计无效字节数，同时计入整个db的无效字节数
+func (cf *ColumnFamily) addInvalidSize(sz int64) {
+	cf.invalidSize += sz
+	cf.db.invalidSize += sz
+}
+
+// 记录被覆盖或删除后，其在数据文件与blob file中占用的空间都变为无效数据
+func (cf *ColumnFamily) discard(pos *data.LogRecordPos) {
+	cf.addInvalidSize(int64(pos.RecordSize))
+	cf.db.discardLiveSize(pos)
+	cf.db.discardBlob(pos)
+}
+
+// 记录被index引用后，其在数据文件中占用的空间计为有效数据
+func (db *DB) addLiveSize(pos *data.LogRecordPos) {
+	db.liveSize[pos.Fid] += int64(pos.RecordSize)
+}
+
+// 记录不再被index引用，其在数据文件中占用的空间不再是有效数据
+func (db *DB) discardLiveSize(pos *data.LogRecordPos) {
+	db.liveSize[pos.Fid] -= int64(pos.RecordSize)
+}
+
+// column family中的所有记录都变为无效数据，返回其在数据文件中占用的字节数
+func (cf *ColumnFamily) discardAll() int64 {
+	iter := index.NewUnorderedIterator(cf.index)
+	defer iter.Close()
+	var size int64 = 0
+	for iter.Rewind(); !iter.IsEnd(); iter.Next() {
+		size += int64(iter.Value().RecordSize)
+		cf.db.discardLiveSize(iter.Value())
+		cf.db.discardBlob(iter.Value())
+	}
+	return size
+}
+
+// 根据名字查找column family，调用者需要持有db.mu
+func (db *DB) getFamily(name string) *ColumnFamily {
+	for _, cf := range db.families {
+		if cf.name == name {
+			return cf
+		}
+	}
+	return nil
+}
+
+// 创建column family的index，B+树索引保存在各自的目录中
+func (db *DB) newFamilyIndex(id uint32) (index.Indexer, error) {
+	dirPath := db.opts.DirPath
+	if db.opts.Indexer == index.BPlusTreeType {
+		dirPath = filepath.Join(db.opts.DirPath, familyDirPrefix+strconv.Itoa(int(id)))
+		if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	familyIndex := index.NewIndexer(db.opts.Indexer, dirPath, db.opts.AlwaysSync)
+	if familyIndex == nil {
+		return nil, ErrCreateIndexFailed
+	}
+	return familyIndex, nil
+}
+
+// 关闭不再使用的column family的index，并删除B+树索引的目录
+func (db *DB) closeFamilyIndex(id uint32, familyIndex index.Indexer) error {
+	if err := familyIndex.Close(); err != nil {
+		return err
+	}
+	if db.opts.Indexer == index.BPlusTreeType {
+		return os.RemoveAll(filepath.Join(db.opts.DirPath, familyDirPrefix+strconv.Itoa(int(id))))
+	}
+	return nil
+}
+
+// 加载column family信息，需要在加载index之前调用
+func (db *DB) loadFamilies() error {
+	fileName := filepath.Join(db.opts.DirPath, data.FamilyFileName)
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return nil
+	}
+	familyFile, err := db.withCipher(data.OpenFamilyFile(db.opts.DirPath, data.FamilyFileName))
+	if err != nil {
+		return err
+	}
+	defer familyFile.Close()
+	var off int64 = 0
+	for {
+		logRecord, sz, err := familyFile.ReadLogRecord(off)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		off += sz
+		id, err := strconv.ParseUint(string(logRecord.Value), 10, 32)
+		if err != nil {
+			return err
+		}
+		// finished类型的记录保存下一个可用的family id
+		if logRecord.Typ == data.LogRecordFinished {
+			db.nextFamilyId = uint32(id)
+			continue
+		}
+		familyIndex, err := db.newFamilyIndex(uint32(id))
+		if err != nil {
+			return err
+		}
+		db.families[uint32(id)] = &ColumnFamily{
+			db:    db,
+			id:    uint32(id),
+			name:  string(logRecord.Key),
+			index: familyIndex,
+		}
+	}
+	return nil
+}
+
+// 持久化column family信息，先写入临时文件再重命名，保证文件总是完整的
+func (db *DB) saveFamilies() error {
+	tmpFileName := filepath.Join(db.opts.DirPath, data.FamilyTmpFileName)
+	if err := os.RemoveAll(tmpFileName); err != nil {
+		return err
+	}
+	familyFile, err := db.withCipher(data.OpenFamilyFile(db.opts.DirPath, data.FamilyTmpFileName))
+	if err != nil {
+		return err
+	}
+	records := []*data.LogRecord{{
+		Key:   []byte(familyNextIdKey),
+		Value: []byte(strconv.Itoa(int(db.nextFamilyId))),
+		Typ:   data.LogRecordFinished,
+	}}
+	for id, cf := range db.families {
+		// 默认的column family不需要保存
+		if id == 0 {
+			continue
+		}
+		records = append(records, &data.LogRecord{
+			Key:   []byte(cf.name),
+			Value: []byte(strconv.Itoa(int(id))),
+		})
+	}
+	for _, record := range records {
+		encRecord, _, err := db.encodeLogRecord(record)
+		if err == nil {
+			err = familyFile.Write(encRecord)
+		}
+		if err != nil {
+			familyFile.Close()
+			return err
+		}
+	}
+	if err := familyFile.Sync(); err != nil {
+		familyFile.Close()
+		return err
+	}
+	if err := familyFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFileName, filepath.Join(db.opts.DirPath, data.FamilyFileName)); err != nil {
+		return err
+	}
+	// follower无法从数据文件中得知column family的变化，需要重新全量同步
+	db.bumpReplicationGen()
+	return nil
+}
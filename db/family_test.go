@@ -0,0 +1,239 @@
+package db
+
+import (
+	"context"
+	"kv-go/index"
+	"kv-go/utils"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestColumnFamily(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-column-family")
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	{
+		// 不同column family中的相同key互不影响
+		users, err := db.CreateColumnFamily("users")
+		assert.Nil(t, err)
+		_, err = db.CreateColumnFamily("users")
+		assert.Equal(t, ErrFamilyExists, err)
+		_, err = db.CreateColumnFamily("")
+		assert.Equal(t, ErrEmptyFamilyName, err)
+		assert.Equal(t, []string{DefaultFamilyName, "users"}, db.ListColumnFamilies())
+
+		assert.Nil(t, db.Put([]byte("k1"), []byte("default")))
+		assert.Nil(t, users.Put([]byte("k1"), []byte("users")))
+		assert.Nil(t, users.Put([]byte("k2"), []byte("users")))
+		assert.Nil(t, users.Put([]byte("k2"), []byte("users-2")))
+		val, err := db.Get([]byte("k1"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("default"), val)
+		val, err = users.Get([]byte("k1"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("users"), val)
+		_, err = db.Get([]byte("k2"))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		// ListKeys、Fold、迭代器与统计信息都只针对各自的column family
+		assert.Equal(t, [][]byte{[]byte("k1")}, db.ListKeys(false))
+		assert.Equal(t, [][]byte{[]byte("k1"), []byte("k2")}, users.ListKeys(false))
+		iter := users.NewIterator(DefaultItOptions)
+		assert.Equal(t, []byte("k1"), iter.Key())
+		iter.Next()
+		val, err = iter.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("users-2"), val)
+		iter.Close()
+		stat, err := users.Stat()
+		assert.Nil(t, err)
+		assert.Equal(t, int64(2), stat.KeyNum)
+		assert.Greater(t, stat.InvalidSize, int64(0))
+		stat, err = db.DefaultColumnFamily().Stat()
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1), stat.KeyNum)
+		assert.Equal(t, int64(0), stat.InvalidSize)
+		dbStat, err := db.Stat()
+		assert.Nil(t, err)
+		assert.Equal(t, int64(3), dbStat.KeyNum)
+
+		assert.Nil(t, users.Delete([]byte("k1")))
+		_, err = users.Get([]byte("k1"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		_, err = db.Get([]byte("k1"))
+		assert.Nil(t, err)
+	}
+
+	{
+		// 重启后column family与其中的数据仍然存在
+		assert.Nil(t, db.Close())
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		users, err := db.ColumnFamily("users")
+		assert.Nil(t, err)
+		val, err := users.Get([]byte("k2"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("users-2"), val)
+		_, err = users.Get([]byte("k1"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		val, err = db.Get([]byte("k1"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("default"), val)
+		_, err = db.ColumnFamily("missing")
+		assert.Equal(t, ErrFamilyNotFound, err)
+	}
+}
+
+func TestColumnFamilyDropTruncate(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-column-family-drop")
+	opts.MergeRatio = 0
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	{
+		// 删除与清空column family后，其中的数据不可见，重启后也不会被加载
+		logs, err := db.CreateColumnFamily("logs")
+		assert.Nil(t, err)
+		tmp, err := db.CreateColumnFamily("tmp")
+		assert.Nil(t, err)
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, logs.Put(utils.GetTestKey(i), utils.GetTestValue(128)))
+			assert.Nil(t, tmp.Put(utils.GetTestKey(i), utils.GetTestValue(128)))
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(128)))
+		}
+		assert.Equal(t, ErrDefaultFamily, db.DropColumnFamily(DefaultFamilyName))
+		assert.Equal(t, ErrDefaultFamily, db.DefaultColumnFamily().Truncate())
+
+		assert.Nil(t, db.DropColumnFamily("tmp"))
+		assert.Equal(t, ErrFamilyNotFound, db.DropColumnFamily("tmp"))
+		_, err = tmp.Get(utils.GetTestKey(1))
+		assert.Equal(t, ErrFamilyNotFound, err)
+		assert.Equal(t, ErrFamilyNotFound, tmp.Put(utils.GetTestKey(1), nil))
+		assert.Nil(t, tmp.NewIterator(DefaultItOptions))
+
+		assert.Nil(t, logs.Truncate())
+		assert.Equal(t, 0, len(logs.ListKeys(false)))
+		assert.Nil(t, logs.Put(utils.GetTestKey(1), []byte("new")))
+		assert.Equal(t, []string{DefaultFamilyName, "logs"}, db.ListColumnFamilies())
+
+		assert.Nil(t, db.Close())
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		logs, err = db.ColumnFamily("logs")
+		assert.Nil(t, err)
+		assert.Equal(t, [][]byte{utils.GetTestKey(1)}, logs.ListKeys(false))
+		_, err = db.ColumnFamily("tmp")
+		assert.Equal(t, ErrFamilyNotFound, err)
+		// 重新创建同名的column family，旧数据不会出现
+		tmp, err = db.CreateColumnFamily("tmp")
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(tmp.ListKeys(false)))
+		assert.Equal(t, 100, len(db.ListKeys(false)))
+	}
+
+	{
+		// merge保留各个column family中的有效数据，回收被删除的数据
+		logs, _ := db.ColumnFamily("logs")
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, logs.Put(utils.GetTestKey(i), utils.GetTestValue(128)))
+		}
+		assert.Nil(t, db.DropColumnFamily("tmp"))
+		assert.Nil(t, db.Merge(context.Background()))
+		stat, err := logs.Stat()
+		assert.Nil(t, err)
+		assert.Equal(t, int64(100), stat.KeyNum)
+		assert.Nil(t, db.Close())
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		logs, err = db.ColumnFamily("logs")
+		assert.Nil(t, err)
+		assert.Equal(t, 100, len(logs.ListKeys(false)))
+		assert.Equal(t, 100, len(db.ListKeys(false)))
+	}
+}
+
+func TestColumnFamilyBatch(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-column-family-batch")
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	{
+		// WriteBatch可以原子地写入多个column family
+		orders, err := db.CreateColumnFamily("orders")
+		assert.Nil(t, err)
+		assert.Nil(t, db.Put([]byte("stock"), []byte("10")))
+		wb := db.NewWriteBatch(DefaultWBOptions)
+		assert.Nil(t, wb.Put([]byte("stock"), []byte("9")))
+		assert.Nil(t, wb.PutCF(orders, []byte("stock"), []byte("order-1")))
+		assert.Nil(t, wb.Commit())
+		val, err := db.Get([]byte("stock"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("9"), val)
+		val, err = orders.Get([]byte("stock"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("order-1"), val)
+
+		wb = db.NewWriteBatch(DefaultWBOptions)
+		assert.Nil(t, wb.DeleteCF(orders, []byte("stock")))
+		assert.Nil(t, wb.Commit())
+		_, err = orders.Get([]byte("stock"))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		// 写入已经被删除的column family时，整个批次都不会写入
+		assert.Nil(t, orders.Put([]byte("o2"), []byte("order-2")))
+		wb = db.NewWriteBatch(DefaultWBOptions)
+		assert.Nil(t, wb.Put([]byte("stock"), []byte("8")))
+		assert.Nil(t, wb.PutCF(orders, []byte("o3"), []byte("order-3")))
+		assert.Nil(t, db.DropColumnFamily("orders"))
+		assert.Equal(t, ErrFamilyNotFound, wb.Commit())
+		val, err = db.Get([]byte("stock"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("9"), val)
+	}
+}
+
+func TestColumnFamilyBPlusTree(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-column-family-bptree")
+	opts.Indexer = index.BPlusTreeType
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	{
+		// B+树索引的column family保存在各自的目录中
+		items, err := db.CreateColumnFamily("items")
+		assert.Nil(t, err)
+		assert.Nil(t, items.Put([]byte("i1"), []byte("item-1")))
+		assert.Nil(t, db.Put([]byte("i1"), []byte("default")))
+		val, err := items.Get([]byte("i1"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("item-1"), val)
+		_, err = os.Stat(filepath.Join(opts.DirPath, familyDirPrefix+"1"))
+		assert.Nil(t, err)
+
+		// 清空后旧的索引目录被删除
+		assert.Nil(t, items.Truncate())
+		_, err = items.Get([]byte("i1"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		entries, _ := os.ReadDir(opts.DirPath)
+		var familyDirs = 0
+		for _, entry := range entries {
+			if entry.IsDir() {
+				familyDirs++
+			}
+		}
+		assert.Equal(t, 1, familyDirs)
+		_, err = os.Stat(filepath.Join(opts.DirPath, familyDirPrefix+"1"))
+		assert.True(t, os.IsNotExist(err))
+		val, err = db.Get([]byte("i1"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("default"), val)
+	}
+}
@@ -0,0 +1,414 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"kv-go/data"
+	"kv-go/fio"
+	"kv-go/index"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	replicaStateFileName    = "replica-state"
+	replicaStateTmpFileName = "replica-state.tmp"
+	followerRetryInterval   = 200 * time.Millisecond
+)
+
+// Follower 从primary复制数据的只读副本
+// 断开后自动重连，并从本地活跃文件的末尾继续同步，primary的数据文件被替换后会重新全量同步
+type Follower struct {
+	opts     DBOptions
+	addr     string             // primary的地址
+	mu       *sync.RWMutex      // 保护db，全量同步时会替换db
+	db       *DB                // 本地的只读副本，为nil时正在全量同步
+	epoch    uint64             // 本地数据对应的primary epoch
+	gen      uint64             // 本地数据对应的primary gen
+	loader   *indexLoader       // 应用记录时暂存未完成的WriteBatch
+	applyOff int64              // 活跃文件中已经应用到index的位置
+	cancel   context.CancelFunc // 用于停止同步
+	wg       *sync.WaitGroup    // 用于等待同步的协程退出
+}
+
+// Follow 在opts.DirPath中打开primaryAddr的只读副本，并在后台持续同步
+// 数据目录必须为空或者是之前的副本，primary使用了加密时需要配置相同的KeyProvider
+func Follow(opts DBOptions, primaryAddr string) (*Follower, error) {
+	if opts.Indexer == index.BPlusTreeType {
+		return nil, ErrReplicationUnsupported
+	}
+	// follower的数据文件必须与primary保持一致，不能自行merge
+	opts.MergeInterval = 0
+	f := &Follower{
+		opts: opts,
+		addr: primaryAddr,
+		mu:   new(sync.RWMutex),
+		wg:   new(sync.WaitGroup),
+	}
+	epoch, gen, err := readReplicaState(opts.DirPath)
+	if os.IsNotExist(err) {
+		// 避免覆盖已有的数据库
+		if entries, err := os.ReadDir(opts.DirPath); err == nil && len(entries) > 0 {
+			return nil, ErrReplicaDirNotEmpty
+		}
+	} else if err != nil {
+		return nil, err
+	} else if epoch == 0 {
+		// 上一次全量同步没有完成，丢弃同步了一部分的文件
+		if err := os.RemoveAll(opts.DirPath); err != nil {
+			return nil, err
+		}
+	}
+	f.epoch, f.gen = epoch, gen
+	if err := f.openDB(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel = cancel
+	f.wg.Add(1)
+	go f.run(ctx)
+	return f, nil
+}
+
+// Get 读取副本中key对应的value
+func (f *Follower) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := f.View(func(db *DB) error {
+		var err error
+		value, err = db.Get(key)
+		return err
+	})
+	return value, err
+}
+
+// View 在副本上执行只读操作，fn执行期间副本不会因为全量同步被替换
+func (f *Follower) View(fn func(db *DB) error) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.db == nil {
+		return ErrReplicaNotReady
+	}
+	return fn(f.db)
+}
+
+// Close 停止同步并关闭副本
+func (f *Follower) Close() error {
+	f.cancel()
+	f.wg.Wait()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.db == nil {
+		return nil
+	}
+	err := f.db.Close()
+	f.db = nil
+	return err
+}
+
+// 断开后等待一段时间再重连
+func (f *Follower) run(ctx context.Context) {
+	defer f.wg.Done()
+	for {
+		err := f.sync(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("replication from %s interrupted, %v\n", f.addr, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(followerRetryInterval):
+		}
+	}
+}
+
+// 连接primary，发送本地的同步位置，然后持续应用primary发送的帧
+func (f *Follower) sync(ctx context.Context) error {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", f.addr)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+	defer conn.Close()
+	pos := f.position()
+	if err := binary.Write(conn, binary.LittleEndian, &pos); err != nil {
+		return err
+	}
+	r := bufio.NewReaderSize(conn, replicationChunkSize)
+	for {
+		var h frameHeader
+		if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+			return err
+		}
+		name := make([]byte, h.NameSize)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return err
+		}
+		payload := make([]byte, h.Size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+		switch h.Typ {
+		case frameData, frameBlob:
+			err = f.apply(h, payload)
+		case frameSeedBegin:
+			err = f.beginSeed()
+		case frameSeedFile:
+			err = f.writeSeedFile(string(name), h.Off, payload)
+		case frameSeedEnd:
+			err = f.endSeed(payload)
+		default:
+			err = ErrInvalidReplicationFrame
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// 本地已经收到的位置，即活跃文件与活跃的blob file的末尾
+func (f *Follower) position() replicationPos {
+	pos := replicationPos{Epoch: f.epoch, Gen: f.gen}
+	db := f.db
+	if db == nil {
+		return replicationPos{}
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.activeFile != nil {
+		pos.DataFid, pos.DataOff = db.activeFile.FileId, db.activeFile.WriteOff
+	}
+	if db.activeBlobFile != nil {
+		pos.BlobFid, pos.BlobOff = db.activeBlobFile.FileId, db.activeBlobFile.WriteOff
+	}
+	return pos
+}
+
+// 将primary发送的字节追加到本地文件，数据文件的负载结束于完整的记录时更新index
+func (f *Follower) apply(h frameHeader, payload []byte) error {
+	db := f.db
+	if db == nil {
+		return ErrReplicationDiverged
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if h.Typ == frameBlob {
+		return f.appendBlob(h, payload)
+	}
+	// primary切换到新的数据文件，当前的活跃文件已经完整
+	if db.activeFile == nil || db.activeFile.FileId != h.Fid {
+		if h.Off != 0 || db.activeFile != nil && (h.Fid < db.activeFile.FileId || f.applyOff != db.activeFile.WriteOff) {
+			return ErrReplicationDiverged
+		}
+		if db.activeFile != nil {
+			if err := db.syncFile(db.activeFile); err != nil {
+				return err
+			}
+			db.inActivaFile[db.activeFile.FileId] = db.activeFile
+			db.writeFileHintAsync(db.activeFile)
+		}
+		dataFile, err := db.withCipher(data.OpenDataFile(db.opts.DirPath, h.Fid, fio.FileIOType))
+		if err != nil {
+			return err
+		}
+		db.activeFile = dataFile
+		f.applyOff = 0
+	}
+	if h.Off != db.activeFile.WriteOff {
+		return ErrReplicationDiverged
+	}
+	if err := db.activeFile.Write(payload); err != nil {
+		return err
+	}
+	if !h.Boundary {
+		return nil
+	}
+	f.loader.now = time.Now().UnixNano()
+	for f.applyOff < db.activeFile.WriteOff {
+		logRecord, sz, err := db.activeFile.ReadLogRecord(f.applyOff)
+		if err != nil {
+			return err
+		}
+		f.loader.loadRecord(logRecord, &data.LogRecordPos{
+			Fid:        h.Fid,
+			Offset:     f.applyOff,
+			RecordSize: uint32(sz),
+			Expire:     logRecord.Expire,
+			Blob:       getBlobPos(logRecord),
+		})
+		f.applyOff += sz
+	}
+	if db.opts.AlwaysSync {
+		if err := db.syncBlobFile(); err != nil {
+			return err
+		}
+		return db.syncFile(db.activeFile)
+	}
+	return nil
+}
+
+// blob file中的value总是先于引用它的记录到达
+func (f *Follower) appendBlob(h frameHeader, payload []byte) error {
+	db := f.db
+	if db.activeBlobFile == nil || db.activeBlobFile.FileId != h.Fid {
+		if h.Off != 0 || db.activeBlobFile != nil && h.Fid < db.activeBlobFile.FileId {
+			return ErrReplicationDiverged
+		}
+		if err := db.syncBlobFile(); err != nil {
+			return err
+		}
+		blobFile, err := db.withCipher(data.OpenBlobFile(db.opts.DirPath, h.Fid, fio.FileIOType))
+		if err != nil {
+			return err
+		}
+		db.blobFiles[h.Fid] = blobFile
+		db.activeBlobFile = blobFile
+	}
+	if h.Off != db.activeBlobFile.WriteOff {
+		return ErrReplicationDiverged
+	}
+	return db.activeBlobFile.Write(payload)
+}
+
+// 关闭并清空本地副本，准备接收全量数据
+func (f *Follower) beginSeed() error {
+	f.mu.Lock()
+	db := f.db
+	f.db = nil
+	f.mu.Unlock()
+	if db != nil {
+		if err := db.Close(); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(f.opts.DirPath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(f.opts.DirPath, os.ModePerm); err != nil {
+		return err
+	}
+	// epoch为0表示全量同步没有完成
+	f.epoch, f.gen = 0, 0
+	return writeReplicaState(f.opts.DirPath, 0, 0)
+}
+
+func (f *Follower) writeSeedFile(name string, off int64, payload []byte) error {
+	if f.db != nil || name != filepath.Base(name) || name == "." || name == ".." || name == replicaStateFileName {
+		return ErrInvalidReplicationFrame
+	}
+	file, err := os.OpenFile(filepath.Join(f.opts.DirPath, name), os.O_CREATE|os.O_WRONLY, fio.DataFilePerm)
+	if err != nil {
+		return err
+	}
+	if _, err = file.WriteAt(payload, off); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// 全量数据接收完成，打开新的副本
+func (f *Follower) endSeed(payload []byte) error {
+	if f.db != nil || len(payload) != 16 {
+		return ErrInvalidReplicationFrame
+	}
+	epoch, gen := binary.LittleEndian.Uint64(payload), binary.LittleEndian.Uint64(payload[8:])
+	if err := writeReplicaState(f.opts.DirPath, epoch, gen); err != nil {
+		return err
+	}
+	f.epoch, f.gen = epoch, gen
+	return f.openDB()
+}
+
+func (f *Follower) openDB() error {
+	db, err := Open(f.opts)
+	if err != nil {
+		return err
+	}
+	db.isReplica = true
+	f.loader = newIndexLoader(db)
+	f.applyOff = 0
+	if db.activeFile != nil {
+		// 上一次退出时WriteBatch的记录可能没有全部到达，重新加载最后的数据文件，将这些记录暂存到loader中
+		var lastFileId uint32
+		for fileId := range db.inActivaFile {
+			lastFileId = max(lastFileId, fileId)
+		}
+		if lastFile, ok := db.inActivaFile[lastFileId]; ok {
+			if _, err := f.replay(lastFile); err != nil {
+				_ = db.Close()
+				return err
+			}
+		}
+		if f.applyOff, err = f.replay(db.activeFile); err != nil {
+			_ = db.Close()
+			return err
+		}
+	}
+	f.mu.Lock()
+	f.db = db
+	f.mu.Unlock()
+	return nil
+}
+
+// 按顺序重新加载数据文件中的所有记录，返回加载到的位置
+func (f *Follower) replay(dataFile *data.DataFile) (int64, error) {
+	var off int64
+	for {
+		logRecord, sz, err := dataFile.ReadLogRecord(off)
+		if err == io.EOF {
+			return off, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		f.loader.loadRecord(logRecord, &data.LogRecordPos{
+			Fid:        dataFile.FileId,
+			Offset:     off,
+			RecordSize: uint32(sz),
+			Expire:     logRecord.Expire,
+			Blob:       getBlobPos(logRecord),
+		})
+		off += sz
+	}
+}
+
+// 读取副本对应的primary epoch与gen，文件不存在时返回的错误满足os.IsNotExist
+func readReplicaState(dirPath string) (uint64, uint64, error) {
+	contents, err := os.ReadFile(filepath.Join(dirPath, replicaStateFileName))
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(contents) != 16 {
+		return 0, 0, nil
+	}
+	return binary.LittleEndian.Uint64(contents), binary.LittleEndian.Uint64(contents[8:]), nil
+}
+
+// 先写入临时文件再重命名
+func writeReplicaState(dirPath string, epoch uint64, gen uint64) error {
+	contents := make([]byte, 16)
+	binary.LittleEndian.PutUint64(contents, epoch)
+	binary.LittleEndian.PutUint64(contents[8:], gen)
+	tmpFileName := filepath.Join(dirPath, replicaStateTmpFileName)
+	if err := os.WriteFile(tmpFileName, contents, fio.DataFilePerm); err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, filepath.Join(dirPath, replicaStateFileName))
+}
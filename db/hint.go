@@ -0,0 +1,188 @@
+package db
+
+import (
+	"io"
+	"kv-go/data"
+	"kv-go/index"
+	"log"
+	"os"
+)
+
+// 写入hint file时使用的临时文件后缀，写入完成后再重命名，保证hint file总是完整的
+const fileHintTmpSuffix = ".tmp"
+
+// 在后台为写满的数据文件生成hint file，下次启动时不需要再读取该数据文件中的value
+func (db *DB) writeFileHintAsync(dataFile *data.DataFile) {
+	// B+树的index保存在磁盘中，启动时不需要加载
+	if db.hintDisabled || db.opts.Indexer == index.BPlusTreeType {
+		return
+	}
+	db.hintWg.Add(1)
+	go func() {
+		defer db.hintWg.Done()
+		if err := db.writeFileHint(dataFile); err != nil {
+			log.Printf("failed to write hint file for data file %d, %v\n", dataFile.FileId, err)
+		}
+	}()
+}
+
+// hint file中的记录与数据文件中的记录一一对应，key与类型不变，value为记录的位置信息
+func (db *DB) writeFileHint(dataFile *data.DataFile) error {
+	hintFileName := data.GetFileHintNameById(db.opts.DirPath, dataFile.FileId)
+	tmpFileName := hintFileName + fileHintTmpSuffix
+	if err := os.RemoveAll(tmpFileName); err != nil {
+		return err
+	}
+	hintFile, err := db.withCipher(data.OpenFileHintFile(tmpFileName, dataFile.FileId))
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpFileName)
+	var off int64 = 0
+	for off < dataFile.WriteOff {
+		logRecord, recordOff, sz, err := db.readDataLogRecord(dataFile, off)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			hintFile.Close()
+			// 数据文件在写入hint file期间被merge替换，不再需要hint file
+			if db.isFileRetired(dataFile) {
+				return nil
+			}
+			return err
+		}
+		off = recordOff
+		pos := &data.LogRecordPos{
+			Fid:        dataFile.FileId,
+			Offset:     off,
+			RecordSize: uint32(sz),
+			Expire:     logRecord.Expire,
+			Blob:       getBlobPos(logRecord),
+		}
+		encRecord, _, err := db.encodeLogRecord(&data.LogRecord{
+			Key:    logRecord.Key,
+			Value:  data.EncodeLogRecordPos(pos),
+			Typ:    logRecord.Typ,
+			Family: logRecord.Family,
+		})
+		if err == nil {
+			err = hintFile.Write(encRecord)
+		}
+		if err != nil {
+			hintFile.Close()
+			return err
+		}
+		off += sz
+	}
+	if err := hintFile.Sync(); err != nil {
+		hintFile.Close()
+		return err
+	}
+	if err := hintFile.Close(); err != nil {
+		return err
+	}
+	// 持有锁时重命名，避免与merge删除旧的hint file竞争
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.inActivaFile[dataFile.FileId] != dataFile {
+		return nil
+	}
+	return os.Rename(tmpFileName, hintFileName)
+}
+
+// 判断数据文件是否已经被merge替换
+func (db *DB) isFileRetired(dataFile *data.DataFile) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.inActivaFile[dataFile.FileId] != dataFile
+}
+
+// 遍历数据文件中的所有记录，useHint为true且存在hint file时，直接从hint file中读取记录的key、类型与位置
+// 返回是否使用了hint file，完整读取数据文件时数据文件的有效长度，以及根据RecoveryMode丢弃的损坏数据
+func (db *DB) foreachFileRecord(dataFile *data.DataFile, useHint bool, fn func(logRecord *data.LogRecord, pos *data.LogRecordPos)) (bool, int64, []DiscardedRange, error) {
+	hintFileName := data.GetFileHintNameById(db.opts.DirPath, dataFile.FileId)
+	if _, err := os.Stat(hintFileName); useHint && err == nil {
+		// hint file只是数据文件的派生数据，损坏时删除它并读取数据文件
+		logRecords, positions, err := db.readFileHint(hintFileName, dataFile)
+		if err == nil {
+			for i, logRecord := range logRecords {
+				fn(logRecord, positions[i])
+			}
+			return true, 0, nil, nil
+		}
+		log.Printf("failed to read hint file for data file %d, fall back to the data file, %v\n", dataFile.FileId, err)
+		if err := os.Remove(hintFileName); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	var discarded []DiscardedRange
+	var off, writeOff int64 = 0, 0
+	for {
+		logRecord, sz, readErr := dataFile.ReadLogRecord(off)
+		if readErr != nil {
+			next, err := db.skipCorruptRecord(dataFile, off, readErr)
+			if next > off {
+				discarded = append(discarded, DiscardedRange{Fid: dataFile.FileId, Offset: off, Size: next - off, Err: corruptError(readErr)})
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return false, 0, nil, err
+			}
+			off = next
+			continue
+		}
+		fn(logRecord, &data.LogRecordPos{
+			Fid:        dataFile.FileId,
+			Offset:     off,
+			RecordSize: uint32(sz),
+			Expire:     logRecord.Expire,
+			Blob:       getBlobPos(logRecord),
+		})
+		off += sz
+		writeOff = off
+	}
+	return false, writeOff, discarded, nil
+}
+
+// 读取并校验hint file中的所有记录，全部有效时才返回，避免损坏的hint file中的部分记录被加载到index中
+func (db *DB) readFileHint(hintFileName string, dataFile *data.DataFile) ([]*data.LogRecord, []*data.LogRecordPos, error) {
+	hintFile, err := db.withCipher(data.OpenFileHintFile(hintFileName, dataFile.FileId))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer hintFile.Close()
+	dataFileSize, err := dataFile.IOManager.Size()
+	if err != nil {
+		return nil, nil, err
+	}
+	hintFileSize, err := hintFile.IOManager.Size()
+	if err != nil {
+		return nil, nil, err
+	}
+	var logRecords []*data.LogRecord
+	var positions []*data.LogRecordPos
+	var off int64 = 0
+	for off < hintFileSize {
+		hintRecord, sz, err := hintFile.ReadLogRecord(off)
+		if err != nil {
+			// 记录超出了文件末尾，hint file不完整
+			if err == io.EOF {
+				return nil, nil, ErrIncompleteRecord
+			}
+			return nil, nil, err
+		}
+		pos := data.DecodeLogRecordPos(hintRecord.Value)
+		// 位置必须在数据文件的范围内
+		if pos.Fid != dataFile.FileId || pos.Offset < 0 || pos.Offset+int64(pos.RecordSize) > dataFileSize {
+			return nil, nil, ErrFileHintCorrupted
+		}
+		hintRecord.Expire = pos.Expire
+		logRecords = append(logRecords, hintRecord)
+		positions = append(positions, pos)
+		off += sz
+	}
+	return logRecords, positions, nil
+}
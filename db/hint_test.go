@@ -0,0 +1,153 @@
+package db
+
+import (
+	"context"
+	"kv-go/data"
+	"kv-go/utils"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 数据目录下所有数据文件的hint file是否存在
+func fileHintExists(db *DB) map[uint32]bool {
+	exists := make(map[uint32]bool)
+	for fileId := range db.inActivaFile {
+		_, err := os.Stat(data.GetFileHintNameById(db.opts.DirPath, fileId))
+		exists[fileId] = err == nil
+	}
+	return exists
+}
+
+func TestFileHint(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-file-hint")
+	opts.DataFileSize = 64 * 1024
+	opts.MergeRatio = 0
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	cnt := 3000
+	{
+		// 写满的数据文件在后台生成hint file，活跃文件没有hint file
+		for i := 0; i < cnt; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(128)))
+		}
+		for i := 0; i < cnt; i += 3 {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		}
+		wb := db.NewWriteBatch(DefaultWBOptions)
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, wb.Put(utils.GetTestKey(cnt+i), utils.GetTestValue(128)))
+		}
+		assert.Nil(t, wb.Commit())
+		assert.Nil(t, db.PutWithTTL(utils.GetTestKey(cnt*2), utils.GetTestValue(128), time.Hour))
+		assert.Nil(t, db.PutWithTTL(utils.GetTestKey(cnt*2+1), utils.GetTestValue(128), time.Millisecond))
+		for i := 0; i < cnt; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(cnt*3+i), utils.GetTestValue(128)))
+		}
+		db.hintWg.Wait()
+		exists := fileHintExists(db)
+		assert.Greater(t, len(exists), 5)
+		for fileId, ok := range exists {
+			assert.True(t, ok, fileId)
+		}
+		_, err := os.Stat(data.GetFileHintNameById(opts.DirPath, db.activeFile.FileId))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	checkData := func(db *DB) {
+		assert.Equal(t, cnt*2-cnt/3+100+1, len(db.ListKeys(false)))
+		for i := 0; i < cnt; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			if i%3 == 0 {
+				assert.Equal(t, ErrKeyNotFound, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		}
+		_, err = db.Get(utils.GetTestKey(cnt + 99))
+		assert.Nil(t, err)
+		ttl, err := db.TTL(utils.GetTestKey(cnt * 2))
+		assert.Nil(t, err)
+		assert.Greater(t, ttl, time.Minute)
+		_, err = db.Get(utils.GetTestKey(cnt*2 + 1))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+
+	{
+		// 从hint file加载的index与读取数据文件得到的index相同
+		assert.Nil(t, db.Close())
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		checkData(db)
+
+		// 没有hint file的数据文件被完整读取，并在启动后补充生成hint file
+		assert.Nil(t, db.Close())
+		assert.Nil(t, os.Remove(data.GetFileHintNameById(opts.DirPath, 2)))
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		checkData(db)
+		db.hintWg.Wait()
+		assert.True(t, fileHintExists(db)[2])
+	}
+
+	{
+		// 损坏或不完整的hint file被删除，改为读取数据文件，启动后重新生成
+		assert.Nil(t, db.Close())
+		hintFileName := data.GetFileHintNameById(opts.DirPath, 2)
+		content, err := os.ReadFile(hintFileName)
+		assert.Nil(t, err)
+		content[len(content)/2] ^= 0xff
+		assert.Nil(t, os.WriteFile(hintFileName, content, 0644))
+		tornHintFileName := data.GetFileHintNameById(opts.DirPath, 4)
+		content, err = os.ReadFile(tornHintFileName)
+		assert.Nil(t, err)
+		assert.Nil(t, os.WriteFile(tornHintFileName, content[:len(content)-3], 0644))
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		checkData(db)
+		db.hintWg.Wait()
+		exists := fileHintExists(db)
+		assert.True(t, exists[2])
+		assert.True(t, exists[4])
+		assert.Nil(t, db.Close())
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		checkData(db)
+	}
+
+	{
+		// 存在hint file时不会读取数据文件，损坏的数据文件只有在没有hint file时才会被发现
+		assert.Nil(t, db.Close())
+		dataFileName := data.GetDataFileNameById(opts.DirPath, 3)
+		content, err := os.ReadFile(dataFileName)
+		assert.Nil(t, err)
+		content[len(content)-1] ^= 0xff
+		assert.Nil(t, os.WriteFile(dataFileName, content, 0644))
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		assert.Nil(t, db.Close())
+		assert.Nil(t, os.Remove(data.GetFileHintNameById(opts.DirPath, 3)))
+		_, err = Open(opts)
+		assert.Equal(t, data.ErrInvalidCrc, err)
+		content[len(content)-1] ^= 0xff
+		assert.Nil(t, os.WriteFile(dataFileName, content, 0644))
+		db, err = Open(opts)
+		assert.Nil(t, err)
+	}
+
+	{
+		// merge后被merge过的数据文件由hint-index加载，单独的hint file被删除
+		assert.Nil(t, db.Merge(context.Background()))
+		for fileId, ok := range fileHintExists(db) {
+			assert.False(t, ok, fileId)
+		}
+		assert.Nil(t, db.Close())
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		checkData(db)
+	}
+}
@@ -3,56 +3,94 @@ package db
 import (
 	"bytes"
 	"kv-go/index"
+	"time"
 )
 
 type DBIterator struct {
 	indexIter index.Iterator // index迭代器，用来在内存中遍历key
 	db        *DB            // DB实例，用来访问磁盘中的value
+	snapshot  *Snapshot      // 不为nil时，迭代器从快照中读取value
+	family    *ColumnFamily  // 迭代器所属的column family
+	mergeGen  uint64         // 创建迭代器时db的mergeGen
 	opts      ItOptions      // 迭代器配置选项
+	count     int            // Rewind或Seek之后已经遍历的key数量
+	done      bool           // 已经越过遍历范围的终点或者达到Limit
 }
 
 // 获取数据库的迭代器
 func (db *DB) NewIterator(opts ItOptions) *DBIterator {
+	return db.defaultFamily.newIterator(opts)
+}
+
+func (cf *ColumnFamily) newIterator(opts ItOptions) *DBIterator {
+	// 持有锁时记录mergeGen并取出第一批key，保证这些位置不早于记录的mergeGen
+	cf.db.mu.RLock()
+	defer cf.db.mu.RUnlock()
 	dbIter := &DBIterator{
-		indexIter: db.index.NewIterator(opts.Reverse),
-		db:        db,
+		indexIter: cf.index.NewIterator(opts.Reverse),
+		db:        cf.db,
+		family:    cf,
 		opts:      opts,
+		mergeGen:  cf.db.mergeGen,
 	}
 	dbIter.Rewind()
 	return dbIter
 }
 
+// 直接定位到遍历范围的起点，而不是从第一个key开始逐个跳过
 func (dbIter *DBIterator) Rewind() {
-	dbIter.indexIter.Rewind()
+	dbIter.count = 0
+	if start := dbIter.opts.start(); start != nil {
+		dbIter.indexIter.Seek(start)
+	} else {
+		dbIter.indexIter.Rewind()
+	}
 	dbIter.NextByPrefix()
 }
 
 func (dbIter *DBIterator) Seek(key []byte) {
+	dbIter.count = 0
+	// 不能越过遍历范围的起点
+	if start := dbIter.opts.start(); start != nil {
+		if cmp := bytes.Compare(key, start); cmp < 0 && !dbIter.opts.Reverse || cmp > 0 && dbIter.opts.Reverse {
+			key = start
+		}
+	}
 	dbIter.indexIter.Seek(key)
 	dbIter.NextByPrefix()
 }
 
 func (dbIter *DBIterator) Next() {
+	if dbIter.done {
+		return
+	}
 	dbIter.indexIter.Next()
+	dbIter.count++
 	dbIter.NextByPrefix()
 }
 
 func (dbIter *DBIterator) NextByPrefix() {
-	var n = len(dbIter.opts.Prefix)
-	if n == 0 {
-		return
-	}
-	// 往后遍历，找到一个前缀相同的key
-	for ; !dbIter.indexIter.IsEnd(); dbIter.indexIter.Next() {
-		var key = dbIter.indexIter.Key()
-		if len(key) >= n && bytes.Equal(dbIter.opts.Prefix, key[:n]) {
+	dbIter.done = dbIter.opts.Limit > 0 && dbIter.count >= dbIter.opts.Limit
+	now := time.Now().UnixNano()
+	// 往后遍历，找到一个在遍历范围内且没有过期的key
+	for ; !dbIter.done && !dbIter.indexIter.IsEnd(); dbIter.indexIter.Next() {
+		pos := dbIter.opts.position(dbIter.indexIter.Key())
+		if pos > 0 {
+			// key是有序的，之后的key都不在范围内
+			dbIter.done = true
+			break
+		}
+		if pos < 0 {
+			continue
+		}
+		if !dbIter.indexIter.Value().IsExpired(now) {
 			break
 		}
 	}
 }
 
 func (dbIter *DBIterator) IsEnd() bool {
-	return dbIter.indexIter.IsEnd()
+	return dbIter.done || dbIter.indexIter.IsEnd()
 }
 
 func (dbIter *DBIterator) Key() []byte {
@@ -60,11 +98,25 @@ func (dbIter *DBIterator) Key() []byte {
 }
 
 func (dbIter *DBIterator) Value() ([]byte, error) {
+	if dbIter.opts.KeysOnly {
+		return nil, ErrKeysOnlyIterator
+	}
 	logRecordPos := dbIter.indexIter.Value()
-	dbIter.db.mu.RLock()
-	defer dbIter.db.mu.RUnlock()
+	if dbIter.snapshot != nil {
+		return dbIter.snapshot.GetValueByPos(logRecordPos)
+	}
+	db := dbIter.db
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	// 迭代器取出的位置在merge之后可能指向其他记录，在blob GC之后可能指向已经删除的blob file，此时从index中重新查找key
+	if dbIter.mergeGen != db.mergeGen || logRecordPos.Blob != nil && db.blobFiles[logRecordPos.Blob.Fid] == nil {
+		logRecordPos = dbIter.family.index.Get(dbIter.Key())
+		if logRecordPos == nil || logRecordPos.IsExpired(time.Now().UnixNano()) {
+			return nil, ErrKeyNotFound
+		}
+	}
 	// 通过LogRecordPos获取磁盘中的value
-	val, err := dbIter.db.GetValueByPos(logRecordPos)
+	val, err := db.GetValueByPos(logRecordPos)
 	if err != nil {
 		return nil, err
 	}
@@ -74,3 +126,62 @@ func (dbIter *DBIterator) Value() ([]byte, error) {
 func (dbIter *DBIterator) Close() {
 	dbIter.indexIter.Close()
 }
+
+// 遍历范围的起点，正向遍历时是下界与前缀中较大的一个，反向遍历时是上界与前缀的终点中较小的一个
+func (opts *ItOptions) start() []byte {
+	if !opts.Reverse {
+		start := opts.LowerBound
+		if len(opts.Prefix) > 0 && bytes.Compare(opts.Prefix, start) > 0 {
+			start = opts.Prefix
+		}
+		if len(start) == 0 {
+			return nil
+		}
+		return start
+	}
+	start := opts.UpperBound
+	if len(opts.Prefix) > 0 {
+		if end := prefixEnd(opts.Prefix); end != nil && (len(start) == 0 || bytes.Compare(end, start) < 0) {
+			start = end
+		}
+	}
+	if len(start) == 0 {
+		return nil
+	}
+	return start
+}
+
+// 判断key相对遍历范围的位置，小于0表示还没有到达起点，大于0表示已经越过终点
+func (opts *ItOptions) position(key []byte) int {
+	pos := 0
+	if len(opts.LowerBound) > 0 {
+		if cmp := bytes.Compare(key, opts.LowerBound); cmp < 0 || cmp == 0 && opts.LowerExclusive {
+			pos = -1
+		}
+	}
+	if len(opts.UpperBound) > 0 {
+		if cmp := bytes.Compare(key, opts.UpperBound); cmp > 0 || cmp == 0 && opts.UpperExclusive {
+			pos = 1
+		}
+	}
+	// 不满足前缀的key要么排在所有满足前缀的key之前，要么排在它们之后
+	if pos == 0 && len(opts.Prefix) > 0 && !bytes.HasPrefix(key, opts.Prefix) {
+		pos = bytes.Compare(key, opts.Prefix)
+	}
+	if opts.Reverse {
+		pos = -pos
+	}
+	return pos
+}
+
+// 大于所有满足前缀的key的最小key，前缀全为0xff时返回nil
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"fmt"
 	"kv-go/utils"
 	"os"
 	"strconv"
@@ -206,4 +207,103 @@ func TestDBIter5(t *testing.T) {
 		assert.True(t, iter.IsEnd())
 		iter.Close()
 	}
-}
\ No newline at end of file
+}
+func TestDBIterBounds(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "KeyCache-iter-test-bounds")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destoryDB(db)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("event-%03d", i)), []byte(strconv.Itoa(i))))
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("other-%03d", i)), []byte(strconv.Itoa(i))))
+	}
+	collect := func(itopts ItOptions) []string {
+		iter := db.NewIterator(itopts)
+		defer iter.Close()
+		var keys []string
+		for ; !iter.IsEnd(); iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		return keys
+	}
+
+	// 闭区间与开区间
+	itopts := DefaultItOptions
+	itopts.LowerBound = []byte("event-010")
+	itopts.UpperBound = []byte("event-020")
+	keys := collect(itopts)
+	assert.Equal(t, 11, len(keys))
+	assert.Equal(t, "event-010", keys[0])
+	assert.Equal(t, "event-020", keys[10])
+	itopts.LowerExclusive = true
+	itopts.UpperExclusive = true
+	keys = collect(itopts)
+	assert.Equal(t, 9, len(keys))
+	assert.Equal(t, "event-011", keys[0])
+	assert.Equal(t, "event-019", keys[8])
+	itopts.Reverse = true
+	keys = collect(itopts)
+	assert.Equal(t, 9, len(keys))
+	assert.Equal(t, "event-019", keys[0])
+	assert.Equal(t, "event-011", keys[8])
+
+	// 前缀与边界同时生效
+	itopts = DefaultItOptions
+	itopts.Prefix = []byte("event-")
+	itopts.LowerBound = []byte("event-095")
+	assert.Equal(t, []string{"event-095", "event-096", "event-097", "event-098", "event-099"}, collect(itopts))
+	itopts = DefaultItOptions
+	itopts.Prefix = []byte("event-")
+	itopts.Reverse = true
+	keys = collect(itopts)
+	assert.Equal(t, 100, len(keys))
+	assert.Equal(t, "event-099", keys[0])
+
+	// 用Limit分页，下一页从上一页最后一个key之后开始
+	itopts = DefaultItOptions
+	itopts.Prefix = []byte("other-")
+	itopts.Limit = 30
+	var pages [][]string
+	for {
+		page := collect(itopts)
+		if len(page) == 0 {
+			break
+		}
+		pages = append(pages, page)
+		itopts.LowerBound = []byte(page[len(page)-1])
+		itopts.LowerExclusive = true
+	}
+	assert.Equal(t, 4, len(pages))
+	assert.Equal(t, "other-000", pages[0][0])
+	assert.Equal(t, "other-030", pages[1][0])
+	assert.Equal(t, 10, len(pages[3]))
+	assert.Equal(t, "other-099", pages[3][9])
+
+	// Seek不会越过遍历范围
+	itopts = DefaultItOptions
+	itopts.LowerBound = []byte("event-050")
+	itopts.UpperBound = []byte("event-060")
+	iter := db.NewIterator(itopts)
+	iter.Seek([]byte("a"))
+	assert.Equal(t, "event-050", string(iter.Key()))
+	iter.Seek([]byte("event-055"))
+	assert.Equal(t, "event-055", string(iter.Key()))
+	iter.Seek([]byte("z"))
+	assert.True(t, iter.IsEnd())
+	iter.Close()
+
+	// KeysOnly不读取value
+	itopts = DefaultItOptions
+	itopts.KeysOnly = true
+	iter = db.NewIterator(itopts)
+	assert.Equal(t, "event-000", string(iter.Key()))
+	_, err = iter.Value()
+	assert.Equal(t, ErrKeysOnlyIterator, err)
+	iter.Close()
+	metrics, err := db.Metrics()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), metrics.BytesRead)
+}
@@ -1,14 +1,20 @@
 package db
 
 import (
+	"context"
 	"io"
 	"kv-go/data"
+	"kv-go/fio"
+	"kv-go/index"
 	"kv-go/utils"
+	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -16,12 +22,19 @@ const (
 	mergeFinishedKey = "finish"
 )
 
-// TODO!!!合并后db的无效数据量应该减小！
-func (db *DB) merge() error {
+// Merge 重写所有不活跃文件中的有效数据，完成后直接在线替换原数据文件，无需重启
+func (db *DB) Merge(ctx context.Context) error {
+	// follower的数据文件必须与primary保持一致
+	if db.isReplica {
+		return ErrReplicaReadOnly
+	}
+	start := time.Now()
+	db.mu.Lock()
+	// 后台的自动merge可能与写入并发，需要持有锁再检查活跃文件
 	if db.activeFile == nil {
+		db.mu.Unlock()
 		return nil
 	}
-	db.mu.Lock()
 	// 同一时间只能有一个线程在merge，当然，检查之前需要上锁
 	if db.isMerge {
 		db.mu.Unlock()
@@ -38,6 +51,8 @@ func (db *DB) merge() error {
 		db.mu.Unlock()
 		return err
 	}
+	// blob file由blob GC回收，不计入数据文件的大小
+	dirSize -= db.blobSize()
 	// 判断比例是否达到阈值
 	if float32(db.invalidSize) / float32(dirSize) < db.opts.MergeRatio {
 		db.mu.Unlock()
@@ -55,7 +70,11 @@ func (db *DB) merge() error {
 	}
 	// 将当前活跃文件关闭，保存为不活跃文件
 	// 先持久化并保存该文件
-	if err := db.activeFile.Sync(); err != nil {
+	if err := db.syncBlobFile(); err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	if err := db.syncFile(db.activeFile); err != nil {
 		db.mu.Unlock()
 		return err
 	}
@@ -72,6 +91,15 @@ func (db *DB) merge() error {
 	for _, dataFile := range db.inActivaFile {
 		dataFiles = append(dataFiles, dataFile)
 	}
+	// 记录merge开始时的无效数据量，这部分数据在替换文件后将被回收
+	mergedInvalidSize := db.invalidSize
+	// 记录merge开始时的column family，已经被删除或清空的column family中的记录不会被重写
+	indexes := make(map[uint32]index.Indexer, len(db.families))
+	familyInvalidSize := make(map[*ColumnFamily]int64, len(db.families))
+	for id, cf := range db.families {
+		indexes[id] = cf.index
+		familyInvalidSize[cf] = cf.invalidSize
+	}
 	// 解db锁
 	db.mu.Unlock()
 	// 将数据文件以fileId排序
@@ -89,54 +117,104 @@ func (db *DB) merge() error {
 	if err := os.MkdirAll(mergePath, os.ModePerm); err != nil {
 		return err
 	}
+	// 重写有效数据到merge目录
+	expiredKeys, err := db.rewriteDataFiles(ctx, dataFiles, mergePath, maxMergeFileId, indexes)
+	if err != nil {
+		return err
+	}
+	// 最后在线替换数据文件
+	if err := db.switchMergeFiles(mergePath, maxMergeFileId, mergedInvalidSize, expiredKeys); err != nil {
+		return err
+	}
+	// 各个column family中被merge的无效数据也已经回收
+	db.mu.Lock()
+	for cf, invalidSize := range familyInvalidSize {
+		cf.invalidSize = max(cf.invalidSize-invalidSize, 0)
+	}
+	db.mu.Unlock()
+	db.metrics.merges.Add(1)
+	db.metrics.mergeDuration.observe(time.Since(start))
+	return nil
+}
 
+// 遍历dataFiles，将其中的有效数据重写到mergePath下，并生成hint file与finish file
+// 已经过期的记录不会被重写，返回这些记录的key与位置，以便从index中删除
+func (db *DB) rewriteDataFiles(ctx context.Context, dataFiles []*data.DataFile, mergePath string, maxMergeFileId uint32, indexes map[uint32]index.Indexer) ([]*data.WBLogRecord, error) {
 	// 打开新的db实例
 	mergeOpts := DefaultDBOptions
 	mergeOpts.AlwaysSync = false
 	mergeOpts.DirPath = mergePath
+	mergeOpts.DataFileSize = db.opts.DataFileSize
+	// 使用当前配置的压缩算法重新压缩，使用当前的密钥重新加密
+	mergeOpts.Compression = db.opts.Compression
+	mergeOpts.KeyProvider = db.opts.KeyProvider
+	// 指向blob file的记录被原样重写，不会再次分离value
+	mergeOpts.BlobThreshold = 0
 	mergeDB, err := Open(mergeOpts)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	// merge后的数据文件由hint-index加载，不需要单独的hint file
+	mergeDB.hintDisabled = true
+	defer mergeDB.Close()
 	// 打开hint文件
-	hintFile, err := data.OpenHintFile(mergePath)
+	hintFile, err := db.withCipher(data.OpenHintFile(mergePath))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer hintFile.Close()
+	expiredKeys := make([]*data.WBLogRecord, 0)
+	now := time.Now().UnixNano()
 	// 遍历，加载所有dataFile
 	for _, datafile := range dataFiles {
 		var off int64 = 0
 		// 读取其所有record
 		for {
-			logRecord, sz, err := datafile.ReadLogRecord(off)
+			// 用户取消时立即停止merge
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			logRecord, recordOff, sz, err := db.readDataLogRecord(datafile, off)
 			if err != nil {
 				if err == io.EOF {
 					break
 				}
-				return err
+				return nil, err
 			}
+			// 跳过损坏的数据后，记录可能不在off处
+			off = recordOff
 			// 解析key
 			realKey, _ := parseKeyId(logRecord.Key)
-			// 根据realKey在index中查找
-			logRecordPos := db.index.Get(realKey)
-			// 如果是最新的record，需要重写
-			if logRecordPos != nil && logRecordPos.Fid == datafile.FileId && logRecordPos.Offset == off {
+			// 根据realKey在所属column family的index中查找
+			var logRecordPos *data.LogRecordPos
+			if familyIndex, ok := indexes[logRecord.Family]; ok {
+				logRecordPos = familyIndex.Get(realKey)
+			}
+			// 如果是最新的record，需要重写，但过期的record直接丢弃
+			isLatest := logRecordPos != nil && logRecordPos.Fid == datafile.FileId && logRecordPos.Offset == off
+			if isLatest && logRecordPos.IsExpired(now) {
+				expiredKeys = append(expiredKeys, &data.WBLogRecord{Key: realKey, Pos: logRecordPos, Family: logRecord.Family})
+			} else if isLatest {
 				// 直接db.Put会获取锁，这是无意义的操作
 				// 而且也会更新index，我们不需要更新index，所以手动append
 				// 在append之前，需要擦除record的wbId
 				logRecord.Key = serializeKeyId(realKey, zeroWbId)
 				newLogRecordPos, err := mergeDB.appendLogRecord(logRecord)
 				if err != nil {
-					return err
+					return nil, err
 				}
 				// 维护hint file, 这里需要写入realKey-encPos
 				encLogRecordPos := data.EncodeLogRecordPos(newLogRecordPos)
-				encLogRecord, _ := data.EncodeLogRecord(&data.LogRecord{
-					Key:   realKey,
-					Value: encLogRecordPos,
+				encLogRecord, _, err := db.encodeLogRecord(&data.LogRecord{
+					Key:    realKey,
+					Value:  encLogRecordPos,
+					Family: logRecord.Family,
 				})
+				if err != nil {
+					return nil, err
+				}
 				if err = hintFile.Write(encLogRecord); err != nil {
-					return err
+					return nil, err
 				}
 			}
 			// 维护offset
@@ -145,30 +223,172 @@ func (db *DB) merge() error {
 	}
 	// 持久化DB与hint file
 	if err := mergeDB.Sync(); err != nil {
-		return err
+		return nil, err
 	}
 	if err := hintFile.Sync(); err != nil {
-		return nil
+		return nil, err
 	}
 	// 最后创建finish文件并写入maxMergeFileId
-	mergeFinishedFile, err := data.OpenMergeFinsihedFile(mergePath)
+	mergeFinishedFile, err := db.withCipher(data.OpenMergeFinsihedFile(mergePath))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer mergeFinishedFile.Close()
 	// 以minMergeFileId, maxMergeFileId为value，构造record
 	finishedRecord := &data.LogRecord{
 		Key:   []byte(mergeFinishedKey),
 		Value: []byte(strconv.Itoa(int(maxMergeFileId))),
 	}
-	encFinishedRecord, _ := data.EncodeLogRecord(finishedRecord)
+	encFinishedRecord, _, err := db.encodeLogRecord(finishedRecord)
+	if err != nil {
+		return nil, err
+	}
 	if err := mergeFinishedFile.Write(encFinishedRecord); err != nil {
-		return err
+		return nil, err
 	}
 	// 写入完成后，不要忘记持久化
 	if err := mergeFinishedFile.Sync(); err != nil {
+		return nil, err
+	}
+	return expiredKeys, nil
+}
+
+// 在线替换被merge过的数据文件，并将index指向新的数据文件
+// 先读取hint file并打开merge后的数据文件，再更新index并关闭被merge过的文件，中途失败时仍然使用旧的文件与index
+func (db *DB) switchMergeFiles(mergePath string, maxMergeFileId uint32, mergedInvalidSize int64, expiredKeys []*data.WBLogRecord) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// 先读取完整的hint file，读取失败时不会修改数据目录与index
+	var hintRecords []*data.WBLogRecord
+	err := db.foreachHintRecord(mergePath, func(family uint32, key []byte, pos *data.LogRecordPos) error {
+		hintRecords = append(hintRecords, &data.WBLogRecord{Key: key, Pos: pos, Family: family})
+		return nil
+	})
+	if err != nil {
+		// merge的结果无法使用，避免重启时被加载
+		_ = os.RemoveAll(mergePath)
 		return err
 	}
-	return nil
+	// 移动merge目录下的文件到数据目录，已经打开的旧文件被覆盖或删除后仍然可以读取，重启时则加载merge后的文件
+	mergeFileIds, err := db.installMergeFiles(mergePath, maxMergeFileId)
+	if err != nil {
+		return err
+	}
+	// 打开merge后的数据文件
+	mergeFiles := make(map[uint32]*data.DataFile, len(mergeFileIds))
+	closeMergeFiles := func() {
+		for _, dataFile := range mergeFiles {
+			_ = dataFile.Close()
+		}
+	}
+	for _, fileId := range mergeFileIds {
+		dataFile, err := db.withCipher(data.OpenDataFile(db.opts.DirPath, fileId, fio.FileIOType))
+		if err != nil {
+			closeMergeFiles()
+			return err
+		}
+		mergeFiles[fileId] = dataFile
+	}
+	// 根据hint file更新index，merge期间被更新/删除的key不需要更新，更新失败时恢复已经更新的key
+	oldPositions := make([]*data.LogRecordPos, len(hintRecords))
+	for i, record := range hintRecords {
+		cf, ok := db.families[record.Family]
+		if !ok {
+			continue
+		}
+		oldPos := cf.index.Get(record.Key)
+		if oldPos == nil || oldPos.Fid > maxMergeFileId {
+			continue
+		}
+		if ok, _ := cf.index.Put(record.Key, record.Pos); !ok {
+			for j := 0; j < i; j++ {
+				if oldPositions[j] != nil {
+					db.families[hintRecords[j].Family].index.Put(hintRecords[j].Key, oldPositions[j])
+				}
+			}
+			closeMergeFiles()
+			return ErrUpdateIndexFailed
+		}
+		oldPositions[i] = oldPos
+	}
+	for i, oldPos := range oldPositions {
+		if oldPos != nil {
+			db.discardLiveSize(oldPos)
+			db.addLiveSize(hintRecords[i].Pos)
+		}
+	}
+	// index已经指向merge后的文件，关闭被merge过的不活跃文件，被快照引用的文件会延迟到快照释放时关闭
+	var retireErr error
+	for fileId, dataFile := range db.inActivaFile {
+		if fileId > maxMergeFileId {
+			continue
+		}
+		if err := db.retireFile(dataFile); err != nil && retireErr == nil {
+			retireErr = err
+		}
+		delete(db.inActivaFile, fileId)
+	}
+	for fileId, dataFile := range mergeFiles {
+		db.inActivaFile[fileId] = dataFile
+	}
+	// 删除merge时丢弃的过期key，merge期间被重新写入的key除外
+	for _, expired := range expiredKeys {
+		cf, ok := db.families[expired.Family]
+		if ok && isSamePos(cf.index.Get(expired.Key), expired.Pos) {
+			cf.index.Delete(expired.Key)
+			db.discardLiveSize(expired.Pos)
+			db.discardBlob(expired.Pos)
+		}
+	}
+	// 没有生成新文件的id已经被删除
+	for fileId := range db.liveSize {
+		if _, ok := db.inActivaFile[fileId]; !ok && fileId <= maxMergeFileId {
+			delete(db.liveSize, fileId)
+		}
+	}
+	// 被merge的无效数据已经回收
+	db.invalidSize = max(db.invalidSize-mergedInvalidSize, 0)
+	db.metrics.reclaimedBytes.Add(uint64(mergedInvalidSize))
+	// merge后的文件复用了旧的文件id，迭代器与缓存中的位置已经失效
+	db.mergeGen++
+	if db.valueCache != nil {
+		db.valueCache.clear()
+	}
+	// 被merge的数据文件已经被替换，follower需要重新全量同步
+	db.bumpReplicationGen()
+	if err := os.RemoveAll(mergePath); err != nil {
+		return err
+	}
+	// column family信息也使用当前的密钥重新加密，轮换后旧的密钥不再被需要
+	if db.cipher != nil {
+		if err := db.saveFamilies(); err != nil {
+			return err
+		}
+	}
+	return retireErr
+}
+
+// 定期检查无效数据的比例，达到阈值时自动merge
+func (db *DB) autoMerge(ctx context.Context) {
+	defer db.mergeWg.Done()
+	ticker := time.NewTicker(db.opts.MergeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := db.Merge(ctx)
+			if err != nil && err != ErrMergeRatioUnreached && err != ErrDBMerging && err != ctx.Err() {
+				log.Printf("failed to merge, %v\n", err)
+			}
+			// 同时回收无效数据较多的blob file
+			err = db.BlobGC(ctx)
+			if err != nil && err != ErrBlobGCIsProgress && err != ctx.Err() {
+				log.Printf("failed to gc blob files, %v\n", err)
+			}
+		}
+	}
 }
 
 func (db *DB) getMergePath() string {
@@ -187,51 +407,85 @@ func (db *DB) loadMergeFiles() error {
 	defer func() {
 		os.RemoveAll(mergePath)
 	}()
+	// 没有finish文件说明merge没有完成
+	finishedFileName := filepath.Join(mergePath, data.MergeFilishedFileName)
+	if _, err := os.Stat(finishedFileName); os.IsNotExist(err) {
+		return nil
+	}
+	// 获取merge完成的最大file id
+	maxMergeFileId, err := db.getMaxMergeFileId(mergePath)
+	if err != nil {
+		return err
+	}
+	_, err = db.installMergeFiles(mergePath, maxMergeFileId)
+	return err
+}
+
+// 将merge目录下的文件移动到数据目录下，并删除被merge过的数据文件，返回移动的数据文件id
+// 移动顺序保证了该操作中途崩溃后可以被重复执行：
+// 先删除不会被覆盖的旧文件，再按id升序覆盖数据文件，最后移动hint file与finish file
+func (db *DB) installMergeFiles(mergePath string, maxMergeFileId uint32) ([]uint32, error) {
 	// 读取目录下的所有文件
 	entrys, err := os.ReadDir(mergePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// 保存merge目录下所有的文件名
-	var finished = false
-	fileNames := make([]string, 0)
+	var hasHintFile = false
+	fileIds := make([]uint32, 0)
 	for _, entry := range entrys {
 		fileName := entry.Name()
-		if fileName == data.MergeFilishedFileName {
-			finished = true
+		if fileName == data.HintFileName {
+			hasHintFile = true
 		}
-		if fileName == data.NextWriteBatchIdFileName || fileName == fileLockName{
-			continue
+		if strings.HasSuffix(fileName, data.DataFileNameSuffix) {
+			fileId, err := strconv.Atoi(strings.TrimSuffix(fileName, data.DataFileNameSuffix))
+			if err != nil {
+				return nil, ErrDataFileNameCorrupted
+			}
+			fileIds = append(fileIds, uint32(fileId))
 		}
-		fileNames = append(fileNames, fileName)
 	}
-	if !finished {
-		return nil
-	}
-	// 获取merge完成的最大file id
-	maxMergeFileId, err := db.getMaxMergeFileId(mergePath)
-	if err != nil {
-		return err
+	sort.Slice(fileIds, func(i, j int) bool {
+		return fileIds[i] < fileIds[j]
+	})
+	// 被merge过的数据文件由hint-index加载，删除这些文件单独的hint file
+	for fileId := uint32(0); fileId <= maxMergeFileId; fileId++ {
+		if err := os.RemoveAll(data.GetFileHintNameById(db.opts.DirPath, fileId)); err != nil {
+			return nil, err
+		}
 	}
-	// 删除原数据目录中，被merge过的file
-	var fileId uint32 = 0
-	for ; fileId <= maxMergeFileId; fileId++ {
-		fileName := data.GetDataFileNameById(db.opts.DirPath, fileId)
-		if _, err := os.Stat(fileName); err == nil {
+	// hint file已经被移动，说明旧文件已经被删除
+	if hasHintFile {
+		// 删除原数据目录中，被merge过且不会被覆盖的file
+		var fileId uint32 = 0
+		if len(fileIds) > 0 {
+			fileId = fileIds[len(fileIds)-1] + 1
+		}
+		for ; fileId <= maxMergeFileId; fileId++ {
+			fileName := data.GetDataFileNameById(db.opts.DirPath, fileId)
 			if err := os.RemoveAll(fileName); err != nil {
-				return nil
+				return nil, err
 			}
 		}
 	}
 	// 将merge目录下的数据文件移动到原目录下
-	for _, fileName := range fileNames {
-		srcName := filepath.Join(mergePath, fileName)
-		desName := filepath.Join(db.opts.DirPath, fileName)
+	for _, fileId := range fileIds {
+		srcName := data.GetDataFileNameById(mergePath, fileId)
+		desName := data.GetDataFileNameById(db.opts.DirPath, fileId)
 		if err := os.Rename(srcName, desName); err != nil {
-			return err
+			return nil, err
 		}
 	}
-	return nil
+	for _, fileName := range []string{data.HintFileName, data.MergeFilishedFileName} {
+		srcName := filepath.Join(mergePath, fileName)
+		if _, err := os.Stat(srcName); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Rename(srcName, filepath.Join(db.opts.DirPath, fileName)); err != nil {
+			return nil, err
+		}
+	}
+	return fileIds, nil
 }
 
 func (db *DB) getMaxMergeFileId(dirPath string) (uint32, error) {
@@ -240,10 +494,11 @@ func (db *DB) getMaxMergeFileId(dirPath string) (uint32, error) {
 		return 0, err
 	}
 	// 打开finished文件
-	finishedFile, err := data.OpenMergeFinsihedFile(dirPath)
+	finishedFile, err := db.withCipher(data.OpenMergeFinsihedFile(dirPath))
 	if err != nil {
 		return 0, err
 	}
+	defer finishedFile.Close()
 	// 读取finished文件中的record
 	logRecord, _, err := finishedFile.ReadLogRecord(0)
 	if err != nil {
@@ -258,29 +513,50 @@ func (db *DB) getMaxMergeFileId(dirPath string) (uint32, error) {
 
 // TODO:系统是如何查看一个文件的？os.Stat()
 func (db *DB) loadIndexFromHintFile() error {
+	now := time.Now().UnixNano()
+	return db.foreachHintRecord(db.opts.DirPath, func(family uint32, key []byte, pos *data.LogRecordPos) error {
+		// 已经过期的key与已经被删除的column family中的key不需要加载
+		cf, ok := db.families[family]
+		if !ok || pos.IsExpired(now) {
+			return nil
+		}
+		if ok, _ := cf.index.Put(key, pos); !ok {
+			return ErrUpdateIndexFailed
+		}
+		return nil
+	})
+}
+
+// 遍历dirPath目录下hint file中的所有记录
+func (db *DB) foreachHintRecord(dirPath string, fn func(family uint32, key []byte, pos *data.LogRecordPos) error) error {
 	// 判断hint文件是否存在
-	hintFileName := filepath.Join(db.opts.DirPath, data.HintFileName)
+	hintFileName := filepath.Join(dirPath, data.HintFileName)
 	if _, err := os.Stat(hintFileName); os.IsNotExist(err) {
 		return nil
 	}
-	// 开启并加载hint文件的数据到data file中
-	hintFile, err := data.OpenHintFile(db.opts.DirPath)
+	// 开启并加载hint文件的数据
+	hintFile, err := db.withCipher(data.OpenHintFile(dirPath))
+	if err != nil {
+		return err
+	}
+	defer hintFile.Close()
+	hintFileSize, err := hintFile.IOManager.Size()
 	if err != nil {
 		return err
 	}
 	var off int64 = 0
-	for {
+	for off < hintFileSize {
 		logRecord, sz, err := hintFile.ReadLogRecord(off)
 		if err != nil {
+			// 文件末尾之前的记录不完整，hint file已经损坏
 			if err == io.EOF {
-				break
+				return ErrIncompleteRecord
 			}
-			return nil
+			return err
 		}
 		off += sz
-		logRecordPos := data.DecodeLogRecordPos(logRecord.Value)
-		if ok, _ := db.index.Put(logRecord.Key, logRecordPos); !ok {
-			return ErrUpdateIndexFailed
+		if err := fn(logRecord.Family, logRecord.Key, data.DecodeLogRecordPos(logRecord.Value)); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -1,10 +1,14 @@
 package db
 
 import (
+	"context"
+	"kv-go/data"
 	"kv-go/utils"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -20,7 +24,7 @@ func TestMerge1(t *testing.T) {
 		for i := 0; i < 10000; i++ {
 			db.Put(utils.GetTestKey(1), utils.GetTestValue(128))
 		}
-		err := db.merge()
+		err := db.Merge(context.Background())
 		assert.Nil(t, err)
 	}
 }
@@ -52,7 +56,7 @@ func TestMerge2(t *testing.T) {
 		// merge并重启
 		err := db.Sync()
 		assert.Nil(t, err)
-		err = db.merge()
+		err = db.Merge(context.Background())
 		assert.Nil(t, err)
 		db.Close()
 		db2, err := Open(opts)
@@ -97,7 +101,7 @@ func TestMerge3(t *testing.T) {
 		// merge并重启
 		err := db.Sync()
 		assert.Nil(t, err)
-		err = db.merge()
+		err = db.Merge(context.Background())
 		assert.Nil(t, err)
 		db.Close()
 		db2, err := Open(opts)
@@ -137,7 +141,7 @@ func TestMergeAtRatio1(t *testing.T) {
 		}
 		before, err := db.Stat()
 		assert.Nil(t, err)
-		db.merge()
+		db.Merge(context.Background())
 		db.Close()
 		db2, err := Open(opts)
 		assert.Nil(t, err)
@@ -158,12 +162,12 @@ func TestMergeAtRatio2(t *testing.T) {
 	defer destoryDB(db)
 	{
 		// 对空数据库进行合并，以及没有达到阈值时合并，将无法合并
-		err := db.merge()
+		err := db.Merge(context.Background())
 		assert.Nil(t, err)
 		for i := 0; i < 100; i++ {
 			db.Put(utils.GetTestKey(i), utils.GetTestValue(128))
 		}
-		err = db.merge()
+		err = db.Merge(context.Background())
 		assert.NotNil(t, err)
 	}
 }
@@ -189,7 +193,7 @@ func TestMergeAtRatio3(t *testing.T) {
 		}
 		before, err := db2.Stat()
 		assert.Nil(t, err)
-		err = db2.merge()
+		err = db2.Merge(context.Background())
 		assert.NotNil(t, err)
 		db2.Close()
 		db3, err := Open(opts)
@@ -217,7 +221,7 @@ func TestMergeAtRatio4(t *testing.T) {
 		for i := 0; i < 10000; i++ {
 			db.Delete(utils.GetTestKey(i))
 		}
-		err = db.merge()
+		err = db.Merge(context.Background())
 		assert.Nil(t, err)
 		err = db.Close()
 		assert.Nil(t, err)
@@ -240,7 +244,7 @@ func TestMergeAtRatio5(t *testing.T) {
 	{
 		// merge的过程中，其他线程同时在put，并且删除已经存在的数据
 		// 需要验证merge不会干扰其他线程的put以及delete
-		err := db.merge()
+		err := db.Merge(context.Background())
 		assert.Nil(t, err)
 		cnt := 50000
 		for i := 0; i < cnt; i++ {
@@ -257,7 +261,7 @@ func TestMergeAtRatio5(t *testing.T) {
 				db.Put(utils.GetTestKey(i), utils.GetTestValue(128))
 			}
 		}()
-		err = db.merge()
+		err = db.Merge(context.Background())
 		assert.Nil(t, err)
 		wg.Wait()
 
@@ -273,3 +277,187 @@ func TestMergeAtRatio5(t *testing.T) {
 		}
 	}
 }
+
+func TestMergeOnline(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("/tmp", "test-merge-online")
+	opts.DataFileSize = 1024 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+	defer destoryDB(db)
+	{
+		// merge后不重启数据库，数据应该仍然可以正常读写，且占用的磁盘空间减小
+		cnt := 50000
+		vals := make([][]byte, cnt)
+		for i := 0; i < cnt; i++ {
+			err := db.Put(utils.GetTestKey(i), utils.GetTestValue(128))
+			assert.Nil(t, err)
+		}
+		for i := 0; i < cnt; i++ {
+			vals[i] = utils.GetTestValue(128)
+			err := db.Put(utils.GetTestKey(i), vals[i])
+			assert.Nil(t, err)
+		}
+		for i := 0; i < cnt/2; i++ {
+			err := db.Delete(utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+		before, err := db.Stat()
+		assert.Nil(t, err)
+		err = db.Merge(context.Background())
+		assert.Nil(t, err)
+		after, err := db.Stat()
+		assert.Nil(t, err)
+		assert.Greater(t, before.DiskSize, after.DiskSize)
+		assert.Greater(t, before.InvalidSize, after.InvalidSize)
+		assert.Equal(t, int64(cnt/2), after.KeyNum)
+		for i := 0; i < cnt/2; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+		for i := cnt / 2; i < cnt; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, vals[i], val)
+		}
+		// merge后继续写入，再重启
+		err = db.Put(utils.GetTestKey(cnt), vals[0])
+		assert.Nil(t, err)
+		err = db.Close()
+		assert.Nil(t, err)
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, cnt/2+1, len(db.ListKeys(false)))
+		val, err := db.Get(utils.GetTestKey(cnt))
+		assert.Nil(t, err)
+		assert.Equal(t, vals[0], val)
+	}
+}
+
+func TestMergeCanceled(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("/tmp", "test-merge-canceled")
+	opts.MergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+	defer destoryDB(db)
+	{
+		// 取消merge后，数据不受影响
+		for i := 0; i < 1000; i++ {
+			db.Put(utils.GetTestKey(i), utils.GetTestValue(128))
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := db.Merge(ctx)
+		assert.Equal(t, context.Canceled, err)
+		for i := 0; i < 1000; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+	}
+}
+
+func TestAutoMerge(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("/tmp", "test-auto-merge")
+	opts.DataFileSize = 1024 * 1024
+	opts.MergeInterval = 50 * time.Millisecond
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+	defer destoryDB(db)
+	{
+		// 产生大量无效数据后，后台应该自动merge
+		for i := 0; i < 20000; i++ {
+			db.Put(utils.GetTestKey(i), utils.GetTestValue(128))
+		}
+		for i := 0; i < 20000; i++ {
+			db.Delete(utils.GetTestKey(i))
+		}
+		before, err := db.Stat()
+		assert.Nil(t, err)
+		assert.Eventually(t, func() bool {
+			after, err := db.Stat()
+			return err == nil && after.DiskSize < before.DiskSize
+		}, 5*time.Second, 50*time.Millisecond)
+	}
+	// 清理前先停止后台的自动merge，避免与destoryDB竞争
+	db.mergeCancel()
+	db.mergeWg.Wait()
+}
+
+func TestMergeWithOpenIterator(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("/tmp", "test-merge-iterator")
+	opts.DataFileSize = 64 * 1024
+	opts.MergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+	defer destoryDB(db)
+	{
+		// merge复用了文件id，merge之前创建的迭代器仍然要读到key自己的value
+		cnt := 10000
+		vals := make(map[string][]byte, cnt)
+		for i := 0; i < cnt; i++ {
+			vals[string(utils.GetTestKey(i))] = utils.GetTestValue(64)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), vals[string(utils.GetTestKey(i))]))
+		}
+		for i := 0; i < cnt; i += 3 {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		}
+		iter := db.NewIterator(DefaultItOptions)
+		defer iter.Close()
+		assert.Nil(t, db.Merge(context.Background()))
+		// 迭代器取出key之后被删除的key读不到value
+		assert.Nil(t, db.Delete(utils.GetTestKey(1)))
+		count := 0
+		for ; !iter.IsEnd(); iter.Next() {
+			val, err := iter.Value()
+			if string(iter.Key()) == string(utils.GetTestKey(1)) {
+				assert.Equal(t, ErrKeyNotFound, err)
+				continue
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, vals[string(iter.Key())], val)
+			count++
+		}
+		assert.Equal(t, cnt-cnt/3-2, count)
+	}
+}
+
+func TestMergeSwitchFailed(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("/tmp", "test-merge-switch-failed")
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	cnt := 2000
+	for i := 0; i < cnt; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	assert.Greater(t, len(db.inActivaFile), 1)
+
+	// 替换文件失败时仍然使用原来的数据文件与index，merge目录被删除
+	mergePath := db.getMergePath()
+	assert.Nil(t, os.MkdirAll(mergePath, os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(mergePath, data.HintFileName), utils.GetTestValue(128), 0644))
+	assert.NotNil(t, db.switchMergeFiles(mergePath, db.activeFile.FileId-1, 0, nil))
+	_, err = os.Stat(mergePath)
+	assert.True(t, os.IsNotExist(err))
+	check := func() {
+		for i := 0; i < cnt; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+	}
+	check()
+	assert.Nil(t, db.Put(utils.GetTestKey(cnt), utils.GetTestValue(64)))
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check()
+}
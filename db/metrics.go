@@ -0,0 +1,227 @@
+package db
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"kv-go/data"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// 延迟直方图中每个桶的上界
+var latencyBuckets = [...]time.Duration{
+	50 * time.Microsecond, 100 * time.Microsecond, 250 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond, 10 * time.Millisecond,
+	25 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond,
+	500 * time.Millisecond, time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// 运行期间累计的统计数据，所有字段都可以无锁更新
+type metrics struct {
+	gets           atomic.Uint64
+	puts           atomic.Uint64
+	deletes        atomic.Uint64
+	batchCommits   atomic.Uint64
+	bytesRead      atomic.Uint64
+	bytesWritten   atomic.Uint64
+	merges         atomic.Uint64
+	reclaimedBytes atomic.Uint64
+	getLatency     histogram
+	writeLatency   histogram
+	syncLatency    histogram
+	mergeDuration  histogram
+}
+
+type histogram struct {
+	counts [len(latencyBuckets) + 1]atomic.Uint64 // 最后一个桶保存超过所有上界的观测值
+	sum    atomic.Int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+func (h *histogram) stat() HistogramStat {
+	stat := HistogramStat{
+		Buckets: latencyBuckets[:],
+		Counts:  make([]uint64, len(latencyBuckets)),
+		Sum:     time.Duration(h.sum.Load()),
+	}
+	for i := range h.counts {
+		stat.Count += h.counts[i].Load()
+		if i < len(latencyBuckets) {
+			stat.Counts[i] = stat.Count
+		}
+	}
+	return stat
+}
+
+// HistogramStat 延迟的分布
+type HistogramStat struct {
+	Buckets []time.Duration // 每个桶的上界
+	Counts  []uint64        // 不超过对应上界的观测次数，与Prometheus一样是累计值
+	Count   uint64          // 总的观测次数
+	Sum     time.Duration   // 所有观测值的和
+}
+
+// Metrics 打开数据库以来的运行统计，以及当前的index与文件状态
+type Metrics struct {
+	Gets           uint64           // Get的次数
+	Puts           uint64           // Put的次数
+	Deletes        uint64           // Delete的次数
+	BatchCommits   uint64           // WriteBatch成功提交的次数
+	BytesRead      uint64           // 读取value时从文件读取的字节数
+	BytesWritten   uint64           // 追加到数据文件与blob file的字节数
+	Merges         uint64           // 完成的merge次数
+	ReclaimedBytes uint64           // merge与blob GC回收的无效数据量(Byte)
+	GetLatency     HistogramStat    // Get的延迟
+	WriteLatency   HistogramStat    // Put、Delete与WriteBatch提交的延迟，包含持久化的时间
+	SyncLatency    HistogramStat    // fsync的延迟，Count即fsync的次数
+	MergeDuration  HistogramStat    // 每次merge的耗时
+	IndexKeys      map[string]int64 // 每个column family的index中key的数量
+	DataFiles      []DataFileStat   // 每个数据文件中有效与无效的数据量
+	BlobFiles      []BlobStat       // 每个blob file中有效与无效的数据量
+	ValueCache     CacheStat        // value缓存的命中率与内存占用，没有开启缓存时为零值
+}
+
+// 获取运行统计
+func (db *DB) Metrics() (*Metrics, error) {
+	m := db.metrics
+	metrics := &Metrics{
+		Gets:           m.gets.Load(),
+		Puts:           m.puts.Load(),
+		Deletes:        m.deletes.Load(),
+		BatchCommits:   m.batchCommits.Load(),
+		BytesRead:      m.bytesRead.Load(),
+		BytesWritten:   m.bytesWritten.Load(),
+		Merges:         m.merges.Load(),
+		ReclaimedBytes: m.reclaimedBytes.Load(),
+		GetLatency:     m.getLatency.stat(),
+		WriteLatency:   m.writeLatency.stat(),
+		SyncLatency:    m.syncLatency.stat(),
+		MergeDuration:  m.mergeDuration.stat(),
+		IndexKeys:      make(map[string]int64),
+	}
+	db.mu.RLock()
+	for _, cf := range db.families {
+		metrics.IndexKeys[cf.name] = int64(cf.index.Size())
+	}
+	db.mu.RUnlock()
+	var err error
+	if metrics.DataFiles, err = db.DataFileStat(); err != nil {
+		return nil, err
+	}
+	metrics.BlobFiles = db.BlobStat()
+	if db.valueCache != nil {
+		metrics.ValueCache = db.valueCache.stat()
+	}
+	return metrics, nil
+}
+
+// 以Prometheus的文本格式输出运行统计
+func (db *DB) WritePrometheus(w io.Writer) error {
+	metrics, err := db.Metrics()
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	counter := func(name string, help string, value uint64) {
+		writeMetricHeader(bw, name, help, "counter")
+		fmt.Fprintf(bw, "%s %d\n", name, value)
+	}
+	counter("bitcask_gets_total", "Number of Get calls.", metrics.Gets)
+	counter("bitcask_puts_total", "Number of Put calls.", metrics.Puts)
+	counter("bitcask_deletes_total", "Number of Delete calls.", metrics.Deletes)
+	counter("bitcask_batch_commits_total", "Number of committed write batches.", metrics.BatchCommits)
+	counter("bitcask_read_bytes_total", "Bytes read from files to serve values.", metrics.BytesRead)
+	counter("bitcask_written_bytes_total", "Bytes appended to data and blob files.", metrics.BytesWritten)
+	counter("bitcask_merges_total", "Number of completed merges.", metrics.Merges)
+	counter("bitcask_reclaimed_bytes_total", "Invalid bytes reclaimed by merge and blob GC.", metrics.ReclaimedBytes)
+	counter("bitcask_value_cache_hits_total", "Value reads served by the value cache.", metrics.ValueCache.Hits)
+	counter("bitcask_value_cache_misses_total", "Value reads that missed the value cache.", metrics.ValueCache.Misses)
+	counter("bitcask_value_cache_evictions_total", "Values evicted from or rejected by the value cache.", metrics.ValueCache.Evictions)
+	writeMetricHeader(bw, "bitcask_value_cache_bytes", "Memory used by the value cache.", "gauge")
+	fmt.Fprintf(bw, "bitcask_value_cache_bytes %d\n", metrics.ValueCache.Size)
+	writeMetricHeader(bw, "bitcask_value_cache_entries", "Number of values in the value cache.", "gauge")
+	fmt.Fprintf(bw, "bitcask_value_cache_entries %d\n", metrics.ValueCache.Entries)
+
+	writeHistogram(bw, "bitcask_get_duration_seconds", "Latency of Get calls.", metrics.GetLatency)
+	writeHistogram(bw, "bitcask_write_duration_seconds", "Latency of Put, Delete and batch commits.", metrics.WriteLatency)
+	writeHistogram(bw, "bitcask_sync_duration_seconds", "Latency of fsync calls.", metrics.SyncLatency)
+	writeHistogram(bw, "bitcask_merge_duration_seconds", "Duration of completed merges.", metrics.MergeDuration)
+
+	writeMetricHeader(bw, "bitcask_index_keys", "Number of keys in the index of each column family.", "gauge")
+	families := make([]string, 0, len(metrics.IndexKeys))
+	for name := range metrics.IndexKeys {
+		families = append(families, name)
+	}
+	sort.Strings(families)
+	for _, name := range families {
+		fmt.Fprintf(bw, "bitcask_index_keys{family=%q} %d\n", name, metrics.IndexKeys[name])
+	}
+	writeMetricHeader(bw, "bitcask_data_file_live_bytes", "Bytes still referenced by the index in each data file.", "gauge")
+	for _, stat := range metrics.DataFiles {
+		fmt.Fprintf(bw, "bitcask_data_file_live_bytes{fid=\"%d\"} %d\n", stat.Fid, stat.LiveSize)
+	}
+	writeMetricHeader(bw, "bitcask_data_file_dead_bytes", "Invalid bytes in each data file.", "gauge")
+	for _, stat := range metrics.DataFiles {
+		fmt.Fprintf(bw, "bitcask_data_file_dead_bytes{fid=\"%d\"} %d\n", stat.Fid, max(stat.Size-stat.LiveSize, 0))
+	}
+	writeMetricHeader(bw, "bitcask_blob_file_live_bytes", "Bytes still referenced in each blob file.", "gauge")
+	for _, stat := range metrics.BlobFiles {
+		fmt.Fprintf(bw, "bitcask_blob_file_live_bytes{fid=\"%d\"} %d\n", stat.Fid, max(stat.Size-stat.GarbageSize, 0))
+	}
+	writeMetricHeader(bw, "bitcask_blob_file_dead_bytes", "Invalid bytes in each blob file.", "gauge")
+	for _, stat := range metrics.BlobFiles {
+		fmt.Fprintf(bw, "bitcask_blob_file_dead_bytes{fid=\"%d\"} %d\n", stat.Fid, stat.GarbageSize)
+	}
+	return bw.Flush()
+}
+
+func writeMetricHeader(w io.Writer, name string, help string, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeHistogram(w io.Writer, name string, help string, stat HistogramStat) {
+	writeMetricHeader(w, name, help, "histogram")
+	for i, bound := range stat.Buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound.Seconds(), 'g', -1, 64), stat.Counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, stat.Count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(stat.Sum.Seconds(), 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, stat.Count)
+}
+
+// 持久化文件并记录耗时
+func (db *DB) syncFile(dataFile *data.DataFile) error {
+	start := time.Now()
+	err := dataFile.Sync()
+	db.metrics.syncLatency.observe(time.Since(start))
+	return err
+}
+
+// 记录一次Get的次数与延迟
+func (m *metrics) observeGet(start time.Time) {
+	m.gets.Add(1)
+	m.getLatency.observe(time.Since(start))
+}
+
+// 记录一次写入的次数与延迟
+func (m *metrics) observeWrite(counter *atomic.Uint64, start time.Time) {
+	counter.Add(1)
+	m.writeLatency.observe(time.Since(start))
+}
+
+// 记录读取value的字节数
+func (m *metrics) observeRead(logRecordPos *data.LogRecordPos) {
+	if logRecordPos.Blob != nil {
+		m.bytesRead.Add(uint64(logRecordPos.Blob.Size))
+		return
+	}
+	m.bytesRead.Add(uint64(logRecordPos.RecordSize))
+}
@@ -0,0 +1,155 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"kv-go/index"
+	"kv-go/utils"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-metrics")
+	opts.DataFileSize = 64 * 1024
+	opts.MergeRatio = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destoryDB(db)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(128)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	_, err = db.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	wb := db.NewWriteBatch(DefaultWBOptions)
+	assert.Nil(t, wb.Put(utils.GetTestKey(2000), utils.GetTestValue(128)))
+	assert.Nil(t, wb.Commit())
+	cf, err := db.CreateColumnFamily("cf")
+	assert.Nil(t, err)
+	assert.Nil(t, cf.Put([]byte("cf-key"), []byte("cf-val")))
+
+	metrics, err := db.Metrics()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1001), metrics.Puts)
+	assert.Equal(t, uint64(500), metrics.Deletes)
+	assert.Equal(t, uint64(2), metrics.Gets)
+	assert.Equal(t, uint64(2), metrics.GetLatency.Count)
+	assert.Equal(t, uint64(1), metrics.BatchCommits)
+	assert.Equal(t, uint64(1502), metrics.WriteLatency.Count)
+	assert.True(t, metrics.BytesRead > 128)
+	assert.True(t, metrics.BytesWritten > 1000*128)
+	// 同步提交的WriteBatch至少持久化一次
+	assert.True(t, metrics.SyncLatency.Count > 0)
+	assert.Equal(t, metrics.SyncLatency.Count, metrics.SyncLatency.Counts[len(metrics.SyncLatency.Counts)-1])
+	assert.Equal(t, int64(501), metrics.IndexKeys[DefaultFamilyName])
+	assert.Equal(t, int64(1), metrics.IndexKeys["cf"])
+	var live, dead int64
+	for _, stat := range metrics.DataFiles {
+		live += stat.LiveSize
+		dead += stat.Size - stat.LiveSize
+	}
+	assert.True(t, live > 0)
+	assert.True(t, dead > 500*128)
+
+	// merge回收无效数据后，数据文件中不再有被删除的记录
+	assert.Nil(t, db.Merge(context.Background()))
+	metrics, err = db.Metrics()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), metrics.Merges)
+	assert.Equal(t, uint64(1), metrics.MergeDuration.Count)
+	assert.True(t, metrics.ReclaimedBytes > 500*128)
+
+	var buf bytes.Buffer
+	assert.Nil(t, db.WritePrometheus(&buf))
+	text := buf.String()
+	assert.True(t, strings.Contains(text, "# TYPE bitcask_puts_total counter\nbitcask_puts_total 1001\n"))
+	assert.True(t, strings.Contains(text, "bitcask_merge_duration_seconds_count 1\n"))
+	assert.True(t, strings.Contains(text, "bitcask_get_duration_seconds_bucket{le=\"+Inf\"} 2\n"))
+	assert.True(t, strings.Contains(text, "bitcask_index_keys{family=\"cf\"} 1\n"))
+	assert.True(t, strings.Contains(text, "bitcask_data_file_live_bytes{fid=\"1\"}"))
+}
+
+// 遍历index统计每个数据文件中的有效数据
+func walkLiveSize(db *DB) map[uint32]int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	liveSize := make(map[uint32]int64)
+	for _, cf := range db.families {
+		iter := index.NewUnorderedIterator(cf.index)
+		for iter.Rewind(); !iter.IsEnd(); iter.Next() {
+			liveSize[iter.Value().Fid] += int64(iter.Value().RecordSize)
+		}
+		iter.Close()
+	}
+	return liveSize
+}
+
+func TestDataFileLiveSize(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("/tmp", "test-live-size")
+	opts.DataFileSize = 64 * 1024
+	opts.MergeRatio = 0
+	opts.BlobThreshold = 1024
+	opts.BlobFileSize = 16 * 1024
+	opts.BlobGCRatio = 0
+	db, err := Open(opts)
+	defer func() { destoryDB(db) }()
+	assert.Nil(t, err)
+
+	// 统计随着写入、删除、merge与blob GC更新，与遍历index的结果一致
+	check := func() {
+		stats, err := db.DataFileStat()
+		assert.Nil(t, err)
+		liveSize := walkLiveSize(db)
+		for _, stat := range stats {
+			assert.Equal(t, liveSize[stat.Fid], stat.LiveSize, stat.Fid)
+			assert.LessOrEqual(t, stat.LiveSize, stat.Size)
+		}
+	}
+	cnt := 2000
+	for i := 0; i < cnt; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	for i := 0; i < cnt; i += 3 {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWBOptions)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	assert.Nil(t, wb.Delete(utils.GetTestKey(1)))
+	assert.Nil(t, wb.Commit())
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, db.PutWithTTL(utils.GetTestKey(cnt+i), utils.GetTestValue(2048), 50*time.Millisecond))
+		assert.Nil(t, db.Put(utils.GetTestKey(cnt*2+i), utils.GetTestValue(2048)))
+	}
+	cf, err := db.CreateColumnFamily("cf")
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, cf.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	check()
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, db.BlobGC(context.Background()))
+	check()
+	assert.Nil(t, db.Merge(context.Background()))
+	check()
+	assert.Nil(t, cf.Truncate())
+	check()
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check()
+}
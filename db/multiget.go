@@ -0,0 +1,117 @@
+package db
+
+import (
+	"kv-go/data"
+	"sort"
+	"time"
+)
+
+// 一次读取中的一条记录
+type multiGetRead struct {
+	i      int            // key在keys中的位置
+	blob   bool           // 记录是否在blob file中
+	file   *data.DataFile // 记录所在的文件
+	fid    uint32         // 文件id
+	offset int64          // 记录在文件中的偏移量
+	size   int64          // 记录占用的字节数
+}
+
+// MultiGet 一次读取多个key，返回的value与error与keys一一对应
+func (db *DB) MultiGet(keys [][]byte) ([][]byte, []error) {
+	return db.defaultFamily.multiGet(keys)
+}
+
+// 只获取一次读锁，把所有读取按文件与偏移量排序后顺序访问磁盘，相邻的记录合并成一次IO
+func (cf *ColumnFamily) multiGet(keys [][]byte) ([][]byte, []error) {
+	db := cf.db
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	db.metrics.gets.Add(uint64(len(keys)))
+	if !cf.isAlive() {
+		for i := range errs {
+			errs[i] = ErrFamilyNotFound
+		}
+		return values, errs
+	}
+	now := time.Now().UnixNano()
+	reads := make([]multiGetRead, 0, len(keys))
+	for i, key := range keys {
+		if len(key) == 0 {
+			errs[i] = ErrEmptyKey
+			continue
+		}
+		logRecordPos := cf.index.Get(key)
+		if logRecordPos == nil || logRecordPos.IsExpired(now) {
+			errs[i] = ErrKeyNotFound
+			continue
+		}
+		if db.valueCache != nil {
+			if value, ok := db.valueCache.get(newCacheKey(logRecordPos)); ok {
+				values[i] = value
+				continue
+			}
+		}
+		db.metrics.observeRead(logRecordPos)
+		read := multiGetRead{i: i, fid: logRecordPos.Fid, offset: logRecordPos.Offset, size: int64(logRecordPos.RecordSize)}
+		if blob := logRecordPos.Blob; blob != nil {
+			read = multiGetRead{i: i, blob: true, file: db.blobFiles[blob.Fid], fid: blob.Fid, offset: blob.Offset, size: int64(blob.Size)}
+		} else if db.activeFile != nil && logRecordPos.Fid == db.activeFile.FileId {
+			read.file = db.activeFile
+		} else {
+			read.file = db.inActivaFile[logRecordPos.Fid]
+		}
+		if read.file == nil {
+			errs[i] = ErrDataFileNotFound
+			continue
+		}
+		reads = append(reads, read)
+	}
+	sort.Slice(reads, func(i, j int) bool {
+		if reads[i].blob != reads[j].blob {
+			return !reads[i].blob
+		}
+		if reads[i].fid != reads[j].fid {
+			return reads[i].fid < reads[j].fid
+		}
+		return reads[i].offset < reads[j].offset
+	})
+	// 同一个文件中首尾相接的记录合并成一次读取，多个key指向同一条记录时也只读取一次
+	for start := 0; start < len(reads); {
+		end, last := start+1, reads[start].offset+reads[start].size
+		for end < len(reads) && reads[end].file == reads[start].file && reads[end].offset <= last {
+			last = max(last, reads[end].offset+reads[end].size)
+			end++
+		}
+		db.readCoalesced(reads[start:end], last, values, errs)
+		start = end
+	}
+	return values, errs
+}
+
+// 用一次IO读取[reads[0].offset, last)中的记录，再逐条解析
+func (db *DB) readCoalesced(reads []multiGetRead, last int64, values [][]byte, errs []error) {
+	first := reads[0].offset
+	buf, err := reads[0].file.ReadBytes(last-first, first)
+	for _, read := range reads {
+		if err != nil {
+			errs[read.i] = err
+			continue
+		}
+		logRecord, _, err := read.file.DecodeLogRecord(buf[read.offset-first : read.offset-first+read.size])
+		if err != nil {
+			// 记录的大小与索引中不一致时退回单独读取
+			values[read.i], errs[read.i] = readValueFromFile(read.file, &data.LogRecordPos{Fid: read.fid, Offset: read.offset})
+			continue
+		}
+		if logRecord.Typ == data.LogRecordDeleted {
+			errs[read.i] = ErrDeletedKey
+			continue
+		}
+		values[read.i] = logRecord.Value
+		if db.valueCache != nil {
+			db.valueCache.put(cacheKey{blob: read.blob, fid: read.fid, offset: read.offset}, logRecord.Value)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"kv-go/fio"
+	"kv-go/utils"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 统计Read调用次数的IOManager
+type countingIOManager struct {
+	fio.IOManager
+	reads int
+}
+
+func (c *countingIOManager) Read(b []byte, off int64) (int, error) {
+	c.reads++
+	return c.IOManager.Read(b, off)
+}
+
+func TestDBMultiGet(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-multiget")
+	opts.DataFileSize = 32 * 1024
+	opts.BlobThreshold = 512
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destoryDB(db)
+
+	// 数据分布在多个数据文件与blob file中
+	values := make(map[int][]byte)
+	for i := 0; i < 500; i++ {
+		values[i] = utils.GetTestValue(128)
+		if i%50 == 0 {
+			values[i] = utils.GetTestValue(1024)
+		}
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	assert.Nil(t, db.Delete(utils.GetTestKey(7)))
+	assert.Nil(t, db.PutWithTTL(utils.GetTestKey(8), []byte("expired"), time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+
+	keys := [][]byte{utils.GetTestKey(499), utils.GetTestKey(7), nil, utils.GetTestKey(8), utils.GetTestKey(1000), utils.GetTestKey(0)}
+	for i := 450; i >= 0; i -= 3 {
+		keys = append(keys, utils.GetTestKey(i))
+	}
+	keys = append(keys, utils.GetTestKey(499))
+	vals, errs := db.MultiGet(keys)
+	assert.Equal(t, len(keys), len(vals))
+	assert.Equal(t, len(keys), len(errs))
+	assert.Equal(t, ErrKeyNotFound, errs[1])
+	assert.Equal(t, ErrEmptyKey, errs[2])
+	assert.Equal(t, ErrKeyNotFound, errs[3])
+	assert.Equal(t, ErrKeyNotFound, errs[4])
+	for i, key := range keys {
+		if errs[i] != nil {
+			assert.Nil(t, vals[i])
+			continue
+		}
+		val, err := db.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, val, vals[i])
+	}
+	assert.Equal(t, values[499], vals[0])
+	assert.Equal(t, values[499], vals[len(vals)-1])
+	assert.Equal(t, values[0], vals[5])
+
+	// 活跃文件中相邻的记录只需要一次IO
+	counting := &countingIOManager{IOManager: db.activeFile.IOManager}
+	db.activeFile.IOManager = counting
+	defer func() { db.activeFile.IOManager = counting.IOManager }()
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, db.Put([]byte("adjacent-"+string(rune('a'+i))), utils.GetTestValue(64)))
+	}
+	keys = keys[:0]
+	for i := 19; i >= 0; i-- {
+		keys = append(keys, []byte("adjacent-"+string(rune('a'+i))))
+	}
+	counting.reads = 0
+	vals, errs = db.MultiGet(keys)
+	assert.Equal(t, 1, counting.reads)
+	for i, key := range keys {
+		assert.Nil(t, errs[i])
+		val, err := db.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, val, vals[i])
+	}
+
+	// 被删除的column family中读取不到任何key
+	cf, err := db.CreateColumnFamily("cf")
+	assert.Nil(t, err)
+	assert.Nil(t, cf.Put([]byte("k"), []byte("v")))
+	vals, errs = cf.MultiGet([][]byte{[]byte("k"), []byte("missing")})
+	assert.Equal(t, []byte("v"), vals[0])
+	assert.Nil(t, errs[0])
+	assert.Equal(t, ErrKeyNotFound, errs[1])
+	assert.Nil(t, db.DropColumnFamily("cf"))
+	_, errs = cf.MultiGet([][]byte{[]byte("k")})
+	assert.Equal(t, ErrFamilyNotFound, errs[0])
+}
@@ -1,8 +1,11 @@
 package db
 
 import (
+	"kv-go/data"
 	"kv-go/index"
 	"os"
+	"runtime"
+	"time"
 )
 
 // DB配置选项
@@ -21,29 +24,82 @@ type DBOptions struct {
 	MMapStartUp bool
 	// 失效数据达到一定比率后触发merge
 	MergeRatio float32
+	// 后台检查是否需要merge与blob GC的时间间隔，为0时不开启自动merge与blob GC
+	MergeInterval time.Duration
+	// 写入value时使用的压缩算法，每条记录都保存了自己的压缩算法，修改后旧的记录仍然可读，merge时使用新的算法重新压缩
+	Compression data.Compression
+	// 提供加密密钥，不为nil时使用AES-GCM加密数据文件、hint file、merge finish file、wbid file中的所有记录
+	// B+树索引会以明文保存key，所以不能与加密一起使用
+	KeyProvider data.KeyProvider
+	// value大小超过该值时保存到单独的blob file中，数据文件中只保存value的位置，为0时不分离value
+	BlobThreshold int
+	// blob file的阈值
+	BlobFileSize int64
+	// blob file中失效数据达到一定比率后，blob GC才会回收该文件
+	BlobGCRatio float32
+	// 启动时并行解码数据文件的goroutine数量，解码结果仍按照文件id顺序加载到index中，不大于1时依次读取
+	RecoveryConcurrency int
+	// 启动时读取到损坏或不完整的记录后的处理方式
+	RecoveryMode RecoveryMode
+	// 每个订阅者最多缓存的未读取的变更数量，每次写入产生的所有事件算作一个
+	WatchBufferSize int
+	// 订阅者的缓冲区已满时的处理方式
+	WatchOverflow WatchOverflowPolicy
+	// value缓存最多占用的内存(Byte)，为0时不缓存，读多写少且有热点数据时开启
+	ValueCacheSize int64
 }
 
+// RecoveryMode 启动时遇到损坏的记录后的处理方式，崩溃时正在追加的记录可能只写入了一部分
+type RecoveryMode byte
+
+const (
+	// RecoveryStrict 遇到损坏或不完整的记录时打开失败
+	RecoveryStrict RecoveryMode = iota
+	// RecoveryTruncateTail 截断活跃文件末尾崩溃时没有写完的数据，损坏的记录之后仍有有效记录或者不活跃文件损坏时仍然打开失败
+	RecoveryTruncateTail
+	// RecoverySkipCorrupt 跳过所有数据文件中损坏的数据，继续读取之后的有效记录，活跃文件末尾的损坏数据同样被截断
+	RecoverySkipCorrupt
+)
+
 // 默认DB配置
 var DefaultDBOptions = DBOptions{
-	DirPath:      os.TempDir(),
-	DataFileSize: 256 * 1024 * 1024,
-	AlwaysSync:   false,
-	Indexer:      index.BTreeType,
-	BytesSync:    0,
-	MMapStartUp:  true,
-	MergeRatio:   0.5,
+	DirPath:             os.TempDir(),
+	DataFileSize:        256 * 1024 * 1024,
+	AlwaysSync:          false,
+	Indexer:             index.BTreeType,
+	BytesSync:           0,
+	MMapStartUp:         true,
+	MergeRatio:          0.5,
+	MergeInterval:       0,
+	Compression:         data.Compression{Codec: data.CodecNone},
+	BlobThreshold:       0,
+	BlobFileSize:        256 * 1024 * 1024,
+	BlobGCRatio:         0.5,
+	RecoveryConcurrency: runtime.NumCPU(),
+	RecoveryMode:        RecoveryStrict,
+	WatchBufferSize:     1024,
+	WatchOverflow:       WatchOverflowClose,
+	ValueCacheSize:      0,
 }
 
 // 迭代器配置选项
 type ItOptions struct {
-	Prefix  []byte // key的前缀信息
-	Reverse bool   // 是否反向遍历
+	Prefix         []byte // key的前缀信息
+	Reverse        bool   // 是否反向遍历
+	LowerBound     []byte // key的下界，为空时不限制
+	LowerExclusive bool   // 是否排除等于下界的key
+	UpperBound     []byte // key的上界，为空时不限制
+	UpperExclusive bool   // 是否排除等于上界的key
+	KeysOnly       bool   // 只遍历key，不读取磁盘中的value
+	Limit          int    // 最多遍历的key数量，为0时不限制
 }
 
 // 默认迭代器配置
 var DefaultItOptions = ItOptions{
-	Prefix:  nil,
-	Reverse: false,
+	Prefix:   nil,
+	Reverse:  false,
+	KeysOnly: false,
+	Limit:    0,
 }
 
 // WriteBatch配置选项
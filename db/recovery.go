@@ -0,0 +1,191 @@
+package db
+
+import (
+	"io"
+	"kv-go/data"
+	"log"
+	"os"
+	"sync"
+)
+
+// 启动时从一个数据文件中解码得到的记录
+type recoveredFile struct {
+	logRecords []*data.LogRecord
+	positions  []*data.LogRecordPos
+	hinted     bool
+	writeOff   int64
+	discarded  []DiscardedRange
+	err        error
+}
+
+// 按照文件顺序遍历所有数据文件中的记录，活跃文件需要读取全部记录，其他文件优先从hint file中读取
+// RecoveryConcurrency大于1时多个数据文件被并行解码，fn仍然按照文件顺序与记录顺序被调用，
+// 保证WriteBatch中的记录只在读到对应的LogRecordFinished之后才被加载，每个文件的记录遍历完成后调用done
+func (db *DB) foreachRecoveryRecord(dataFiles []*data.DataFile,
+	fn func(logRecord *data.LogRecord, pos *data.LogRecordPos),
+	done func(dataFile *data.DataFile, hinted bool, writeOff int64, discarded []DiscardedRange) error) error {
+	concurrency := min(db.opts.RecoveryConcurrency, len(dataFiles))
+	if concurrency <= 1 {
+		for _, dataFile := range dataFiles {
+			hinted, writeOff, discarded, err := db.foreachFileRecord(dataFile, dataFile != db.activeFile, fn)
+			if err != nil {
+				return err
+			}
+			if err := done(dataFile, hinted, writeOff, discarded); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	results := make([]chan *recoveredFile, len(dataFiles))
+	for i := range results {
+		results[i] = make(chan *recoveredFile, 1)
+	}
+	// 限制已经开始解码但还没有加载的文件数量，避免解码结果堆积在内存中
+	tokens := make(chan struct{}, concurrency)
+	stop := make(chan struct{})
+	wg := new(sync.WaitGroup)
+	// 出错返回前等待所有解码中的goroutine退出，之后数据文件才能被关闭
+	defer wg.Wait()
+	defer close(stop)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, dataFile := range dataFiles {
+			select {
+			case tokens <- struct{}{}:
+			case <-stop:
+				return
+			}
+			wg.Add(1)
+			go func(i int, dataFile *data.DataFile) {
+				defer wg.Done()
+				results[i] <- db.decodeRecoveryFile(dataFile)
+			}(i, dataFile)
+		}
+	}()
+
+	for i, dataFile := range dataFiles {
+		result := <-results[i]
+		if result.err != nil {
+			return result.err
+		}
+		for j, logRecord := range result.logRecords {
+			fn(logRecord, result.positions[j])
+		}
+		if err := done(dataFile, result.hinted, result.writeOff, result.discarded); err != nil {
+			return err
+		}
+		<-tokens
+	}
+	return nil
+}
+
+// 解码一个数据文件中的所有记录，只保留加载index需要的信息，不缓存value
+func (db *DB) decodeRecoveryFile(dataFile *data.DataFile) *recoveredFile {
+	result := new(recoveredFile)
+	result.hinted, result.writeOff, result.discarded, result.err = db.foreachFileRecord(dataFile, dataFile != db.activeFile, func(logRecord *data.LogRecord, pos *data.LogRecordPos) {
+		result.logRecords = append(result.logRecords, &data.LogRecord{
+			// key与value共用同一块内存，复制key以释放value
+			Key:    append([]byte(nil), logRecord.Key...),
+			Typ:    logRecord.Typ,
+			Family: logRecord.Family,
+			Expire: logRecord.Expire,
+		})
+		result.positions = append(result.positions, pos)
+	})
+	return result
+}
+
+// DiscardedRange 启动时根据RecoveryMode丢弃的损坏数据
+type DiscardedRange struct {
+	Fid    uint32 // 数据文件id
+	Offset int64  // 损坏数据在数据文件中的起始位置
+	Size   int64  // 丢弃的字节数
+	Err    error  // 读取损坏数据时遇到的错误
+}
+
+// DiscardedRanges 返回启动时丢弃的所有损坏数据，按照文件id与位置排序
+func (db *DB) DiscardedRanges() []DiscardedRange {
+	return db.discarded
+}
+
+// 记录并输出被丢弃的损坏数据
+func (db *DB) discardRanges(discarded []DiscardedRange) {
+	for _, r := range discarded {
+		log.Printf("discard %d bytes at offset %d of data file %d, %v\n", r.Size, r.Offset, r.Fid, r.Err)
+	}
+	db.discarded = append(db.discarded, discarded...)
+}
+
+// 记录不完整或者校验失败，崩溃时没有写完的记录会出现这些错误
+func isCorruptError(err error) bool {
+	return err == io.EOF || err == io.ErrUnexpectedEOF || err == data.ErrInvalidCrc || err == data.ErrEmptyKey
+}
+
+// 文件末尾之前读取到io.EOF说明记录不完整
+func corruptError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrIncompleteRecord
+	}
+	return err
+}
+
+// 读取off处的记录失败后，根据RecoveryMode决定是否跳过损坏的数据
+// 返回下一条有效记录的位置，读取到文件末尾或者丢弃文件剩余的数据时返回文件大小与io.EOF
+func (db *DB) skipCorruptRecord(dataFile *data.DataFile, off int64, readErr error) (int64, error) {
+	fileSize, err := dataFile.IOManager.Size()
+	if err != nil {
+		return 0, err
+	}
+	if readErr == io.EOF && off >= fileSize {
+		return off, io.EOF
+	}
+	if !isCorruptError(readErr) {
+		return 0, readErr
+	}
+	switch {
+	case db.opts.RecoveryMode == RecoverySkipCorrupt:
+		next, err := dataFile.FindNextRecord(off)
+		if err == io.EOF {
+			return fileSize, io.EOF
+		}
+		return next, err
+	case db.opts.RecoveryMode == RecoveryTruncateTail && dataFile == db.activeFile:
+		// 只截断崩溃时没有写完的末尾数据，之后仍有有效记录说明是文件中间的损坏，不能丢弃之后的数据
+		if _, err := dataFile.FindNextRecord(off); err != io.EOF {
+			if err != nil {
+				return 0, err
+			}
+			return 0, corruptError(readErr)
+		}
+		return fileSize, io.EOF
+	default:
+		return 0, corruptError(readErr)
+	}
+}
+
+// 截断活跃文件最后一条有效记录之后的数据，之后的写入从WriteOff开始
+func (db *DB) truncateActiveFile() error {
+	fileSize, err := db.activeFile.IOManager.Size()
+	if err != nil || fileSize <= db.activeFile.WriteOff {
+		return err
+	}
+	return os.Truncate(data.GetDataFileNameById(db.opts.DirPath, db.activeFile.FileId), db.activeFile.WriteOff)
+}
+
+// 读取数据文件中off处的记录，RecoverySkipCorrupt模式下跳过损坏的数据，返回记录实际所在的位置
+// merge与生成hint file时读取数据文件，需要与启动时加载index的方式保持一致
+func (db *DB) readDataLogRecord(dataFile *data.DataFile, off int64) (*data.LogRecord, int64, int64, error) {
+	logRecord, sz, err := dataFile.ReadLogRecord(off)
+	if err == nil || db.opts.RecoveryMode != RecoverySkipCorrupt {
+		return logRecord, off, sz, err
+	}
+	next, err := db.skipCorruptRecord(dataFile, off, err)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	logRecord, sz, err = dataFile.ReadLogRecord(next)
+	return logRecord, next, sz, err
+}
@@ -0,0 +1,334 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"kv-go/data"
+	"kv-go/fio"
+	"kv-go/utils"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// index中所有key及其位置
+func indexPositions(db *DB) map[string]data.LogRecordPos {
+	positions := make(map[string]data.LogRecordPos)
+	for _, cf := range db.families {
+		iter := cf.index.NewIterator(false)
+		for iter.Rewind(); !iter.IsEnd(); iter.Next() {
+			positions[fmt.Sprintf("%d/%s", cf.id, iter.Key())] = *iter.Value()
+		}
+		iter.Close()
+	}
+	return positions
+}
+
+func TestRecoveryConcurrency(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("/tmp", "test-recovery")
+	opts.DataFileSize = 32 * 1024
+	opts.MergeRatio = 0
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	cnt := 2000
+	for i := 0; i < cnt; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	for i := 0; i < cnt; i += 4 {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	// 跨越多个数据文件的WriteBatch
+	wb := db.NewWriteBatch(DefaultWBOptions)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(cnt+i), utils.GetTestValue(128)))
+	}
+	assert.Nil(t, wb.Commit())
+	cf, err := db.CreateColumnFamily("recovery")
+	assert.Nil(t, err)
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, cf.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	assert.Nil(t, db.PutWithTTL(utils.GetTestKey(cnt*2), utils.GetTestValue(64), time.Millisecond))
+	// 没有LogRecordFinished的WriteBatch记录，模拟提交过程中崩溃
+	db.mu.Lock()
+	for i := 0; i < 100; i++ {
+		_, err := db.appendLogRecord(&data.LogRecord{
+			Key:   serializeKeyId(utils.GetTestKey(cnt*3+i), db.wbId+100),
+			Value: utils.GetTestValue(256),
+			Typ:   data.LogRecordNormal,
+		})
+		assert.Nil(t, err)
+	}
+	db.mu.Unlock()
+	db.hintWg.Wait()
+	assert.Nil(t, db.Close())
+	// 部分数据文件没有hint file，需要完整读取
+	for fileId := uint32(1); fileId < 10; fileId += 2 {
+		assert.Nil(t, os.Remove(data.GetFileHintNameById(opts.DirPath, fileId)))
+	}
+
+	// 并行加载得到的index与依次加载得到的index相同
+	opts.RecoveryConcurrency = 1
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Greater(t, len(db.inActivaFile), 10)
+	expected := indexPositions(db)
+	assert.Equal(t, cnt-cnt/4+500+300, len(expected))
+	assert.Nil(t, db.Close())
+	for _, concurrency := range []int{0, 2, 8, 64} {
+		opts.RecoveryConcurrency = concurrency
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, indexPositions(db), concurrency)
+		_, err = db.Get(utils.GetTestKey(cnt * 3))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.Nil(t, db.Close())
+	}
+
+	// 损坏的数据文件在并行加载时同样会被发现
+	assert.Nil(t, os.Remove(data.GetFileHintNameById(opts.DirPath, 6)))
+	dataFileName := data.GetDataFileNameById(opts.DirPath, 6)
+	content, err := os.ReadFile(dataFileName)
+	assert.Nil(t, err)
+	content[len(content)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(dataFileName, content, 0644))
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrInvalidCrc, err)
+	content[len(content)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(dataFileName, content, 0644))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	opts.RecoveryConcurrency = -1
+	_, err = Open(opts)
+	assert.Equal(t, ErrInvalidRecoveryConcurrency, err)
+}
+
+func BenchmarkRecovery(b *testing.B) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("/tmp", "bench-recovery")
+	defer os.RemoveAll(opts.DirPath)
+	opts.DataFileSize = 4 * 1024 * 1024
+	db, err := Open(opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 200000; i++ {
+		if err := db.Put(utils.GetTestKey(i), utils.GetTestValue(512)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	db.hintWg.Wait()
+	if err := db.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, concurrency := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("concurrency-%d", concurrency), func(b *testing.B) {
+			opts.RecoveryConcurrency = concurrency
+			for i := 0; i < b.N; i++ {
+				// 删除hint file，每次启动都需要完整读取数据文件
+				b.StopTimer()
+				for fileId := range db.inActivaFile {
+					os.Remove(data.GetFileHintNameById(opts.DirPath, fileId))
+				}
+				b.StartTimer()
+				db, err = Open(opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				db.hintWg.Wait()
+				if err := db.Close(); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func TestTornWriteRecovery(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("/tmp", "test-torn-write")
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	cnt := 50
+	for i := 0; i < cnt; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(32)))
+	}
+	// 最后写入的WriteBatch在崩溃时只写入了一部分
+	tailOff := db.activeFile.WriteOff
+	wb := db.NewWriteBatch(DefaultWBOptions)
+	assert.Nil(t, wb.Put(utils.GetTestKey(cnt), utils.GetTestValue(32)))
+	assert.Nil(t, wb.Put(utils.GetTestKey(cnt+1), utils.GetTestValue(32)))
+	assert.Nil(t, wb.Commit())
+	fileId := db.activeFile.FileId
+	dataFileName := data.GetDataFileNameById(opts.DirPath, fileId)
+	assert.Nil(t, db.Close())
+	content, err := os.ReadFile(dataFileName)
+	assert.Nil(t, err)
+	// WriteBatch中每条记录的起始位置
+	dataFile, err := data.OpenDataFile(opts.DirPath, fileId, fio.FileIOType)
+	assert.Nil(t, err)
+	boundaries := make(map[int64]bool)
+	for off := tailOff; off < int64(len(content)); {
+		boundaries[off] = true
+		_, sz, err := dataFile.ReadLogRecord(off)
+		if !assert.Nil(t, err) {
+			break
+		}
+		off += sz
+	}
+	assert.Nil(t, dataFile.Close())
+
+	checkData := func(db *DB) {
+		for i := 0; i < cnt; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+		// 没有读到LogRecordFinished，WriteBatch中的记录都不会被加载
+		for i := cnt; i < cnt+2; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+	}
+
+	for cut := tailOff + 1; cut < int64(len(content)); cut++ {
+		// 严格模式下，不完整的记录导致打开失败
+		assert.Nil(t, os.WriteFile(dataFileName, content[:cut], 0644))
+		opts.RecoveryMode = RecoveryStrict
+		db, err = Open(opts)
+		if boundaries[cut] {
+			assert.Nil(t, err, cut)
+			checkData(db)
+			assert.Nil(t, db.Close())
+			continue
+		}
+		assert.Contains(t, []error{ErrIncompleteRecord, data.ErrInvalidCrc, data.ErrEmptyKey}, err, cut)
+
+		// 截断模式下，丢弃最后一条有效记录之后的数据，之后的写入与重启正常
+		opts.RecoveryMode = RecoveryTruncateTail
+		db, err = Open(opts)
+		assert.Nil(t, err, cut)
+		checkData(db)
+		discarded := db.DiscardedRanges()
+		assert.Equal(t, 1, len(discarded))
+		assert.Equal(t, fileId, discarded[0].Fid)
+		assert.Equal(t, cut, discarded[0].Offset+discarded[0].Size)
+		assert.True(t, boundaries[discarded[0].Offset])
+		stat, err := os.Stat(dataFileName)
+		assert.Nil(t, err)
+		assert.Equal(t, discarded[0].Offset, stat.Size())
+		assert.Nil(t, db.Put(utils.GetTestKey(cnt*2), utils.GetTestValue(32)))
+		assert.Nil(t, db.Close())
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(db.DiscardedRanges()))
+		checkData(db)
+		_, err = db.Get(utils.GetTestKey(cnt * 2))
+		assert.Nil(t, err)
+		assert.Nil(t, db.Close())
+	}
+}
+
+func TestTruncateTailMidFileCorruption(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("/tmp", "test-truncate-tail-corrupt")
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	cnt := 50
+	for i := 0; i < cnt; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(32)))
+	}
+	// 损坏活跃文件中间的一条记录，之后仍有有效记录
+	pos := db.index.Get(utils.GetTestKey(cnt / 2))
+	assert.Equal(t, db.activeFile.FileId, pos.Fid)
+	dataFileName := data.GetDataFileNameById(opts.DirPath, pos.Fid)
+	assert.Nil(t, db.Close())
+	content, err := os.ReadFile(dataFileName)
+	assert.Nil(t, err)
+	content[pos.Offset+int64(pos.RecordSize)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(dataFileName, content, 0644))
+
+	// 默认使用严格模式
+	assert.Equal(t, RecoveryStrict, DefaultDBOptions.RecoveryMode)
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrInvalidCrc, err)
+
+	// 截断模式只截断末尾不完整的记录，文件中间的损坏同样打开失败，且不会修改文件
+	opts.RecoveryMode = RecoveryTruncateTail
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrInvalidCrc, err)
+	stat, err := os.Stat(dataFileName)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)), stat.Size())
+}
+
+func TestSkipCorruptRecovery(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("/tmp", "test-skip-corrupt")
+	opts.DataFileSize = 16 * 1024
+	opts.MergeRatio = 0
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	cnt := 500
+	for i := 0; i < cnt; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	// 损坏第二个数据文件中的一条记录
+	pos := db.index.Get(utils.GetTestKey(200))
+	assert.NotEqual(t, db.activeFile.FileId, pos.Fid)
+	db.hintWg.Wait()
+	assert.Nil(t, db.Close())
+	assert.Nil(t, os.Remove(data.GetFileHintNameById(opts.DirPath, pos.Fid)))
+	dataFileName := data.GetDataFileNameById(opts.DirPath, pos.Fid)
+	content, err := os.ReadFile(dataFileName)
+	assert.Nil(t, err)
+	content[pos.Offset+int64(pos.RecordSize)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(dataFileName, content, 0644))
+
+	// 不活跃文件中的损坏不会被截断
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrInvalidCrc, err)
+
+	// 跳过损坏的记录，只有该记录丢失
+	opts.RecoveryMode = RecoverySkipCorrupt
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []DiscardedRange{{Fid: pos.Fid, Offset: pos.Offset, Size: int64(pos.RecordSize), Err: data.ErrInvalidCrc}}, db.DiscardedRanges())
+	checkData := func(db *DB) {
+		for i := 0; i < cnt; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			if i == 200 {
+				assert.Equal(t, ErrKeyNotFound, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		}
+	}
+	checkData(db)
+
+	// 生成hint file与merge同样跳过损坏的记录
+	db.hintWg.Wait()
+	assert.True(t, fileHintExists(db)[pos.Fid])
+	assert.Nil(t, db.Merge(context.Background()))
+	assert.Nil(t, db.Close())
+	opts.RecoveryMode = RecoveryStrict
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	checkData(db)
+	assert.Nil(t, db.Close())
+
+	opts.RecoveryMode = RecoverySkipCorrupt + 1
+	_, err = Open(opts)
+	assert.Equal(t, ErrInvalidRecoveryMode, err)
+}
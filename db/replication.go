@@ -0,0 +1,385 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"kv-go/data"
+	"kv-go/index"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 主从复制
+// primary将数据文件与blob file中追加的字节原样发送给follower，follower写入自己的数据目录后更新index，
+// 两端的LogRecordPos完全相同，因此follower断开后可以从(file id, offset)处继续同步
+// merge与column family的变化会修改已有的文件，此时primary通过Checkpoint为follower重新提供全量数据
+
+const (
+	frameData      uint8 = iota + 1 // 数据文件中追加的字节
+	frameBlob                       // blob file中追加的字节
+	frameSeedBegin                  // 开始全量同步，follower清空数据目录
+	frameSeedFile                   // 全量同步中的一个文件
+	frameSeedEnd                    // 全量同步完成，负载为新的epoch与gen
+)
+
+const replicationChunkSize = 1 << 20
+
+// primary端的复制状态
+type replication struct {
+	epoch uint64         // 每次Open时生成，primary重启后follower需要重新全量同步
+	gen   uint64         // merge或column family变化时递增，follower的gen不同时需要重新全量同步
+	wait  chan struct{}  // 追加记录时关闭，唤醒等待新数据的连接
+	stop  chan struct{}  // 关闭数据库时关闭，停止所有连接
+	wg    sync.WaitGroup // 用于等待所有连接退出
+}
+
+func newReplication() *replication {
+	return &replication{
+		epoch: uint64(time.Now().UnixNano()),
+		stop:  make(chan struct{}),
+	}
+}
+
+// follower连接时发送的同步位置
+type replicationPos struct {
+	Epoch   uint64
+	Gen     uint64
+	DataFid uint32 // 已经收到的最后一个数据文件
+	DataOff int64  // 该数据文件中已经收到的字节数
+	BlobFid uint32
+	BlobOff int64
+}
+
+// 连接上发送的帧，之后是NameSize字节的文件名与Size字节的负载
+type frameHeader struct {
+	Typ      uint8
+	Boundary bool   // 负载结束于一条完整记录的末尾，follower此时才会应用记录
+	Fid      uint32 // 数据文件或blob file的id
+	Off      int64  // 负载在文件中的偏移量
+	NameSize uint16 // frameSeedFile的文件名长度
+	Size     uint32 // 负载的长度
+}
+
+// 一次需要发送的文件区间
+type replicationRange struct {
+	typ  uint8
+	file *data.DataFile
+	from int64
+	to   int64
+}
+
+// ServeReplication 接受follower的连接，并将追加的记录持续发送给它们，直到listener被关闭或数据库被关闭
+func (db *DB) ServeReplication(listener net.Listener) error {
+	// B+树的index不在数据文件中，follower无法根据记录重建
+	if db.opts.Indexer == index.BPlusTreeType {
+		return ErrReplicationUnsupported
+	}
+	repl := db.replication
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-repl.stop:
+			_ = listener.Close()
+		case <-done:
+		}
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if isClosed(repl.stop) {
+				return nil
+			}
+			return err
+		}
+		db.mu.Lock()
+		if isClosed(repl.stop) {
+			db.mu.Unlock()
+			_ = conn.Close()
+			return nil
+		}
+		repl.wg.Add(1)
+		db.mu.Unlock()
+		go db.serveFollower(conn)
+	}
+}
+
+func (db *DB) serveFollower(conn net.Conn) {
+	repl := db.replication
+	defer repl.wg.Done()
+	done := make(chan struct{})
+	defer close(done)
+	// 关闭数据库时关闭连接，避免阻塞在写入上
+	go func() {
+		select {
+		case <-repl.stop:
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+	defer conn.Close()
+	var pos replicationPos
+	err := binary.Read(conn, binary.LittleEndian, &pos)
+	if err == nil {
+		err = db.shipLog(bufio.NewWriterSize(conn, replicationChunkSize), &pos)
+	}
+	if err != nil && !isClosed(repl.stop) {
+		log.Printf("replication to %s stopped, %v\n", conn.RemoteAddr(), err)
+	}
+}
+
+// 从pos开始持续发送追加的字节，follower的数据与当前的文件不一致时重新全量同步
+func (db *DB) shipLog(w *bufio.Writer, pos *replicationPos) error {
+	buf := make([]byte, replicationChunkSize)
+	for {
+		ranges, wait, ok := db.captureReplication(pos)
+		if !ok {
+			if err := db.seedFollower(w, pos); err != nil {
+				return err
+			}
+			continue
+		}
+		err := db.sendRanges(w, ranges, pos, buf)
+		db.mu.Lock()
+		for _, r := range ranges {
+			_ = db.releaseFile(r.file)
+		}
+		db.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if len(ranges) == 0 {
+			select {
+			case <-wait:
+			case <-db.replication.stop:
+				return nil
+			}
+		}
+	}
+}
+
+// 获取pos之后追加的所有文件区间，并引用这些文件
+// blob file的区间在前，数据文件中的记录引用的value都会先被发送
+// follower与当前的文件不一致时返回false，没有新数据时返回等待新数据的channel
+func (db *DB) captureReplication(pos *replicationPos) ([]*replicationRange, chan struct{}, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	repl := db.replication
+	if pos.Epoch != repl.epoch || pos.Gen != repl.gen {
+		return nil, nil, false
+	}
+	var ranges []*replicationRange
+	capture := func(typ uint8, files map[uint32]*data.DataFile, fid uint32, off int64) bool {
+		fileIds := make([]uint32, 0, len(files))
+		for fileId := range files {
+			if fileId >= fid {
+				fileIds = append(fileIds, fileId)
+			}
+		}
+		sort.Slice(fileIds, func(i, j int) bool {
+			return fileIds[i] < fileIds[j]
+		})
+		for _, fileId := range fileIds {
+			file := files[fileId]
+			// merge后重新打开的数据文件没有设置WriteOff
+			size := file.WriteOff
+			if typ == frameData && file != db.activeFile {
+				var err error
+				if size, err = file.IOManager.Size(); err != nil {
+					return false
+				}
+			}
+			var from int64
+			if fileId == fid {
+				from = off
+			}
+			if from > size {
+				return false
+			}
+			if from < size {
+				ranges = append(ranges, &replicationRange{typ: typ, file: file, from: from, to: size})
+			}
+		}
+		return true
+	}
+	dataFiles := make(map[uint32]*data.DataFile, len(db.inActivaFile)+1)
+	for fileId, dataFile := range db.inActivaFile {
+		dataFiles[fileId] = dataFile
+	}
+	if db.activeFile != nil {
+		dataFiles[db.activeFile.FileId] = db.activeFile
+	}
+	if !capture(frameBlob, db.blobFiles, pos.BlobFid, pos.BlobOff) || !capture(frameData, dataFiles, pos.DataFid, pos.DataOff) {
+		return nil, nil, false
+	}
+	for _, r := range ranges {
+		db.fileRefs[r.file]++
+	}
+	if len(ranges) > 0 {
+		return ranges, nil, true
+	}
+	if repl.wait == nil {
+		repl.wait = make(chan struct{})
+	}
+	return nil, repl.wait, true
+}
+
+// 分块发送文件区间，每个区间的最后一块结束于一条完整的记录
+func (db *DB) sendRanges(w *bufio.Writer, ranges []*replicationRange, pos *replicationPos, buf []byte) error {
+	for _, r := range ranges {
+		for off := r.from; off < r.to; {
+			n := min(r.to-off, int64(len(buf)))
+			if _, err := r.file.IOManager.Read(buf[:n], off); err != nil {
+				return err
+			}
+			h := frameHeader{Typ: r.typ, Boundary: off+n == r.to, Fid: r.file.FileId, Off: off, Size: uint32(n)}
+			if err := writeFrame(w, h, nil, buf[:n]); err != nil {
+				return err
+			}
+			off += n
+		}
+		if r.typ == frameBlob {
+			pos.BlobFid, pos.BlobOff = r.file.FileId, r.to
+		} else {
+			pos.DataFid, pos.DataOff = r.file.FileId, r.to
+		}
+	}
+	return nil
+}
+
+// 通过Checkpoint为follower提供全量数据，完成后pos指向检查点中的活跃文件末尾
+func (db *DB) seedFollower(w *bufio.Writer, pos *replicationPos) error {
+	// 先读取gen，创建检查点期间gen发生变化时，follower会在下一次同步时再次全量同步
+	db.mu.RLock()
+	epoch, gen := db.replication.epoch, db.replication.gen
+	db.mu.RUnlock()
+	// 检查点使用硬链接，需要与数据目录在同一个文件系统中
+	dirPath := filepath.Clean(db.opts.DirPath)
+	seedDir, err := os.MkdirTemp(filepath.Dir(dirPath), filepath.Base(dirPath)+"-seed")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(seedDir)
+	if err := db.Checkpoint(seedDir); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(seedDir)
+	if err != nil {
+		return err
+	}
+	if err := writeFrame(w, frameHeader{Typ: frameSeedBegin}, nil, nil); err != nil {
+		return err
+	}
+	newPos := replicationPos{Epoch: epoch, Gen: gen}
+	buf := make([]byte, replicationChunkSize)
+	for _, entry := range entries {
+		name := entry.Name()
+		size, err := sendSeedFile(w, filepath.Join(seedDir, name), buf)
+		if err != nil {
+			return err
+		}
+		// 检查点中id最大的文件就是活跃文件
+		if strings.HasSuffix(name, data.DataFileNameSuffix) || strings.HasSuffix(name, data.BlobFileNameSuffix) {
+			fileId, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(name, data.DataFileNameSuffix), data.BlobFileNameSuffix))
+			if err != nil {
+				return ErrDataFileNameCorrupted
+			}
+			if strings.HasSuffix(name, data.DataFileNameSuffix) && uint32(fileId) >= newPos.DataFid {
+				newPos.DataFid, newPos.DataOff = uint32(fileId), size
+			} else if strings.HasSuffix(name, data.BlobFileNameSuffix) && uint32(fileId) >= newPos.BlobFid {
+				newPos.BlobFid, newPos.BlobOff = uint32(fileId), size
+			}
+		}
+	}
+	payload := make([]byte, 16)
+	binary.LittleEndian.PutUint64(payload, epoch)
+	binary.LittleEndian.PutUint64(payload[8:], gen)
+	if err := writeFrame(w, frameHeader{Typ: frameSeedEnd, Size: uint32(len(payload))}, nil, payload); err != nil {
+		return err
+	}
+	*pos = newPos
+	return nil
+}
+
+// 分块发送检查点中的一个文件，返回文件大小
+func sendSeedFile(w *bufio.Writer, fileName string, buf []byte) (int64, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	name := []byte(filepath.Base(fileName))
+	var off int64
+	for {
+		n, err := io.ReadFull(file, buf)
+		if err == io.EOF && off > 0 {
+			return off, nil
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		h := frameHeader{Typ: frameSeedFile, Off: off, NameSize: uint16(len(name)), Size: uint32(n)}
+		if err := writeFrame(w, h, name, buf[:n]); err != nil {
+			return 0, err
+		}
+		off += int64(n)
+		if n < len(buf) {
+			return off, nil
+		}
+	}
+}
+
+func writeFrame(w io.Writer, h frameHeader, name []byte, payload []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, &h); err != nil {
+		return err
+	}
+	if _, err := w.Write(name); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// 唤醒等待新数据的连接，调用时需要持有db.mu
+func (db *DB) notifyReplication() {
+	if db.replication.wait != nil {
+		close(db.replication.wait)
+		db.replication.wait = nil
+	}
+}
+
+// 已有的文件被修改，follower需要重新全量同步，调用时需要持有db.mu
+func (db *DB) bumpReplicationGen() {
+	db.replication.gen++
+	db.notifyReplication()
+}
+
+// 停止所有复制连接，并等待它们退出
+func (db *DB) stopReplication() {
+	db.mu.Lock()
+	if !isClosed(db.replication.stop) {
+		close(db.replication.stop)
+	}
+	db.mu.Unlock()
+	db.replication.wg.Wait()
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
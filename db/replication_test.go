@@ -0,0 +1,144 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"kv-go/data"
+	"kv-go/utils"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 等待follower与primary中的数据一致
+func waitReplicated(t *testing.T, primary *DB, follower *Follower) {
+	matched := func() bool {
+		err := follower.View(func(replica *DB) error {
+			for _, name := range primary.ListColumnFamilies() {
+				cf, err := primary.ColumnFamily(name)
+				if err != nil {
+					return err
+				}
+				replicaCf, err := replica.ColumnFamily(name)
+				if err != nil {
+					return err
+				}
+				keys := cf.ListKeys(false)
+				if len(keys) != len(replicaCf.ListKeys(false)) {
+					return ErrReplicaNotReady
+				}
+				for _, key := range keys {
+					val, _ := cf.Get(key)
+					replicaVal, err := replicaCf.Get(key)
+					if err != nil || !bytes.Equal(val, replicaVal) {
+						return ErrReplicaNotReady
+					}
+				}
+			}
+			return nil
+		})
+		return err == nil
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for !matched() {
+		if time.Now().After(deadline) {
+			t.Fatal("follower did not catch up with the primary")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-replication")
+	opts.DataFileSize = 64 * 1024
+	opts.MergeRatio = 0
+	opts.BlobThreshold = 1024
+	defer os.RemoveAll(opts.DirPath)
+	primary, err := Open(opts)
+	assert.Nil(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- primary.ServeReplication(listener)
+	}()
+
+	followerOpts := opts
+	followerOpts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-follower")
+	defer os.RemoveAll(followerOpts.DirPath)
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			size := 128
+			if i%50 == 0 {
+				size = 2048
+			}
+			assert.Nil(t, primary.Put(utils.GetTestKey(i), utils.GetTestValue(size)))
+		}
+	}
+	{
+		// 已有的数据通过全量同步到达，之后的写入通过追加的记录到达
+		put(0, 500)
+		follower, err := Follow(followerOpts, listener.Addr().String())
+		assert.Nil(t, err)
+		waitReplicated(t, primary, follower)
+		put(500, 1500)
+		wb := primary.NewWriteBatch(DefaultWBOptions)
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, wb.Delete(utils.GetTestKey(i)))
+		}
+		assert.Nil(t, wb.Put(utils.GetTestKey(2000), utils.GetTestValue(4096)))
+		assert.Nil(t, wb.Commit())
+		waitReplicated(t, primary, follower)
+
+		// follower是只读的
+		err = follower.View(func(replica *DB) error {
+			return replica.Put(utils.GetTestKey(1), utils.GetTestValue(128))
+		})
+		assert.Equal(t, ErrReplicaReadOnly, err)
+		assert.Nil(t, follower.Close())
+	}
+	{
+		// 重启后从本地文件的末尾继续同步，不需要重新全量同步
+		sealed := filepath.Join(followerOpts.DirPath, filepath.Base(data.GetDataFileNameById(followerOpts.DirPath, 1)))
+		before, err := os.Stat(sealed)
+		assert.Nil(t, err)
+		put(1500, 2000)
+		follower, err := Follow(followerOpts, listener.Addr().String())
+		assert.Nil(t, err)
+		waitReplicated(t, primary, follower)
+		after, err := os.Stat(sealed)
+		assert.Nil(t, err)
+		assert.True(t, os.SameFile(before, after))
+
+		// merge与column family的变化会触发全量同步
+		for i := 100; i < 1000; i += 2 {
+			assert.Nil(t, primary.Delete(utils.GetTestKey(i)))
+		}
+		assert.Nil(t, primary.Merge(context.Background()))
+		cf, err := primary.CreateColumnFamily("cf")
+		assert.Nil(t, err)
+		assert.Nil(t, cf.Put([]byte("cf-key"), []byte("cf-val")))
+		put(2000, 2500)
+		waitReplicated(t, primary, follower)
+		val, err := follower.Get(utils.GetTestKey(2499))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+
+		// primary关闭后follower仍然可以读取
+		assert.Nil(t, primary.Close())
+		assert.Nil(t, <-served)
+		_, err = follower.Get(utils.GetTestKey(2499))
+		assert.Nil(t, err)
+		assert.Nil(t, follower.Close())
+	}
+	{
+		// 不是副本的数据目录不会被覆盖
+		_, err := Follow(opts, listener.Addr().String())
+		assert.Equal(t, ErrReplicaDirNotEmpty, err)
+	}
+}
@@ -0,0 +1,166 @@
+package db
+
+import (
+	"kv-go/data"
+	"kv-go/index"
+	"time"
+)
+
+// Snapshot 数据库在某一时刻的只读视图
+// 快照会引用创建时的所有数据文件与blob file，merge与blob GC不会关闭这些文件，直到快照被关闭
+// 快照只包含默认的column family
+type Snapshot struct {
+	db        *DB
+	index     index.Indexer             // 创建快照时index的只读副本
+	dataFiles map[uint32]*data.DataFile // 创建快照时的所有数据文件
+	blobFiles map[uint32]*data.DataFile // 创建快照时的所有blob file
+	closed    bool                      // 快照是否已经关闭
+	mergeGen  uint64                    // 创建快照时db的mergeGen
+}
+
+// 创建默认column family的快照，使用完毕后需要调用Close释放快照引用的数据文件
+func (db *DB) Snapshot() (*Snapshot, error) {
+	// 写操作会在持有写锁时追加记录并更新index，所以这里得到的index与数据文件是一致的
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	indexSnap := db.index.Snapshot()
+	if indexSnap == nil {
+		return nil, ErrSnapshotUnsupported
+	}
+	dataFiles := make(map[uint32]*data.DataFile, len(db.inActivaFile)+1)
+	for fileId, dataFile := range db.inActivaFile {
+		dataFiles[fileId] = dataFile
+	}
+	if db.activeFile != nil {
+		dataFiles[db.activeFile.FileId] = db.activeFile
+	}
+	blobFiles := make(map[uint32]*data.DataFile, len(db.blobFiles))
+	for fileId, blobFile := range db.blobFiles {
+		blobFiles[fileId] = blobFile
+	}
+	// 引用所有数据文件与blob file，避免被merge或blob GC关闭
+	for _, dataFile := range dataFiles {
+		db.fileRefs[dataFile]++
+	}
+	for _, blobFile := range blobFiles {
+		db.fileRefs[blobFile]++
+	}
+	return &Snapshot{
+		db:        db,
+		index:     indexSnap,
+		dataFiles: dataFiles,
+		blobFiles: blobFiles,
+		mergeGen:  db.mergeGen,
+	}, nil
+}
+
+// Get 获取快照中key对应的value
+func (snap *Snapshot) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	logRecordPos := snap.index.Get(key)
+	if logRecordPos == nil || logRecordPos.IsExpired(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
+	}
+	return snap.GetValueByPos(logRecordPos)
+}
+
+// GetValueByPos 从快照引用的数据文件中读取value
+func (snap *Snapshot) GetValueByPos(logRecordPos *data.LogRecordPos) ([]byte, error) {
+	snap.db.metrics.observeRead(logRecordPos)
+	if logRecordPos.Blob != nil {
+		return readValueFromBlob(snap.blobFiles[logRecordPos.Blob.Fid], logRecordPos.Blob)
+	}
+	return readValueFromFile(snap.dataFiles[logRecordPos.Fid], logRecordPos)
+}
+
+// 获取快照上的迭代器
+func (snap *Snapshot) NewIterator(opts ItOptions) *DBIterator {
+	dbIter := &DBIterator{
+		indexIter: snap.index.NewIterator(opts.Reverse),
+		db:        snap.db,
+		snapshot:  snap,
+		opts:      opts,
+	}
+	dbIter.Rewind()
+	return dbIter
+}
+
+func (snap *Snapshot) ListKeys(reverse bool) [][]byte {
+	iter := snap.index.NewIterator(reverse)
+	defer iter.Close()
+	keys := make([][]byte, 0, snap.index.Size())
+	now := time.Now().UnixNano()
+	for iter.Rewind(); !iter.IsEnd(); iter.Next() {
+		if iter.Value().IsExpired(now) {
+			continue
+		}
+		keys = append(keys, iter.Key())
+	}
+	return keys
+}
+
+func (snap *Snapshot) Fold(fn func(key []byte, val []byte) bool) error {
+	iter := snap.index.NewIterator(false)
+	defer iter.Close()
+	now := time.Now().UnixNano()
+	for iter.Rewind(); !iter.IsEnd(); iter.Next() {
+		if iter.Value().IsExpired(now) {
+			continue
+		}
+		val, err := snap.GetValueByPos(iter.Value())
+		if err != nil {
+			return err
+		}
+		if !fn(iter.Key(), val) {
+			break
+		}
+	}
+	return nil
+}
+
+// 关闭快照，释放对数据文件的引用
+func (snap *Snapshot) Close() error {
+	db := snap.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if snap.closed {
+		return nil
+	}
+	snap.closed = true
+	for _, dataFile := range snap.dataFiles {
+		if err := db.releaseFile(dataFile); err != nil {
+			return err
+		}
+	}
+	for _, blobFile := range snap.blobFiles {
+		if err := db.releaseFile(blobFile); err != nil {
+			return err
+		}
+	}
+	return snap.index.Close()
+}
+
+// 释放快照对数据文件的引用，如果文件已经被merge或blob GC替换且不再被引用，则关闭它
+func (db *DB) releaseFile(dataFile *data.DataFile) error {
+	db.fileRefs[dataFile]--
+	if db.fileRefs[dataFile] > 0 {
+		return nil
+	}
+	delete(db.fileRefs, dataFile)
+	if db.retiredFiles[dataFile] {
+		delete(db.retiredFiles, dataFile)
+		return dataFile.Close()
+	}
+	return nil
+}
+
+// 关闭被merge替换的数据文件，如果文件仍被快照引用，则延迟关闭
+func (db *DB) retireFile(dataFile *data.DataFile) error {
+	if db.fileRefs[dataFile] > 0 {
+		db.retiredFiles[dataFile] = true
+		return nil
+	}
+	return dataFile.Close()
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"kv-go/index"
+	"kv-go/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotGet(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-snapshot-get")
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	{
+		// 创建快照后继续Put/Delete/WriteBatch，快照中的数据不变
+		val1, val2 := utils.GetTestValue(128), utils.GetTestValue(128)
+		assert.Nil(t, db.Put(utils.GetTestKey(1), val1))
+		assert.Nil(t, db.Put(utils.GetTestKey(2), val2))
+		snap, err := db.Snapshot()
+		assert.Nil(t, err)
+		assert.NotNil(t, snap)
+		defer snap.Close()
+
+		assert.Nil(t, db.Put(utils.GetTestKey(1), utils.GetTestValue(128)))
+		assert.Nil(t, db.Delete(utils.GetTestKey(2)))
+		wb := db.NewWriteBatch(DefaultWBOptions)
+		assert.Nil(t, wb.Put(utils.GetTestKey(3), utils.GetTestValue(128)))
+		assert.Nil(t, wb.Commit())
+
+		res1, err := snap.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, val1, res1)
+		res2, err := snap.Get(utils.GetTestKey(2))
+		assert.Nil(t, err)
+		assert.Equal(t, val2, res2)
+		_, err = snap.Get(utils.GetTestKey(3))
+		assert.Equal(t, ErrKeyNotFound, err)
+		_, err = snap.Get(nil)
+		assert.Equal(t, ErrEmptyKey, err)
+
+		// db本身能看到最新的数据
+		_, err = db.Get(utils.GetTestKey(2))
+		assert.Equal(t, ErrKeyNotFound, err)
+		_, err = db.Get(utils.GetTestKey(3))
+		assert.Nil(t, err)
+	}
+}
+
+func TestSnapshotIterFold(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.Indexer = index.ARTreeType
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-snapshot-iter")
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	{
+		// 快照上的迭代器与Fold只能看到创建快照时的数据
+		cnt := 1000
+		vals := make([][]byte, cnt)
+		for i := 0; i < cnt; i++ {
+			vals[i] = utils.GetTestValue(128)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), vals[i]))
+		}
+		snap, err := db.Snapshot()
+		assert.Nil(t, err)
+		defer snap.Close()
+		for i := 0; i < cnt; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(128)))
+			assert.Nil(t, db.Put(utils.GetTestKey(cnt+i), utils.GetTestValue(128)))
+		}
+
+		iter := snap.NewIterator(DefaultItOptions)
+		var i = 0
+		for ; !iter.IsEnd(); iter.Next() {
+			assert.Equal(t, utils.GetTestKey(i), iter.Key())
+			val, err := iter.Value()
+			assert.Nil(t, err)
+			assert.Equal(t, vals[i], val)
+			i++
+		}
+		iter.Close()
+		assert.Equal(t, cnt, i)
+
+		i = 0
+		err = snap.Fold(func(key []byte, val []byte) bool {
+			if !bytes.Equal(vals[i], val) {
+				return false
+			}
+			i++
+			return true
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, cnt, i)
+		assert.Equal(t, cnt, len(snap.ListKeys(false)))
+	}
+}
+
+func TestSnapshotMerge(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-snapshot-merge")
+	opts.DataFileSize = 1024 * 1024
+	opts.MergeRatio = 0
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	{
+		// merge会替换快照引用的数据文件，快照仍能读取到原来的数据
+		cnt := 20000
+		vals := make([][]byte, cnt)
+		for i := 0; i < cnt; i++ {
+			vals[i] = utils.GetTestValue(128)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), vals[i]))
+		}
+		snap, err := db.Snapshot()
+		assert.Nil(t, err)
+		for i := 0; i < cnt/2; i++ {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		}
+		assert.Nil(t, db.Merge(context.Background()))
+		assert.NotEmpty(t, db.retiredFiles)
+
+		for i := 0; i < cnt; i++ {
+			val, err := snap.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, vals[i], val)
+		}
+		// 关闭快照后，被替换的文件也会被关闭
+		assert.Nil(t, snap.Close())
+		assert.Empty(t, db.retiredFiles)
+		assert.Empty(t, db.fileRefs)
+		for i := cnt / 2; i < cnt; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, vals[i], val)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package db
+
+import (
+	"io"
+	"kv-go/data"
+	"kv-go/fio"
+	"kv-go/index"
+	"kv-go/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gofrs/flock"
+)
+
+// 离线工具，用于检查与修复已经关闭的数据目录
+
+// CorruptRange 离线检查时发现的损坏数据
+type CorruptRange struct {
+	File   string // 文件名
+	Offset int64  // 损坏数据在文件中的起始位置
+	Size   int64  // 损坏数据的字节数，直到下一条有效记录或文件末尾
+	Err    error  // 读取损坏数据时遇到的错误
+}
+
+// DumpRecord 数据文件中的一条记录
+type DumpRecord struct {
+	Fid       uint32             // 数据文件id
+	Offset    int64              // 记录在数据文件中的位置
+	Size      int64              // 记录的长度
+	Typ       data.LogRecordType // 记录类型
+	WbId      uint64             // WriteBatch id，不属于WriteBatch的记录为0
+	Family    uint32             // column family id
+	Key       []byte             // 去掉wbId前缀的key
+	ValueSize int                // 解压后value的长度，blob记录为value在blob file中的位置的长度
+	Expire    int64              // 过期时间，为0时不过期
+}
+
+// Verify 检查目录下所有数据文件、blob file、hint file与merge finish file中的记录，报告所有损坏的数据
+func Verify(opts DBOptions) ([]CorruptRange, error) {
+	unlock, err := lockDir(opts.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	fileNames, err := logFileNames(opts.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	cipher := data.NewCipher(opts.KeyProvider)
+	var corrupts []CorruptRange
+	for _, fileName := range fileNames {
+		logFile, err := data.OpenLogFile(filepath.Join(opts.DirPath, fileName), 0)
+		if err != nil {
+			return nil, err
+		}
+		logFile.Cipher = cipher
+		err = scanLogFile(logFile, fileName, func(*data.LogRecord, int64, int64) {}, func(corrupt CorruptRange) {
+			corrupts = append(corrupts, corrupt)
+		})
+		logFile.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return corrupts, nil
+}
+
+// Dump 按照文件id与位置的顺序遍历所有数据文件中的有效记录，fn返回false时停止遍历，fid不为0时只遍历该数据文件
+func Dump(opts DBOptions, fid uint32, fn func(record *DumpRecord) bool) error {
+	unlock, err := lockDir(opts.DirPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	fileIds, err := dataFileIds(opts.DirPath)
+	if err != nil {
+		return err
+	}
+	cipher := data.NewCipher(opts.KeyProvider)
+	for _, fileId := range fileIds {
+		if fid != 0 && fileId != fid {
+			continue
+		}
+		dataFile, err := data.OpenLogFile(data.GetDataFileNameById(opts.DirPath, fileId), fileId)
+		if err != nil {
+			return err
+		}
+		dataFile.Cipher = cipher
+		stop := false
+		err = scanLogFile(dataFile, filepath.Base(data.GetDataFileNameById(opts.DirPath, fileId)), func(logRecord *data.LogRecord, off int64, sz int64) {
+			if stop {
+				return
+			}
+			key, wbId := parseKeyId(logRecord.Key)
+			stop = !fn(&DumpRecord{
+				Fid:       fileId,
+				Offset:    off,
+				Size:      sz,
+				Typ:       logRecord.Typ,
+				WbId:      wbId,
+				Family:    logRecord.Family,
+				Key:       key,
+				ValueSize: len(logRecord.Value),
+				Expire:    logRecord.Expire,
+			})
+		}, func(CorruptRange) {})
+		dataFile.Close()
+		if err != nil || stop {
+			return err
+		}
+	}
+	return nil
+}
+
+// Repair 将数据目录重写到dstDir中，丢弃数据文件中损坏的记录，返回被丢弃的数据
+// 记录在数据文件中的位置会发生变化，所以不会复制hint file与merge生成的hint-index，blob file与其他文件原样复制
+func Repair(opts DBOptions, dstDir string) ([]CorruptRange, error) {
+	// B+树的index保存了记录的位置，无法根据数据文件重建
+	if opts.Indexer == index.BPlusTreeType {
+		return nil, ErrRepairUnsupported
+	}
+	unlock, err := lockDir(opts.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if entries, err := os.ReadDir(dstDir); err == nil && len(entries) > 0 {
+		return nil, ErrRepairDirNotEmpty
+	}
+	fileIds, err := dataFileIds(opts.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	// 复制数据文件与索引文件之外的所有文件
+	dirEntries, err := os.ReadDir(opts.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	exclude := map[string]struct{}{fileLockName: {}, data.HintFileName: {}, data.MergeFilishedFileName: {}}
+	for _, entry := range dirEntries {
+		name := entry.Name()
+		if strings.HasSuffix(name, data.DataFileNameSuffix) || strings.HasSuffix(name, data.FileHintNameSuffix) ||
+			strings.HasSuffix(name, fileHintTmpSuffix) {
+			exclude[name] = struct{}{}
+		}
+	}
+	if err := utils.CopyDir(opts.DirPath, dstDir, exclude); err != nil {
+		return nil, err
+	}
+	cipher := data.NewCipher(opts.KeyProvider)
+	var corrupts []CorruptRange
+	for _, fileId := range fileIds {
+		fileName := data.GetDataFileNameById(opts.DirPath, fileId)
+		srcFile, err := data.OpenLogFile(fileName, fileId)
+		if err != nil {
+			return nil, err
+		}
+		srcFile.Cipher = cipher
+		corrupt, err := repairDataFile(srcFile, filepath.Base(fileName), dstDir)
+		srcFile.Close()
+		if err != nil {
+			return nil, err
+		}
+		corrupts = append(corrupts, corrupt...)
+	}
+	return corrupts, nil
+}
+
+// 将数据文件中的有效记录原样复制到dstDir下的同名文件中，加密与压缩的记录不需要重新编码
+func repairDataFile(srcFile *data.DataFile, fileName string, dstDir string) ([]CorruptRange, error) {
+	dstFile, err := data.OpenDataFile(dstDir, srcFile.FileId, fio.FileIOType)
+	if err != nil {
+		return nil, err
+	}
+	defer dstFile.Close()
+	var corrupts []CorruptRange
+	var writeErr error
+	err = scanLogFile(srcFile, fileName, func(_ *data.LogRecord, off int64, sz int64) {
+		if writeErr != nil {
+			return
+		}
+		buf := make([]byte, sz)
+		if _, writeErr = srcFile.IOManager.Read(buf, off); writeErr == nil {
+			writeErr = dstFile.Write(buf)
+		}
+	}, func(corrupt CorruptRange) {
+		corrupts = append(corrupts, corrupt)
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return corrupts, dstFile.Sync()
+}
+
+// 遍历文件中的所有有效记录，跳过并报告损坏的数据
+func scanLogFile(logFile *data.DataFile, fileName string, fn func(logRecord *data.LogRecord, off int64, sz int64), corrupt func(CorruptRange)) error {
+	fileSize, err := logFile.IOManager.Size()
+	if err != nil {
+		return err
+	}
+	var off int64 = 0
+	for off < fileSize {
+		logRecord, sz, err := logFile.ReadLogRecord(off)
+		if err == nil {
+			fn(logRecord, off, sz)
+			off += sz
+			continue
+		}
+		if !isCorruptError(err) {
+			return err
+		}
+		next, findErr := logFile.FindNextRecord(off)
+		if findErr == io.EOF {
+			next = fileSize
+		} else if findErr != nil {
+			return findErr
+		}
+		corrupt(CorruptRange{File: fileName, Offset: off, Size: next - off, Err: corruptError(err)})
+		off = next
+	}
+	return nil
+}
+
+// 获取目录的文件锁，保证数据库没有被打开
+func lockDir(dirPath string) (func(), error) {
+	if _, err := os.Stat(dirPath); err != nil {
+		return nil, err
+	}
+	fileLock := flock.New(filepath.Join(dirPath, fileLockName))
+	hold, err := fileLock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	if !hold {
+		return nil, ErrDBUsing
+	}
+	return func() { _ = fileLock.Unlock() }, nil
+}
+
+// 目录下所有数据文件的id，按照从小到大排序
+func dataFileIds(dirPath string) ([]uint32, error) {
+	dirEntries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var fileIds []uint32
+	for _, entry := range dirEntries {
+		if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			fileId, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), data.DataFileNameSuffix))
+			if err != nil {
+				return nil, ErrDataFileNameCorrupted
+			}
+			fileIds = append(fileIds, uint32(fileId))
+		}
+	}
+	sort.Slice(fileIds, func(i, j int) bool {
+		return fileIds[i] < fileIds[j]
+	})
+	return fileIds, nil
+}
+
+// 目录下所有保存LogRecord的文件名，按照文件名排序
+func logFileNames(dirPath string) ([]string, error) {
+	dirEntries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var fileNames []string
+	for _, entry := range dirEntries {
+		name := entry.Name()
+		if strings.HasSuffix(name, data.DataFileNameSuffix) || strings.HasSuffix(name, data.BlobFileNameSuffix) ||
+			strings.HasSuffix(name, data.FileHintNameSuffix) || name == data.HintFileName ||
+			name == data.MergeFilishedFileName || name == data.NextWriteBatchIdFileName || name == data.FamilyFileName {
+			fileNames = append(fileNames, name)
+		}
+	}
+	sort.Strings(fileNames)
+	return fileNames, nil
+}
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"kv-go/data"
+	"kv-go/utils"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineTools(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-tools")
+	opts.DataFileSize = 16 * 1024
+	opts.MergeRatio = 0
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	cnt := 300
+	for i := 0; i < cnt; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	for i := 0; i < cnt; i += 2 {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWBOptions)
+	assert.Nil(t, wb.Put(utils.GetTestKey(cnt), utils.GetTestValue(64)))
+	assert.Nil(t, wb.Commit())
+
+	// 每个数据文件的有效数据与无效数据
+	stats, err := db.DataFileStat()
+	assert.Nil(t, err)
+	assert.Greater(t, len(stats), 2)
+	var liveSize int64 = 0
+	for _, stat := range stats {
+		assert.LessOrEqual(t, stat.LiveSize, stat.Size)
+		liveSize += stat.LiveSize
+	}
+	assert.Greater(t, liveSize, int64(0))
+	assert.Less(t, stats[0].LiveSize, stats[0].Size)
+
+	// 数据库打开时不能使用离线工具
+	_, err = Verify(opts)
+	assert.Equal(t, ErrDBUsing, err)
+	pos := db.index.Get(utils.GetTestKey(1))
+	db.hintWg.Wait()
+	assert.Nil(t, db.Close())
+
+	{
+		corrupts, err := Verify(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(corrupts))
+
+		// dump输出所有记录，WriteBatch中的记录带有wbId
+		var puts, deletes, finished int
+		assert.Nil(t, Dump(opts, 0, func(record *DumpRecord) bool {
+			switch record.Typ {
+			case data.LogRecordNormal:
+				puts++
+			case data.LogRecordDeleted:
+				deletes++
+			case data.LogRecordFinished:
+				finished++
+				assert.NotEqual(t, zeroWbId, record.WbId)
+			}
+			if record.Fid == pos.Fid && record.Offset == pos.Offset {
+				assert.Equal(t, utils.GetTestKey(1), record.Key)
+				assert.Equal(t, int64(pos.RecordSize), record.Size)
+			}
+			return true
+		}))
+		assert.Equal(t, cnt+1, puts)
+		assert.Equal(t, cnt/2, deletes)
+		assert.Equal(t, 1, finished)
+		num := 0
+		assert.Nil(t, Dump(opts, pos.Fid, func(record *DumpRecord) bool {
+			assert.Equal(t, pos.Fid, record.Fid)
+			num++
+			return num < 3
+		}))
+		assert.Equal(t, 3, num)
+	}
+
+	// 损坏一条数据文件中的记录与一个hint file
+	dataFileName := data.GetDataFileNameById(opts.DirPath, pos.Fid)
+	content, err := os.ReadFile(dataFileName)
+	assert.Nil(t, err)
+	content[pos.Offset+int64(pos.RecordSize)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(dataFileName, content, 0644))
+	hintFileName := data.GetFileHintNameById(opts.DirPath, pos.Fid+1)
+	content, err = os.ReadFile(hintFileName)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(hintFileName, content[:len(content)-1], 0644))
+
+	{
+		corrupts, err := Verify(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(corrupts))
+		assert.Equal(t, CorruptRange{File: filepath.Base(dataFileName), Offset: pos.Offset, Size: int64(pos.RecordSize), Err: data.ErrInvalidCrc}, corrupts[0])
+		assert.Equal(t, filepath.Base(hintFileName), corrupts[1].File)
+		assert.Equal(t, ErrIncompleteRecord, corrupts[1].Err)
+
+		// 修复后只有损坏的记录丢失
+		dstDir, _ := os.MkdirTemp("", "KeyCache-test-tools-repair")
+		defer os.RemoveAll(dstDir)
+		corrupts, err = Repair(opts, dstDir)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(corrupts))
+		_, err = Repair(opts, dstDir)
+		assert.Equal(t, ErrRepairDirNotEmpty, err)
+		repairOpts := opts
+		repairOpts.DirPath = dstDir
+		repairOpts.RecoveryMode = RecoveryStrict
+		corrupts, err = Verify(repairOpts)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(corrupts))
+		repaired, err := Open(repairOpts)
+		assert.Nil(t, err)
+		for i := 0; i <= cnt; i++ {
+			_, err := repaired.Get(utils.GetTestKey(i))
+			if i%2 == 0 && i != cnt || i == 1 {
+				assert.Equal(t, ErrKeyNotFound, err, i)
+			} else {
+				assert.Nil(t, err, i)
+			}
+		}
+		assert.Nil(t, repaired.Close())
+	}
+}
@@ -0,0 +1,266 @@
+package db
+
+import (
+	"bytes"
+	"kv-go/data"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Txn 基于WriteBatch的乐观读写事务
+// 事务从创建时的快照中读取数据，写入暂存在WriteBatch中，提交时检查读过的key是否被其他写入修改过
+// 注意：只检查读过的key，Iterate期间其他事务插入的新key不会被视为冲突
+type Txn struct {
+	db       *DB
+	snapshot *Snapshot                     // 事务开始时的快照，事务的读操作都基于该快照
+	batch    *WriteBatch                   // 暂存事务的写操作
+	reads    map[string]*data.LogRecordPos // 读集合，保存读取时key的位置，nil表示key不存在
+	done     bool                          // 事务是否已经提交或回滚
+	mu       *sync.Mutex
+}
+
+// 开启一个事务
+func (db *DB) Begin() (*Txn, error) {
+	batch := db.NewWriteBatch(DefaultWBOptions)
+	if batch == nil {
+		return nil, ErrWriteBatchUnavailable
+	}
+	snapshot, err := db.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &Txn{
+		db:       db,
+		snapshot: snapshot,
+		batch:    batch,
+		reads:    make(map[string]*data.LogRecordPos),
+		mu:       new(sync.Mutex),
+	}, nil
+}
+
+// 读取key对应的value，优先读取事务自己的写入
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.done {
+		return nil, ErrTxnClosed
+	}
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	// 先查看事务自己的写入
+	if record, ok := txn.batch.pendingWrites[txn.pendingKey(key)]; ok {
+		if record.Typ == data.LogRecordDeleted {
+			return nil, ErrKeyNotFound
+		}
+		return record.Value, nil
+	}
+	// 再从快照中读取，并记录到读集合
+	logRecordPos := txn.snapshot.index.Get(key)
+	txn.reads[string(key)] = logRecordPos
+	if logRecordPos == nil || logRecordPos.IsExpired(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
+	}
+	return txn.snapshot.GetValueByPos(logRecordPos)
+}
+
+// 写入数据到事务的暂存区
+func (txn *Txn) Put(key []byte, value []byte) error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.done {
+		return ErrTxnClosed
+	}
+	return txn.batch.Put(key, value)
+}
+
+// 在事务的暂存区中删除数据
+func (txn *Txn) Delete(key []byte) error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.done {
+		return ErrTxnClosed
+	}
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	// 不能使用WriteBatch.Delete，它根据最新的index判断key是否存在
+	// 事务需要保留墓碑值，才能在之后的读取中看到自己的删除
+	txn.batch.mu.Lock()
+	defer txn.batch.mu.Unlock()
+	txn.batch.pendingWrites[txn.pendingKey(key)] = &data.LogRecord{
+		Key: key,
+		Typ: data.LogRecordDeleted,
+	}
+	return nil
+}
+
+// 按key的顺序遍历事务能看到的数据，fn返回false时停止遍历，KeysOnly时传给fn的value为nil
+func (txn *Txn) Iterate(opts ItOptions, fn func(key []byte, val []byte) bool) error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.done {
+		return ErrTxnClosed
+	}
+	// 暂存区中在遍历范围内的key，按遍历方向排序
+	pendingKeys := make([]string, 0)
+	for pk := range txn.batch.pendingWrites {
+		if opts.position([]byte(pk.key)) == 0 {
+			pendingKeys = append(pendingKeys, pk.key)
+		}
+	}
+	sort.Strings(pendingKeys)
+	if opts.Reverse {
+		slices.Reverse(pendingKeys)
+	}
+	// Limit限制的是归并之后的key数量
+	limit := opts.Limit
+	opts.Limit = 0
+	iter := txn.snapshot.NewIterator(opts)
+	defer iter.Close()
+	count := 0
+	// 归并快照与暂存区中的key，key相同时暂存区优先
+	i := 0
+	for (!iter.IsEnd() || i < len(pendingKeys)) && (limit <= 0 || count < limit) {
+		fromPending := false
+		if i < len(pendingKeys) {
+			if iter.IsEnd() {
+				fromPending = true
+			} else {
+				cmp := bytes.Compare([]byte(pendingKeys[i]), iter.Key())
+				if opts.Reverse {
+					cmp = -cmp
+				}
+				if cmp == 0 {
+					iter.Next()
+				}
+				fromPending = cmp <= 0
+			}
+		}
+		if fromPending {
+			record := txn.batch.pendingWrites[txn.pendingKey([]byte(pendingKeys[i]))]
+			i++
+			if record.Typ == data.LogRecordDeleted {
+				continue
+			}
+			count++
+			val := record.Value
+			if opts.KeysOnly {
+				val = nil
+			}
+			if !fn(record.Key, val) {
+				return nil
+			}
+			continue
+		}
+		key := iter.Key()
+		logRecordPos := iter.indexIter.Value()
+		var val []byte
+		if !opts.KeysOnly {
+			var err error
+			if val, err = txn.snapshot.GetValueByPos(logRecordPos); err != nil {
+				return err
+			}
+		}
+		txn.reads[string(key)] = logRecordPos
+		iter.Next()
+		count++
+		if !fn(key, val) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// 提交事务，读过的key被其他写入修改时返回ErrTxnConflict
+func (txn *Txn) Commit() error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.done {
+		return ErrTxnClosed
+	}
+	txn.done = true
+	defer txn.snapshot.Close()
+	batch := txn.batch
+	batch.mu.Lock()
+	defer batch.mu.Unlock()
+	// 只读事务读取的是一致的快照，无需检查冲突
+	if len(batch.pendingWrites) == 0 {
+		return nil
+	}
+	if uint(len(batch.pendingWrites)) > batch.opts.MaxWriteNum {
+		return ErrExceedMaxWriteNum
+	}
+	db := txn.db
+	return db.write(func() (func() error, error) {
+		// 检查读集合中的key是否被修改过
+		for key, readPos := range txn.reads {
+			changed, err := txn.isKeyChanged([]byte(key), readPos)
+			if err != nil {
+				return nil, err
+			}
+			if changed {
+				return nil, ErrTxnConflict
+			}
+		}
+		// 删除不存在的key没有意义，WriteBatch也无法更新index
+		for pk, record := range batch.pendingWrites {
+			if record.Typ == data.LogRecordDeleted && db.index.Get([]byte(pk.key)) == nil {
+				delete(batch.pendingWrites, pk)
+			}
+		}
+		if len(batch.pendingWrites) == 0 {
+			return nil, nil
+		}
+		return batch.commit()
+	}, true, batch.needSync())
+}
+
+// 回滚事务，丢弃所有写入
+func (txn *Txn) Rollback() error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.done {
+		return ErrTxnClosed
+	}
+	txn.done = true
+	return txn.snapshot.Close()
+}
+
+// 判断读过的key是否被修改过
+// merge会复用文件id，被修改过的key可能恰好回到读取时的位置，所以事务期间发生过merge时改为比较读取时与当前的过期时间和value
+func (txn *Txn) isKeyChanged(key []byte, readPos *data.LogRecordPos) (bool, error) {
+	db := txn.db
+	logRecordPos := db.index.Get(key)
+	if db.mergeGen == txn.snapshot.mergeGen || logRecordPos == nil || readPos == nil {
+		return !isSamePos(logRecordPos, readPos), nil
+	}
+	if logRecordPos.Expire != readPos.Expire {
+		return true, nil
+	}
+	// 读取时的value从快照引用的旧文件中读取
+	readVal, err := txn.snapshot.GetValueByPos(readPos)
+	if err != nil {
+		return false, err
+	}
+	val, err := db.GetValueByPos(logRecordPos)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(readVal, val), nil
+}
+
+// 事务只读写默认的column family
+func (txn *Txn) pendingKey(key []byte) pendingKey {
+	return pendingKey{family: txn.db.defaultFamily, key: string(key)}
+}
+
+// 判断两个位置是否指向同一条记录
+func isSamePos(l, r *data.LogRecordPos) bool {
+	if l == nil || r == nil {
+		return l == r
+	}
+	return l.Fid == r.Fid && l.Offset == r.Offset
+}
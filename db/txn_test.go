@@ -0,0 +1,261 @@
+package db
+
+import (
+	"context"
+	"kv-go/utils"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxnReadOwnWrites(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-txn-read-own-writes")
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	{
+		// 事务能读到自己的写入，提交前其他人看不到
+		assert.Nil(t, db.Put(utils.GetTestKey(1), utils.GetTestValue(128)))
+		txn, err := db.Begin()
+		assert.Nil(t, err)
+		assert.NotNil(t, txn)
+		val2 := utils.GetTestValue(128)
+		assert.Nil(t, txn.Put(utils.GetTestKey(2), val2))
+		assert.Nil(t, txn.Delete(utils.GetTestKey(1)))
+
+		res, err := txn.Get(utils.GetTestKey(2))
+		assert.Nil(t, err)
+		assert.Equal(t, val2, res)
+		_, err = txn.Get(utils.GetTestKey(1))
+		assert.Equal(t, ErrKeyNotFound, err)
+		_, err = db.Get(utils.GetTestKey(2))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		assert.Nil(t, txn.Commit())
+		res, err = db.Get(utils.GetTestKey(2))
+		assert.Nil(t, err)
+		assert.Equal(t, val2, res)
+		_, err = db.Get(utils.GetTestKey(1))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		// 提交后不能再使用事务
+		assert.Equal(t, ErrTxnClosed, txn.Commit())
+		_, err = txn.Get(utils.GetTestKey(2))
+		assert.Equal(t, ErrTxnClosed, err)
+	}
+
+	{
+		// 回滚后写入不会生效
+		txn, err := db.Begin()
+		assert.Nil(t, err)
+		assert.Nil(t, txn.Put(utils.GetTestKey(3), utils.GetTestValue(128)))
+		assert.Nil(t, txn.Rollback())
+		_, err = db.Get(utils.GetTestKey(3))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.Equal(t, ErrTxnClosed, txn.Put(utils.GetTestKey(3), nil))
+	}
+}
+
+func TestTxnConflict(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-txn-conflict")
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	{
+		// 读过的key被其他写入修改后，提交失败
+		assert.Nil(t, db.Put([]byte("counter"), []byte("1")))
+		txn1, err := db.Begin()
+		assert.Nil(t, err)
+		txn2, err := db.Begin()
+		assert.Nil(t, err)
+		_, err = txn1.Get([]byte("counter"))
+		assert.Nil(t, err)
+		_, err = txn2.Get([]byte("counter"))
+		assert.Nil(t, err)
+		assert.Nil(t, txn1.Put([]byte("counter"), []byte("2")))
+		assert.Nil(t, txn2.Put([]byte("counter"), []byte("2")))
+		assert.Nil(t, txn1.Commit())
+		assert.Equal(t, ErrTxnConflict, txn2.Commit())
+	}
+
+	{
+		// 读取时不存在的key被其他人写入，也是冲突
+		txn, err := db.Begin()
+		assert.Nil(t, err)
+		_, err = txn.Get([]byte("missing"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.Nil(t, db.Put([]byte("missing"), []byte("x")))
+		assert.Nil(t, txn.Put([]byte("other"), []byte("y")))
+		assert.Equal(t, ErrTxnConflict, txn.Commit())
+	}
+
+	{
+		// 没有读过的key被修改，不是冲突
+		txn, err := db.Begin()
+		assert.Nil(t, err)
+		assert.Nil(t, db.Put([]byte("counter"), []byte("3")))
+		assert.Nil(t, txn.Put([]byte("counter"), []byte("4")))
+		assert.Nil(t, txn.Commit())
+		val, err := db.Get([]byte("counter"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("4"), val)
+	}
+}
+
+func TestTxnConflictAcrossMerge(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("/tmp", "test-txn-merge")
+	opts.MergeRatio = 0
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	{
+		// key被修改后经过merge又回到了读取时的位置，提交仍然失败
+		assert.Nil(t, db.Put([]byte("counter"), []byte("1")))
+		txn, err := db.Begin()
+		assert.Nil(t, err)
+		val, err := txn.Get([]byte("counter"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("1"), val)
+		readPos := db.index.Get([]byte("counter"))
+		assert.Nil(t, db.Put([]byte("counter"), []byte("2")))
+		assert.Nil(t, db.Merge(context.Background()))
+		assert.True(t, isSamePos(readPos, db.index.Get([]byte("counter"))))
+		assert.Nil(t, txn.Put([]byte("counter"), []byte("2")))
+		assert.Equal(t, ErrTxnConflict, txn.Commit())
+		val, err = db.Get([]byte("counter"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("2"), val)
+	}
+	{
+		// 读过的key没有被修改，merge之后仍然可以提交
+		assert.Nil(t, db.Put([]byte("stable"), []byte("1")))
+		txn, err := db.Begin()
+		assert.Nil(t, err)
+		val, err := txn.Get([]byte("stable"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("1"), val)
+		_, err = txn.Get([]byte("absent"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		for i := 0; i < 10; i++ {
+			assert.Nil(t, db.Put([]byte("counter"), []byte(strconv.Itoa(i))))
+		}
+		assert.Nil(t, db.Merge(context.Background()))
+		assert.Nil(t, txn.Put([]byte("stable"), []byte("2")))
+		assert.Nil(t, txn.Commit())
+		val, err = db.Get([]byte("stable"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("2"), val)
+	}
+	{
+		// merge之后读过的key被删除或者读取时不存在的key被写入，提交失败
+		assert.Nil(t, db.Put([]byte("deleted"), []byte("1")))
+		changes := map[string]func() error{
+			"deleted":  func() error { return db.Delete([]byte("deleted")) },
+			"inserted": func() error { return db.Put([]byte("inserted"), []byte("1")) },
+		}
+		for key, change := range changes {
+			txn, err := db.Begin()
+			assert.Nil(t, err)
+			_, _ = txn.Get([]byte(key))
+			assert.Nil(t, db.Merge(context.Background()))
+			assert.Nil(t, change())
+			assert.Nil(t, txn.Put([]byte("stable"), []byte("3")))
+			assert.Equal(t, ErrTxnConflict, txn.Commit())
+		}
+		val, err := db.Get([]byte("stable"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("2"), val)
+	}
+}
+
+func TestTxnCounter(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-txn-counter")
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	{
+		// 多个线程并发地对计数器加一，冲突时重试，最终结果应该是准确的
+		key := []byte("counter")
+		assert.Nil(t, db.Put(key, []byte("0")))
+		workers, cnt := 8, 100
+		wg := new(sync.WaitGroup)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < cnt; i++ {
+					for {
+						txn, err := db.Begin()
+						assert.Nil(t, err)
+						val, err := txn.Get(key)
+						assert.Nil(t, err)
+						n, _ := strconv.Atoi(string(val))
+						assert.Nil(t, txn.Put(key, []byte(strconv.Itoa(n+1))))
+						err = txn.Commit()
+						if err == ErrTxnConflict {
+							continue
+						}
+						assert.Nil(t, err)
+						break
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		val, err := db.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, strconv.Itoa(workers*cnt), string(val))
+	}
+}
+
+func TestTxnIterate(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-txn-iterate")
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	{
+		// 遍历时合并快照与事务的写入
+		for _, key := range []string{"a1", "a3", "a5", "b1"} {
+			assert.Nil(t, db.Put([]byte(key), []byte("db-"+key)))
+		}
+		txn, err := db.Begin()
+		assert.Nil(t, err)
+		assert.Nil(t, txn.Put([]byte("a2"), []byte("txn-a2")))
+		assert.Nil(t, txn.Put([]byte("a3"), []byte("txn-a3")))
+		assert.Nil(t, txn.Delete([]byte("a5")))
+		assert.Nil(t, txn.Put([]byte("a6"), []byte("txn-a6")))
+
+		var keys, vals []string
+		itOpts := DefaultItOptions
+		itOpts.Prefix = []byte("a")
+		err = txn.Iterate(itOpts, func(key []byte, val []byte) bool {
+			keys = append(keys, string(key))
+			vals = append(vals, string(val))
+			return true
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"a1", "a2", "a3", "a6"}, keys)
+		assert.Equal(t, []string{"db-a1", "txn-a2", "txn-a3", "txn-a6"}, vals)
+
+		keys = keys[:0]
+		itOpts.Reverse = true
+		err = txn.Iterate(itOpts, func(key []byte, val []byte) bool {
+			keys = append(keys, string(key))
+			return true
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"a6", "a3", "a2", "a1"}, keys)
+
+		// 遍历时读过的key被修改，提交失败
+		assert.Nil(t, db.Put([]byte("a1"), []byte("changed")))
+		assert.Equal(t, ErrTxnConflict, txn.Commit())
+	}
+}
@@ -0,0 +1,192 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"sync"
+)
+
+// WatchEventType 变更事件的类型
+type WatchEventType byte
+
+const (
+	WatchPut WatchEventType = iota
+	WatchDelete
+)
+
+// WatchOverflowPolicy 订阅者的缓冲区已满时的处理方式
+type WatchOverflowPolicy byte
+
+const (
+	// WatchOverflowClose 关闭订阅者的channel，订阅者需要重新订阅并自行同步丢失的变更
+	WatchOverflowClose WatchOverflowPolicy = iota
+	// WatchOverflowBlock 不丢弃事件，事件在订阅者的队列中排队，由订阅者自己的协程阻塞地发送
+	// 写入与读取不会被慢速的订阅者阻塞，订阅者在处理事件时也可以读写数据库，但是慢速的订阅者会使队列占用的内存不断增长
+	WatchOverflowBlock
+)
+
+// WatchEvent 一个key的变更
+type WatchEvent struct {
+	Type  WatchEventType
+	Key   []byte
+	Value []byte // 删除事件的value为nil
+	Seq   uint64 // 事件的序号，数据库打开后从1开始递增，只在本次打开期间有效
+}
+
+// 一次写入中的变更，key与value引用用户传入的数据，有订阅者时才复制
+type watchChange struct {
+	family *ColumnFamily
+	typ    WatchEventType
+	key    []byte
+	value  []byte
+	copied bool
+}
+
+// 订阅者
+type watcher struct {
+	family *ColumnFamily
+	prefix []byte
+	ch     chan []WatchEvent
+	done   chan struct{}
+
+	// WatchOverflowBlock时使用，等待发送的事件与唤醒发送协程的信号
+	queue  [][]WatchEvent
+	notify chan struct{}
+	mu     *sync.Mutex
+}
+
+// Watch 订阅默认column family中以prefix为前缀的key的变更
+// 每次Put、Delete或WriteBatch提交产生的事件在一次发送中被一起交付，ctx取消或数据库关闭后channel被关闭
+// 过期、merge、blob GC以及删除或清空column family不会产生事件
+func (db *DB) Watch(ctx context.Context, prefix []byte) (<-chan []WatchEvent, error) {
+	return db.defaultFamily.Watch(ctx, prefix)
+}
+
+// Watch 订阅column family中以prefix为前缀的key的变更，column family被删除后channel被关闭
+func (cf *ColumnFamily) Watch(ctx context.Context, prefix []byte) (<-chan []WatchEvent, error) {
+	db := cf.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !cf.isAlive() {
+		return nil, ErrFamilyNotFound
+	}
+	w := &watcher{
+		family: cf,
+		prefix: append([]byte(nil), prefix...),
+		ch:     make(chan []WatchEvent, db.opts.WatchBufferSize),
+		done:   make(chan struct{}),
+	}
+	if db.opts.WatchOverflow == WatchOverflowBlock {
+		w.notify = make(chan struct{}, 1)
+		w.mu = new(sync.Mutex)
+		go w.deliver()
+	}
+	db.watchers[w] = struct{}{}
+	go func() {
+		select {
+		case <-ctx.Done():
+			db.mu.Lock()
+			db.removeWatcher(w)
+			db.mu.Unlock()
+		case <-w.done:
+		}
+	}()
+	return w.ch, nil
+}
+
+// 移除订阅者并关闭其channel，调用者需要持有db.mu
+func (db *DB) removeWatcher(w *watcher) {
+	if _, ok := db.watchers[w]; !ok {
+		return
+	}
+	delete(db.watchers, w)
+	// 有发送协程时由其关闭channel，避免向已关闭的channel发送
+	if w.notify == nil {
+		close(w.ch)
+	}
+	close(w.done)
+}
+
+// 在db.mu之外依次发送队列中的事件，订阅者被移除后关闭channel并丢弃未发送的事件
+func (w *watcher) deliver() {
+	defer close(w.ch)
+	for {
+		w.mu.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.mu.Unlock()
+		for _, events := range queue {
+			select {
+			case w.ch <- events:
+			case <-w.done:
+				return
+			}
+		}
+		select {
+		case <-w.notify:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// 移除订阅了column family的所有订阅者，cf为nil时移除所有订阅者，调用者需要持有db.mu
+func (db *DB) removeWatchers(cf *ColumnFamily) {
+	for w := range db.watchers {
+		if cf == nil || w.family == cf {
+			db.removeWatcher(w)
+		}
+	}
+}
+
+// 写入完成后为变更分配序号并通知订阅者，调用者需要持有db.mu，保证事件的顺序与写入顺序一致
+func (db *DB) notifyWatchers(changes []watchChange) {
+	firstSeq := db.watchSeq + 1
+	db.watchSeq += uint64(len(changes))
+	if len(db.watchers) == 0 {
+		return
+	}
+	for w := range db.watchers {
+		var events []WatchEvent
+		for i := range changes {
+			change := &changes[i]
+			if change.family != w.family || !bytes.HasPrefix(change.key, w.prefix) {
+				continue
+			}
+			// 复制一次后由所有订阅者共享，避免用户修改传入的数据
+			if !change.copied {
+				change.key = append([]byte(nil), change.key...)
+				if change.typ == WatchPut {
+					change.value = append([]byte{}, change.value...)
+				}
+				change.copied = true
+			}
+			events = append(events, WatchEvent{
+				Type:  change.typ,
+				Key:   change.key,
+				Value: change.value,
+				Seq:   firstSeq + uint64(i),
+			})
+		}
+		if len(events) == 0 {
+			continue
+		}
+		switch db.opts.WatchOverflow {
+		case WatchOverflowBlock:
+			// 持有db.mu时不能阻塞，交给订阅者的发送协程
+			w.mu.Lock()
+			w.queue = append(w.queue, events)
+			w.mu.Unlock()
+			select {
+			case w.notify <- struct{}{}:
+			default:
+			}
+		default:
+			select {
+			case w.ch <- events:
+			default:
+				db.removeWatcher(w)
+			}
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package db
+
+import (
+	"context"
+	"kv-go/utils"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 在超时前从channel中读取一次交付的事件
+func receiveEvents(t *testing.T, ch <-chan []WatchEvent) []WatchEvent {
+	select {
+	case events, ok := <-ch:
+		assert.True(t, ok)
+		return events
+	case <-time.After(time.Second):
+		t.Fatal("no events received")
+		return nil
+	}
+}
+
+func TestWatch(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-watch")
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	all, err := db.Watch(ctx, nil)
+	assert.Nil(t, err)
+	users, err := db.Watch(ctx, []byte("user:"))
+	assert.Nil(t, err)
+
+	// Put与Delete分别产生一个事件，只有前缀匹配的订阅者收到
+	value := []byte("v1")
+	assert.Nil(t, db.Put([]byte("user:1"), value))
+	value[0] = 'x'
+	assert.Nil(t, db.Put([]byte("order:1"), []byte("v2")))
+	assert.Nil(t, db.Delete([]byte("user:1")))
+	assert.Equal(t, ErrKeyNotFound, db.Delete([]byte("user:2")))
+	assert.Equal(t, []WatchEvent{{Type: WatchPut, Key: []byte("user:1"), Value: []byte("v1"), Seq: 1}}, receiveEvents(t, all))
+	assert.Equal(t, []WatchEvent{{Type: WatchPut, Key: []byte("order:1"), Value: []byte("v2"), Seq: 2}}, receiveEvents(t, all))
+	assert.Equal(t, []WatchEvent{{Type: WatchDelete, Key: []byte("user:1"), Seq: 3}}, receiveEvents(t, all))
+	assert.Equal(t, []WatchEvent{{Type: WatchPut, Key: []byte("user:1"), Value: []byte("v1"), Seq: 1}}, receiveEvents(t, users))
+	assert.Equal(t, []WatchEvent{{Type: WatchDelete, Key: []byte("user:1"), Seq: 3}}, receiveEvents(t, users))
+
+	// WriteBatch与事务中的所有变更一起交付
+	wb := db.NewWriteBatch(DefaultWBOptions)
+	assert.Nil(t, wb.Put([]byte("user:2"), []byte("v3")))
+	assert.Nil(t, wb.Put([]byte("user:3"), []byte("v4")))
+	assert.Nil(t, wb.Delete([]byte("order:1")))
+	assert.Nil(t, wb.Commit())
+	events := receiveEvents(t, all)
+	assert.Equal(t, 3, len(events))
+	sort.Slice(events, func(i, j int) bool {
+		return string(events[i].Key) < string(events[j].Key)
+	})
+	assert.Equal(t, WatchEvent{Type: WatchDelete, Key: []byte("order:1"), Seq: events[0].Seq}, events[0])
+	assert.Equal(t, []byte("v3"), events[1].Value)
+	assert.Equal(t, 2, len(receiveEvents(t, users)))
+	txn, err := db.Begin()
+	assert.Nil(t, err)
+	assert.Nil(t, txn.Put([]byte("user:4"), []byte("v5")))
+	assert.Nil(t, txn.Commit())
+	events = receiveEvents(t, users)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, uint64(7), events[0].Seq)
+	receiveEvents(t, all)
+
+	// 其他column family中的变更只通知该column family的订阅者
+	cf, err := db.CreateColumnFamily("watch")
+	assert.Nil(t, err)
+	cfEvents, err := cf.Watch(ctx, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, cf.Put([]byte("user:5"), []byte("v6")))
+	assert.Equal(t, []byte("user:5"), receiveEvents(t, cfEvents)[0].Key)
+	assert.Nil(t, db.Put([]byte("user:6"), []byte("v7")))
+	assert.Equal(t, []byte("user:6"), receiveEvents(t, users)[0].Key)
+	assert.Equal(t, 0, len(cfEvents))
+	assert.Nil(t, db.DropColumnFamily("watch"))
+	_, ok := <-cfEvents
+	assert.False(t, ok)
+
+	// 取消订阅后channel被关闭
+	cancel()
+	for range users {
+	}
+	for range all {
+	}
+	db.mu.RLock()
+	assert.Equal(t, 0, len(db.watchers))
+	db.mu.RUnlock()
+}
+
+func TestWatchOverflow(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "KeyCache-test-watch-overflow")
+	opts.WatchBufferSize = 2
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+
+	// 缓冲区满后关闭channel，已经缓存的事件仍然可以读取
+	ch, err := db.Watch(context.Background(), nil)
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(8)))
+	}
+	num := 0
+	for range ch {
+		num++
+	}
+	assert.Equal(t, 2, num)
+	assert.Nil(t, db.Close())
+
+	// 事件在队列中等待订阅者取走，不会丢失
+	opts.WatchOverflow = WatchOverflowBlock
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err = db.Watch(ctx, nil)
+	assert.Nil(t, err)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(8)))
+		}
+		close(done)
+	}()
+	var lastSeq uint64 = 0
+	for i := 0; i < 10; i++ {
+		events := receiveEvents(t, ch)
+		assert.Greater(t, events[0].Seq, lastSeq)
+		lastSeq = events[0].Seq
+	}
+	<-done
+
+	// 订阅者不读取时写入也不会被阻塞，取消订阅后channel被关闭
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(8)))
+	}
+	cancel()
+	for range ch {
+	}
+	// 数据库关闭时关闭所有channel
+	ch, err = db.Watch(context.Background(), nil)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+	_, ok := <-ch
+	assert.False(t, ok)
+
+	opts.WatchBufferSize = -1
+	_, err = Open(opts)
+	assert.Equal(t, ErrInvalidWatchOptions, err)
+}
+
+func TestWatchBlockAccessDB(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("/tmp", "test-watch-access-db")
+	opts.WatchBufferSize = 1
+	opts.WatchOverflow = WatchOverflowBlock
+	db, err := Open(opts)
+	defer destoryDB(db)
+	assert.Nil(t, err)
+
+	// 订阅者在处理事件时读写数据库，不会与写入互相等待
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := db.Watch(ctx, []byte("src"))
+	assert.Nil(t, err)
+	cnt := 100
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		num := 0
+		for events := range ch {
+			for _, event := range events {
+				val, err := db.Get(event.Key)
+				assert.Nil(t, err)
+				assert.Nil(t, db.Put(append([]byte("dst"), event.Key...), val))
+				num++
+			}
+			if num == cnt {
+				return
+			}
+		}
+	}()
+	go func() {
+		for i := 0; i < cnt; i++ {
+			assert.Nil(t, db.Put(append([]byte("src"), utils.GetTestKey(i)...), utils.GetTestValue(8)))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher blocked")
+	}
+	for i := 0; i < cnt; i++ {
+		_, err := db.Get(append([]byte("dstsrc"), utils.GetTestKey(i)...))
+		assert.Nil(t, err)
+	}
+}
@@ -2,26 +2,87 @@ package http
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"kv-go/cluster"
 	bitcask "kv-go/db"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 )
 
-var db *bitcask.DB
+// 单机的DB与集群中的节点都可以作为存储
+type store interface {
+	Put(key []byte, value []byte) error
+	Get(key []byte) ([]byte, error)
+	MultiGet(keys [][]byte) ([][]byte, []error)
+	Delete(key []byte) error
+	ListKeys(reverse bool) [][]byte
+	Stat() (*bitcask.DBStat, error)
+	WritePrometheus(w io.Writer) error
+}
 
-func init() {
-	// 初始化DB实例
-	opts := bitcask.DefaultDBOptions
-	// TODO!!!这里放在tmp目录下是否合适？
-	dir, _ := os.MkdirTemp("", "bitcask-http")
-	opts.DirPath = dir
-	var err error
-	db, err = bitcask.Open(opts)
+var db store
+
+var (
+	addr     = flag.String("addr", "localhost:8080", "address to serve http on")
+	dir      = flag.String("dir", "", "database directory, a temporary directory is used if empty")
+	raftAddr = flag.String("raft-addr", "", "cluster mode: address for raft messages, also the id of the node")
+	peers    = flag.String("peers", "", "cluster mode: comma separated raft addresses of all nodes, including this one")
+)
+
+func openStore() (store, error) {
+	dirPath := *dir
+	if dirPath == "" {
+		// TODO!!!这里放在tmp目录下是否合适？
+		dirPath, _ = os.MkdirTemp("", "bitcask-http")
+	}
+	if *raftAddr == "" {
+		opts := bitcask.DefaultDBOptions
+		opts.DirPath = dirPath
+		return bitcask.Open(opts)
+	}
+	transport, err := cluster.NewTCPTransport(*raftAddr)
 	if err != nil {
-		panic(fmt.Sprintf("fail to create db, %v", err))
+		return nil, err
 	}
+	opts := cluster.DefaultOptions
+	opts.ID = *raftAddr
+	opts.Peers = strings.Split(*peers, ",")
+	opts.DirPath = dirPath
+	opts.Transport = transport
+	node, err := cluster.NewNode(opts)
+	if err != nil {
+		_ = transport.Close()
+		return nil, err
+	}
+	return clusterStore{Node: node}, nil
+}
+
+// 集群中的get是线性一致的，listkeys、stat与metrics只读取本地节点，可能不包含最新的写入
+type clusterStore struct {
+	*cluster.Node
+}
+
+func (s clusterStore) ListKeys(reverse bool) [][]byte {
+	var keys [][]byte
+	_ = s.View(cluster.Stale, func(db *bitcask.DB) error {
+		keys = db.ListKeys(reverse)
+		return nil
+	})
+	return keys
+}
+
+func (s clusterStore) Stat() (*bitcask.DBStat, error) {
+	var stat *bitcask.DBStat
+	err := s.View(cluster.Stale, func(db *bitcask.DB) error {
+		var err error
+		stat, err = db.Stat()
+		return err
+	})
+	return stat, err
 }
 
 func handlePut(writer http.ResponseWriter, request *http.Request) {
@@ -61,6 +122,44 @@ func handleGet(writer http.ResponseWriter, request *http.Request) {
 	_ = json.NewEncoder(writer).Encode(string(val))
 }
 
+// 批量读取的结果，与请求中的key一一对应
+type multiGetResult struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// key可以通过多个key参数传入，key很多时也可以POST一个json数组
+func handleMultiGet(writer http.ResponseWriter, request *http.Request) {
+	var keys []string
+	switch request.Method {
+	case http.MethodGet:
+		keys = request.URL.Query()["key"]
+	case http.MethodPost:
+		if err := json.NewDecoder(request.Body).Decode(&keys); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	byteKeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		byteKeys[i] = []byte(key)
+	}
+	values, errs := db.MultiGet(byteKeys)
+	results := make([]multiGetResult, len(keys))
+	for i, key := range keys {
+		results[i] = multiGetResult{Key: key, Value: string(values[i])}
+		if errs[i] != nil {
+			results[i].Error = errs[i].Error()
+		}
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(writer).Encode(results)
+}
+
 func handleDelete(writer http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodGet {
 		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
@@ -109,15 +208,41 @@ func handleStat(writer http.ResponseWriter, request *http.Request) {
 	_ = json.NewEncoder(writer).Encode(stat)
 }
 
+func (s clusterStore) WritePrometheus(w io.Writer) error {
+	return s.View(cluster.Stale, func(db *bitcask.DB) error {
+		return db.WritePrometheus(w)
+	})
+}
+
+func handleMetrics(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Prometheus的文本格式
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := db.WritePrometheus(writer); err != nil {
+		log.Printf("failed to write metrics, %v\n", err)
+	}
+}
+
 func main() {
+	flag.Parse()
+	// 初始化存储，指定raft地址时作为集群中的节点运行
+	var err error
+	if db, err = openStore(); err != nil {
+		panic(fmt.Sprintf("fail to create db, %v", err))
+	}
 	// 注册http处理方法
 	http.HandleFunc("/bitcask/put", handlePut)
 	http.HandleFunc("/bitcask/get", handleGet)
+	http.HandleFunc("/bitcask/mget", handleMultiGet)
 	http.HandleFunc("/bitcask/delete", handleDelete)
 	http.HandleFunc("/bitcask/listkeys", handleListKeys)
 	http.HandleFunc("/bitcask/stat", handleStat)
+	http.HandleFunc("/metrics", handleMetrics)
 	// 启动http服务
-	if err := http.ListenAndServe("localhost:8080", nil); err != nil {
+	if err := http.ListenAndServe(*addr, nil); err != nil {
 		panic(fmt.Sprintf("fail to start http server, %v", err))
 	}
 }
@@ -3,7 +3,6 @@ package index
 import (
 	"kv-go/data"
 	"sync"
-	"sort"
 	"bytes"
 
 	goart "github.com/plar/go-adaptive-radix-tree"
@@ -14,10 +13,9 @@ type ARTree struct {
 	lock *sync.RWMutex
 }
 
+// ART的迭代器，按批从ART中取出key
 type ARTIterator struct {
-	datas   []*Item // 类似快照，迭代器保存了当前数据库的所有value
-	idx     int     // 用来访问vals, 表示当前遍历到的位置
-	reverse bool    // 是否反向遍历
+	batchIterator
 }
 
 func NewARTree() *ARTree {
@@ -63,6 +61,8 @@ func (art *ARTree) Delete(key []byte) (bool, *data.LogRecordPos) {
 }
 
 func (art *ARTree) Size() int {
+	art.lock.RLock()
+	defer art.lock.RUnlock()
 	return art.tree.Size()
 }
 
@@ -70,77 +70,157 @@ func (art *ARTree) Close() error {
 	return nil
 }
 
-// 创建索引上的迭代器
-func (art *ARTree) NewIterator(reverse bool) Iterator {
+// ART不支持写时复制，创建快照需要拷贝整棵树，开销为O(N)
+func (art *ARTree) Snapshot() Indexer {
 	art.lock.RLock()
 	defer art.lock.RUnlock()
+	snap := NewARTree()
+	art.tree.ForEach(func(node goart.Node) bool {
+		snap.tree.Insert(node.Key(), node.Value())
+		return true
+	})
+	return snap
+}
+
+// 创建索引上的迭代器
+func (art *ARTree) NewIterator(reverse bool) Iterator {
 	return NewARTIterator(art, reverse)
 }
 
+// 创建ART的迭代器，只取出第一批key
 func NewARTIterator(art *ARTree, reverse bool) *ARTIterator {
-	var i int = 0
-	if reverse {
-		i = art.Size() - 1
-	}
-	datas := make([]*Item, art.Size())
-	saveItems := func (item goart.Node) bool {
-		key := item.Key()
-		val := item.Value().(*data.LogRecordPos)
-		datas[i] = &Item{
-			key: key,
-			pos: val,
-		}
+	it := &ARTIterator{batchIterator{
+		fill: art.fill(reverse),
+	}}
+	it.Rewind()
+	return it
+}
+
+// 在读锁下按遍历方向取出从from开始的key
+func (art *ARTree) fill(reverse bool) func(from []byte, inclusive bool, n int) []*Item {
+	return func(from []byte, inclusive bool, n int) []*Item {
+		items := make([]*Item, 0, n)
+		w := newARTWalker(art.tree, collectItems(&items, from, inclusive, n))
+		art.lock.RLock()
+		defer art.lock.RUnlock()
 		if reverse {
-			i--
+			w.descend(from)
 		} else {
-			i++
+			w.ascend(from)
 		}
-		return true
-	}
-	art.tree.ForEach(saveItems)
-	return &ARTIterator{
-		datas: datas,
-		idx: 0,
-		reverse: reverse,
+		return items
 	}
 }
 
-// 使迭代器指向起点
-func (it *ARTIterator) Rewind() {
-	it.idx = 0
+// goart只能按升序遍历整棵树或者某个前缀下的key，walker把遍历范围拆分成若干个前缀，按顺序遍历这些前缀
+// 试探前缀的次数很多，所以回调只在创建walker时分配一次
+type artWalker struct {
+	tree    goart.Tree
+	fn      func(item *Item) bool // 返回false时停止遍历
+	next    bool                  // fn是否要求继续遍历
+	leaves  []goart.Node          // 前缀下收集到的叶子节点
+	full    bool                  // 前缀下的叶子节点超过一批
+	visit   goart.Callback        // 把叶子节点交给fn
+	collect goart.Callback        // 把叶子节点收集到leaves中
 }
 
-// 找到key值满足大于等于/小于等于关系的位置，开始迭代
-func (it *ARTIterator) Seek(key []byte) {
-	if !it.reverse {
-		// sort.Search是二分查找，闭包将把数组划分成两个区间，Search将返回区间的分界点
-		it.idx = sort.Search(len(it.datas), func(i int) bool {
-			return bytes.Compare(it.datas[i].key, key) >= 0
-		})
-	} else {
-		it.idx = sort.Search(len(it.datas), func(i int) bool {
-			return bytes.Compare(it.datas[i].key, key) <= 0
-		})
+func newARTWalker(tree goart.Tree, fn func(item *Item) bool) *artWalker {
+	w := &artWalker{tree: tree, fn: fn, next: true}
+	// ForEachPrefix会把前缀下的内部节点也交给回调，需要先过滤出叶子节点
+	w.visit = func(node goart.Node) bool {
+		if node.Kind() != goart.Leaf {
+			return true
+		}
+		w.next = w.fn(leafItem(node))
+		return w.next
+	}
+	w.collect = func(node goart.Node) bool {
+		if node.Kind() != goart.Leaf {
+			return true
+		}
+		if len(w.leaves) == iteratorBatchSize {
+			w.full = true
+			return false
+		}
+		w.leaves = append(w.leaves, node)
+		return true
 	}
+	return w
 }
 
-// 使迭代器往后遍历
-func (it *ARTIterator) Next() {
-	it.idx++
+func leafItem(node goart.Node) *Item {
+	return &Item{key: node.Key(), pos: node.Value().(*data.LogRecordPos)}
 }
-// 判断迭代器是否遍历完成
-func (it *ARTIterator) IsEnd() bool {
-	return it.idx >= len(it.datas)
+
+// 按升序遍历不小于from的key，from为nil时遍历整棵树
+func (w *artWalker) ascend(from []byte) {
+	if from == nil {
+		w.tree.ForEach(w.visit)
+		return
+	}
+	// 以from为前缀的key都不小于from
+	w.tree.ForEachPrefix(from, w.visit)
+	// 其余大于from的key在第i个字节上第一次大于from，i越大key越小
+	prefix := bytes.Clone(from)
+	for i := len(from) - 1; i >= 0 && w.next; i-- {
+		for c := int(from[i]) + 1; c <= 0xff && w.next; c++ {
+			prefix[i] = byte(c)
+			w.tree.ForEachPrefix(prefix[:i+1], w.visit)
+		}
+		prefix[i] = from[i]
+	}
 }
-// 取key
-func (it *ARTIterator) Key() []byte {
-	return it.datas[it.idx].key
+
+// 按降序遍历不大于from的key，from为nil时遍历整棵树
+func (w *artWalker) descend(from []byte) {
+	if from == nil {
+		w.descendPrefix(nil)
+		return
+	}
+	w.visitKey(from)
+	// 其余小于from的key要么在第i个字节上第一次小于from，要么是from的前缀，i越大key越大
+	prefix := bytes.Clone(from)
+	for i := len(from) - 1; i >= 0 && w.next; i-- {
+		for c := int(from[i]) - 1; c >= 0 && w.next; c-- {
+			prefix[i] = byte(c)
+			w.descendPrefix(prefix[:i+1])
+		}
+		if i > 0 && w.next {
+			w.visitKey(from[:i])
+		}
+	}
 }
-// 取value
-func (it *ARTIterator) Value() *data.LogRecordPos {
-	return it.datas[it.idx].pos
+
+// 按降序遍历以prefix为前缀的key
+// 前缀下的key不超过一批时直接取出后逆序遍历，否则按下一个字节从大到小递归，递归只发生在key很多的前缀上
+func (w *artWalker) descendPrefix(prefix []byte) {
+	w.leaves, w.full = w.leaves[:0], false
+	if prefix == nil {
+		w.tree.ForEach(w.collect)
+	} else {
+		w.tree.ForEachPrefix(prefix, w.collect)
+	}
+	if !w.full {
+		for i := len(w.leaves) - 1; i >= 0 && w.next; i-- {
+			w.next = w.fn(leafItem(w.leaves[i]))
+		}
+		return
+	}
+	child := make([]byte, len(prefix)+1)
+	copy(child, prefix)
+	for c := 0xff; c >= 0 && w.next; c-- {
+		child[len(prefix)] = byte(c)
+		w.descendPrefix(child)
+	}
+	// 前缀本身是其中最小的key
+	if len(prefix) > 0 && w.next {
+		w.visitKey(prefix)
+	}
+}
+
+// key存在时交给fn遍历
+func (w *artWalker) visitKey(key []byte) {
+	if pos, ok := w.tree.Search(key); ok {
+		w.next = w.fn(&Item{key: bytes.Clone(key), pos: pos.(*data.LogRecordPos)})
+	}
 }
-// 关闭迭代器
-func (it *ARTIterator) Close() {
-	it.datas = nil
-}
\ No newline at end of file
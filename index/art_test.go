@@ -156,4 +156,23 @@ func TestARTreeIterator3(t *testing.T) {
 		assert.Equal(t, iter.Value(), &val2)
 		assert.False(t, iter.IsEnd())
 	}
-}
\ No newline at end of file
+}
+func TestARTSnapshot(t *testing.T) {
+	art := NewARTree()
+	{
+		// 创建快照后继续写入，快照不受影响
+		art.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 1})
+		art.Put([]byte("b"), &data.LogRecordPos{Fid: 1, Offset: 2})
+		snap := art.Snapshot()
+		art.Put([]byte("a"), &data.LogRecordPos{Fid: 2, Offset: 1})
+		art.Put([]byte("c"), &data.LogRecordPos{Fid: 2, Offset: 2})
+		art.Delete([]byte("b"))
+
+		assert.Equal(t, 2, snap.Size())
+		assert.Equal(t, uint32(1), snap.Get([]byte("a")).Fid)
+		assert.NotNil(t, snap.Get([]byte("b")))
+		assert.Nil(t, snap.Get([]byte("c")))
+		assert.Equal(t, uint32(2), art.Get([]byte("a")).Fid)
+		assert.Nil(t, art.Get([]byte("b")))
+	}
+}
@@ -1,6 +1,7 @@
 package index
 
 import (
+	"bytes"
 	"kv-go/data"
 	"path/filepath"
 
@@ -123,6 +124,27 @@ func (bp *BPlusTree) Close() error {
 	return bp.tree.Close()
 }
 
+// 长时间持有bolt的读事务会阻塞写事务扩容，所以将索引拷贝到内存的btree中，开销为O(N)
+func (bp *BPlusTree) Snapshot() Indexer {
+	snap := NewBTree()
+	if err := bp.tree.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bucketName)
+		if bucket == nil {
+			return bbolt.ErrBucketNotFound
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			// bolt返回的key只在事务中有效，需要拷贝
+			key := make([]byte, len(k))
+			copy(key, k)
+			snap.Put(key, data.DecodeLogRecordPos(v))
+			return nil
+		})
+	}); err != nil {
+		return nil
+	}
+	return snap
+}
+
 // 创建索引上的迭代器
 func (bp *BPlusTree) NewIterator(reverse bool) Iterator {
 	return NewBPlusTreeIterator(bp, reverse)
@@ -156,6 +178,9 @@ func (it *BPlusTreeIterator) Seek(key []byte) {
 	it.key, it.val = it.cursor.Seek(key)
 	if it.reverse && len(it.key) == 0 {
 		it.key, it.val = it.cursor.Last()
+	} else if it.reverse && bytes.Compare(it.key, key) > 0 {
+		// 反向遍历时需要定位到小于等于key的位置
+		it.key, it.val = it.cursor.Prev()
 	}
 }
 
@@ -159,5 +159,11 @@ func TestBPlusTreeIterator3(t *testing.T) {
 		assert.Equal(t, iter.Key(), key2)
 		assert.Equal(t, iter.Value(), &val2)
 		assert.False(t, iter.IsEnd())
+
+		// 定位到小于等于key的位置
+		iter.Seek([]byte("25"))
+		assert.Equal(t, iter.Key(), key1)
+		iter.Seek([]byte("1"))
+		assert.True(t, iter.IsEnd())
 	}
 }
\ No newline at end of file
@@ -3,7 +3,6 @@ package index
 import (
 	"bytes"
 	"kv-go/data"
-	"sort"
 	"sync"
 
 	"github.com/google/btree"
@@ -15,11 +14,9 @@ type BTree struct {
 	lock *sync.RWMutex
 }
 
-// 封装btree的迭代器(只读？)
+// 封装btree的迭代器，按批从btree中取出key
 type BTreeIterator struct {
-	datas   []*Item // 类似快照，迭代器保存了当前数据库的所有value
-	idx     int     // 用来访问vals, 表示当前遍历到的位置
-	reverse bool    // 是否反向遍历
+	batchIterator
 }
 
 func NewBTree() *BTree {
@@ -31,7 +28,9 @@ func NewBTree() *BTree {
 
 func (bt *BTree) Get(key []byte) *data.LogRecordPos {
 	it := &Item{key: key}
+	bt.lock.RLock()
 	item := bt.tree.Get(it)
+	bt.lock.RUnlock()
 	if item == nil {
 		return nil
 	}
@@ -64,6 +63,8 @@ func (bt *BTree) Delete(key []byte) (bool, *data.LogRecordPos) {
 }
 
 func (bt *BTree) Size() int {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
 	return bt.tree.Len()
 }
 
@@ -71,6 +72,16 @@ func (bt *BTree) Close() error {
 	return nil
 }
 
+// btree的Clone是写时复制的，创建快照的开销为O(1)
+func (bt *BTree) Snapshot() Indexer {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	return &BTree{
+		tree: bt.tree.Clone(),
+		lock: new(sync.RWMutex),
+	}
+}
+
 func (l *Item) Less(r btree.Item) bool {
 	return bytes.Compare(l.key, r.(*Item).key) == -1
 }
@@ -80,68 +91,38 @@ func (bt *BTree) NewIterator(reverse bool) Iterator {
 	if bt.tree == nil {
 		return nil
 	}
-	bt.lock.Lock()
-	defer bt.lock.Unlock()
-	return NewBTreeIterator(bt.tree, reverse)
-}
-
-// 创建btree的迭代器
-func NewBTreeIterator(tree *btree.BTree, reverse bool) *BTreeIterator {
-	var i = 0
-	datas := make([]*Item, tree.Len())
-	// 创建闭包，以遍历btree
-	saveItems := func (item btree.Item) bool {
-		datas[i] = item.(*Item)
-		i++
-		return true
-	}
-	// 根据reverse决定遍历btree的方向
-	if !reverse {
-		tree.Ascend(saveItems)
-	} else {
-		tree.Descend(saveItems)
-	}
-	// 构造迭代器并返回
-	return &BTreeIterator{
-		datas: datas,
-		idx: 0,
-		reverse: reverse,
+	return NewBTreeIterator(bt, reverse)
+}
+
+// 创建btree的迭代器，只取出第一批key
+func NewBTreeIterator(bt *BTree, reverse bool) *BTreeIterator {
+	it := &BTreeIterator{batchIterator{
+		fill: bt.fill(reverse),
+	}}
+	it.Rewind()
+	return it
+}
+
+// 在读锁下按遍历方向取出从from开始的key
+func (bt *BTree) fill(reverse bool) func(from []byte, inclusive bool, n int) []*Item {
+	return func(from []byte, inclusive bool, n int) []*Item {
+		items := make([]*Item, 0, n)
+		collect := collectItems(&items, from, inclusive, n)
+		visit := func(item btree.Item) bool {
+			return collect(item.(*Item))
+		}
+		bt.lock.RLock()
+		defer bt.lock.RUnlock()
+		switch {
+		case from == nil && !reverse:
+			bt.tree.Ascend(visit)
+		case from == nil:
+			bt.tree.Descend(visit)
+		case !reverse:
+			bt.tree.AscendGreaterOrEqual(&Item{key: from}, visit)
+		default:
+			bt.tree.DescendLessOrEqual(&Item{key: from}, visit)
+		}
+		return items
 	}
 }
-
-func (it *BTreeIterator) Rewind() {
-	it.idx = 0
-}
-
-func (it *BTreeIterator) Key() []byte {
-	return it.datas[it.idx].key
-}
-
-func (it *BTreeIterator) Value() *data.LogRecordPos {
-	return it.datas[it.idx].pos
-}
-
-func (it *BTreeIterator) Next() {
-	it.idx++
-}
-
-func (it *BTreeIterator) IsEnd() bool {
-	return it.idx >= len(it.datas)
-}
-
-func (it *BTreeIterator) Close() {
-	it.datas = nil
-}
-
-func (it *BTreeIterator) Seek(key []byte) {
-	if !it.reverse {
-		// sort.Search是二分查找，闭包将把数组划分成两个区间，Search将返回区间的分界点
-		it.idx = sort.Search(len(it.datas), func(i int) bool {
-			return bytes.Compare(it.datas[i].key, key) >= 0
-		})
-	} else {
-		it.idx = sort.Search(len(it.datas), func(i int) bool {
-			return bytes.Compare(it.datas[i].key, key) <= 0
-		})
-	}
-}
\ No newline at end of file
@@ -156,4 +156,23 @@ func TestBTreeIterator3(t *testing.T) {
 		assert.Equal(t, iter.Value(), &val2)
 		assert.False(t, iter.IsEnd())
 	}
-}
\ No newline at end of file
+}
+func TestBTreeSnapshot(t *testing.T) {
+	bt := NewBTree()
+	{
+		// 创建快照后继续写入，快照不受影响
+		bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 1})
+		bt.Put([]byte("b"), &data.LogRecordPos{Fid: 1, Offset: 2})
+		snap := bt.Snapshot()
+		bt.Put([]byte("a"), &data.LogRecordPos{Fid: 2, Offset: 1})
+		bt.Put([]byte("c"), &data.LogRecordPos{Fid: 2, Offset: 2})
+		bt.Delete([]byte("b"))
+
+		assert.Equal(t, 2, snap.Size())
+		assert.Equal(t, uint32(1), snap.Get([]byte("a")).Fid)
+		assert.NotNil(t, snap.Get([]byte("b")))
+		assert.Nil(t, snap.Get([]byte("c")))
+		assert.Equal(t, uint32(2), bt.Get([]byte("a")).Fid)
+		assert.Nil(t, bt.Get([]byte("b")))
+	}
+}
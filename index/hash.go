@@ -0,0 +1,318 @@
+package index
+
+import (
+	"bytes"
+	"hash/maphash"
+	"kv-go/data"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// hash索引的分片数量，每个分片有自己的锁
+const hashShardCount = 64
+
+// 分片的负载因子超过3/4时扩容
+const (
+	hashLoadNum = 3
+	hashLoadDen = 4
+)
+
+// 分片式的开放寻址hash索引，Put、Get、Delete的开销都是O(1)，只适合不需要有序遍历的场景
+// 有序的迭代器需要复制并排序所有key，开销为O(NlogN)，且迭代器是创建时的快照，不会看到之后的写入
+// 只需要遍历所有key而不关心顺序时，使用NewUnorderedIterator
+type HashIndex struct {
+	seed   maphash.Seed
+	shards [hashShardCount]hashShard
+}
+
+// 线性探测的hash表，槽位中只保存tag与条目的位置，条目连续地保存在entries中
+// 删除时把之后的槽位向前移动，不需要墓碑，并用最后一个条目填补被删除的条目，entries中没有空洞
+type hashShard struct {
+	lock    sync.RWMutex
+	slots   []uint64 // 高32位是key的hash的低32位，低32位是条目在entries中的位置+1，0表示空槽
+	entries []hashEntry
+}
+
+// 紧凑的条目，LogRecordPos的字段直接保存在条目中，key被复制为string，不会引用调用者的内存
+type hashEntry struct {
+	key        string
+	offset     int64
+	expire     int64
+	blob       *data.BlobPos
+	fid        uint32
+	recordSize uint32
+}
+
+func (e *hashEntry) pos() *data.LogRecordPos {
+	return &data.LogRecordPos{Fid: e.fid, Offset: e.offset, RecordSize: e.recordSize, Expire: e.expire, Blob: e.blob}
+}
+
+func (e *hashEntry) setPos(pos *data.LogRecordPos) {
+	e.fid, e.offset, e.recordSize, e.expire, e.blob = pos.Fid, pos.Offset, pos.RecordSize, pos.Expire, pos.Blob
+}
+
+func NewHashIndex() *HashIndex {
+	return &HashIndex{seed: maphash.MakeSeed()}
+}
+
+// 高位选择分片，低32位用于分片内的槽位
+func (h *HashIndex) locate(key []byte) (*hashShard, uint32) {
+	sum := maphash.Bytes(h.seed, key)
+	return &h.shards[sum>>(64-6)], uint32(sum)
+}
+
+// 槽位的理想位置，表的大小是2的幂
+func (s *hashShard) home(slot uint64) int {
+	return int((slot >> 32) * uint64(len(s.slots)) >> 32)
+}
+
+// 返回key所在的槽位，不存在时返回-1
+func (s *hashShard) find(key []byte, tag uint32) int {
+	if len(s.slots) == 0 {
+		return -1
+	}
+	mask := len(s.slots) - 1
+	for i := s.home(uint64(tag) << 32); ; i = (i + 1) & mask {
+		slot := s.slots[i]
+		if slot == 0 {
+			return -1
+		}
+		if uint32(slot>>32) == tag && s.entries[uint32(slot)-1].key == string(key) {
+			return i
+		}
+	}
+}
+
+// 把槽位放入第一个空位，调用者保证有空位
+func (s *hashShard) insert(slot uint64) {
+	mask := len(s.slots) - 1
+	i := s.home(slot)
+	for s.slots[i] != 0 {
+		i = (i + 1) & mask
+	}
+	s.slots[i] = slot
+}
+
+func (s *hashShard) grow() {
+	old := s.slots
+	s.slots = make([]uint64, max(len(old)*2, 8))
+	for _, slot := range old {
+		if slot != 0 {
+			s.insert(slot)
+		}
+	}
+}
+
+// 清空槽位i，把之后理想位置不在(i, j]之间的槽位前移到空出的位置，保证探测序列不被打断
+func (s *hashShard) removeSlot(i int) {
+	mask := len(s.slots) - 1
+	for {
+		s.slots[i] = 0
+		j := i
+		for {
+			j = (j + 1) & mask
+			if s.slots[j] == 0 {
+				return
+			}
+			k := s.home(s.slots[j])
+			if i <= j && (i < k && k <= j) || i > j && (i < k || k <= j) {
+				continue
+			}
+			break
+		}
+		s.slots[i] = s.slots[j]
+		i = j
+	}
+}
+
+func (h *HashIndex) Put(key []byte, pos *data.LogRecordPos) (bool, *data.LogRecordPos) {
+	if len(key) == 0 {
+		return false, nil
+	}
+	s, tag := h.locate(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if i := s.find(key, tag); i >= 0 {
+		e := &s.entries[uint32(s.slots[i])-1]
+		oldPos := e.pos()
+		e.setPos(pos)
+		return true, oldPos
+	}
+	if (len(s.entries)+1)*hashLoadDen > len(s.slots)*hashLoadNum {
+		s.grow()
+	}
+	entry := hashEntry{key: string(key)}
+	entry.setPos(pos)
+	s.entries = append(s.entries, entry)
+	s.insert(uint64(tag)<<32 | uint64(len(s.entries)))
+	return true, nil
+}
+
+func (h *HashIndex) Get(key []byte) *data.LogRecordPos {
+	s, tag := h.locate(key)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if i := s.find(key, tag); i >= 0 {
+		return s.entries[uint32(s.slots[i])-1].pos()
+	}
+	return nil
+}
+
+func (h *HashIndex) Delete(key []byte) (bool, *data.LogRecordPos) {
+	s, tag := h.locate(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	i := s.find(key, tag)
+	if i < 0 {
+		return false, nil
+	}
+	idx := uint32(s.slots[i]) - 1
+	oldPos := s.entries[idx].pos()
+	s.removeSlot(i)
+	// 把最后一个条目移动到被删除的位置，并修改指向它的槽位
+	last := uint32(len(s.entries)) - 1
+	if idx != last {
+		lastKey := s.entries[last].key
+		j := s.find([]byte(lastKey), uint32(maphash.String(h.seed, lastKey)))
+		s.slots[j] = s.slots[j]&^0xffffffff | uint64(idx+1)
+		s.entries[idx] = s.entries[last]
+	}
+	s.entries[last] = hashEntry{}
+	s.entries = s.entries[:last]
+	// 大量删除后释放entries占用的内存
+	if cap(s.entries) > 64 && len(s.entries) < cap(s.entries)/4 {
+		s.entries = slices.Clone(s.entries)
+	}
+	return true, oldPos
+}
+
+func (h *HashIndex) Size() int {
+	size := 0
+	for i := range h.shards {
+		h.shards[i].lock.RLock()
+		size += len(h.shards[i].entries)
+		h.shards[i].lock.RUnlock()
+	}
+	return size
+}
+
+func (h *HashIndex) Close() error {
+	return nil
+}
+
+// 复制所有分片，开销为O(N)
+func (h *HashIndex) Snapshot() Indexer {
+	snap := &HashIndex{seed: h.seed}
+	for i := range h.shards {
+		h.shards[i].lock.RLock()
+		snap.shards[i].slots = slices.Clone(h.shards[i].slots)
+		snap.shards[i].entries = slices.Clone(h.shards[i].entries)
+		h.shards[i].lock.RUnlock()
+	}
+	return snap
+}
+
+// 创建有序的迭代器，需要复制并排序所有key，开销为O(NlogN)
+func (h *HashIndex) NewIterator(reverse bool) Iterator {
+	items := make([]*Item, 0, h.Size())
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.lock.RLock()
+		for j := range s.entries {
+			items = append(items, &Item{key: []byte(s.entries[j].key), pos: s.entries[j].pos()})
+		}
+		s.lock.RUnlock()
+	}
+	slices.SortFunc(items, func(l, r *Item) int {
+		if reverse {
+			return bytes.Compare(r.key, l.key)
+		}
+		return bytes.Compare(l.key, r.key)
+	})
+	it := &HashIterator{batchIterator{fill: sortedFill(items, reverse)}}
+	it.Rewind()
+	return it
+}
+
+// hash索引的有序迭代器，遍历创建时排好序的key
+type HashIterator struct {
+	batchIterator
+}
+
+// 在按遍历方向排好序的items中二分查找from
+func sortedFill(items []*Item, reverse bool) func(from []byte, inclusive bool, n int) []*Item {
+	return func(from []byte, inclusive bool, n int) []*Item {
+		start := 0
+		if from != nil {
+			start = sort.Search(len(items), func(i int) bool {
+				cmp := bytes.Compare(items[i].key, from)
+				if reverse {
+					cmp = -cmp
+				}
+				return cmp > 0 || cmp == 0 && inclusive
+			})
+		}
+		return items[start:min(start+n, len(items))]
+	}
+}
+
+// 创建无序的迭代器，每次只复制一个分片，不需要排序
+func (h *HashIndex) NewUnorderedIterator() Iterator {
+	it := &hashUnorderedIterator{index: h}
+	it.Rewind()
+	return it
+}
+
+// 逐个分片遍历hash索引，遍历期间的写入是否可见取决于它所在的分片是否已经被复制
+type hashUnorderedIterator struct {
+	index   *HashIndex
+	shard   int         // 下一个要复制的分片
+	entries []hashEntry // 当前分片中条目的副本
+	idx     int
+}
+
+// 复制下一个不为空的分片
+func (it *hashUnorderedIterator) load() {
+	it.entries, it.idx = it.entries[:0], 0
+	for ; it.shard < hashShardCount && len(it.entries) == 0; it.shard++ {
+		s := &it.index.shards[it.shard]
+		s.lock.RLock()
+		it.entries = append(it.entries, s.entries...)
+		s.lock.RUnlock()
+	}
+}
+
+func (it *hashUnorderedIterator) Rewind() {
+	it.shard = 0
+	it.load()
+}
+
+// 无序的迭代器中Seek没有意义，等同于Rewind
+func (it *hashUnorderedIterator) Seek(key []byte) {
+	it.Rewind()
+}
+
+func (it *hashUnorderedIterator) Next() {
+	it.idx++
+	if it.idx >= len(it.entries) {
+		it.load()
+	}
+}
+
+func (it *hashUnorderedIterator) IsEnd() bool {
+	return it.idx >= len(it.entries)
+}
+
+func (it *hashUnorderedIterator) Key() []byte {
+	return []byte(it.entries[it.idx].key)
+}
+
+func (it *hashUnorderedIterator) Value() *data.LogRecordPos {
+	return it.entries[it.idx].pos()
+}
+
+func (it *hashUnorderedIterator) Close() {
+	it.entries = nil
+	it.shard = hashShardCount
+}
@@ -0,0 +1,240 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"kv-go/data"
+	"math/rand"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashIndexPutGetDelete(t *testing.T) {
+	h := NewHashIndex()
+	res1, old := h.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 1})
+	assert.True(t, res1)
+	assert.Nil(t, old)
+	res2, old := h.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2, RecordSize: 10})
+	assert.True(t, res2)
+	assert.Equal(t, int64(1), old.Offset)
+	res3, _ := h.Put(nil, &data.LogRecordPos{Fid: 2, Offset: 2})
+	assert.False(t, res3)
+
+	blob := &data.BlobPos{Fid: 3, Offset: 4, Size: 5}
+	h.Put([]byte("b"), &data.LogRecordPos{Fid: 2, Offset: 3, Expire: 6, Blob: blob})
+	pos := h.Get([]byte("b"))
+	assert.Equal(t, &data.LogRecordPos{Fid: 2, Offset: 3, Expire: 6, Blob: blob}, pos)
+	assert.Equal(t, uint32(10), h.Get([]byte("a")).RecordSize)
+	assert.Nil(t, h.Get([]byte("c")))
+	assert.Nil(t, h.Get(nil))
+	assert.Equal(t, 2, h.Size())
+
+	// 修改返回的LogRecordPos不影响索引
+	pos.Offset = 100
+	assert.Equal(t, int64(3), h.Get([]byte("b")).Offset)
+
+	res4, old := h.Delete([]byte("a"))
+	assert.True(t, res4)
+	assert.Equal(t, int64(2), old.Offset)
+	res5, old := h.Delete([]byte("a"))
+	assert.False(t, res5)
+	assert.Nil(t, old)
+	assert.Nil(t, h.Get([]byte("a")))
+	assert.Equal(t, 1, h.Size())
+}
+
+func TestHashIndexRandom(t *testing.T) {
+	h := NewHashIndex()
+	expected := make(map[string]int64)
+	r := rand.New(rand.NewSource(1))
+	// key空间较小，频繁的删除与插入会触发前移与扩容
+	for i := 0; i < 200000; i++ {
+		key := fmt.Sprintf("key-%d", r.Intn(20000))
+		if r.Intn(3) == 0 {
+			ok, old := h.Delete([]byte(key))
+			_, exist := expected[key]
+			assert.Equal(t, exist, ok)
+			if exist {
+				assert.Equal(t, expected[key], old.Offset)
+			}
+			delete(expected, key)
+		} else {
+			h.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+			expected[key] = int64(i)
+		}
+	}
+	assert.Equal(t, len(expected), h.Size())
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		pos := h.Get([]byte(key))
+		if offset, ok := expected[key]; ok {
+			assert.Equal(t, offset, pos.Offset)
+		} else {
+			assert.Nil(t, pos)
+		}
+	}
+
+	// 无序的迭代器返回每个key恰好一次
+	seen := make(map[string]int64)
+	iter := NewUnorderedIterator(h)
+	for ; !iter.IsEnd(); iter.Next() {
+		_, dup := seen[string(iter.Key())]
+		assert.False(t, dup)
+		seen[string(iter.Key())] = iter.Value().Offset
+	}
+	iter.Close()
+	assert.Equal(t, expected, seen)
+}
+
+func TestHashIterator(t *testing.T) {
+	h := NewHashIndex()
+	var sorted []string
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%05d", i*2)
+		h.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		sorted = append(sorted, key)
+	}
+	reversed := make([]string, len(sorted))
+	for i, key := range sorted {
+		reversed[len(sorted)-1-i] = key
+	}
+	asc, desc := h.NewIterator(false), h.NewIterator(true)
+	// 迭代器是创建时的快照
+	h.Put([]byte("key-00001"), &data.LogRecordPos{Fid: 1})
+	h.Delete([]byte("key-00000"))
+	assert.Equal(t, sorted, iterKeys(asc, len(sorted)+1))
+	assert.Equal(t, reversed, iterKeys(desc, len(sorted)+1))
+
+	asc.Seek([]byte("key-00101"))
+	assert.Equal(t, sorted[51:51+300], iterKeys(asc, 300))
+	asc.Seek([]byte("key-00102"))
+	assert.Equal(t, "key-00102", string(asc.Key()))
+	desc.Seek([]byte("key-00101"))
+	assert.Equal(t, reversed[len(sorted)-51:], iterKeys(desc, 300))
+	asc.Seek([]byte("zzz"))
+	assert.True(t, asc.IsEnd())
+	desc.Seek(nil)
+	assert.True(t, desc.IsEnd())
+	asc.Rewind()
+	assert.Equal(t, sorted[0], string(asc.Key()))
+	assert.Equal(t, int64(0), asc.Value().Offset)
+	asc.Close()
+	desc.Close()
+
+	// 其他索引没有无序的迭代器，退化为有序遍历
+	bt := NewBTree()
+	for _, key := range sorted {
+		bt.Put([]byte(key), &data.LogRecordPos{Fid: 1})
+	}
+	assert.Equal(t, sorted, iterKeys(NewUnorderedIterator(bt), len(sorted)+1))
+}
+
+func TestHashIndexSnapshot(t *testing.T) {
+	h := NewHashIndex()
+	for i := 0; i < 100; i++ {
+		h.Put([]byte(fmt.Sprintf("key-%03d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	snap := h.Snapshot()
+	h.Delete([]byte("key-000"))
+	h.Put([]byte("key-001"), &data.LogRecordPos{Fid: 2})
+	h.Put([]byte("key-100"), &data.LogRecordPos{Fid: 2})
+	assert.Equal(t, 100, snap.Size())
+	assert.Equal(t, int64(0), snap.Get([]byte("key-000")).Offset)
+	assert.Equal(t, uint32(1), snap.Get([]byte("key-001")).Fid)
+	assert.Nil(t, snap.Get([]byte("key-100")))
+	keys := iterKeys(snap.NewIterator(false), 200)
+	assert.True(t, sort.StringsAreSorted(keys))
+	assert.Equal(t, 100, len(keys))
+}
+
+// 与BTree对比的基准测试
+var benchIndexers = map[string]func() Indexer{
+	"btree": func() Indexer { return NewBTree() },
+	"hash":  func() Indexer { return NewHashIndex() },
+}
+
+const benchKeyNum = 1_000_000
+
+func benchKeys() [][]byte {
+	keys := make([][]byte, benchKeyNum)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%09d", i))
+	}
+	return keys
+}
+
+// 每个key占用的内存，包含key本身，建议使用-benchtime=1x
+// db从数据文件中解码出的key是新分配的，BTree直接引用它，hash索引复制后原来的key被回收，所以每次Put都传入key的副本
+func BenchmarkIndexMemory(b *testing.B) {
+	keys := benchKeys()
+	for name, newIndexer := range benchIndexers {
+		b.Run(name, func(b *testing.B) {
+			var stats runtime.MemStats
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+				runtime.ReadMemStats(&stats)
+				before := stats.HeapAlloc
+				idx := newIndexer()
+				for j, key := range keys {
+					idx.Put(bytes.Clone(key), &data.LogRecordPos{Fid: 1, Offset: int64(j)})
+				}
+				runtime.GC()
+				runtime.ReadMemStats(&stats)
+				b.ReportMetric(float64(stats.HeapAlloc-before)/benchKeyNum, "B/key")
+				runtime.KeepAlive(idx)
+			}
+		})
+	}
+}
+
+func BenchmarkIndexPut(b *testing.B) {
+	keys := benchKeys()
+	for name, newIndexer := range benchIndexers {
+		b.Run(name, func(b *testing.B) {
+			idx := newIndexer()
+			pos := &data.LogRecordPos{Fid: 1}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				idx.Put(keys[i%benchKeyNum], pos)
+			}
+		})
+	}
+}
+
+func BenchmarkIndexGet(b *testing.B) {
+	keys := benchKeys()
+	for name, newIndexer := range benchIndexers {
+		idx := newIndexer()
+		for i, key := range keys {
+			idx.Put(key, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		}
+		b.Run(name, func(b *testing.B) {
+			r := rand.New(rand.NewSource(1))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				idx.Get(keys[r.Intn(benchKeyNum)])
+			}
+		})
+		// 并发读写，hash索引只锁住key所在的分片
+		b.Run(name+"-parallel", func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(rand.Int63()))
+				pos := &data.LogRecordPos{Fid: 2}
+				for pb.Next() {
+					key := keys[r.Intn(benchKeyNum)]
+					if r.Intn(10) == 0 {
+						idx.Put(key, pos)
+					} else {
+						idx.Get(key)
+					}
+				}
+			})
+		})
+	}
+}
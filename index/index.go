@@ -1,6 +1,7 @@
 package index
 
 import (
+	"bytes"
 	"kv-go/data"
 )
 
@@ -11,6 +12,8 @@ const (
 	BTreeType IndexType = iota
 	BPlusTreeType
 	ARTreeType
+	// 分片的hash索引，只适合点查，有序遍历需要排序
+	HashType
 )
 
 // 索引的节点封装，将k-v封装成Item, 实现Less特征即可
@@ -31,6 +34,8 @@ type Indexer interface {
 	NewIterator(reverse bool) Iterator
 	// 索引中的数据数量
 	Size() int
+	// 创建索引的只读快照，快照不受之后写入的影响
+	Snapshot() Indexer
 	// 关闭索引
 	Close() error
 }
@@ -53,6 +58,86 @@ type Iterator interface {
 	Close()
 }
 
+// 迭代器每次从索引中取出的key数量
+const iteratorBatchSize = 256
+
+// 按批从索引中取出key的迭代器，创建迭代器与Seek的开销与索引大小无关
+// 迭代器不持有索引的快照：每批key在索引的读锁下取出，取完一批后从最后一个key之后继续取，
+// 所以迭代器总是按顺序前进，不会重复返回同一个key，遍历期间的写入是否可见取决于它是否落在还没有取出的批次中，
+// 已经取出的key被修改后，迭代器仍然返回取出时的LogRecordPos
+type batchIterator struct {
+	fill  func(from []byte, inclusive bool, n int) []*Item // 按遍历方向取出从from开始的至多n个key，from为nil时从头开始
+	items []*Item                                          // 当前批次的key
+	idx   int                                              // 当前批次中遍历到的位置
+	more  bool                                             // 当前批次取满了，之后可能还有key
+}
+
+func (it *batchIterator) load(from []byte, inclusive bool) {
+	it.items = it.fill(from, inclusive, iteratorBatchSize)
+	it.idx = 0
+	it.more = len(it.items) == iteratorBatchSize
+}
+
+func (it *batchIterator) Rewind() {
+	it.load(nil, true)
+}
+
+func (it *batchIterator) Seek(key []byte) {
+	if key == nil {
+		key = []byte{}
+	}
+	it.load(key, true)
+}
+
+func (it *batchIterator) Next() {
+	it.idx++
+	if it.idx >= len(it.items) && it.more {
+		it.load(it.items[len(it.items)-1].key, false)
+	}
+}
+
+func (it *batchIterator) IsEnd() bool {
+	return it.idx >= len(it.items)
+}
+
+func (it *batchIterator) Key() []byte {
+	return it.items[it.idx].key
+}
+
+func (it *batchIterator) Value() *data.LogRecordPos {
+	return it.items[it.idx].pos
+}
+
+func (it *batchIterator) Close() {
+	it.items = nil
+	it.more = false
+}
+
+// 返回把遍历到的key收集到items中的闭包，非inclusive时跳过from，收集满n个后返回false
+func collectItems(items *[]*Item, from []byte, inclusive bool, n int) func(item *Item) bool {
+	return func(item *Item) bool {
+		if !inclusive && bytes.Equal(item.key, from) {
+			return true
+		}
+		*items = append(*items, item)
+		return len(*items) < n
+	}
+}
+
+// 能够不按顺序遍历的索引，无序遍历的开销低于有序遍历
+type unorderedIndexer interface {
+	NewUnorderedIterator() Iterator
+}
+
+// NewUnorderedIterator 创建不保证遍历顺序的迭代器，用于统计等只关心所有key、不关心顺序的遍历
+// 调用者不应依赖Seek，索引不支持无序遍历时退化为有序的迭代器
+func NewUnorderedIterator(idx Indexer) Iterator {
+	if u, ok := idx.(unorderedIndexer); ok {
+		return u.NewUnorderedIterator()
+	}
+	return idx.NewIterator(false)
+}
+
 // TODO:添加更多index type
 func NewIndexer(indexerType IndexType, dirPath string, sync bool) Indexer {
 	switch indexerType {
@@ -62,6 +147,8 @@ func NewIndexer(indexerType IndexType, dirPath string, sync bool) Indexer {
 		return NewBPlusTree(dirPath, sync)
 	case ARTreeType:
 		return NewARTree()
+	case HashType:
+		return NewHashIndex()
 	default:
 		return nil
 	}
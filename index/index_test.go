@@ -0,0 +1,161 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"kv-go/data"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 内存中的索引，迭代器按批取出key
+var lazyIndexers = map[string]func() Indexer{
+	"btree": func() Indexer { return NewBTree() },
+	"art":   func() Indexer { return NewARTree() },
+}
+
+// 从迭代器中最多取出n个key
+func iterKeys(iter Iterator, n int) []string {
+	var keys []string
+	for ; !iter.IsEnd() && len(keys) < n; iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	return keys
+}
+
+func TestIteratorSeek(t *testing.T) {
+	for name, newIndexer := range lazyIndexers {
+		t.Run(name, func(t *testing.T) {
+			// 字母表很小，key之间经常互为前缀，覆盖0x00与0xff
+			alphabet := []byte{0x00, 'a', 'b', 'c', 0xff}
+			randKey := func(r *rand.Rand) []byte {
+				key := make([]byte, 1+r.Intn(6))
+				for i := range key {
+					key[i] = alphabet[r.Intn(len(alphabet))]
+				}
+				return key
+			}
+			r := rand.New(rand.NewSource(1))
+			idx := newIndexer()
+			set := make(map[string]struct{})
+			for i := 0; i < 3000; i++ {
+				key := randKey(r)
+				idx.Put(key, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+				set[string(key)] = struct{}{}
+			}
+			var sorted []string
+			for key := range set {
+				sorted = append(sorted, key)
+			}
+			sort.Strings(sorted)
+			reversed := make([]string, len(sorted))
+			for i, key := range sorted {
+				reversed[len(sorted)-1-i] = key
+			}
+			assert.True(t, len(sorted) > 2*iteratorBatchSize)
+
+			asc, desc := idx.NewIterator(false), idx.NewIterator(true)
+			assert.Equal(t, sorted, iterKeys(asc, len(sorted)+1))
+			assert.Equal(t, reversed, iterKeys(desc, len(sorted)+1))
+
+			for i := 0; i < 300; i++ {
+				target := randKey(r)
+				start := sort.SearchStrings(sorted, string(target))
+				asc.Seek(target)
+				assert.Equal(t, sorted[start:min(start+300, len(sorted))], iterKeys(asc, 300))
+				start = sort.Search(len(reversed), func(i int) bool { return reversed[i] <= string(target) })
+				desc.Seek(target)
+				assert.Equal(t, reversed[start:min(start+300, len(reversed))], iterKeys(desc, 300))
+			}
+			asc.Rewind()
+			assert.Equal(t, sorted[0], string(asc.Key()))
+			desc.Seek(nil)
+			assert.True(t, desc.IsEnd())
+			asc.Close()
+			desc.Close()
+		})
+	}
+}
+
+func TestIteratorConcurrentModification(t *testing.T) {
+	for name, newIndexer := range lazyIndexers {
+		t.Run(name, func(t *testing.T) {
+			idx := newIndexer()
+			key := func(i int) []byte { return []byte(fmt.Sprintf("key-%05d", i)) }
+			for i := 0; i < 2000; i += 2 {
+				idx.Put(key(i), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+			}
+			iter := idx.NewIterator(false)
+			assert.Equal(t, "key-00000", string(iter.Key()))
+			// 还没有取出的key被删除或者插入后对迭代器可见，删除当前的key不影响继续遍历
+			idx.Delete(key(1800))
+			idx.Put(key(1801), &data.LogRecordPos{Fid: 1, Offset: 1801})
+			idx.Delete(key(0))
+			keys := iterKeys(iter, 2000)
+			assert.Equal(t, 1000, len(keys))
+			assert.NotContains(t, keys, "key-01800")
+			assert.Contains(t, keys, "key-01801")
+			iter.Close()
+
+			// 并发写入时迭代器总是按顺序前进，不会重复返回同一个key
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(2))
+				for i := 0; i < 5000; i++ {
+					k := r.Intn(2000)
+					if r.Intn(2) == 0 {
+						idx.Put(key(k), &data.LogRecordPos{Fid: 2, Offset: int64(k)})
+					} else {
+						idx.Delete(key(k))
+					}
+				}
+			}()
+			for round := 0; round < 20; round++ {
+				for _, reverse := range []bool{false, true} {
+					iter := idx.NewIterator(reverse)
+					var last []byte
+					for ; !iter.IsEnd(); iter.Next() {
+						if last != nil {
+							assert.Equal(t, reverse, bytes.Compare(iter.Key(), last) < 0)
+						}
+						last = iter.Key()
+					}
+					iter.Close()
+				}
+			}
+			wg.Wait()
+		})
+	}
+}
+
+// 创建迭代器只取出第一批key，开销与索引大小无关
+func benchmarkNewIterator(b *testing.B, idx Indexer) {
+	for i := 0; i < 10_000_000; i++ {
+		idx.Put([]byte(fmt.Sprintf("key-%09d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	for _, reverse := range []bool{false, true} {
+		b.Run(fmt.Sprintf("reverse=%v", reverse), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				iter := idx.NewIterator(reverse)
+				iter.Seek([]byte(fmt.Sprintf("key-%09d", i%10_000_000)))
+				_ = iter.Key()
+				iter.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkBTreeNewIterator(b *testing.B) {
+	benchmarkNewIterator(b, NewBTree())
+}
+
+func BenchmarkARTreeNewIterator(b *testing.B) {
+	benchmarkNewIterator(b, NewARTree())
+}
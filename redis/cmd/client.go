@@ -22,6 +22,7 @@ type cmdHandle func(client *BitcaskClient, args [][]byte) (interface{}, error)
 var supportedCommands = map[string]cmdHandle{
 	"set":       set,
 	"get":       get,
+	"mget":      mget,
 	"del":       del,
 	"hset":      hset,
 	"hget":      hget,
@@ -33,6 +34,7 @@ var supportedCommands = map[string]cmdHandle{
 	"rpush":     rpush,
 	"lpop":      lpop,
 	"rpop":      rpop,
+	"info":      info,
 	"quit":      nil,
 	"ping":      nil,
 }
@@ -89,6 +91,14 @@ func del(client *BitcaskClient, args [][]byte) (interface{}, error) {
 	return redcon.SimpleString("OK"), nil
 }
 
+// 返回存储引擎的运行统计，忽略section参数
+func info(client *BitcaskClient, args [][]byte) (interface{}, error) {
+	if len(args) > 1 {
+		return nil, newNumberError("info")
+	}
+	return client.db.Info()
+}
+
 // ==================== String ====================
 // TODO:超时设置
 func set(client *BitcaskClient, args [][]byte) (interface{}, error) {
@@ -112,6 +122,24 @@ func get(client *BitcaskClient, args [][]byte) (interface{}, error) {
 	return val, nil
 }
 
+// 不存在的key返回nil
+func mget(client *BitcaskClient, args [][]byte) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, newNumberError("mget")
+	}
+	values, err := client.db.MGet(args)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]interface{}, len(values))
+	for i, val := range values {
+		if val != nil {
+			res[i] = val
+		}
+	}
+	return res, nil
+}
+
 // ==================== Hash ====================
 func hset(client *BitcaskClient, args [][]byte) (interface{}, error) {
 	n := len(args)
@@ -1,15 +1,23 @@
 package main
 
 import (
+	"flag"
+	"kv-go/cluster"
 	bitcask "kv-go/db"
 	bitcask_redis "kv-go/redis"
 	"log"
+	"strings"
 	"sync"
 
 	"github.com/tidwall/redcon"
 )
 
-var addr = "127.0.0.1:8888"
+var (
+	addr     = flag.String("addr", "127.0.0.1:8888", "address to serve redis clients on")
+	dir      = flag.String("dir", bitcask.DefaultDBOptions.DirPath, "database directory")
+	raftAddr = flag.String("raft-addr", "", "cluster mode: address for raft messages, also the id of the node")
+	peers    = flag.String("peers", "", "cluster mode: comma separated raft addresses of all nodes, including this one")
+)
 
 type BitcaskServer struct {
 	dbs map[int]*bitcask_redis.RedisDataStructure
@@ -18,8 +26,9 @@ type BitcaskServer struct {
 }
 
 func main() {
+	flag.Parse()
 	// 创建rds结构
-	rds, err := bitcask_redis.NewRedisDataStructure(bitcask.DefaultDBOptions)
+	rds, err := openDataStructure()
 	if err != nil {
 		panic(err)
 	}
@@ -29,10 +38,34 @@ func main() {
 	}
 	bitcaskServer.dbs[0] = rds
 	// 创建redis服务端(使用redcon框架)
-	bitcaskServer.server = redcon.NewServer(addr, execClientCommand, bitcaskServer.accept, bitcaskServer.close)
+	bitcaskServer.server = redcon.NewServer(*addr, execClientCommand, bitcaskServer.accept, bitcaskServer.close)
 	bitcaskServer.listen()
 }
 
+// 指定raft地址时作为集群中的节点运行，写入复制到所有节点，读取是线性一致的
+func openDataStructure() (*bitcask_redis.RedisDataStructure, error) {
+	if *raftAddr == "" {
+		opts := bitcask.DefaultDBOptions
+		opts.DirPath = *dir
+		return bitcask_redis.NewRedisDataStructure(opts)
+	}
+	transport, err := cluster.NewTCPTransport(*raftAddr)
+	if err != nil {
+		return nil, err
+	}
+	opts := cluster.DefaultOptions
+	opts.ID = *raftAddr
+	opts.Peers = strings.Split(*peers, ",")
+	opts.DirPath = *dir
+	opts.Transport = transport
+	node, err := cluster.NewNode(opts)
+	if err != nil {
+		_ = transport.Close()
+		return nil, err
+	}
+	return bitcask_redis.NewClusterRedisDataStructure(node), nil
+}
+
 func (svr *BitcaskServer) listen() {
 	log.Println("bitcask server is running...")
 	_ = svr.server.ListenAndServe()
@@ -0,0 +1,65 @@
+package redis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Info 以redis INFO命令的格式返回存储引擎的运行统计
+func (rds *RedisDataStructure) Info() (string, error) {
+	metrics, err := rds.db.Metrics()
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	field := func(name string, value any) {
+		fmt.Fprintf(&b, "%s:%v\r\n", name, value)
+	}
+	b.WriteString("# Stats\r\n")
+	field("total_gets", metrics.Gets)
+	field("total_puts", metrics.Puts)
+	field("total_deletes", metrics.Deletes)
+	field("total_batch_commits", metrics.BatchCommits)
+	field("total_read_bytes", metrics.BytesRead)
+	field("total_written_bytes", metrics.BytesWritten)
+	field("total_syncs", metrics.SyncLatency.Count)
+	field("total_merges", metrics.Merges)
+	field("total_reclaimed_bytes", metrics.ReclaimedBytes)
+	field("value_cache_hits", metrics.ValueCache.Hits)
+	field("value_cache_misses", metrics.ValueCache.Misses)
+	field("value_cache_bytes", metrics.ValueCache.Size)
+
+	// 直方图只输出平均延迟，完整的分布通过Prometheus获取
+	b.WriteString("\r\n# Latency\r\n")
+	average := func(sum time.Duration, count uint64) int64 {
+		if count == 0 {
+			return 0
+		}
+		return sum.Microseconds() / int64(count)
+	}
+	field("get_avg_us", average(metrics.GetLatency.Sum, metrics.GetLatency.Count))
+	field("write_avg_us", average(metrics.WriteLatency.Sum, metrics.WriteLatency.Count))
+	field("sync_avg_us", average(metrics.SyncLatency.Sum, metrics.SyncLatency.Count))
+	field("merge_avg_us", average(metrics.MergeDuration.Sum, metrics.MergeDuration.Count))
+
+	b.WriteString("\r\n# Keyspace\r\n")
+	families := make([]string, 0, len(metrics.IndexKeys))
+	for name := range metrics.IndexKeys {
+		families = append(families, name)
+	}
+	sort.Strings(families)
+	for _, name := range families {
+		field(name, fmt.Sprintf("keys=%d", metrics.IndexKeys[name]))
+	}
+
+	b.WriteString("\r\n# Files\r\n")
+	for _, stat := range metrics.DataFiles {
+		field(fmt.Sprintf("data_file_%d", stat.Fid), fmt.Sprintf("live=%d,dead=%d", stat.LiveSize, max(stat.Size-stat.LiveSize, 0)))
+	}
+	for _, stat := range metrics.BlobFiles {
+		field(fmt.Sprintf("blob_file_%d", stat.Fid), fmt.Sprintf("live=%d,dead=%d", max(stat.Size-stat.GarbageSize, 0), stat.GarbageSize))
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,96 @@
+package redis
+
+import (
+	"kv-go/cluster"
+	bitcask "kv-go/db"
+)
+
+// Storage 保存编码后的redis数据，可以是单机的DB，也可以是集群
+type Storage interface {
+	Get(key []byte) ([]byte, error)
+	MultiGet(keys [][]byte) ([][]byte, []error)
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+	NewBatch() Batch
+	Metrics() (*bitcask.Metrics, error)
+	Close() error
+}
+
+// Batch 原子提交的一组写入
+type Batch interface {
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+	Commit() error
+}
+
+type dbStorage struct {
+	db *bitcask.DB
+}
+
+func (s dbStorage) Get(key []byte) ([]byte, error) {
+	return s.db.Get(key)
+}
+
+func (s dbStorage) MultiGet(keys [][]byte) ([][]byte, []error) {
+	return s.db.MultiGet(keys)
+}
+
+func (s dbStorage) Put(key []byte, value []byte) error {
+	return s.db.Put(key, value)
+}
+
+func (s dbStorage) Delete(key []byte) error {
+	return s.db.Delete(key)
+}
+
+func (s dbStorage) NewBatch() Batch {
+	return s.db.NewWriteBatch(bitcask.DefaultWBOptions)
+}
+
+func (s dbStorage) Metrics() (*bitcask.Metrics, error) {
+	return s.db.Metrics()
+}
+
+func (s dbStorage) Close() error {
+	return s.db.Close()
+}
+
+// 集群中的读取都是线性一致的，任意节点都能读到之前完成的写入
+type clusterStorage struct {
+	node *cluster.Node
+}
+
+func (s clusterStorage) Get(key []byte) ([]byte, error) {
+	return s.node.Get(key)
+}
+
+func (s clusterStorage) MultiGet(keys [][]byte) ([][]byte, []error) {
+	return s.node.MultiGet(keys)
+}
+
+func (s clusterStorage) Put(key []byte, value []byte) error {
+	return s.node.Put(key, value)
+}
+
+func (s clusterStorage) Delete(key []byte) error {
+	return s.node.Delete(key)
+}
+
+func (s clusterStorage) NewBatch() Batch {
+	return s.node.NewWriteBatch()
+}
+
+// 运行统计只包含本地节点
+func (s clusterStorage) Metrics() (*bitcask.Metrics, error) {
+	var metrics *bitcask.Metrics
+	err := s.node.View(cluster.Stale, func(db *bitcask.DB) error {
+		var err error
+		metrics, err = db.Metrics()
+		return err
+	})
+	return metrics, err
+}
+
+func (s clusterStorage) Close() error {
+	return s.node.Close()
+}
@@ -3,6 +3,7 @@ package redis
 import (
 	"encoding/binary"
 	"errors"
+	"kv-go/cluster"
 	bitcask "kv-go/db"
 	"time"
 )
@@ -25,7 +26,7 @@ var (
 )
 
 type RedisDataStructure struct {
-	db *bitcask.DB
+	db Storage
 }
 
 func NewRedisDataStructure(opts bitcask.DBOptions) (*RedisDataStructure, error) {
@@ -33,7 +34,12 @@ func NewRedisDataStructure(opts bitcask.DBOptions) (*RedisDataStructure, error)
 	if err != nil {
 		return nil, err
 	}
-	return &RedisDataStructure{db: db}, nil
+	return &RedisDataStructure{db: dbStorage{db: db}}, nil
+}
+
+// 使用集群存储数据，所有写入都通过raft日志复制到集群中的每个节点
+func NewClusterRedisDataStructure(node *cluster.Node) *RedisDataStructure {
+	return &RedisDataStructure{db: clusterStorage{node: node}}
 }
 
 func (rds *RedisDataStructure) Close() error {
@@ -77,6 +83,29 @@ func (rds *RedisDataStructure) Get(key []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	return decodeString(encValue)
+}
+
+// MGet 一次读取多个String，key不存在、已经过期或者不是String时对应的value为nil
+func (rds *RedisDataStructure) MGet(keys [][]byte) ([][]byte, error) {
+	encValues, errs := rds.db.MultiGet(keys)
+	values := make([][]byte, len(keys))
+	for i, encValue := range encValues {
+		if errs[i] == bitcask.ErrKeyNotFound || errs[i] == bitcask.ErrEmptyKey {
+			continue
+		}
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if value, err := decodeString(encValue); err == nil {
+			values[i] = value
+		}
+	}
+	return values, nil
+}
+
+// 解码String的value，过期时返回nil
+func decodeString(encValue []byte) ([]byte, error) {
 	// 解码encValue中的type
 	typ := encValue[0]
 	if typ != String {
@@ -108,7 +137,7 @@ func (rds *RedisDataStructure) HSet(key []byte, fields, values [][]byte) (int, e
 	}
 	cnt := 0
 	n := len(fields)
-	wb := rds.db.NewWriteBatch(bitcask.DefaultWBOptions)
+	wb := rds.db.NewBatch()
 	for i := 0; i < n; i++ {
 		ok, err := rds.hSet(meta, key, fields[i], values[i], wb)
 		if err != nil {
@@ -130,7 +159,7 @@ func (rds *RedisDataStructure) HSet(key []byte, fields, values [][]byte) (int, e
 	return cnt, nil
 }
 
-func (rds *RedisDataStructure) hSet(meta *metaData, key, field, value []byte, wb *bitcask.WriteBatch) (bool, error) {
+func (rds *RedisDataStructure) hSet(meta *metaData, key, field, value []byte, wb Batch) (bool, error) {
 	// 构造field
 	fieldKey := &hashField{
 		key:       key,
@@ -205,7 +234,7 @@ func (rds *RedisDataStructure) HDel(key []byte, fields [][]byte) (int, error) {
 		return 0, nil
 	}
 	cnt := 0
-	wb := rds.db.NewWriteBatch(bitcask.DefaultWBOptions)
+	wb := rds.db.NewBatch()
 	for _, field := range fields {
 		ok, err := rds.hDel(meta, key, field, wb)
 		if err != nil {
@@ -227,7 +256,7 @@ func (rds *RedisDataStructure) HDel(key []byte, fields [][]byte) (int, error) {
 	return cnt, nil
 }
 
-func (rds *RedisDataStructure) hDel(meta *metaData, key, field []byte, wb *bitcask.WriteBatch) (bool, error) {
+func (rds *RedisDataStructure) hDel(meta *metaData, key, field []byte, wb Batch) (bool, error) {
 	// 构造field字段
 	fieldKey := &hashField{
 		key:       key,
@@ -259,7 +288,7 @@ func (rds *RedisDataStructure) SAdd(key []byte, members [][]byte) (int, error) {
 	}
 	var cnt = 0
 	// 开启writebatch
-	wb := rds.db.NewWriteBatch(bitcask.DefaultWBOptions)
+	wb := rds.db.NewBatch()
 	for _, member := range members {
 		ok, err := rds.sAdd(meta, key, member, wb)
 		if err != nil {
@@ -282,7 +311,7 @@ func (rds *RedisDataStructure) SAdd(key []byte, members [][]byte) (int, error) {
 	return cnt, nil
 }
 
-func (rds *RedisDataStructure) sAdd(meta *metaData, key, member []byte, wb *bitcask.WriteBatch) (bool, error) {
+func (rds *RedisDataStructure) sAdd(meta *metaData, key, member []byte, wb Batch) (bool, error) {
 	if len(key) == 0 || len(member) == 0 {
 		return false, bitcask.ErrEmptyKey
 	}
@@ -343,7 +372,7 @@ func (rds *RedisDataStructure) SRem(key []byte, members [][]byte) (int, error) {
 	}
 	var cnt = 0
 	// 开启writebatch
-	wb := rds.db.NewWriteBatch(bitcask.DefaultWBOptions)
+	wb := rds.db.NewBatch()
 	for _, member := range members {
 		ok, err := rds.sRem(meta, key, member, wb)
 		if err != nil {
@@ -366,7 +395,7 @@ func (rds *RedisDataStructure) SRem(key []byte, members [][]byte) (int, error) {
 	return cnt, nil
 }
 
-func (rds *RedisDataStructure) sRem(meta *metaData, key, member []byte, wb *bitcask.WriteBatch) (bool, error) {
+func (rds *RedisDataStructure) sRem(meta *metaData, key, member []byte, wb Batch) (bool, error) {
 	// 构造member
 	memberKey := &setField{
 		key:       key,
@@ -414,7 +443,7 @@ func (rds *RedisDataStructure) push(key []byte, field []byte, head bool) (uint32
 		liseNode.idx = meta.tail
 	}
 	// 新建wb更新元数据
-	wb := rds.db.NewWriteBatch(bitcask.DefaultWBOptions)
+	wb := rds.db.NewBatch()
 	if err := wb.Put(liseNode.encode(), field); err != nil {
 		return 0, err
 	}
@@ -1,10 +1,14 @@
 package redis
 
 import (
+	"fmt"
+	"kv-go/cluster"
 	bitcask "kv-go/db"
 	"kv-go/utils"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -15,7 +19,7 @@ func TestString(t *testing.T) {
 	db, err := bitcask.Open(opts)
 	assert.Nil(t, err)
 	rds := &RedisDataStructure{
-		db: db,
+		db: dbStorage{db: db},
 	}
 	{
 		// 在没有数据的情况下，Delete，Get
@@ -65,7 +69,7 @@ func TestHash1(t *testing.T) {
 	db, err := bitcask.Open(opts)
 	assert.Nil(t, err)
 	rds := &RedisDataStructure{
-		db: db,
+		db: dbStorage{db: db},
 	}
 	{
 		// 在没有数据的情况下，Delete，Get
@@ -122,7 +126,7 @@ func TestHash2(t *testing.T) {
 	db, err := bitcask.Open(opts)
 	assert.Nil(t, err)
 	rds := &RedisDataStructure{
-		db: db,
+		db: dbStorage{db: db},
 	}
 	{
 		// 往不同的key中插入一条field，get验证
@@ -161,7 +165,7 @@ func TestHash3(t *testing.T) {
 	db, err := bitcask.Open(opts)
 	assert.Nil(t, err)
 	rds := &RedisDataStructure{
-		db: db,
+		db: dbStorage{db: db},
 	}
 	{
 		// 往不同的key中插入多条field，get验证
@@ -209,7 +213,7 @@ func TestSet1(t *testing.T) {
 	db, err := bitcask.Open(opts)
 	assert.Nil(t, err)
 	rds := &RedisDataStructure{
-		db: db,
+		db: dbStorage{db: db},
 	}
 	{
 		// 没有数据时，get，delete
@@ -262,7 +266,7 @@ func TestSet2(t *testing.T) {
 	db, err := bitcask.Open(opts)
 	assert.Nil(t, err)
 	rds := &RedisDataStructure{
-		db: db,
+		db: dbStorage{db: db},
 	}
 	{
 		// 向不同的key插入一个member
@@ -303,7 +307,7 @@ func TestSet3(t *testing.T) {
 	db, err := bitcask.Open(opts)
 	assert.Nil(t, err)
 	rds := &RedisDataStructure{
-		db: db,
+		db: dbStorage{db: db},
 	}
 	{
 		// 向不同的key插入多个member
@@ -357,7 +361,7 @@ func TestList1(t *testing.T) {
 	db, err := bitcask.Open(opts)
 	assert.Nil(t, err)
 	rds := &RedisDataStructure{
-		db: db,
+		db: dbStorage{db: db},
 	}
 	{
 		// 没有数据时，pop
@@ -415,4 +419,81 @@ func TestList1(t *testing.T) {
 			assert.Equal(t, val, utils.GetTestKey(i))
 		}
 	}
-}
\ No newline at end of file
+}
+func TestCluster(t *testing.T) {
+	network := cluster.NewInmemNetwork()
+	peers := []string{"node-0", "node-1", "node-2"}
+	var nodes []*RedisDataStructure
+	for _, id := range peers {
+		opts := cluster.DefaultOptions
+		opts.ID = id
+		opts.Peers = peers
+		opts.Transport = network.Transport()
+		opts.DirPath, _ = os.MkdirTemp("", "redis-cluster-"+id)
+		defer os.RemoveAll(opts.DirPath)
+		node, err := cluster.NewNode(opts)
+		assert.Nil(t, err)
+		rds := NewClusterRedisDataStructure(node)
+		defer rds.Close()
+		nodes = append(nodes, rds)
+	}
+	// 在任意节点写入的数据结构，在所有节点都能读到
+	for i, rds := range nodes {
+		assert.Nil(t, rds.Set(utils.GetTestKey(i), []byte(fmt.Sprintf("value-%d", i)), 0))
+		cnt, err := rds.HSet(utils.GetTestKey(100), [][]byte{utils.GetTestKey(i)}, [][]byte{[]byte("field")})
+		assert.Nil(t, err)
+		assert.Equal(t, 1, cnt)
+	}
+	for _, rds := range nodes {
+		for i := range nodes {
+			val, err := rds.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, fmt.Sprintf("value-%d", i), string(val))
+			val, err = rds.HGet(utils.GetTestKey(100), utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, "field", string(val))
+		}
+		values, err := rds.MGet([][]byte{utils.GetTestKey(0), utils.GetTestKey(1), utils.GetTestKey(2)})
+		assert.Nil(t, err)
+		assert.Equal(t, "value-2", string(values[2]))
+	}
+}
+
+func TestMGet(t *testing.T) {
+	opts := bitcask.DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "redis-mget")
+	defer os.RemoveAll(opts.DirPath)
+	rds, err := NewRedisDataStructure(opts)
+	assert.Nil(t, err)
+	defer rds.Close()
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, rds.Set(utils.GetTestKey(i), []byte(fmt.Sprintf("value-%d", i)), 0))
+	}
+	assert.Nil(t, rds.Set(utils.GetTestKey(100), []byte("expired"), time.Millisecond))
+	_, err = rds.HSet(utils.GetTestKey(101), [][]byte{[]byte("field")}, [][]byte{[]byte("value")})
+	assert.Nil(t, err)
+	time.Sleep(5 * time.Millisecond)
+
+	// 不存在、过期与不是String的key对应nil
+	keys := [][]byte{utils.GetTestKey(99), utils.GetTestKey(100), utils.GetTestKey(101), utils.GetTestKey(1000), nil, utils.GetTestKey(0)}
+	values, err := rds.MGet(keys)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("value-99"), nil, nil, nil, nil, []byte("value-0")}, values)
+}
+
+func TestInfo(t *testing.T) {
+	opts := bitcask.DefaultDBOptions
+	opts.DirPath, _ = os.MkdirTemp("", "redis-info")
+	defer os.RemoveAll(opts.DirPath)
+	rds, err := NewRedisDataStructure(opts)
+	assert.Nil(t, err)
+	defer rds.Close()
+	assert.Nil(t, rds.Set(utils.GetTestKey(1), []byte("value"), 0))
+	_, err = rds.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	info, err := rds.Info()
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(info, "total_puts:1\r\n"))
+	assert.True(t, strings.Contains(info, "total_gets:1\r\n"))
+	assert.True(t, strings.Contains(info, "default:keys=1\r\n"))
+}